@@ -0,0 +1,278 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_POOL_SIZE     int           = 4
+	DEFAULT_DIAL_TIMEOUT  time.Duration = 5 * time.Second
+	DEFAULT_MAX_RETRIES   int           = 2
+	DEFAULT_RETRY_BACKOFF time.Duration = 50 * time.Millisecond
+)
+
+var ErrClosed = errors.New("Client is closed.")
+
+// Options configure a Client, zero values take the defaults.
+type Options struct {
+	// Addr is the RESP address of a server started with serve.
+	Addr string
+	// PoolSize bounds the connections open at once, callers beyond it wait
+	// for a free one.
+	PoolSize    int
+	DialTimeout time.Duration
+	// MaxRetries is how often an idempotent command is sent again after
+	// its connection failed, waiting RetryBackoff longer each time.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.PoolSize <= 0 {
+		o.PoolSize = DEFAULT_POOL_SIZE
+	}
+
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	} else if o.MaxRetries == 0 {
+		o.MaxRetries = DEFAULT_MAX_RETRIES
+	}
+
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+
+	return o
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Client talks to a store served over RESP. It is safe for concurrent use,
+// each call borrows a connection from the pool.
+type Client struct {
+	options Options
+	idle    chan *conn
+	slots   chan struct{}
+	done    chan struct{}
+}
+
+// NewClient returns a client for options.Addr. Connections are opened as
+// they are needed.
+func NewClient(options Options) *Client {
+	options = options.withDefaults()
+	return &Client{options: options, idle: make(chan *conn, options.PoolSize),
+		slots: make(chan struct{}, options.PoolSize), done: make(chan struct{})}
+}
+
+// Close closes the idle connections, those in use are closed as they are
+// returned.
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+
+	close(c.done)
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+			<-c.slots
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case <-c.done:
+		return nil, ErrClosed
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	select {
+	case <-c.done:
+		return nil, ErrClosed
+	case cn := <-c.idle:
+		return cn, nil
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	dialer := net.Dialer{Timeout: c.options.DialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.options.Addr)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+
+	return &conn{nc, bufio.NewReader(nc), bufio.NewWriter(nc)}, nil
+}
+
+// put returns cn to the pool, a broken connection is closed instead.
+func (c *Client) put(cn *conn, broken bool) {
+	select {
+	case <-c.done:
+		broken = true
+	default:
+	}
+
+	if broken {
+		cn.Close()
+		<-c.slots
+		return
+	}
+
+	c.idle <- cn
+}
+
+// roundTrip sends cmds in one write and reads their replies. The deadline
+// and cancellation of ctx apply to the connection while it runs.
+func (cn *conn) roundTrip(ctx context.Context, cmds [][]string) ([]Reply, error) {
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	for _, args := range cmds {
+		writeCommand(cn.w, args)
+	}
+
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]Reply, 0, len(cmds))
+	for range cmds {
+		reply, err := readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
+
+// do runs cmds on one connection. Idempotent commands are sent again on a
+// new connection when the old one fails, error replies are not retried.
+func (c *Client) do(ctx context.Context, idempotent bool, cmds [][]string) ([]Reply, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var cn *conn
+		if cn, err = c.get(ctx); err == nil {
+			var replies []Reply
+			replies, err = cn.roundTrip(ctx, cmds)
+			c.put(cn, err != nil)
+			if err == nil {
+				return replies, nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err == ErrClosed || !idempotent || attempt >= c.options.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt+1) * c.options.RetryBackoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Do sends one command and returns its reply, the error is either that of
+// the connection or the error reply.
+func (c *Client) Do(ctx context.Context, idempotent bool, args ...string) (Reply, error) {
+	replies, err := c.do(ctx, idempotent, [][]string{args})
+	if err != nil {
+		return Reply{}, err
+	}
+
+	return replies[0], replies[0].Err()
+}
+
+// Pipeline queues commands to send in a single round trip.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c, idempotent: true}
+}
+
+// Pipeline collects commands for Exec. Each queueing method returns the
+// index of its reply.
+type Pipeline struct {
+	client     *Client
+	cmds       [][]string
+	idempotent bool
+}
+
+func (p *Pipeline) add(idempotent bool, args ...string) int {
+	p.cmds = append(p.cmds, args)
+	p.idempotent = p.idempotent && idempotent
+	return len(p.cmds) - 1
+}
+
+func (p *Pipeline) Get(key string) int {
+	return p.add(true, "GET", key)
+}
+
+func (p *Pipeline) Put(key string, value string) int {
+	return p.add(true, "SET", key, value)
+}
+
+func (p *Pipeline) Del(key string) int {
+	return p.add(true, "DEL", key)
+}
+
+func (p *Pipeline) Exists(key string) int {
+	return p.add(true, "EXISTS", key)
+}
+
+func (p *Pipeline) Count(keyone string, keytwo string) int {
+	return p.add(true, "COUNT", keyone, keytwo)
+}
+
+// Do queues any command, idempotent tells whether it may be sent twice.
+func (p *Pipeline) Do(idempotent bool, args ...string) int {
+	return p.add(idempotent, args...)
+}
+
+// Exec sends the queued commands and returns their replies in order. The
+// pipeline is retried as a whole only when all its commands are idempotent.
+func (p *Pipeline) Exec(ctx context.Context) ([]Reply, error) {
+	if len(p.cmds) == 0 {
+		return nil, nil
+	}
+
+	replies, err := p.client.do(ctx, p.idempotent, p.cmds)
+	p.cmds = nil
+	p.idempotent = true
+	return replies, err
+}
@@ -0,0 +1,364 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/shimanekb/project2-A/server"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	if os.Getenv("TEST_LOGS") != "" {
+		log.SetOutput(os.Stderr)
+	}
+	os.Exit(m.Run())
+}
+
+// startServer serves a fresh store over RESP on a loopback port and
+// returns its address.
+func startServer(t *testing.T) string {
+	options := store.DefaultOptions()
+	options.Dir = t.TempDir()
+	storage, err := store.NewSsStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.NewServer(storage)
+	if err = s.Start(server.Config{RespAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Shutdown)
+	return s.Addrs()[0].String()
+}
+
+// proxy forwards connections to a server, counting them. The first drop
+// connections are closed once the client has sent something, without
+// passing it on.
+type proxy struct {
+	target   string
+	listener net.Listener
+	mutex    sync.Mutex
+	accepted int
+	open     int
+	maxOpen  int
+	drop     int
+}
+
+func startProxy(t *testing.T, target string, drop int) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &proxy{target: target, listener: listener, drop: drop}
+	t.Cleanup(func() { listener.Close() })
+	go p.serve()
+	return p
+}
+
+func (p *proxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) counts() (accepted int, maxOpen int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.accepted, p.maxOpen
+}
+
+func (p *proxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mutex.Lock()
+		p.accepted++
+		drop := p.accepted <= p.drop
+		p.open++
+		if p.open > p.maxOpen {
+			p.maxOpen = p.open
+		}
+		p.mutex.Unlock()
+
+		go func() {
+			defer func() {
+				conn.Close()
+				p.mutex.Lock()
+				p.open--
+				p.mutex.Unlock()
+			}()
+
+			if drop {
+				conn.Read(make([]byte, 1))
+				return
+			}
+
+			upstream, err := net.Dial("tcp", p.target)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func newTestClient(t *testing.T, options Options) *Client {
+	c := NewClient(options)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestRemoteMirrorsStore(t *testing.T) {
+	remote := NewRemote(newTestClient(t, Options{Addr: startServer(t)}), 0)
+
+	if err := remote.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.MultiPut([]store.KeyValue{{Key: "b", Value: "two\r\nlines"},
+		{Key: "c", Value: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, ok := remote.Get("b"); !ok || value != "two\r\nlines" {
+		t.Fatalf("b is %q, %v", value, ok)
+	}
+
+	if _, ok := remote.Get("missing"); ok {
+		t.Fatal("missing key is found")
+	}
+
+	want := []store.KeyValue{{Key: "a", Value: "1"}, {Key: "c", Value: "1"}}
+	if items := remote.MultiGet([]string{"a", "missing", "c"}); !reflect.DeepEqual(items, want) {
+		t.Fatalf("mget returned %v", items)
+	}
+
+	if !remote.Exists("a") || remote.Exists("missing") {
+		t.Fatal("exists is wrong")
+	}
+
+	if err := remote.DefineIndex(store.IndexDefinition{Name: "v", Type: store.VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := remote.QueryIndex("v", "1")
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Fatalf("query returned %v, %v", keys, err)
+	}
+
+	remote.Del("a")
+	if count, ok := remote.Count("a", "a"); !ok || count != 2 {
+		t.Fatalf("count is %d, %v", count, ok)
+	}
+
+	if items, ok := remote.Scan("a", "a"); !ok || len(items) != 2 {
+		t.Fatalf("scan returned %v, %v", items, ok)
+	}
+
+	if err = remote.DeleteRange("a", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, ok := remote.Count("a", "a"); !ok || count != 0 {
+		t.Fatalf("count after delete range is %d, %v", count, ok)
+	}
+}
+
+func TestPoolReusesAndBoundsConnections(t *testing.T) {
+	p := startProxy(t, startServer(t), 0)
+	c := newTestClient(t, Options{Addr: p.addr(), PoolSize: 2})
+	ctx := testContext(t)
+
+	for i := 0; i < 20; i++ {
+		if err := c.Put(ctx, "k", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if accepted, _ := p.counts(); accepted != 1 {
+		t.Fatalf("sequential calls opened %d connections", accepted)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 16; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("k-%d-%d", n, i)
+				if err := c.Put(ctx, key, key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if _, maxOpen := p.counts(); maxOpen > 2 {
+		t.Fatalf("%d connections were open at once with a pool of 2", maxOpen)
+	}
+
+	if count, err := c.Count(ctx, "a", "a"); err != nil || count != 321 {
+		t.Fatalf("count is %d, %v", count, err)
+	}
+
+	c.Close()
+	if err := c.Ping(ctx); err != ErrClosed {
+		t.Fatalf("ping after close returned %v", err)
+	}
+}
+
+func TestPipelineRepliesInOrder(t *testing.T) {
+	p := startProxy(t, startServer(t), 0)
+	c := newTestClient(t, Options{Addr: p.addr()})
+	ctx := testContext(t)
+
+	pipe := c.Pipeline()
+	var gets []int
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		pipe.Put(key, strconv.Itoa(i))
+		gets = append(gets, pipe.Get(key))
+	}
+	missing := pipe.Get("missing")
+	failed := pipe.Do(true, "NOPE")
+
+	replies, err := pipe.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replies) != 402 {
+		t.Fatalf("got %d replies", len(replies))
+	}
+
+	for i, at := range gets {
+		if value, ok, err := replies[at].Value(); err != nil || !ok || value != strconv.Itoa(i) {
+			t.Fatalf("get %d answered %q, %v, %v", i, value, ok, err)
+		}
+	}
+
+	if !replies[missing].Null {
+		t.Fatal("missing key is not a null reply")
+	}
+
+	if _, ok := replies[failed].Err().(ServerError); !ok {
+		t.Fatalf("unknown command answered %v", replies[failed].Err())
+	}
+
+	if accepted, _ := p.counts(); accepted != 1 {
+		t.Fatalf("pipeline opened %d connections", accepted)
+	}
+}
+
+func TestRetriesOnlyIdempotentCommands(t *testing.T) {
+	addr := startServer(t)
+	ctx := testContext(t)
+	options := Options{MaxRetries: 2, RetryBackoff: time.Millisecond}
+
+	p := startProxy(t, addr, 1)
+	options.Addr = p.addr()
+	c := newTestClient(t, options)
+	if _, err := c.Do(ctx, true, "SET", "a", "1"); err != nil {
+		t.Fatalf("idempotent command failed after a dropped connection: %v", err)
+	}
+
+	if accepted, _ := p.counts(); accepted != 2 {
+		t.Fatalf("idempotent command took %d connections", accepted)
+	}
+
+	p = startProxy(t, addr, 1)
+	options.Addr = p.addr()
+	c = newTestClient(t, options)
+	if _, err := c.Do(ctx, false, "SET", "b", "1"); err == nil {
+		t.Fatal("non idempotent command succeeded on a dropped connection")
+	}
+
+	pipe := c.Pipeline()
+	pipe.Put("c", "1")
+	pipe.Do(false, "SET", "d", "1")
+	p.mutex.Lock()
+	p.drop = 2
+	p.mutex.Unlock()
+	if _, err := pipe.Exec(ctx); err == nil {
+		t.Fatal("pipeline with a non idempotent command succeeded on a dropped connection")
+	}
+
+	if accepted, _ := p.counts(); accepted != 2 {
+		t.Fatalf("non idempotent commands took %d connections", accepted)
+	}
+
+	// Error replies leave the connection usable and are not retried.
+	if _, err := c.Do(ctx, true, "NOPE"); err == nil {
+		t.Fatal("unknown command succeeded")
+	} else if _, ok := err.(ServerError); !ok {
+		t.Fatalf("unknown command returned %v", err)
+	}
+
+	if accepted, _ := p.counts(); accepted != 3 {
+		t.Fatalf("error reply took %d connections", accepted-2)
+	}
+
+	if _, ok, err := c.Get(ctx, "b"); err != nil || ok {
+		t.Fatalf("dropped write of b is found: %v, %v", ok, err)
+	}
+}
+
+func TestContextBoundsCalls(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The server accepts but never answers.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := newTestClient(t, Options{Addr: listener.Addr().String()})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err = c.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("ping returned %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("ping took %v past its deadline", elapsed)
+	}
+}
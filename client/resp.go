@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ServerError is an error reply of the server. The command failed but the
+// connection can still be used.
+type ServerError struct {
+	Message string
+}
+
+func (e ServerError) Error() string {
+	return "Server error: " + e.Message
+}
+
+// Reply is the answer to one command. Null bulk strings, the replies for
+// missing keys, have Null set.
+type Reply struct {
+	kind  byte
+	str   string
+	n     int
+	Null  bool
+	elems []Reply
+	err   error
+}
+
+// Err is the error reply of the command, if it failed.
+func (r Reply) Err() error {
+	return r.err
+}
+
+// Value is a bulk or simple string reply, ok is false for a null one.
+func (r Reply) Value() (value string, ok bool, err error) {
+	if r.err != nil {
+		return "", false, r.err
+	}
+
+	switch r.kind {
+	case '$', '+':
+		return r.str, !r.Null, nil
+	}
+
+	return "", false, fmt.Errorf("Expected a string reply, got %q.", r.kind)
+}
+
+// Int is an integer reply.
+func (r Reply) Int() (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.kind != ':' {
+		return 0, fmt.Errorf("Expected an integer reply, got %q.", r.kind)
+	}
+
+	return r.n, nil
+}
+
+// Array is the elements of an array reply.
+func (r Reply) Array() ([]Reply, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if r.kind != '*' {
+		return nil, fmt.Errorf("Expected an array reply, got %q.", r.kind)
+	}
+
+	return r.elems, nil
+}
+
+// writeCommand writes args as an array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return "", fmt.Errorf("Malformed reply line %q.", line)
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readReply reads one reply. An error reply is returned in Reply.err, the
+// error is only set when the connection cannot be read any further.
+func readReply(r *bufio.Reader) (reply Reply, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return reply, err
+	}
+
+	reply.kind = line[0]
+	switch reply.kind {
+	case '+':
+		reply.str = line[1:]
+	case '-':
+		reply.err = ServerError{strings.TrimPrefix(line[1:], "ERR ")}
+	case ':':
+		reply.n, err = strconv.Atoi(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return reply, err
+		}
+
+		if size < 0 {
+			reply.Null = true
+			return reply, nil
+		}
+
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return reply, err
+		}
+		reply.str = string(buf[:size])
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return reply, err
+		}
+
+		if n < 0 {
+			reply.Null = true
+			return reply, nil
+		}
+
+		reply.elems = make([]Reply, 0, n)
+		for i := 0; i < n; i++ {
+			elem, err := readReply(r)
+			if err != nil {
+				return reply, err
+			}
+			reply.elems = append(reply.elems, elem)
+		}
+	default:
+		return reply, fmt.Errorf("Unknown reply %q.", line)
+	}
+
+	return reply, err
+}
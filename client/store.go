@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_CALL_TIMEOUT bounds each call of a Remote store.
+const DEFAULT_CALL_TIMEOUT time.Duration = 10 * time.Second
+
+// The methods below mirror store.Store with a context and an error added.
+
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, true, "PING")
+	return err
+}
+
+func (c *Client) Put(ctx context.Context, key string, value string) error {
+	_, err := c.Do(ctx, true, "SET", key, value)
+	return err
+}
+
+func (c *Client) Get(ctx context.Context, key string) (value string, ok bool, err error) {
+	reply, err := c.Do(ctx, true, "GET", key)
+	if err != nil {
+		return "", false, err
+	}
+
+	return reply.Value()
+}
+
+func (c *Client) Del(ctx context.Context, key string) error {
+	_, err := c.Do(ctx, true, "DEL", key)
+	return err
+}
+
+func (c *Client) Scan(ctx context.Context, keyone string, keytwo string) ([]store.KeyValue, error) {
+	reply, err := c.Do(ctx, true, "RANGE", keyone, keytwo)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := reply.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elems)%2 != 0 {
+		return nil, fmt.Errorf("Range reply has an odd length %d.", len(elems))
+	}
+
+	items := make([]store.KeyValue, 0, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		items = append(items, store.KeyValue{Key: elems[i].str, Value: elems[i+1].str})
+	}
+
+	return items, nil
+}
+
+// MultiGet returns the keys that are present, like store.Store.
+func (c *Client) MultiGet(ctx context.Context, keys []string) ([]store.KeyValue, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	reply, err := c.Do(ctx, true, append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := reply.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elems) != len(keys) {
+		return nil, fmt.Errorf("Mget of %d keys returned %d values.", len(keys), len(elems))
+	}
+
+	var items []store.KeyValue
+	for i, elem := range elems {
+		if !elem.Null {
+			items = append(items, store.KeyValue{Key: keys[i], Value: elem.str})
+		}
+	}
+
+	return items, nil
+}
+
+func (c *Client) MultiPut(ctx context.Context, items []store.KeyValue) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	args := make([]string, 0, 1+2*len(items))
+	args = append(args, "MSET")
+	for _, kv := range items {
+		args = append(args, kv.Key, kv.Value)
+	}
+
+	_, err := c.Do(ctx, true, args...)
+	return err
+}
+
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	reply, err := c.Do(ctx, true, "EXISTS", key)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := reply.Int()
+	return n > 0, err
+}
+
+func (c *Client) Count(ctx context.Context, keyone string, keytwo string) (int, error) {
+	reply, err := c.Do(ctx, true, "COUNT", keyone, keytwo)
+	if err != nil {
+		return 0, err
+	}
+
+	return reply.Int()
+}
+
+func (c *Client) DeleteRange(ctx context.Context, start string, end string) error {
+	_, err := c.Do(ctx, true, "DELRANGE", start, end)
+	return err
+}
+
+func (c *Client) Flush(ctx context.Context) error {
+	_, err := c.Do(ctx, true, "FLUSH")
+	return err
+}
+
+// DefineIndex redefines an existing index and rebuilds it.
+func (c *Client) DefineIndex(ctx context.Context, def store.IndexDefinition) error {
+	args := []string{"INDEX", def.Name, def.Type}
+	if def.Type == store.PREFIX_INDEX {
+		args = append(args, strconv.Itoa(def.PrefixLength))
+	}
+
+	_, err := c.Do(ctx, true, args...)
+	return err
+}
+
+func (c *Client) QueryIndex(ctx context.Context, indexName string, value string) ([]string, error) {
+	reply, err := c.Do(ctx, true, "QUERY", indexName, value)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := reply.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		keys = append(keys, elem.str)
+	}
+
+	return keys, nil
+}
+
+func (c *Client) RebuildIndexes(ctx context.Context) error {
+	_, err := c.Do(ctx, true, "REINDEX")
+	return err
+}
+
+// Remote is a store.Store backed by a Client, so code written against an
+// embedded store runs against a server unchanged. Each call gets its own
+// timeout, errors of the calls that cannot return one are logged.
+type Remote struct {
+	client  *Client
+	timeout time.Duration
+}
+
+// NewRemote wraps client, a zero timeout takes DEFAULT_CALL_TIMEOUT.
+func NewRemote(client *Client, timeout time.Duration) store.Store {
+	if timeout <= 0 {
+		timeout = DEFAULT_CALL_TIMEOUT
+	}
+
+	return &Remote{client, timeout}
+}
+
+func (r *Remote) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+func (r *Remote) Put(key string, value string) error {
+	ctx, cancel := r.context()
+	defer cancel()
+	return r.client.Put(ctx, key, value)
+}
+
+func (r *Remote) Get(key string) (value string, ok bool) {
+	ctx, cancel := r.context()
+	defer cancel()
+	value, ok, err := r.client.Get(ctx, key)
+	if err != nil {
+		log.Errorf("Could not get %s: %v", key, err)
+	}
+
+	return value, ok
+}
+
+func (r *Remote) Del(key string) {
+	ctx, cancel := r.context()
+	defer cancel()
+	if err := r.client.Del(ctx, key); err != nil {
+		log.Errorf("Could not delete %s: %v", key, err)
+	}
+}
+
+func (r *Remote) Scan(keyone string, keytwo string) (items []store.KeyValue, ok bool) {
+	ctx, cancel := r.context()
+	defer cancel()
+	items, err := r.client.Scan(ctx, keyone, keytwo)
+	if err != nil {
+		log.Errorf("Could not scan %s to %s: %v", keyone, keytwo, err)
+		return nil, false
+	}
+
+	return items, true
+}
+
+func (r *Remote) MultiGet(keys []string) (items []store.KeyValue) {
+	ctx, cancel := r.context()
+	defer cancel()
+	items, err := r.client.MultiGet(ctx, keys)
+	if err != nil {
+		log.Errorf("Could not get %d keys: %v", len(keys), err)
+	}
+
+	return items
+}
+
+func (r *Remote) MultiPut(items []store.KeyValue) error {
+	ctx, cancel := r.context()
+	defer cancel()
+	return r.client.MultiPut(ctx, items)
+}
+
+func (r *Remote) Exists(key string) bool {
+	ctx, cancel := r.context()
+	defer cancel()
+	found, err := r.client.Exists(ctx, key)
+	if err != nil {
+		log.Errorf("Could not check %s: %v", key, err)
+	}
+
+	return found
+}
+
+func (r *Remote) Count(keyone string, keytwo string) (count int, ok bool) {
+	ctx, cancel := r.context()
+	defer cancel()
+	count, err := r.client.Count(ctx, keyone, keytwo)
+	if err != nil {
+		log.Errorf("Could not count %s to %s: %v", keyone, keytwo, err)
+		return 0, false
+	}
+
+	return count, true
+}
+
+func (r *Remote) DeleteRange(start string, end string) error {
+	ctx, cancel := r.context()
+	defer cancel()
+	return r.client.DeleteRange(ctx, start, end)
+}
+
+func (r *Remote) Flush() {
+	ctx, cancel := r.context()
+	defer cancel()
+	if err := r.client.Flush(ctx); err != nil {
+		log.Errorf("Could not flush: %v", err)
+	}
+}
+
+func (r *Remote) DefineIndex(def store.IndexDefinition) error {
+	ctx, cancel := r.context()
+	defer cancel()
+	return r.client.DefineIndex(ctx, def)
+}
+
+func (r *Remote) QueryIndex(indexName string, value string) (keys []string, err error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	return r.client.QueryIndex(ctx, indexName, value)
+}
+
+func (r *Remote) RebuildIndexes() error {
+	ctx, cancel := r.context()
+	defer cancel()
+	return r.client.RebuildIndexes(ctx)
+}
@@ -8,7 +8,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
-	"path/filepath"
+	"strconv"
 )
 
 const (
@@ -16,134 +16,254 @@ const (
 	PUT_COMMAND       string = "put"
 	DEL_COMMAND       string = "del"
 	SCAN_COMMAND      string = "scan"
+	INDEX_COMMAND     string = "index"
+	QUERY_COMMAND     string = "query"
+	REINDEX_COMMAND   string = "reindex"
+	GC_COMMAND        string = "gc"
+	MGET_COMMAND      string = "mget"
+	MPUT_COMMAND      string = "mput"
+	EXISTS_COMMAND    string = "exists"
+	COUNT_COMMAND     string = "count"
+	DELRANGE_COMMAND  string = "delrange"
 	FIRST_LINE_RECORD string = "type"
-	STORAGE_DIR       string = "storage"
-	STORAGE_FILE      string = "data_records.txt"
+	CHECK_COMMAND     string = "check"
+	REPAIR_COMMAND    string = "repair"
+	REBALANCE_COMMAND string = "rebalance"
+	REPAIR_SUFFIX     string = ".repaired"
 )
 
+// Command is one input row. Args holds the keys of an mget and the key
+// value pairs of an mput, Key is then the first key.
 type Command struct {
 	Type   string
 	Key    string
 	KeyTwo string
 	Value  string
+	Args   []string
 }
 
-func ReadCsvCommands(filePath string, outputPath string) {
+func openStore(engine string, options store.Options) (store.Store, error) {
+	switch engine {
+	case store.SS_ENGINE:
+		return store.NewSsStore(options)
+	case store.HASH_ENGINE:
+		return store.NewHashStore(options)
+	case store.SHARDED_ENGINE:
+		return store.NewShardedStore(options)
+	}
+
+	return nil, fmt.Errorf("Unknown storage engine %q.", engine)
+}
+
+// ReadCsvCommands runs the commands of the csv file at filePath against the
+// store and writes the results to outputPath, "-" being stdout.
+func ReadCsvCommands(filePath string, outputPath string, engine string,
+	options store.Options) error {
+	return ReadCommands(filePath, outputPath, FORMAT_CSV, false, engine, options)
+}
+
+// ReadCommands runs the commands of filePath, csv rows or ndjson lines as
+// format says, and writes the results in the same format to outputPath.
+// Input that could not be read, or the bad rows of a strict run as
+// InputErrors, is returned after the store is flushed and the output is
+// written.
+func ReadCommands(filePath string, outputPath string, format string, strict bool,
+	engine string, options store.Options) error {
+	format, err := ResolveFormat(format, filePath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	csv_file, err := os.Open(filePath)
 
-	log.Infof("Opening csv file %s", filePath)
+	log.Infof("Opening %s file %s", format, filePath)
 
 	if err != nil {
-		log.Fatalln("FATAL: Could not open csv file.", err)
+		log.Fatalln("FATAL: Could not open input file.", err)
 	}
+	defer csv_file.Close()
 
 	log.Infof("Creating output file.")
-	outErr := WriteOutputFirstLine(outputPath)
+	run, open := RunCsvCommands, OpenOutput
+	if format == FORMAT_JSON {
+		run, open = RunJsonCommands, OpenJsonOutput
+	}
+
+	out, outErr := open(outputPath)
 	if outErr != nil {
 		log.Fatal("Could not create output file", outErr)
 	}
 
-	reader := csv.NewReader(csv_file)
-	path := filepath.Join(".", STORAGE_DIR)
-	err = os.MkdirAll(path, os.ModePerm)
+	err = os.MkdirAll(options.Dir, os.ModePerm)
 
 	if err != nil {
-		log.Fatalf("Cannot create directory for storage at %s", STORAGE_DIR)
+		log.Fatalf("Cannot create directory for storage at %s", options.Dir)
 	}
 
-	logPath := filepath.Join(path, STORAGE_FILE)
-	localStore, storeErr := store.NewSsStore(logPath)
+	localStore, storeErr := openStore(engine, options)
 	if storeErr != nil {
-		log.Fatal("Could not create store.", storeErr)
+		log.Error("Could not create store.", storeErr)
+		return storeErr
 	}
 
+	runErr := run(csv_file, localStore, out, strict)
+	if err = store.Close(localStore); err != nil {
+		log.Error("Could not close store.", err)
+	}
+	if err = out.Close(); err != nil {
+		log.Fatal("Could not write output file", err)
+	}
+
+	return runErr
+}
+
+// RunCsvCommands processes every command read from r against storage and
+// writes the results to out. A row that cannot be run, one with the wrong
+// number of columns, an unknown command or missing arguments, is written
+// out with the ERROR_OUTCOME and its reason. In strict mode bad rows are
+// skipped instead and returned together as InputErrors once r is read.
+// Flushing the store and the output is left to the caller.
+func RunCsvCommands(r io.Reader, storage store.Store, out Output, strict bool) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
 	log.Infoln("Reading in csv records.")
+	var bad InputErrors
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 
-		if err != nil {
-			log.Fatal(err)
+		var command Command
+		var inputErr *InputError
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			inputErr = &InputError{Line: parseErr.StartLine, Reason: parseErr.Err.Error()}
+		} else if err != nil {
+			return err
+		} else {
+			line, _ := reader.FieldPos(0)
+			if record[0] == FIRST_LINE_RECORD {
+				log.Infoln("First line detected, skipping.")
+				continue
+			}
+
+			if isMultiKey(record[0]) {
+				command = multiKeyCommand(record[0], record[1:])
+				if err = validateCommand(command); err != nil {
+					inputErr = &InputError{Line: line, Reason: err.Error()}
+				}
+			} else if len(record) != CSV_COLUMNS {
+				command.Type = record[0]
+				if len(record) > 1 {
+					command.Key = record[1]
+				}
+				inputErr = &InputError{Line: line, Reason: fmt.Sprintf(
+					"Expected %d columns, got %d.", CSV_COLUMNS, len(record))}
+			} else {
+				command = Command{Type: record[0], Key: record[1], KeyTwo: record[2],
+					Value: record[3]}
+				if err = validateCommand(command); err != nil {
+					inputErr = &InputError{Line: line, Reason: err.Error()}
+				}
+			}
 		}
 
-		if record[0] == FIRST_LINE_RECORD {
-			log.Infoln("First line detected, skipping.")
+		if inputErr != nil {
+			if err = badRow(&bad, strict, command, inputErr, out); err != nil {
+				return err
+			}
 			continue
 		}
-		command := Command{record[0], record[1], record[2], record[3]}
-		cmd_err := ProcessCommand(command, localStore, outputPath)
+
+		cmd_err := ProcessCommand(command, storage, out)
 		if cmd_err != nil {
 			log.Errorln(cmd_err)
 		}
 	}
 
-	localStore.Flush()
+	if len(bad) > 0 {
+		return bad
+	}
+
+	return nil
 }
 
-func WriteOutputFirstLine(outputPath string) error {
-	file, err := os.OpenFile(outputPath, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+// CheckStore prints every problem found in the store directory dir, it
+// returns false when there were any.
+func CheckStore(dir string, out io.Writer) (ok bool, err error) {
+	problems, err := store.CheckDir(dir)
+	for _, p := range problems {
+		fmt.Fprintln(out, p)
+	}
+
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	_, write_err := file.WriteString("type,key1,outcome,values\n")
-	file.Close()
-	return write_err
+	fmt.Fprintf(out, "%s: %d problems found.\n", dir, len(problems))
+	return len(problems) == 0, nil
 }
 
-func WriteOutputs(command Command, outcome int, value []string, outputPath string) error {
-	file, err := os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-
-	if err != nil {
-		return err
+// RepairStore salvages the readable records of the store directory dir
+// into a fresh store at dstDir, which defaults to dir with a .repaired
+// suffix. The fresh store is written with the given options.
+func RepairStore(dir string, dstDir string, options store.Options, out io.Writer) error {
+	if dstDir == "" {
+		dstDir = dir + REPAIR_SUFFIX
 	}
 
-	vstring := ""
-	first := true
-	for _, v := range value {
-		if first {
-			vstring = fmt.Sprintf("%s", v)
-			first = false
-		} else {
-			vstring = fmt.Sprintf("%s,%s", vstring, v)
-		}
+	options.Dir = dstDir
+	options.MergeInterval = 0
+	salvaged, problems, err := store.Repair(dir, options)
+	for _, p := range problems {
+		fmt.Fprintln(out, p)
 	}
 
-	_, write_err := file.WriteString(fmt.Sprintf("%s,%s,%d,%s\n", command.Type,
-		command.Key, outcome, vstring))
-	file.Close()
-	return write_err
+	if err != nil {
+		return err
+	}
 
+	fmt.Fprintf(out, "Salvaged %d keys from %s into %s, %d problems found.\n", salvaged,
+		dir, dstDir, len(problems))
+	return nil
 }
-func WriteOutput(command Command, outcome int, value string, outputPath string) error {
-	file, err := os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 
+// RebalanceStore changes the shard count of the sharded store in
+// options.Dir, which must not be served meanwhile.
+func RebalanceStore(options store.Options, shards int, out io.Writer) error {
+	moved, err := store.Rebalance(options, shards)
 	if err != nil {
 		return err
 	}
 
-	_, write_err := file.WriteString(fmt.Sprintf("%s,%s,%d,%s\n", command.Type,
-		command.Key, outcome, value))
-	file.Close()
-	return write_err
+	fmt.Fprintf(out, "Moved %d keys, %s has %d shards.\n", moved, options.Dir, shards)
+	return nil
+}
 
+// itemsResult reports the found items of a scan or mget.
+func itemsResult(command Command, items []store.KeyValue) Result {
+	result := Result{Command: command, Outcome: len(items)}
+	for _, it := range items {
+		result.Keys = append(result.Keys, it.Key)
+		result.Values = append(result.Values, it.Value)
+	}
+
+	return result
 }
 
-func ProcessCommand(command Command, storage store.Store, outputPath string) error {
+func ProcessCommand(command Command, storage store.Store, out Output) error {
 	switch {
 	case SCAN_COMMAND == command.Type:
 		log.Infof("Scan command given for key: %s, key2: %s", command.Key,
 			command.KeyTwo)
-		values, ok := storage.Scan(command.Key, command.KeyTwo)
+		items, ok := storage.Scan(command.Key, command.KeyTwo)
 		if ok {
-			WriteOutputs(command, len(values), values, outputPath)
+			out.WriteResult(itemsResult(command, items))
 
 			log.Infof("Scan command successful given for key: %s, key2: %s. Found %d items.", command.Key,
-				command.KeyTwo, len(values))
+				command.KeyTwo, len(items))
 		} else {
-			WriteOutput(command, 0, "", outputPath)
+			out.WriteResult(Result{Command: command, Outcome: 0})
 		}
 
 		return nil
@@ -152,11 +272,11 @@ func ProcessCommand(command Command, storage store.Store, outputPath string) err
 			command.Value)
 		value, ok := storage.Get(command.Key)
 		if ok {
-			WriteOutput(command, 1, value, outputPath)
+			out.WriteResult(Result{Command: command, Outcome: 1, Values: []string{value}})
 			log.Infof("Get command successful found value: %s, for key: %s",
 				value, command.Key)
 		} else {
-			WriteOutput(command, 0, "", outputPath)
+			out.WriteResult(Result{Command: command, Outcome: 0})
 		}
 
 		return nil
@@ -164,14 +284,123 @@ func ProcessCommand(command Command, storage store.Store, outputPath string) err
 		log.Infof("Put command given for key: %s, value: %s", command.Key,
 			command.Value)
 
-		WriteOutput(command, 0, "", outputPath)
+		out.WriteResult(Result{Command: command, Outcome: 0})
 		return storage.Put(command.Key, command.Value)
 	case DEL_COMMAND == command.Type:
 		log.Infof("Del command given for key: %s, value: %s", command.Key,
 			command.Value)
 		storage.Del(command.Key)
-		WriteOutput(command, 1, "", outputPath)
+		out.WriteResult(Result{Command: command, Outcome: 1})
+
+		return nil
+	case DELRANGE_COMMAND == command.Type:
+		log.Infof("Delrange command given for key: %s, key2: %s", command.Key,
+			command.KeyTwo)
+		if err := storage.DeleteRange(command.Key, command.KeyTwo); err != nil {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return err
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: 1})
+		return nil
+	case INDEX_COMMAND == command.Type:
+		log.Infof("Index command given for index: %s, type: %s", command.Key,
+			command.KeyTwo)
+		def := store.IndexDefinition{Name: command.Key, Type: command.KeyTwo}
+		if def.Type == store.PREFIX_INDEX {
+			prefixLength, err := strconv.Atoi(command.Value)
+			if err != nil {
+				out.WriteResult(Result{Command: command, Outcome: 0})
+				return fmt.Errorf("Invalid prefix length %q for index %s.",
+					command.Value, command.Key)
+			}
+			def.PrefixLength = prefixLength
+		}
+
+		err := storage.DefineIndex(def)
+		if err != nil {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return err
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: 1})
+		return nil
+	case QUERY_COMMAND == command.Type:
+		log.Infof("Query command given for index: %s, value: %s", command.Key,
+			command.Value)
+		keys, err := storage.QueryIndex(command.Key, command.Value)
+		if err != nil {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return err
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: len(keys), Values: keys})
+		return nil
+	case REINDEX_COMMAND == command.Type:
+		log.Info("Reindex command given.")
+		err := storage.RebuildIndexes()
+		if err != nil {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return err
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: 1})
+		return nil
+	case MGET_COMMAND == command.Type:
+		log.Infof("Mget command given for %d keys.", len(command.Args))
+		items := storage.MultiGet(command.Args)
+		out.WriteResult(itemsResult(command, items))
+		return nil
+	case MPUT_COMMAND == command.Type:
+		items := make([]store.KeyValue, 0, len(command.Args)/2)
+		for i := 0; i+1 < len(command.Args); i += 2 {
+			items = append(items, store.KeyValue{Key: command.Args[i], Value: command.Args[i+1]})
+		}
+
+		log.Infof("Mput command given for %d keys.", len(items))
+		if err := storage.MultiPut(items); err != nil {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return err
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: len(items)})
+		return nil
+	case EXISTS_COMMAND == command.Type:
+		log.Infof("Exists command given for key: %s", command.Key)
+		outcome := 0
+		if storage.Exists(command.Key) {
+			outcome = 1
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: outcome})
+		return nil
+	case COUNT_COMMAND == command.Type:
+		log.Infof("Count command given for key: %s, key2: %s", command.Key,
+			command.KeyTwo)
+		count, ok := storage.Count(command.Key, command.KeyTwo)
+		if !ok {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return fmt.Errorf("Could not count keys between %s and %s.", command.Key,
+				command.KeyTwo)
+		}
+
+		out.WriteResult(Result{Command: command, Outcome: count})
+		return nil
+	case GC_COMMAND == command.Type:
+		log.Info("Garbage collection command given.")
+		collector, ok := storage.(store.GarbageCollector)
+		if !ok {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return errors.New("Store does not support garbage collection.")
+		}
+
+		err := collector.CollectGarbage()
+		if err != nil {
+			out.WriteResult(Result{Command: command, Outcome: 0})
+			return err
+		}
 
+		out.WriteResult(Result{Command: command, Outcome: 1})
 		return nil
 	}
 
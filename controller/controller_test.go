@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+const csvInput = `type,key1,key2,value
+put,a,,1
+put,b,,"x,y"
+put,c,,"say ""hi"""
+get,b,,
+scan,a,c,
+mput,d,4,e,5
+mget,a,d,zz,
+exists,d,,
+count,a,z,
+del,a,,
+get,a,,
+bogus,k,,
+get,k
+`
+
+// csvResults is the output of csvInput without the rows of its bad lines.
+const csvResults = `type,key1,outcome,values
+put,a,0,
+put,b,0,
+put,c,0,
+get,b,1,"x,y"
+scan,a,3,"say ""hi""",1,"x,y"
+mput,d,2,
+mget,a,2,1,4
+exists,d,1,
+count,a,2,
+del,a,1,
+get,a,0,
+`
+
+const csvErrorResults = `bogus,k,-1,"line 13: Unknown command ""bogus""."
+get,k,-1,"line 14: Expected 4 columns, got 2."
+`
+
+const jsonInput = `{"op":"put","key":"a","value":"1"}
+{"op":"put","key":"b","value":{"n":[1,2]}}
+{"op":"get","key":"b"}
+{"op":"scan","key":"a","end":"c"}
+{"op":"mput","items":[{"key":"d","value":"4"},{"key":"e","value":"5"}]}
+{"op":"mget","keys":["a","d","zz"]}
+{"op":"exists","key":"d"}
+{"op":"count","key":"a","end":"z"}
+
+{"op":"del","key":"a"}
+{"op":"get","key":"a"}
+{"op":"bogus","key":"k"}
+{"op":"get","key":"k","extra":1}
+`
+
+const jsonResults = `{"op":"put","key":"a","outcome":0}
+{"op":"put","key":"b","outcome":0}
+{"op":"get","key":"b","outcome":1,"value":"{\"n\":[1,2]}"}
+{"op":"scan","key":"a","end":"c","outcome":2,"results":[{"key":"a","value":"1"},{"key":"b","value":"{\"n\":[1,2]}"}]}
+{"op":"mput","key":"d","outcome":2}
+{"op":"mget","key":"a","outcome":2,"results":[{"key":"a","value":"1"},{"key":"d","value":"4"}]}
+{"op":"exists","key":"d","outcome":1}
+{"op":"count","key":"a","end":"z","outcome":2}
+{"op":"del","key":"a","outcome":1}
+{"op":"get","key":"a","outcome":0}
+`
+
+const jsonErrorResults = `{"op":"bogus","key":"k","outcome":-1,"error":"line 12: Unknown command \"bogus\"."}
+{"op":"","key":"","outcome":-1,"error":"line 13: json: unknown field \"extra\""}
+`
+
+func TestReadCommandsInEveryFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		format   string
+		strict   bool
+		input    string
+		want     string
+		badLines []int
+	}{
+		{"csv", "in.txt", FORMAT_CSV, false, csvInput, csvResults + csvErrorResults, nil},
+		{"csv strict", "in.txt", FORMAT_CSV, true, csvInput, csvResults, []int{13, 14}},
+		{"auto csv", "in.csv", FORMAT_AUTO, false, csvInput, csvResults + csvErrorResults, nil},
+		{"json", "in.txt", FORMAT_JSON, false, jsonInput, jsonResults + jsonErrorResults, nil},
+		{"json strict", "in.txt", FORMAT_JSON, true, jsonInput, jsonResults, []int{12, 13}},
+		{"auto ndjson", "in.ndjson", FORMAT_AUTO, false, jsonInput, jsonResults + jsonErrorResults, nil},
+		{"auto jsonl", "in.JSONL", "", false, jsonInput, jsonResults + jsonErrorResults, nil},
+	}
+
+	for _, engine := range []string{store.SS_ENGINE, store.HASH_ENGINE, store.SHARDED_ENGINE} {
+		for _, test := range tests {
+			dir := t.TempDir()
+			input := filepath.Join(dir, test.file)
+			if err := ioutil.WriteFile(input, []byte(test.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			options := store.DefaultOptions()
+			options.Dir = filepath.Join(dir, "store")
+			output := filepath.Join(dir, "out")
+			err := ReadCommands(input, output, test.format, test.strict, engine, options)
+
+			var badLines []int
+			if bad, ok := err.(InputErrors); ok {
+				for _, e := range bad {
+					badLines = append(badLines, e.Line)
+				}
+			} else if err != nil {
+				t.Fatalf("%s %s: %v", engine, test.name, err)
+			}
+
+			if !reflect.DeepEqual(badLines, test.badLines) {
+				t.Errorf("%s %s: bad lines are %v, want %v", engine, test.name, badLines,
+					test.badLines)
+			}
+
+			got, err := ioutil.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The hash engine scans in no particular order.
+			format, _ := ResolveFormat(test.format, test.file)
+			gotRows, err := outputRows(bytes.NewReader(got), format, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantRows, _ := outputRows(strings.NewReader(test.want), format, true)
+			if !reflect.DeepEqual(gotRows, wantRows) {
+				t.Errorf("%s %s: output is\n%s\nwant\n%s", engine, test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestCsvOutputRoundTrips(t *testing.T) {
+	values := []string{"plain", "a,b", `"quoted"`, "two\nlines", " padded ", ""}
+	dir := t.TempDir()
+	options := store.DefaultOptions()
+	options.Dir = filepath.Join(dir, "store")
+
+	var input bytes.Buffer
+	w := csv.NewWriter(&input)
+	for n, v := range values {
+		w.Write([]string{PUT_COMMAND, fmt.Sprintf("k%d", n), "", v})
+		w.Write([]string{GET_COMMAND, fmt.Sprintf("k%d", n), "", ""})
+	}
+	w.Flush()
+
+	path := filepath.Join(dir, "in.csv")
+	if err := ioutil.WriteFile(path, input.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "out.csv")
+	if err := ReadCsvCommands(path, output, store.SS_ENGINE, options); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, row := range rows {
+		if row[0] == GET_COMMAND {
+			got = append(got, row[3])
+		}
+	}
+
+	if !reflect.DeepEqual(got, values) {
+		t.Fatalf("values read back as %q, want %q", got, values)
+	}
+}
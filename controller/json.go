@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FORMAT_CSV  string = "csv"
+	FORMAT_JSON string = "json"
+	FORMAT_AUTO string = "auto"
+
+	// MAX_JSON_LINE_BYTES bounds a single ndjson command line.
+	MAX_JSON_LINE_BYTES int = 16 << 20
+)
+
+// jsonExtensions are the input file extensions FORMAT_AUTO reads as ndjson.
+var jsonExtensions = []string{".ndjson", ".jsonl", ".json"}
+
+// jsonCommand is one ndjson input line. End is the second column of the
+// csv rows, the scan end key or the index type. A value that is not a json
+// string is stored as its compact json text. Keys are the keys of an mget
+// and Items the pairs of an mput.
+type jsonCommand struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	End   string          `json:"end,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Keys  []string        `json:"keys,omitempty"`
+	Items []jsonItem      `json:"items,omitempty"`
+}
+
+type jsonItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// jsonResult is one ndjson output line. Get sets Value, scan and mget set
+// Results and query sets Values.
+type jsonResult struct {
+	Op      string     `json:"op"`
+	Key     string     `json:"key"`
+	End     string     `json:"end,omitempty"`
+	Outcome int        `json:"outcome"`
+	Value   *string    `json:"value,omitempty"`
+	Values  []string   `json:"values,omitempty"`
+	Results []jsonItem `json:"results,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ResolveFormat picks the input format for filePath, FORMAT_AUTO reads
+// files ending in .ndjson, .jsonl or .json as ndjson and anything else as
+// csv.
+func ResolveFormat(format string, filePath string) (string, error) {
+	switch format {
+	case FORMAT_CSV, FORMAT_JSON:
+		return format, nil
+	case FORMAT_AUTO, "":
+		ext := strings.ToLower(filepath.Ext(filePath))
+		for _, e := range jsonExtensions {
+			if ext == e {
+				return FORMAT_JSON, nil
+			}
+		}
+		return FORMAT_CSV, nil
+	}
+
+	return "", fmt.Errorf("Unknown input format %s, expected csv, json or auto.", format)
+}
+
+type jsonOutput struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+// NewJsonOutput writes one json object per result to w.
+func NewJsonOutput(w io.Writer) Output {
+	return newJsonOutput(w, nil)
+}
+
+func newJsonOutput(w io.Writer, closer io.Closer) Output {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+	return &jsonOutput{buffered, encoder, closer}
+}
+
+// OpenJsonOutput creates the ndjson output file at path, truncating an old
+// one. A path of "-" writes to stdout.
+func OpenJsonOutput(path string) (Output, error) {
+	if path == STDOUT_PATH {
+		return NewJsonOutput(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return newJsonOutput(file, file), nil
+}
+
+func (o *jsonOutput) WriteResult(result Result) error {
+	command := result.Command
+	line := jsonResult{Op: command.Type, Key: command.Key, Outcome: result.Outcome,
+		Error: result.Error}
+	switch {
+	case result.Error != "":
+	case command.Type == GET_COMMAND:
+		if len(result.Values) > 0 {
+			line.Value = &result.Values[0]
+		}
+	case command.Type == SCAN_COMMAND || command.Type == MGET_COMMAND:
+		line.End = command.KeyTwo
+		line.Results = make([]jsonItem, 0, len(result.Values))
+		for n, v := range result.Values {
+			item := jsonItem{Value: v}
+			if n < len(result.Keys) {
+				item.Key = result.Keys[n]
+			}
+			line.Results = append(line.Results, item)
+		}
+	case command.Type == COUNT_COMMAND || command.Type == DELRANGE_COMMAND:
+		line.End = command.KeyTwo
+	default:
+		line.Values = result.Values
+	}
+
+	return o.encoder.Encode(line)
+}
+
+func (o *jsonOutput) Flush() error {
+	return o.w.Flush()
+}
+
+func (o *jsonOutput) Close() error {
+	err := o.Flush()
+	if o.closer != nil {
+		if closeErr := o.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// parseJsonCommand maps an ndjson line onto the columns of a csv row.
+func parseJsonCommand(line []byte) (command Command, err error) {
+	var parsed jsonCommand
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&parsed); err != nil {
+		return command, err
+	}
+
+	if parsed.Op == "" {
+		return command, fmt.Errorf("Missing op.")
+	}
+
+	command = Command{Type: strings.ToLower(parsed.Op), Key: parsed.Key, KeyTwo: parsed.End}
+	switch command.Type {
+	case MGET_COMMAND:
+		command.Args = parsed.Keys
+	case MPUT_COMMAND:
+		for _, it := range parsed.Items {
+			command.Args = append(command.Args, it.Key, it.Value)
+		}
+	}
+
+	if len(command.Args) > 0 {
+		command.Key = command.Args[0]
+	}
+
+	if len(parsed.Value) == 0 || string(parsed.Value) == "null" {
+		return command, nil
+	}
+
+	if parsed.Value[0] == '"' {
+		err = json.Unmarshal(parsed.Value, &command.Value)
+		return command, err
+	}
+
+	var compact bytes.Buffer
+	if err = json.Compact(&compact, parsed.Value); err != nil {
+		return command, err
+	}
+	command.Value = compact.String()
+	return command, nil
+}
+
+// RunJsonCommands processes one json command per line of r against storage
+// and writes the results to out, blank lines are skipped. Bad lines are
+// handled as RunCsvCommands handles bad rows.
+func RunJsonCommands(r io.Reader, storage store.Store, out Output, strict bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_JSON_LINE_BYTES)
+	log.Infoln("Reading in json records.")
+	var bad InputErrors
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		command, err := parseJsonCommand(line)
+		if err == nil {
+			err = validateCommand(command)
+		}
+
+		if err != nil {
+			inputErr := &InputError{Line: lineNumber, Reason: err.Error()}
+			if err = badRow(&bad, strict, command, inputErr, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if cmdErr := ProcessCommand(command, storage, out); cmdErr != nil {
+			log.Errorln(cmdErr)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return &InputError{Line: lineNumber + 1, Reason: err.Error()}
+	}
+
+	if len(bad) > 0 {
+		return bad
+	}
+
+	return nil
+}
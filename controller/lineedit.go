@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	keyCtrlA     rune = 1
+	keyCtrlB     rune = 2
+	keyCtrlC     rune = 3
+	keyCtrlD     rune = 4
+	keyCtrlE     rune = 5
+	keyCtrlF     rune = 6
+	keyCtrlH     rune = 8
+	keyCtrlK     rune = 11
+	keyEnter     rune = 13
+	keyCtrlN     rune = 14
+	keyCtrlP     rune = 16
+	keyCtrlU     rune = 21
+	keyEscape    rune = 27
+	keyBackspace rune = 127
+)
+
+// errInterrupted is returned by ReadLine when the line is dropped with
+// Ctrl-C.
+var errInterrupted = errors.New("Interrupted.")
+
+// lineReader reads command lines, remembering them for History.
+type lineReader interface {
+	ReadLine(prompt string) (line string, err error)
+	History() []string
+}
+
+// plainReader reads lines as they come, for input that is not a terminal.
+type plainReader struct {
+	scanner *bufio.Scanner
+	history []string
+}
+
+func newPlainReader(in io.Reader) *plainReader {
+	return &plainReader{scanner: bufio.NewScanner(in)}
+}
+
+func (p *plainReader) ReadLine(prompt string) (line string, err error) {
+	if !p.scanner.Scan() {
+		if err = p.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+
+	line = p.scanner.Text()
+	p.history = addHistory(p.history, line)
+	return line, nil
+}
+
+func (p *plainReader) History() []string {
+	return p.history
+}
+
+func addHistory(history []string, line string) []string {
+	if strings.TrimSpace(line) == "" {
+		return history
+	}
+
+	if n := len(history); n > 0 && history[n-1] == line {
+		return history
+	}
+
+	return append(history, line)
+}
+
+// lineEditor reads lines from a terminal in raw mode. It supports moving
+// within the line, the usual emacs style control keys and walking the
+// history with the arrow keys.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history []string
+	line    []rune
+	pos     int
+}
+
+func newLineEditor(in io.Reader, out io.Writer) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(in), out: out}
+}
+
+func (e *lineEditor) History() []string {
+	return e.history
+}
+
+func (e *lineEditor) refresh(prompt string) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(e.line))
+	if back := len(e.line) - e.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+func (e *lineEditor) setLine(line string) {
+	e.line = []rune(line)
+	e.pos = len(e.line)
+}
+
+func (e *lineEditor) ReadLine(prompt string) (line string, err error) {
+	e.line = e.line[:0]
+	e.pos = 0
+	browsing := len(e.history)
+	draft := ""
+	e.refresh(prompt)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case keyEnter, '\n':
+			fmt.Fprint(e.out, "\n")
+			line = string(e.line)
+			e.history = addHistory(e.history, line)
+			return line, nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(e.line) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case keyBackspace, keyCtrlH:
+			if e.pos > 0 {
+				e.pos--
+				e.deleteAt(e.pos)
+			}
+		case keyCtrlA:
+			e.pos = 0
+		case keyCtrlE:
+			e.pos = len(e.line)
+		case keyCtrlB:
+			e.moveBy(-1)
+		case keyCtrlF:
+			e.moveBy(1)
+		case keyCtrlK:
+			e.line = e.line[:e.pos]
+		case keyCtrlU:
+			e.line = e.line[:0]
+			e.pos = 0
+		case keyCtrlP:
+			browsing, draft = e.browse(browsing, -1, draft)
+		case keyCtrlN:
+			browsing, draft = e.browse(browsing, 1, draft)
+		case keyEscape:
+			browsing, draft = e.escape(browsing, draft)
+		default:
+			if r >= ' ' {
+				e.insert(r)
+			}
+		}
+		e.refresh(prompt)
+	}
+}
+
+// escape handles the arrow, home, end and delete key sequences.
+func (e *lineEditor) escape(browsing int, draft string) (int, string) {
+	if r, _, err := e.in.ReadRune(); err != nil || (r != '[' && r != 'O') {
+		return browsing, draft
+	}
+
+	r, _, err := e.in.ReadRune()
+	if err != nil {
+		return browsing, draft
+	}
+
+	switch r {
+	case 'A':
+		return e.browse(browsing, -1, draft)
+	case 'B':
+		return e.browse(browsing, 1, draft)
+	case 'C':
+		e.moveBy(1)
+	case 'D':
+		e.moveBy(-1)
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.line)
+	case '3':
+		if next, _, err := e.in.ReadRune(); err == nil && next == '~' {
+			e.deleteAt(e.pos)
+		}
+	}
+
+	return browsing, draft
+}
+
+// browse moves through the history, keeping the line being typed as the
+// entry after the newest one.
+func (e *lineEditor) browse(browsing int, step int, draft string) (int, string) {
+	next := browsing + step
+	if next < 0 || next > len(e.history) {
+		return browsing, draft
+	}
+
+	if browsing == len(e.history) {
+		draft = string(e.line)
+	}
+
+	if next == len(e.history) {
+		e.setLine(draft)
+	} else {
+		e.setLine(e.history[next])
+	}
+
+	return next, draft
+}
+
+func (e *lineEditor) moveBy(n int) {
+	pos := e.pos + n
+	if pos >= 0 && pos <= len(e.line) {
+		e.pos = pos
+	}
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.line = append(e.line, 0)
+	copy(e.line[e.pos+1:], e.line[e.pos:])
+	e.line[e.pos] = r
+	e.pos++
+}
+
+func (e *lineEditor) deleteAt(pos int) {
+	if pos < len(e.line) {
+		e.line = append(e.line[:pos], e.line[pos+1:]...)
+	}
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	STDOUT_PATH   string = "-"
+	OUTPUT_HEADER string = "type,key1,outcome,values"
+)
+
+// Result is the outcome of one processed command. Keys, when set, holds the
+// key each of the values was found under. Error is set instead of values
+// for rows with the ERROR_OUTCOME.
+type Result struct {
+	Command Command
+	Outcome int
+	Values  []string
+	Keys    []string
+	Error   string
+}
+
+// Output receives one result per processed command. Results are buffered,
+// Flush writes them out and Close flushes and releases the destination.
+type Output interface {
+	WriteResult(result Result) error
+	Flush() error
+	Close() error
+}
+
+// csvOutput quotes fields as RFC 4180 asks, so values holding commas,
+// quotes or line breaks read back as they were written.
+type csvOutput struct {
+	w      *csv.Writer
+	closer io.Closer
+}
+
+// NewOutput writes result rows to w, starting with the header line.
+func NewOutput(w io.Writer) Output {
+	return newCsvOutput(w, nil)
+}
+
+func newCsvOutput(w io.Writer, closer io.Closer) Output {
+	out := &csvOutput{csv.NewWriter(w), closer}
+	out.w.Write(strings.Split(OUTPUT_HEADER, ","))
+	return out
+}
+
+// OpenOutput creates the output file at path, truncating an old one. A
+// path of "-" writes to stdout.
+func OpenOutput(path string) (Output, error) {
+	if path == STDOUT_PATH {
+		return NewOutput(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCsvOutput(file, file), nil
+}
+
+func (o *csvOutput) WriteResult(result Result) error {
+	row := []string{result.Command.Type, result.Command.Key, strconv.Itoa(result.Outcome)}
+	switch {
+	case result.Error != "":
+		row = append(row, result.Error)
+	case len(result.Values) == 0:
+		row = append(row, "")
+	default:
+		row = append(row, result.Values...)
+	}
+
+	return o.w.Write(row)
+}
+
+func (o *csvOutput) Flush() error {
+	o.w.Flush()
+	return o.w.Error()
+}
+
+func (o *csvOutput) Close() error {
+	err := o.Flush()
+	if o.closer != nil {
+		if closeErr := o.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CSV_COLUMNS is the number of columns of every input row.
+	CSV_COLUMNS int = 4
+
+	// ERROR_OUTCOME is the outcome of a row lenient mode could not run.
+	ERROR_OUTCOME int = -1
+)
+
+// InputError is an input row that could not be run. Line is the 1 based
+// line the row starts on.
+type InputError struct {
+	Line   int
+	Reason string
+}
+
+func (e *InputError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// InputErrors are all the bad rows of a strict run, one per line.
+type InputErrors []*InputError
+
+func (e InputErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// badRow collects a bad input row. A strict run only reports it once the
+// input is read, a lenient run writes it out as an error row and carries on.
+func badRow(bad *InputErrors, strict bool, command Command, err *InputError,
+	out Output) error {
+	log.Errorln(err)
+	if strict {
+		*bad = append(*bad, err)
+		return nil
+	}
+
+	return out.WriteResult(Result{Command: command, Outcome: ERROR_OUTCOME,
+		Error: err.Error()})
+}
+
+func isMultiKey(commandType string) bool {
+	return commandType == MGET_COMMAND || commandType == MPUT_COMMAND
+}
+
+// multiKeyCommand builds an mget or mput from the fields after the command
+// type. Empty fields left by padding the row out to the usual columns are
+// dropped, for an mput only one that would leave a key without a value.
+func multiKeyCommand(commandType string, fields []string) Command {
+	if commandType == MPUT_COMMAND {
+		if n := len(fields); n%2 != 0 && fields[n-1] == "" {
+			fields = fields[:n-1]
+		}
+	} else {
+		for len(fields) > 0 && fields[len(fields)-1] == "" {
+			fields = fields[:len(fields)-1]
+		}
+	}
+
+	command := Command{Type: commandType, Args: fields}
+	if len(fields) > 0 {
+		command.Key = fields[0]
+	}
+
+	return command
+}
+
+// validateCommand reports why a command cannot be run, before it gets to
+// the store.
+func validateCommand(command Command) error {
+	switch command.Type {
+	case GET_COMMAND, PUT_COMMAND, DEL_COMMAND, EXISTS_COMMAND:
+		if command.Key == "" {
+			return fmt.Errorf("%s needs a key.", command.Type)
+		}
+
+		if store.IsInternalKey(command.Key) {
+			return fmt.Errorf("Key %q is reserved for internal use.", command.Key)
+		}
+	case QUERY_COMMAND:
+		if command.Key == "" {
+			return fmt.Errorf("%s needs a key.", command.Type)
+		}
+	case SCAN_COMMAND, COUNT_COMMAND, DELRANGE_COMMAND:
+		if command.Key == "" || command.KeyTwo == "" {
+			return fmt.Errorf("%s needs a start and an end key.", command.Type)
+		}
+	case MGET_COMMAND, MPUT_COMMAND:
+		step := 1
+		if command.Type == MPUT_COMMAND {
+			step = 2
+			if len(command.Args)%2 != 0 {
+				return errors.New("mput needs key value pairs.")
+			}
+		}
+
+		if len(command.Args) == 0 {
+			return fmt.Errorf("%s needs at least one key.", command.Type)
+		}
+
+		for i := 0; i < len(command.Args); i += step {
+			if command.Args[i] == "" {
+				return fmt.Errorf("%s has an empty key.", command.Type)
+			}
+
+			if store.IsInternalKey(command.Args[i]) {
+				return fmt.Errorf("Key %q is reserved for internal use.", command.Args[i])
+			}
+		}
+	case INDEX_COMMAND:
+		def := store.IndexDefinition{Name: command.Key, Type: command.KeyTwo}
+		if def.Type == store.PREFIX_INDEX {
+			prefixLength, err := strconv.Atoi(command.Value)
+			if err != nil {
+				return fmt.Errorf("Invalid prefix length %q for index %s.", command.Value,
+					command.Key)
+			}
+			def.PrefixLength = prefixLength
+		}
+
+		return def.Validate()
+	case REINDEX_COMMAND, GC_COMMAND:
+	case "":
+		return errors.New("Missing command.")
+	default:
+		return fmt.Errorf("Unknown command %q.", command.Type)
+	}
+
+	return nil
+}
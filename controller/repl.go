@@ -0,0 +1,319 @@
+package controller
+
+import (
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	REPL_COMMAND string = "repl"
+	REPL_PROMPT  string = "> "
+	META_PREFIX  string = "."
+)
+
+const replHelp = `Commands, same as the csv rows:
+  get <key>                 put <key> <value>        del <key>
+  scan <key1> <key2>        index <name> <type> [n]  query <name> <value>
+  mget <key>...             mput <key> <value>...    exists <key>
+  count <key1> <key2>       delrange <key1> <key2>   reindex
+  gc
+Meta commands:
+  .stats    store figures      .tables   live files and sizes
+  .flush    flush the store    .history  lines typed so far
+  .help     this text          .quit     flush and leave
+Values with spaces can be double quoted, Ctrl-D leaves as well.
+`
+
+// textOutput prints results for people instead of as csv rows.
+type textOutput struct {
+	w io.Writer
+}
+
+func (t *textOutput) WriteResult(result Result) error {
+	var err error
+	outcome, values := result.Outcome, result.Values
+	if result.Error != "" {
+		_, err = fmt.Fprintf(t.w, "(error) %s\n", result.Error)
+		return err
+	}
+
+	switch result.Command.Type {
+	case GET_COMMAND:
+		if outcome == 1 {
+			_, err = fmt.Fprintf(t.w, "%q\n", values[0])
+		} else {
+			_, err = fmt.Fprintln(t.w, "(not found)")
+		}
+	case SCAN_COMMAND, QUERY_COMMAND, MGET_COMMAND:
+		if len(values) == 0 {
+			_, err = fmt.Fprintln(t.w, "(empty)")
+		}
+
+		for n, v := range values {
+			if n < len(result.Keys) {
+				_, err = fmt.Fprintf(t.w, "%d) %q => %q\n", n+1, result.Keys[n], v)
+			} else {
+				_, err = fmt.Fprintf(t.w, "%d) %q\n", n+1, v)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+	case EXISTS_COMMAND, COUNT_COMMAND:
+		_, err = fmt.Fprintf(t.w, "(integer) %d\n", outcome)
+	case MPUT_COMMAND:
+		_, err = fmt.Fprintf(t.w, "OK, %d keys\n", outcome)
+	case PUT_COMMAND:
+		// Put reports its outcome before the write, the repl prints OK after.
+	default:
+		if outcome == 1 {
+			_, err = fmt.Fprintln(t.w, "OK")
+		}
+	}
+
+	return err
+}
+
+func (t *textOutput) Flush() error {
+	return nil
+}
+
+func (t *textOutput) Close() error {
+	return nil
+}
+
+// splitReplLine splits a line on spaces, double quotes group words and
+// allow backslash escapes.
+func splitReplLine(line string) (words []string, err error) {
+	var word strings.Builder
+	inWord, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("Unterminated quote.")
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// parseReplCommand maps the words of a line onto the columns of a csv row.
+// Put takes every word after the key as its value.
+func parseReplCommand(words []string) (command Command, err error) {
+	command.Type = strings.ToLower(words[0])
+	args := words[1:]
+	want := 0
+	switch command.Type {
+	case GET_COMMAND, DEL_COMMAND, EXISTS_COMMAND:
+		want = 1
+	case SCAN_COMMAND, QUERY_COMMAND, COUNT_COMMAND, DELRANGE_COMMAND:
+		want = 2
+	case MGET_COMMAND, MPUT_COMMAND:
+		command = Command{Type: command.Type, Args: args}
+		if len(args) > 0 {
+			command.Key = args[0]
+		}
+		return command, validateCommand(command)
+	case PUT_COMMAND:
+		if len(args) < 2 {
+			return command, fmt.Errorf("Usage: put <key> <value>")
+		}
+		command.Key = args[0]
+		command.Value = strings.Join(args[1:], " ")
+		return command, nil
+	case INDEX_COMMAND:
+		if len(args) != 2 && len(args) != 3 {
+			return command, fmt.Errorf("Usage: index <name> <type> [prefix length]")
+		}
+		command.Key, command.KeyTwo = args[0], args[1]
+		if len(args) == 3 {
+			command.Value = args[2]
+		}
+		return command, nil
+	case REINDEX_COMMAND, GC_COMMAND:
+	default:
+		return command, fmt.Errorf("Unknown command %s, try .help", command.Type)
+	}
+
+	if len(args) != want {
+		return command, fmt.Errorf("%s takes %d arguments, got %d.", command.Type, want,
+			len(args))
+	}
+
+	switch command.Type {
+	case GET_COMMAND, DEL_COMMAND, EXISTS_COMMAND:
+		command.Key = args[0]
+	case SCAN_COMMAND, COUNT_COMMAND, DELRANGE_COMMAND:
+		command.Key, command.KeyTwo = args[0], args[1]
+	case QUERY_COMMAND:
+		command.Key, command.Value = args[0], args[1]
+	}
+
+	return command, nil
+}
+
+type repl struct {
+	storage store.Store
+	lines   lineReader
+	out     io.Writer
+}
+
+// metaCommand runs a dot command and reports whether the repl should end.
+func (r *repl) metaCommand(name string) (quit bool) {
+	inspector, canInspect := r.storage.(store.Inspector)
+	switch name {
+	case ".help":
+		fmt.Fprint(r.out, replHelp)
+	case ".quit", ".exit":
+		return true
+	case ".flush":
+		r.storage.Flush()
+		fmt.Fprintln(r.out, "OK")
+	case ".history":
+		for n, line := range r.lines.History() {
+			fmt.Fprintf(r.out, "%4d  %s\n", n+1, line)
+		}
+	case ".stats":
+		if !canInspect {
+			fmt.Fprintln(r.out, "Store does not report stats.")
+			break
+		}
+
+		for _, stat := range inspector.Stats() {
+			fmt.Fprintf(r.out, "%-22s %s\n", stat.Name, stat.Value)
+		}
+	case ".tables":
+		if !canInspect {
+			fmt.Fprintln(r.out, "Store does not list its files.")
+			break
+		}
+
+		files := inspector.Files()
+		if len(files) == 0 {
+			fmt.Fprintln(r.out, "(no files)")
+		}
+
+		for _, path := range files {
+			size := "missing"
+			if fi, err := os.Stat(path); err == nil {
+				size = fmt.Sprintf("%d bytes", fi.Size())
+			}
+			fmt.Fprintf(r.out, "%-40s %s\n", path, size)
+		}
+	default:
+		fmt.Fprintf(r.out, "Unknown meta command %s, try .help\n", name)
+	}
+
+	return false
+}
+
+func (r *repl) run() error {
+	results := &textOutput{r.out}
+	for {
+		line, err := r.lines.ReadLine(REPL_PROMPT)
+		if err == errInterrupted {
+			continue
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		words, err := splitReplLine(line)
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			continue
+		}
+
+		if len(words) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(words[0], META_PREFIX) {
+			if r.metaCommand(words[0]) {
+				return nil
+			}
+			continue
+		}
+
+		command, err := parseReplCommand(words)
+		if err == nil {
+			err = ProcessCommand(command, r.storage, results)
+		}
+
+		if err != nil {
+			fmt.Fprintf(r.out, "(error) %v\n", err)
+		} else if command.Type == PUT_COMMAND {
+			fmt.Fprintln(r.out, "OK")
+		}
+	}
+}
+
+// RunRepl opens the store and reads commands from the terminal until the
+// input ends or .quit is given, flushing the store on the way out. Lines
+// can be edited and recalled when stdin is a terminal.
+func RunRepl(engine string, options store.Options) error {
+	if err := os.MkdirAll(options.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	storage, err := openStore(engine, options)
+	if err != nil {
+		return err
+	}
+
+	r := &repl{storage: storage, out: os.Stdout}
+	fd := int(os.Stdin.Fd())
+	if isTerminal(fd) {
+		restore, err := makeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer restore()
+
+		r.lines = newLineEditor(os.Stdin, os.Stdout)
+		fmt.Fprintf(r.out, "Opened %s store in %s, .help lists the commands.\n", engine,
+			options.Dir)
+	} else {
+		r.lines = newPlainReader(os.Stdin)
+	}
+
+	err = r.run()
+	log.Info("Leaving repl, flushing store.")
+	if closeErr := store.Close(storage); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"bytes"
+	store "github.com/shimanekb/project2-A/store"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplRunsCommandsAndMetaCommands(t *testing.T) {
+	options := store.DefaultOptions()
+	options.Dir = t.TempDir()
+	storage, err := openStore(store.SS_ENGINE, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := `put k hello world
+get k
+put "sp ace" "a \"q\""
+get "sp ace"
+exists k
+mput a 1 b 2
+mget a b zz
+del k
+get k
+get "k
+bogus
+get
+.flush
+.history
+.nope
+.quit
+get never
+`
+	want := `OK
+"hello world"
+OK
+"a \"q\""
+(integer) 1
+OK, 2 keys
+1) "a" => "1"
+2) "b" => "2"
+OK
+(not found)
+Unterminated quote.
+(error) Unknown command bogus, try .help
+(error) get takes 1 arguments, got 0.
+OK
+   1  put k hello world
+   2  get k
+   3  put "sp ace" "a \"q\""
+   4  get "sp ace"
+   5  exists k
+   6  mput a 1 b 2
+   7  mget a b zz
+   8  del k
+   9  get k
+  10  get "k
+  11  bogus
+  12  get
+  13  .flush
+  14  .history
+Unknown meta command .nope, try .help
+`
+
+	var out bytes.Buffer
+	r := &repl{storage: storage, lines: newPlainReader(strings.NewReader(input)), out: &out}
+	if err = r.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != want {
+		t.Fatalf("repl printed\n%s\nwant\n%s", out.String(), want)
+	}
+
+	if _, ok := storage.Get("never"); ok {
+		t.Fatal("repl ran a command after .quit")
+	}
+}
+
+func TestSplitReplLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		words []string
+	}{
+		{"get k", []string{"get", "k"}},
+		{"  put\tk   v  ", []string{"put", "k", "v"}},
+		{`put k "two words"`, []string{"put", "k", "two words"}},
+		{`put k "say \"hi\" \\o/"`, []string{"put", "k", `say "hi" \o/`}},
+		{`put k ""`, []string{"put", "k", ""}},
+		{`put k"ey" v`, []string{"put", "key", "v"}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		words, err := splitReplLine(test.line)
+		if err != nil || !reflect.DeepEqual(words, test.words) {
+			t.Errorf("%q split into %q, %v, want %q", test.line, words, err, test.words)
+		}
+	}
+
+	if _, err := splitReplLine(`get "k`); err == nil {
+		t.Error("unterminated quote is accepted")
+	}
+}
+
+func TestLineEditorEditsAndRecallsLines(t *testing.T) {
+	keys := strings.Join([]string{
+		"get a\r",
+		// Left twice to insert before b, then home and delete the g.
+		"get bd\x1b[D\x1b[Dx\x01\x1b[3~\r",
+		// Up recalls the last line, Ctrl-P the one before, Ctrl-N goes back.
+		"\x1b[A\x10\x0e\r",
+		// A draft survives a trip through the history, Ctrl-U clears it.
+		"dra\x10\x0eft\r",
+		"junk\x15put k v\x0b\r",
+		"abc\x03",
+		"\x04",
+	}, "")
+
+	e := newLineEditor(strings.NewReader(keys), ioutil.Discard)
+	var lines []string
+	for {
+		line, err := e.ReadLine(REPL_PROMPT)
+		if err == io.EOF {
+			break
+		}
+
+		if err == errInterrupted {
+			lines = append(lines, "^C")
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	want := []string{"get a", "et xbd", "et xbd", "draft", "put k v", "^C"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("editor read %q, want %q", lines, want)
+	}
+
+	// A line repeating the one before is kept once.
+	history := []string{"get a", "et xbd", "draft", "put k v"}
+	if !reflect.DeepEqual(e.History(), history) {
+		t.Fatalf("history is %q, want %q", e.History(), history)
+	}
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-A/raft"
+	"github.com/shimanekb/project2-A/server"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	SERVE_COMMAND string = "serve"
+
+	// RAFT_DIR is the subdirectory of the store a raft member keeps its
+	// log in.
+	RAFT_DIR string = "raft"
+)
+
+// ClusterConfig makes serve a member of a raft cluster when ID is set.
+// Addr is where the raft http api listens, the address the other members
+// reach it at. Peers lists the initial members as id=host:port pairs
+// separated by commas, empty to join an existing cluster.
+type ClusterConfig struct {
+	ID    string
+	Addr  string
+	Peers string
+}
+
+func parsePeers(peers string) ([]raft.Peer, error) {
+	var parsed []raft.Peer
+	for _, field := range strings.Split(peers, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid raft peer %q, expected id=host:port.", field)
+		}
+		parsed = append(parsed, raft.Peer{ID: parts[0], Addr: parts[1]})
+	}
+
+	return parsed, nil
+}
+
+// cluster is the raft member a server runs as.
+type cluster struct {
+	node   *raft.Node
+	server *http.Server
+}
+
+// joinCluster starts the raft node over storage and its http api.
+func joinCluster(config ClusterConfig, options store.Options, storage store.Store) (*cluster, error) {
+	if config.Addr == "" {
+		return nil, errors.New("A raft member needs an address for the other members.")
+	}
+
+	peers, err := parsePeers(config.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	member := len(peers) == 0
+	for _, p := range peers {
+		member = member || p.ID == config.ID
+	}
+
+	if !member {
+		return nil, fmt.Errorf("Raft peers have to include %s itself.", config.ID)
+	}
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := raft.NewNode(raft.Config{ID: config.ID, Dir: filepath.Join(options.Dir, RAFT_DIR),
+		Peers: peers, Transport: raft.NewHttpTransport(), Store: storage})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	c := &cluster{node: node, server: &http.Server{Handler: raft.NewHandler(node)}}
+	go func() {
+		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Raft api stopped: %v", err)
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *cluster) stop() {
+	c.server.Close()
+	c.node.Stop()
+}
+
+// RunServer opens the store and serves it on the addresses of config until
+// SIGINT or SIGTERM arrives. Shutting down lets the commands in flight
+// finish and flushes the store. With a cluster id the store is replicated
+// by raft, writes and reads then go through the cluster's leader.
+func RunServer(engine string, options store.Options, config server.Config,
+	clusterConfig ClusterConfig) error {
+	if config.Follow != "" && engine != store.SS_ENGINE {
+		return fmt.Errorf("Followers need the %s engine, got %s.", store.SS_ENGINE, engine)
+	}
+
+	if clusterConfig.ID != "" && config.Follow != "" {
+		return errors.New("A raft member cannot also follow a leader.")
+	}
+
+	if err := os.MkdirAll(options.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	storage, err := openStore(engine, options)
+	if err != nil {
+		return err
+	}
+
+	var c *cluster
+	served := storage
+	if clusterConfig.ID != "" {
+		if c, err = joinCluster(clusterConfig, options, storage); err != nil {
+			store.Close(storage)
+			return err
+		}
+		served = raft.NewReplica(c.node, 0)
+	}
+
+	srv := server.NewServer(served)
+	if err = srv.Start(config); err != nil {
+		srv.Shutdown()
+		if c != nil {
+			c.stop()
+		}
+		store.Close(storage)
+		return err
+	}
+
+	for _, addr := range srv.Addrs() {
+		fmt.Printf("Serving %s store in %s on %s.\n", engine, options.Dir, addr)
+	}
+
+	if c != nil {
+		fmt.Printf("Raft member %s listening on %s.\n", clusterConfig.ID, clusterConfig.Addr)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	log.Infof("Received %s, shutting down.", sig)
+	fmt.Println("Shutting down, flushing store.")
+	srv.Shutdown()
+	if c != nil {
+		c.stop()
+	}
+	return store.Close(storage)
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"github.com/shimanekb/project2-A/raft"
+	"github.com/shimanekb/project2-A/server"
+	store "github.com/shimanekb/project2-A/store"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePeers(t *testing.T) {
+	tests := []struct {
+		peers string
+		want  []raft.Peer
+		ok    bool
+	}{
+		{"", nil, true},
+		{"a=127.0.0.1:7001", []raft.Peer{{ID: "a", Addr: "127.0.0.1:7001"}}, true},
+		{" a=h:1, b=h:2 ,", []raft.Peer{{ID: "a", Addr: "h:1"}, {ID: "b", Addr: "h:2"}}, true},
+		{"a=h:1,b", nil, false},
+		{"=h:1", nil, false},
+		{"a=", nil, false},
+	}
+
+	for _, test := range tests {
+		peers, err := parsePeers(test.peers)
+		if (err == nil) != test.ok || !reflect.DeepEqual(peers, test.want) {
+			t.Errorf("%q parsed as %v, %v", test.peers, peers, err)
+		}
+	}
+}
+
+func TestRunServerRejectsConflictingFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		engine  string
+		config  server.Config
+		cluster ClusterConfig
+	}{
+		{"hash follower", store.HASH_ENGINE, server.Config{Follow: "127.0.0.1:1"}, ClusterConfig{}},
+		{"sharded follower", store.SHARDED_ENGINE, server.Config{Follow: "127.0.0.1:1"},
+			ClusterConfig{}},
+		{"raft follower", store.SS_ENGINE, server.Config{Follow: "127.0.0.1:1"},
+			ClusterConfig{ID: "a", Addr: "127.0.0.1:1"}},
+	}
+
+	for _, test := range tests {
+		options := store.DefaultOptions()
+		options.Dir = filepath.Join(t.TempDir(), "store")
+		if err := RunServer(test.engine, options, test.config, test.cluster); err == nil {
+			t.Errorf("%s: server started", test.name)
+		}
+
+		if _, err := os.Stat(options.Dir); !os.IsNotExist(err) {
+			t.Errorf("%s: store directory was created: %v", test.name, err)
+		}
+	}
+}
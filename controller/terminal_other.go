@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package controller
+
+import (
+	"errors"
+)
+
+// isTerminal reports false where raw terminal mode is not supported, the
+// repl then reads plain lines without editing.
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("Raw terminal mode is not supported on this platform.")
+}
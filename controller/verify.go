@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	VERIFY_COMMAND string = "verify"
+
+	// VERIFY_CONTEXT_ROWS is the number of matching rows shown before the
+	// first mismatch.
+	VERIFY_CONTEXT_ROWS int = 3
+)
+
+// outputRows splits a result stream into rows, csv records or ndjson
+// lines, each put back into a single line of text. With unordered set the
+// values of scan rows are sorted, so rows differing only in scan order
+// compare equal.
+func outputRows(r io.Reader, format string, unordered bool) (rows []string, err error) {
+	if format == FORMAT_JSON {
+		return jsonRows(r, unordered)
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+
+		if err != nil {
+			return rows, err
+		}
+
+		if unordered && record[0] == SCAN_COMMAND && len(record) > 3 {
+			sort.Strings(record[3:])
+		}
+
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		w.Write(record)
+		w.Flush()
+		rows = append(rows, strings.TrimSuffix(b.String(), "\n"))
+	}
+}
+
+func jsonRows(r io.Reader, unordered bool) (rows []string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_JSON_LINE_BYTES)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if !unordered {
+			rows = append(rows, string(line))
+			continue
+		}
+
+		var result jsonResult
+		if err = json.Unmarshal(line, &result); err != nil {
+			return rows, fmt.Errorf("Row %d: %v", len(rows)+1, err)
+		}
+
+		if result.Op == SCAN_COMMAND {
+			sort.Slice(result.Results, func(i, j int) bool {
+				return result.Results[i].Key < result.Results[j].Key
+			})
+		}
+
+		canonical, err := json.Marshal(result)
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, string(canonical))
+	}
+
+	return rows, scanner.Err()
+}
+
+// reportMismatch prints the rows leading up to row n, then the expected
+// and the actual row n. A missing row is shown as (end of output).
+func reportMismatch(out io.Writer, n int, expected []string, actual []string) {
+	fmt.Fprintf(out, "Mismatch at row %d:\n", n+1)
+	start := n - VERIFY_CONTEXT_ROWS
+	if start < 0 {
+		start = 0
+	}
+
+	for i := start; i < n; i++ {
+		fmt.Fprintf(out, "    %6d  %s\n", i+1, expected[i])
+	}
+
+	row := func(rows []string) string {
+		if n < len(rows) {
+			return rows[n]
+		}
+		return "(end of output)"
+	}
+
+	fmt.Fprintf(out, "  - %6d  %s\n", n+1, row(expected))
+	fmt.Fprintf(out, "  + %6d  %s\n", n+1, row(actual))
+}
+
+// VerifyCommands runs the commands of filePath against a fresh store and
+// compares the results with expectedPath row by row, reporting the first
+// row that differs. The store lives in a temporary directory that is
+// removed afterwards, so options.Dir is left alone.
+func VerifyCommands(filePath string, expectedPath string, format string, engine string,
+	options store.Options, unordered bool, out io.Writer) (ok bool, err error) {
+	format, err = ResolveFormat(format, filePath)
+	if err != nil {
+		return false, err
+	}
+
+	input, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer input.Close()
+
+	expectedFile, err := os.Open(expectedPath)
+	if err != nil {
+		return false, err
+	}
+	defer expectedFile.Close()
+
+	options.Dir, err = ioutil.TempDir("", "verify")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(options.Dir)
+
+	storage, err := openStore(engine, options)
+	if err != nil {
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	results, run := NewOutput(&buf), RunCsvCommands
+	if format == FORMAT_JSON {
+		results, run = NewJsonOutput(&buf), RunJsonCommands
+	}
+
+	log.Infof("Verifying %s against %s.", filePath, expectedPath)
+	if err = run(input, storage, results, false); err != nil {
+		return false, err
+	}
+
+	if err = store.Close(storage); err != nil {
+		return false, err
+	}
+
+	if err = results.Flush(); err != nil {
+		return false, err
+	}
+
+	actual, err := outputRows(&buf, format, unordered)
+	if err != nil {
+		return false, err
+	}
+
+	expected, err := outputRows(expectedFile, format, unordered)
+	if err != nil {
+		return false, fmt.Errorf("Could not read %s: %v", expectedPath, err)
+	}
+
+	for n := 0; n < len(expected) || n < len(actual); n++ {
+		if n >= len(expected) || n >= len(actual) || expected[n] != actual[n] {
+			reportMismatch(out, n, expected, actual)
+			if len(expected) != len(actual) {
+				fmt.Fprintf(out, "Expected %d rows, got %d.\n", len(expected), len(actual))
+			}
+			return false, nil
+		}
+	}
+
+	fmt.Fprintf(out, "%s: all %d rows match %s.\n", filePath, len(actual), expectedPath)
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAcceptsTheSampleOutput(t *testing.T) {
+	options := store.DefaultOptions()
+	options.Dir = filepath.Join(t.TempDir(), "untouched")
+	var out bytes.Buffer
+	ok, err := VerifyCommands("../docs/input_sample.txt", "../docs/output_sample.txt", FORMAT_AUTO,
+		store.SS_ENGINE, options, false, &out)
+	if err != nil || !ok {
+		t.Fatalf("verify returned %v, %v:\n%s", ok, err, out.String())
+	}
+
+	if !strings.Contains(out.String(), "all 221 rows match") {
+		t.Fatalf("verify printed %s", out.String())
+	}
+}
+
+func TestVerifyReportsTheFirstMismatch(t *testing.T) {
+	csvIn := "put,a,,1\nput,b,,2\nput,c,,3\nscan,a,c,\nget,b,,\nget,c,,\n"
+	jsonIn := `{"op":"put","key":"a","value":"1"}
+{"op":"put","key":"b","value":"2"}
+{"op":"scan","key":"a","end":"c"}
+{"op":"get","key":"b"}
+`
+	csvHead := "type,key1,outcome,values\nput,a,0,\nput,b,0,\nput,c,0,\n"
+	csvMatch := csvHead + "scan,a,3,3,1,2\nget,b,1,2\nget,c,1,3\n"
+	csvSorted := csvHead + "scan,a,3,1,2,3\nget,b,1,2\nget,c,1,3\n"
+
+	jsonScan := `{"op":"scan","key":"a","end":"c","outcome":2,"results":[%s,%s]}` + "\n"
+	a, b := `{"key":"a","value":"1"}`, `{"key":"b","value":"2"}`
+	jsonHead := `{"op":"put","key":"a","outcome":0}
+{"op":"put","key":"b","outcome":0}
+`
+	jsonGet := `{"op":"get","key":"b","outcome":1,"value":"2"}` + "\n"
+	jsonMatch := jsonHead + fmt.Sprintf(jsonScan, a, b) + jsonGet
+	jsonSwapped := jsonHead + fmt.Sprintf(jsonScan, b, a) + jsonGet
+
+	tests := []struct {
+		name      string
+		file      string
+		input     string
+		expected  string
+		unordered bool
+		ok        bool
+		report    []string
+	}{
+		{"csv match", "in.csv", csvIn, csvMatch, false, true, []string{"all 7 rows match"}},
+		{"csv changed value", "in.csv", csvIn, strings.Replace(csvMatch, "get,b,1,2", "get,b,1,5", 1),
+			false, false, []string{"Mismatch at row 6:", "         3  put,b,0,",
+				"         5  scan,a,3,3,1,2", "  -      6  get,b,1,5", "  +      6  get,b,1,2"}},
+		{"csv scan order", "in.csv", csvIn, csvSorted, false, false, []string{"Mismatch at row 5:"}},
+		{"csv unordered scan", "in.csv", csvIn, csvSorted, true, true, []string{"all 7 rows match"}},
+		{"csv missing rows", "in.csv", csvIn, "type,key1,outcome,values\nput,a,0,\n", false, false,
+			[]string{"Mismatch at row 3:", "  -      3  (end of output)", "  +      3  put,b,0,",
+				"Expected 2 rows, got 7."}},
+		{"json match", "in.ndjson", jsonIn, jsonMatch, false, true, []string{"all 4 rows match"}},
+		{"json scan order", "in.ndjson", jsonIn, jsonSwapped, false, false,
+			[]string{"Mismatch at row 3:"}},
+		{"json unordered scan", "in.ndjson", jsonIn, jsonSwapped, true, true,
+			[]string{"all 4 rows match"}},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		input, expected := filepath.Join(dir, test.file), filepath.Join(dir, "expected")
+		if err := ioutil.WriteFile(input, []byte(test.input), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(expected, []byte(test.expected), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		options := store.DefaultOptions()
+		var out bytes.Buffer
+		ok, err := VerifyCommands(input, expected, FORMAT_AUTO, store.SS_ENGINE, options,
+			test.unordered, &out)
+		if err != nil || ok != test.ok {
+			t.Errorf("%s: verify returned %v, %v:\n%s", test.name, ok, err, out.String())
+			continue
+		}
+
+		for _, line := range test.report {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("%s: report lacks %q:\n%s", test.name, line, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package index
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Problem is an inconsistency found while checking a store file.
+type Problem struct {
+	Path    string
+	Offset  int64
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s at offset %d: %s", p.Path, p.Offset, p.Message)
+}
+
+// fileRecord is one csv line of a store file and the offset it starts at.
+type fileRecord struct {
+	offset int64
+	fields []string
+}
+
+// readFileRecords parses data as csv lines. A line that does not parse is
+// reported and reading resumes at the next line, so one torn record does
+// not hide the records after it.
+func readFileRecords(path string, data []byte, fieldsPerRecord int) (records []fileRecord, problems []Problem) {
+	var start int64
+	for start < int64(len(data)) {
+		r := csv.NewReader(bytes.NewReader(data[start:]))
+		r.FieldsPerRecord = fieldsPerRecord
+		for {
+			offset := start + r.InputOffset()
+			fields, err := r.Read()
+			if err == io.EOF {
+				return records, problems
+			}
+
+			if err != nil {
+				problems = append(problems, Problem{path, offset,
+					fmt.Sprintf("unreadable record: %v", err)})
+				next := bytes.IndexByte(data[offset:], '\n')
+				if next < 0 {
+					return records, problems
+				}
+				start = offset + int64(next) + 1
+				break
+			}
+
+			records = append(records, fileRecord{offset, fields})
+		}
+	}
+
+	return records, problems
+}
+
+func isKeyHash(s string) bool {
+	if len(s) != KeySizeChar {
+		return false
+	}
+
+	_, err := strconv.ParseUint(s, 16, 64)
+	return err == nil
+}
+
+// isIndexRecord tells the index line of a table apart from a block. Both
+// start with a number and a key hash, but the third field of a block is
+// the item kind.
+func isIndexRecord(fields []string) bool {
+	if len(fields)%2 != 0 {
+		return false
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		if !isKeyHash(fields[i]) {
+			return false
+		}
+
+		if _, err := strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkBlockItem verifies the recorded hash and size of one item against
+// its key and value, they are the only checksums a block carries.
+func checkBlockItem(fields []string) (item KeyValueItem, err error) {
+	key, value, size, err := decodeFields(fields[3], fields[4], fields[0])
+	if err != nil {
+		return item, err
+	}
+
+	item = KeyValueItem{key, fields[1], fields[2], value, size}
+	if item.keyHash != keyHash(item.key) {
+		return item, fmt.Errorf("hash %s does not match key %q", item.keyHash, item.key)
+	}
+
+	if want := int64(KeySizeChar + len(item.key) + len(item.value)); size != want {
+		return item, fmt.Errorf("key %q records size %d, its data is %d", item.key, size, want)
+	}
+
+	switch item.kind {
+	case INLINE_VALUE:
+	case VALUE_POINTER:
+		if _, err = item.Pointer(); err != nil {
+			return item, err
+		}
+	default:
+		return item, fmt.Errorf("key %q has unknown kind %q", item.key, item.kind)
+	}
+
+	return item, nil
+}
+
+// ScanTable reads an ss table without the table cache and checks the hash
+// and size of every item, that items are in hash order and that every
+// index offset lands on the start of the block it names. It returns every
+// item that could be read and the range tombstones of the table along with
+// the problems found.
+func ScanTable(path string) (items []KeyValueItem, tombstones []RangeTombstone,
+	problems []Problem, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	records, problems := readFileRecords(path, data, -1)
+	format := TABLE_FORMAT
+	if len(records) > 0 && !isIndexRecord(records[0].fields) {
+		if format, err = tableFormat(path, records[0].fields); err != nil {
+			return nil, nil, problems, err
+		}
+
+		if isTableHeader(records[0].fields) {
+			records = records[1:]
+		}
+	}
+
+	if len(records) > 0 && format >= 4 && isTombstoneRecord(records[0].fields) {
+		tombstones = decodeTombstoneRecord(records[0].fields)
+		records = records[1:]
+	}
+
+	// A table without blocks has an empty index line.
+	var indexRecord *fileRecord
+	if n := len(records); n > 0 && isIndexRecord(records[n-1].fields) {
+		indexRecord = &records[n-1]
+		records = records[:n-1]
+	} else if n > 0 {
+		problems = append(problems, Problem{path, int64(len(data)),
+			"table has no index line, it was not completely written"})
+	}
+
+	blocks := make(map[int64]string)
+	lastHash := ""
+	for _, rec := range records {
+		fields, err := decodeBlockRecord(rec.fields)
+		if err == nil {
+			fields, err = upgradeBlockFields(path, fields, format)
+		}
+
+		if err != nil {
+			problems = append(problems, Problem{path, rec.offset, err.Error()})
+			continue
+		}
+
+		if len(fields)%BlockRecordFields != 0 {
+			problems = append(problems, Problem{path, rec.offset, fmt.Sprintf(
+				"block has %d fields, expected a multiple of %d", len(fields),
+				BlockRecordFields)})
+		}
+
+		for i := 0; i+BlockRecordFields <= len(fields); i += BlockRecordFields {
+			item, err := checkBlockItem(fields[i : i+BlockRecordFields])
+			if err != nil {
+				problems = append(problems, Problem{path, rec.offset, err.Error()})
+				continue
+			}
+
+			if i == 0 {
+				blocks[rec.offset] = item.keyHash
+			}
+
+			if item.keyHash <= lastHash {
+				problems = append(problems, Problem{path, rec.offset, fmt.Sprintf(
+					"key %q is out of hash order", item.key)})
+			} else {
+				lastHash = item.keyHash
+			}
+			items = append(items, item)
+		}
+	}
+
+	if indexRecord == nil {
+		return items, tombstones, problems, nil
+	}
+
+	referenced := make(map[int64]bool)
+	lastKey := ""
+	for i := 0; i < len(indexRecord.fields); i += 2 {
+		key := indexRecord.fields[i]
+		offset, _ := strconv.ParseInt(indexRecord.fields[i+1], 10, 64)
+		blockKey, ok := blocks[offset]
+		if !ok {
+			problems = append(problems, Problem{path, indexRecord.offset, fmt.Sprintf(
+				"index offset %d of block %s is not on a block boundary", offset, key)})
+		} else if blockKey != key {
+			problems = append(problems, Problem{path, indexRecord.offset, fmt.Sprintf(
+				"index names block %s at offset %d, the block starts with %s", key,
+				offset, blockKey)})
+		}
+
+		if key <= lastKey {
+			problems = append(problems, Problem{path, indexRecord.offset, fmt.Sprintf(
+				"index entry %s is out of order", key)})
+		}
+		lastKey = key
+		referenced[offset] = true
+	}
+
+	for offset := range blocks {
+		if !referenced[offset] {
+			problems = append(problems, Problem{path, offset,
+				"block is not referenced by the index"})
+		}
+	}
+
+	return items, tombstones, problems, nil
+}
+
+// ScanDataLog reads every segment of the data log at path, checking the
+// recorded size of each item, the hint files of its segments and the given
+// index hint files. It returns every item that could be read, in log
+// order, along with the problems found.
+func ScanDataLog(path string, indexHints ...string) (items []LogItem, problems []Problem, err error) {
+	l := &LocalDataLog{filePath: path}
+	var segments []SegmentInfo
+	for _, base := range segmentBases(path) {
+		segPath := l.segmentPath(base)
+		data, err := ioutil.ReadFile(segPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return items, problems, err
+		}
+
+		seg := SegmentInfo{base, int64(len(data))}
+		segments = append(segments, seg)
+		records, ps := readFileRecords(segPath, data, 3)
+		problems = append(problems, ps...)
+		segItems := make([]LogItem, 0, len(records))
+		for n, rec := range records {
+			key, value, size, err := decodeFields(rec.fields[0], rec.fields[1], rec.fields[2])
+			if err != nil {
+				problems = append(problems, Problem{segPath, rec.offset, fmt.Sprintf(
+					"%v for key %q", err, rec.fields[0])})
+				continue
+			}
+
+			item := NewLogItem(key, value, base+rec.offset)
+			item.size = size
+			item.length = seg.Size - rec.offset
+			if n+1 < len(records) {
+				item.length = records[n+1].offset - rec.offset
+			}
+
+			if !item.IsTombstone() && item.size != int64(len(item.value)) {
+				problems = append(problems, Problem{segPath, rec.offset, fmt.Sprintf(
+					"key %q records size %d, its value is %d bytes", item.key, item.size,
+					len(item.value))})
+				continue
+			}
+			segItems = append(segItems, item)
+		}
+
+		hintPath := l.segmentHintPath(base)
+		if _, err := os.Stat(hintPath); err == nil {
+			problems = append(problems, checkHintFile(hintPath, []SegmentInfo{seg},
+				segItems)...)
+		}
+		items = append(items, segItems...)
+	}
+
+	for _, hintPath := range indexHints {
+		if _, err := os.Stat(hintPath); err == nil {
+			problems = append(problems, checkHintFile(hintPath, segments, items)...)
+		}
+	}
+
+	return items, problems, nil
+}
+
+// checkHintFile verifies that every entry of a hint file points at an item
+// written for the same key. Hints saved against segments that have been
+// merged since are ignored on load and are not checked.
+func checkHintFile(path string, segments []SegmentInfo, items []LogItem) []Problem {
+	hint, err := ReadHintFile(path)
+	if err != nil {
+		return []Problem{{path, 0, err.Error()}}
+	}
+
+	if !sameSealedSegments(hint.Segments, segments) {
+		log.Infof("Hint file %s predates a merge, skipping it.", path)
+		return nil
+	}
+
+	var problems []Problem
+	if n := len(segments); n > 0 && hint.CoveredOffset > segments[n-1].End() {
+		problems = append(problems, Problem{path, 0, fmt.Sprintf(
+			"covers the data log up to %d, it ends at %d", hint.CoveredOffset,
+			segments[n-1].End())})
+	}
+
+	byOffset := make(map[int64]LogItem, len(items))
+	for _, it := range items {
+		byOffset[it.offset] = it
+	}
+
+	for _, e := range hint.Entries {
+		it, ok := byOffset[e.Offset]
+		if !ok {
+			problems = append(problems, Problem{path, 0, fmt.Sprintf(
+				"entry for key %q points at offset %d, which starts no item", e.Key,
+				e.Offset)})
+		} else if it.key != e.Key {
+			problems = append(problems, Problem{path, 0, fmt.Sprintf(
+				"entry for key %q points at the item of key %q", e.Key, it.key)})
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,219 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+const (
+	SYNC_ALWAYS   string = "always"
+	SYNC_INTERVAL string = "interval"
+	SYNC_NONE     string = "none"
+)
+
+// SyncPolicy decides when data log writes are fsynced. Every Commit writes
+// the items added so far to the log file, so they survive the process
+// crashing. SYNC_ALWAYS also makes every Commit wait for an fsync,
+// concurrent commits share one write and fsync. SYNC_INTERVAL fsyncs in the
+// background every Interval and SYNC_NONE leaves flushing to the OS.
+type SyncPolicy struct {
+	Mode     string
+	Interval time.Duration
+}
+
+func (p SyncPolicy) Validate() error {
+	switch p.Mode {
+	case SYNC_ALWAYS, SYNC_NONE:
+		return nil
+	case SYNC_INTERVAL:
+		if p.Interval <= 0 {
+			return fmt.Errorf("Sync policy %s needs a positive interval.", p.Mode)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown sync policy %q.", p.Mode)
+}
+
+// SetSyncPolicy changes the sync policy of the log, starting or stopping
+// the background sync as needed.
+func (l *LocalDataLog) SetSyncPolicy(policy SyncPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	stop := l.stopSync
+	l.stopSync = nil
+	l.policy = policy
+	if policy.Mode == SYNC_INTERVAL {
+		l.stopSync = make(chan struct{})
+		go l.syncEvery(policy.Interval, l.stopSync)
+	}
+	l.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+
+	log.Infof("Data log %s uses sync policy %s.", l.filePath, policy.Mode)
+	return nil
+}
+
+func (l *LocalDataLog) syncEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				log.Errorf("Background sync of data log %s failed: %v", l.filePath, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// openActiveLocked opens the active segment for appending.
+func (l *LocalDataLog) openActiveLocked() (*os.File, error) {
+	if l.active != nil {
+		return l.active, nil
+	}
+
+	path := l.segmentPath(l.segments[len(l.segments)-1].Base)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Errorf("Could not open data log file %s: %v", path, err)
+		return nil, err
+	}
+
+	l.active = file
+	return file, nil
+}
+
+func encodeLogItems(items []LogItem) []byte {
+	var buf bytes.Buffer
+	for _, it := range items {
+		buf.Write(encodeLogItem(it))
+	}
+
+	return buf.Bytes()
+}
+
+// writePendingLocked writes the buffered items to the active segment
+// without syncing it.
+func (l *LocalDataLog) writePendingLocked() error {
+	for l.syncing {
+		l.flushed.Wait()
+	}
+
+	if len(l.buffer) == 0 {
+		return nil
+	}
+
+	file, err := l.openActiveLocked()
+	if err != nil {
+		return err
+	}
+
+	last := l.buffer[len(l.buffer)-1]
+	if _, err = file.Write(encodeLogItems(l.buffer)); err != nil {
+		log.Errorf("Could not write log items to data log file %s: %v", file.Name(), err)
+		return err
+	}
+
+	l.written = last.Offset() + last.Length()
+	l.buffer = l.buffer[:0]
+	return nil
+}
+
+// syncTo blocks until everything before end is written and fsynced. The
+// first waiter writes and fsyncs everything buffered so far, waiters that
+// arrive meanwhile are covered by the next single write and fsync.
+func (l *LocalDataLog) syncTo(end int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for l.durable < end {
+		if l.syncErr != nil {
+			return l.syncErr
+		}
+
+		if l.syncing {
+			l.flushed.Wait()
+			continue
+		}
+
+		file, err := l.openActiveLocked()
+		if err != nil {
+			return err
+		}
+
+		batch := l.buffer
+		l.buffer = make([]LogItem, 0, cap(batch))
+		batchEnd := l.segments[len(l.segments)-1].End()
+		l.syncing = true
+		l.mutex.Unlock()
+
+		if len(batch) > 0 {
+			_, err = file.Write(encodeLogItems(batch))
+		}
+
+		if err == nil {
+			err = file.Sync()
+		}
+
+		l.mutex.Lock()
+		l.syncing = false
+		if err != nil {
+			log.Errorf("Could not sync data log file %s: %v", file.Name(), err)
+			l.syncErr = err
+		} else {
+			l.written = batchEnd
+			l.durable = batchEnd
+		}
+		l.flushed.Broadcast()
+	}
+
+	return nil
+}
+
+// Commit writes the items added so far to the log file and makes them
+// durable as the sync policy asks.
+func (l *LocalDataLog) Commit() error {
+	l.mutex.Lock()
+	if l.policy.Mode != SYNC_ALWAYS {
+		defer l.mutex.Unlock()
+		return l.writePendingLocked()
+	}
+
+	end := l.segments[len(l.segments)-1].End()
+	l.mutex.Unlock()
+	return l.syncTo(end)
+}
+
+// Sync writes and fsyncs every buffered item regardless of the policy.
+func (l *LocalDataLog) Sync() error {
+	size, _ := l.Size()
+	return l.syncTo(size)
+}
+
+// Close syncs the log and releases its file handle.
+func (l *LocalDataLog) Close() error {
+	err := l.SetSyncPolicy(SyncPolicy{Mode: SYNC_NONE})
+	if syncErr := l.Sync(); err == nil {
+		err = syncErr
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if closeErr := l.closeActiveLocked(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
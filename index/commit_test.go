@@ -0,0 +1,75 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPolicies() []SyncPolicy {
+	return []SyncPolicy{{Mode: SYNC_ALWAYS}, {Mode: SYNC_INTERVAL, Interval: time.Second},
+		{Mode: SYNC_NONE}}
+}
+
+// A committed item has to be in the log file before Commit returns under
+// every policy, only the fsync may be deferred.
+func TestCommitWritesEveryItem(t *testing.T) {
+	for _, policy := range testPolicies() {
+		path := filepath.Join(t.TempDir(), "data_log.txt")
+		l := NewSegmentedDataLog(path, 0)
+		if err := l.SetSyncPolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			item := NewLogItem(fmt.Sprintf("key-%d", i), "value", 0)
+			if _, err := l.AddLogItem(item); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := l.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Contains(data, encodeLogItem(item)) {
+				t.Fatalf("%s: committed item %d is not in the log file", policy.Mode, i)
+			}
+		}
+		l.Close()
+	}
+}
+
+// BenchmarkCommit compares the sync policies, each iteration adds and
+// commits one item.
+func BenchmarkCommit(b *testing.B) {
+	value := strings.Repeat("v", 100)
+	for _, policy := range testPolicies() {
+		b.Run(policy.Mode, func(b *testing.B) {
+			l := NewSegmentedDataLog(filepath.Join(b.TempDir(), "data_log.txt"), 0)
+			if err := l.SetSyncPolicy(policy); err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.AddLogItem(NewLogItem(fmt.Sprintf("key-%d", i), value, 0)); err != nil {
+					b.Fatal(err)
+				}
+
+				if err := l.Commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,13 +1,24 @@
 package index
 
 import (
+	"bytes"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TOMBSTONE_SIZE int64  = -1
+	HINT_SUFFIX    string = ".hint"
+	MERGE_SUFFIX   string = ".merge"
 )
 
 type LocalDataLogReader struct {
@@ -18,6 +29,10 @@ type LocalDataLogReader struct {
 type DataLog interface {
 	ReadLogItem(offset int64) (logItem *LogItem, err error)
 	AddLogItem(logItem LogItem) (offset int64, err error)
+	Size() (size int64, err error)
+	Commit() error
+	Sync() error
+	Close() error
 }
 
 type LogItem struct {
@@ -25,6 +40,7 @@ type LogItem struct {
 	value  string
 	size   int64
 	offset int64
+	length int64
 }
 
 func (l *LogItem) Key() string {
@@ -43,95 +59,430 @@ func (l *LogItem) Offset() int64 {
 	return l.offset
 }
 
+// Length is the number of bytes the item takes up in the data log, the next
+// item starts at Offset() + Length().
+func (l *LogItem) Length() int64 {
+	return l.length
+}
+
+// IsTombstone reports whether the item records a delete of its key.
+func (l *LogItem) IsTombstone() bool {
+	return l.size == TOMBSTONE_SIZE
+}
+
 func NewLogItem(key string, value string, offset int64) LogItem {
 	size := int64(len([]byte(value)))
-	return LogItem{key, value, size, offset}
+	return LogItem{key, value, size, offset, 0}
+}
+
+func NewTombstoneLogItem(key string) LogItem {
+	return LogItem{key, "", TOMBSTONE_SIZE, 0, 0}
 }
 
 type LocalDataLog struct {
 	flushThreshold int
 	filePath       string
 	buffer         []LogItem
+	segmentSize    int64
+	segments       []SegmentInfo
+	mutex          sync.Mutex
+	flushed        *sync.Cond
+	policy         SyncPolicy
+	active         *os.File
+	readers        int
+	written        int64
+	durable        int64
+	syncing        bool
+	syncErr        error
+	stopSync       chan struct{}
+}
+
+// SegmentInfo describes one file of a data log. Offsets handed out by the
+// log are logical, a segment holds the items from Base to Base + Size.
+type SegmentInfo struct {
+	Base int64
+	Size int64
+}
+
+func (s SegmentInfo) End() int64 {
+	return s.Base + s.Size
 }
 
 func NewLocalDataLog(filePath string) DataLog {
+	return NewSegmentedDataLog(filePath, 0)
+}
+
+// NewSegmentedDataLog opens a data log that rolls over to a new segment
+// file once the active one reaches segmentSize bytes. A segmentSize of zero
+// keeps the whole log in one file.
+func NewSegmentedDataLog(filePath string, segmentSize int64) *LocalDataLog {
 	buffer := make([]LogItem, 0, 10)
-	dataLog := LocalDataLog{10, filePath, buffer}
-	return &dataLog
+	dataLog := &LocalDataLog{flushThreshold: 10, filePath: filePath, buffer: buffer,
+		segmentSize: segmentSize, policy: SyncPolicy{Mode: SYNC_NONE}}
+	dataLog.flushed = sync.NewCond(&dataLog.mutex)
+	dataLog.segments = dataLog.loadSegments()
+	dataLog.written = dataLog.segments[len(dataLog.segments)-1].End()
+	dataLog.durable = dataLog.written
+	return dataLog
 }
 
-func (l *LocalDataLog) ReadLogItem(offset int64) (logItem *LogItem, err error) {
-	storeFile, err := os.OpenFile(l.filePath, os.O_RDONLY, 0644)
+// segmentPath names the segment starting at base. The first segment keeps
+// the plain file path so unsegmented logs read the same.
+func (l *LocalDataLog) segmentPath(base int64) string {
+	if base == 0 {
+		return l.filePath
+	}
+
+	return fmt.Sprintf("%s.%d", l.filePath, base)
+}
+
+func (l *LocalDataLog) segmentHintPath(base int64) string {
+	return l.segmentPath(base) + HINT_SUFFIX
+}
+
+// segmentBases lists the bases of the segment files of the data log at
+// filePath in order, the first segment is always at base zero.
+func segmentBases(filePath string) []int64 {
+	bases := []int64{0}
+	paths, _ := filepath.Glob(filePath + ".*")
+	for _, p := range paths {
+		base, err := strconv.ParseInt(strings.TrimPrefix(p, filePath+"."), 10, 64)
+		if err == nil && base > 0 {
+			bases = append(bases, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	return bases
+}
 
-	if _, err := os.Stat(l.filePath); os.IsNotExist(err) {
-		return nil, io.EOF
+func (l *LocalDataLog) loadSegments() []SegmentInfo {
+	leftovers, _ := filepath.Glob(l.filePath + "*" + MERGE_SUFFIX)
+	for _, p := range leftovers {
+		log.Warnf("Removing unfinished merge output %s.", p)
+		os.Remove(p)
 	}
 
+	bases := segmentBases(l.filePath)
+	segments := make([]SegmentInfo, 0, len(bases))
+	for _, base := range bases {
+		fi, err := os.Stat(l.segmentPath(base))
+		if err != nil {
+			continue
+		}
+
+		seg := SegmentInfo{base, fi.Size()}
+		if n := len(segments); n > 0 && segments[n-1].End() > base {
+			log.Warnf("Segment %s overlaps a merged segment, removing it.", l.segmentPath(base))
+			os.Remove(l.segmentPath(base))
+			os.Remove(l.segmentHintPath(base))
+			continue
+		}
+		segments = append(segments, seg)
+	}
+
+	if len(segments) == 0 || segments[0].Base != 0 {
+		segments = append([]SegmentInfo{{0, 0}}, segments...)
+	}
+
+	return segments
+}
+
+// Segments lists the segments of the log, the last one is active.
+func (l *LocalDataLog) Segments() []SegmentInfo {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	segments := make([]SegmentInfo, len(l.segments))
+	copy(segments, l.segments)
+	return segments
+}
+
+// pinActiveLocked opens the active segment for a read and returns the
+// handle and a function to call once the read is done. The handle is not
+// closed by a rollover or Close while it is pinned.
+func (l *LocalDataLog) pinActiveLocked() (io.ReaderAt, func(), error) {
+	file, err := l.openActiveLocked()
 	if err != nil {
-		log.Error(fmt.Sprintf("Unable to open data log file at %s", l.filePath), err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	l.readers++
+	return file, func() {
+		l.mutex.Lock()
+		l.readers--
+		l.flushed.Broadcast()
+		l.mutex.Unlock()
+	}, nil
+}
+
+// closeActiveLocked syncs and closes the active segment handle once no read
+// has it pinned.
+func (l *LocalDataLog) closeActiveLocked() error {
+	for l.readers > 0 {
+		l.flushed.Wait()
+	}
+
+	if l.active == nil {
+		return nil
+	}
+
+	err := l.active.Sync()
+	if closeErr := l.active.Close(); err == nil {
+		err = closeErr
 	}
+	l.active = nil
+	return err
+}
+
+// findSegment returns the index of the segment holding offset.
+func (l *LocalDataLog) findSegment(offset int64) int {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].Base > offset
+	})
 
-	defer storeFile.Close()
+	return i - 1
+}
 
-	stat, _ := storeFile.Stat()
-	if stat.Size() <= offset {
-		log.Info("End of data log detected sined EOF.")
-		return nil, io.EOF
+func (l *LocalDataLog) ReadLogItem(offset int64) (logItem *LogItem, err error) {
+	l.mutex.Lock()
+	segIndex := l.findSegment(offset)
+	if segIndex < 0 {
+		l.mutex.Unlock()
+		return nil, fmt.Errorf("Offset %d is before the start of data log %s.", offset, l.filePath)
+	}
+
+	seg := l.segments[segIndex]
+	if offset >= seg.End() {
+		if segIndex+1 >= len(l.segments) {
+			l.mutex.Unlock()
+			log.Info("End of data log detected sined EOF.")
+			return nil, io.EOF
+		}
+
+		// Merged segments leave a gap before the next segment.
+		segIndex++
+		offset = l.segments[segIndex].Base
+		seg = l.segments[segIndex]
+	}
+
+	if offset >= l.written {
+		if err = l.writePendingLocked(); err != nil {
+			l.mutex.Unlock()
+			return nil, err
+		}
+	}
+
+	var storeFile io.ReaderAt
+	var release func()
+	path := l.segmentPath(seg.Base)
+	if segIndex == len(l.segments)-1 {
+		// The active segment keeps growing, read it through the append
+		// handle, pinned so a concurrent rollover cannot close it.
+		seg = l.segments[segIndex]
+		storeFile, release, err = l.pinActiveLocked()
+		l.mutex.Unlock()
+	} else {
+		// Sealed segments never change and are read through the table cache.
+		l.mutex.Unlock()
+		var h *TableHandle
+		if h, err = tables.Open(path); err == nil {
+			storeFile, release = h, func() { tables.Release(h) }
+		}
 	}
 
-	_, err = storeFile.Seek(offset, 0)
 	if err != nil {
-		log.Error(fmt.Sprintf("Unable to seek to offset in data log file at %s", l.filePath), err)
+		log.Error(fmt.Sprintf("Unable to open data log file at %s", path), err)
 		return nil, err
 	}
 
-	reader := csv.NewReader(storeFile)
+	defer release()
+
+	local := offset - seg.Base
+	reader := csv.NewReader(io.NewSectionReader(storeFile, local, seg.Size-local))
+	reader.FieldsPerRecord = 3
 	record, err := reader.Read()
 
 	if err != nil {
-		log.Error(fmt.Sprintf("Unable to read csv record in data log file at %s", l.filePath), err)
+		log.Error(fmt.Sprintf("Unable to read csv record in data log file at %s", path), err)
 		return nil, err
 	}
 
-	key := record[0]
-	value := record[1]
-	s := record[2]
-	size, parseError := strconv.ParseInt(s, 10, 64)
-
+	key, value, size, parseError := decodeFields(record[0], record[1], record[2])
 	if parseError != nil {
-		return nil, errors.New(fmt.Sprintf("Could not convert size to int for offset %d", offset))
+		return nil, errors.New(fmt.Sprintf("Could not decode log item at offset %d: %v",
+			offset, parseError))
 	}
 
 	li := NewLogItem(key, value, offset)
 	li.size = size
+	li.length = reader.InputOffset()
 	return &li, nil
 }
 
+func encodeLogItem(logItem LogItem) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	key, value, size := encodeFields(logItem.Key(), logItem.Value(), logItem.Size())
+	w.Write([]string{key, value, size})
+	w.Flush()
+	return buf.Bytes()
+}
+
+// AddLogItem buffers the item and returns its offset. The item is written
+// by the next Commit, or earlier once the buffer fills up, it is read or the
+// log is synced.
 func (l *LocalDataLog) AddLogItem(logItem LogItem) (offset int64, err error) {
-	log.Infof("Adding log item to %s.", l.filePath)
-	file, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	record := encodeLogItem(logItem)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	active := &l.segments[len(l.segments)-1]
+	if l.segmentSize > 0 && active.Size > 0 && active.Size+int64(len(record)) > l.segmentSize {
+		log.Infof("Segment at %d is full, rolling data log %s.", active.Base, l.filePath)
+		if err = l.writePendingLocked(); err != nil {
+			return 0, err
+		}
+
+		if err = l.closeActiveLocked(); err != nil {
+			return 0, err
+		}
+		active = &l.segments[len(l.segments)-1]
+		l.segments = append(l.segments, SegmentInfo{active.End(), 0})
+		active = &l.segments[len(l.segments)-1]
+	}
+
+	offset = active.End()
+	logItem.offset = offset
+	logItem.length = int64(len(record))
+	l.buffer = append(l.buffer, logItem)
+	active.Size += logItem.length
+	log.Infof("Buffered log item at offset %d for %s.", offset, l.filePath)
+
+	if len(l.buffer) >= l.flushThreshold && !l.syncing {
+		err = l.writePendingLocked()
+	}
+
+	return offset, err
+}
+
+// Size returns the offset the next log item will be written at.
+func (l *LocalDataLog) Size() (size int64, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.segments[len(l.segments)-1].End(), nil
+}
+
+// segmentHint returns the hint of the sealed segment starting at base, if
+// it has a complete one.
+func (l *LocalDataLog) segmentHint(base int64) (hint *Hint, seg SegmentInfo, ok bool) {
+	l.mutex.Lock()
+	segIndex := l.findSegment(base)
+	if segIndex < 0 || segIndex == len(l.segments)-1 || l.segments[segIndex].Base != base {
+		l.mutex.Unlock()
+		return nil, seg, false
+	}
+
+	seg = l.segments[segIndex]
+	l.mutex.Unlock()
+	hint, err := ReadHintFile(l.segmentHintPath(base))
+	if err != nil || hint.CoveredOffset != seg.End() {
+		return nil, seg, false
+	}
+
+	return hint, seg, true
+}
+
+// mergedItem is a live item copied into a merged segment.
+type mergedItem struct {
+	key       string
+	oldOffset int64
+	newOffset int64
+	size      int64
+	sequence  int64
+}
+
+// merge rewrites the given live items from all sealed segments into a single
+// segment at the base of the first one, writes its hint and removes the old
+// segments. It returns the new offsets.
+func (l *LocalDataLog) merge(items []mergedItem, sequence int64) ([]mergedItem, error) {
+	segments := l.Segments()
+	if len(segments) < 2 {
+		return nil, nil
+	}
+
+	sealed := segments[:len(segments)-1]
+	base := sealed[0].Base
+	path := l.segmentPath(base)
+	tmpPath := path + MERGE_SUFFIX
+	log.Infof("Merging %d sealed segments of %s into %s.", len(sealed), l.filePath, tmpPath)
+
+	file, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Errorf("Could not open data log file %s", l.filePath, err)
-		return 0, err
+		return nil, err
 	}
 
-	defer file.Close()
+	var written int64
+	hint := Hint{Sequence: sequence}
+	for n, it := range items {
+		logItem, err := l.ReadLogItem(it.oldOffset)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		length, err := file.Write(encodeLogItem(*logItem))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
 
-	length, write_err := file.WriteString(fmt.Sprintf("%s,%s,%d\n", logItem.Key(), logItem.Value(), logItem.Size()))
+		items[n].newOffset = base + written
+		written += int64(length)
+		hint.Entries = append(hint.Entries, HintEntry{it.key, items[n].newOffset,
+			it.size, it.sequence})
+	}
 
-	if write_err != nil {
-		log.Errorf("Could not write log item to data log file %s", l.filePath, err)
-		return 0, write_err
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return nil, err
 	}
 
-	fi, statErr := file.Stat()
-	if statErr != nil {
-		log.Error("Could not get current file size to calculate new offset.", err)
-		return 0, statErr
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+
+	hint.CoveredOffset = base + written
+	os.Remove(l.segmentHintPath(base))
+	tables.Evict(path)
+	if err = os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+
+	if err = WriteHintFile(l.segmentHintPath(base), hint); err != nil {
+		log.Errorf("Could not write hint for merged segment %s: %v", path, err)
+	}
+
+	for _, seg := range sealed[1:] {
+		log.Infof("Removing merged segment %s.", l.segmentPath(seg.Base))
+		tables.Evict(l.segmentPath(seg.Base))
+		os.Remove(l.segmentPath(seg.Base))
+		os.Remove(l.segmentHintPath(seg.Base))
+	}
+
+	l.mutex.Lock()
+	l.segments = append([]SegmentInfo{{base, written}}, l.segments[len(sealed):]...)
+	l.mutex.Unlock()
+	log.Infof("Merged %d sealed segments into %d bytes.", len(sealed), written)
+	return items, nil
+}
+
+// Files lists the segment files of the log, oldest first.
+func (l *LocalDataLog) Files() []string {
+	segments := l.Segments()
+	files := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		files = append(files, l.segmentPath(seg.Base))
 	}
 
-	offset = fi.Size() - int64(length)
-	log.Infof("Added log item at offset %d to %s.", offset, l.filePath)
-	return offset, nil
+	return files
 }
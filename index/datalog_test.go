@@ -0,0 +1,81 @@
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Reads of the newest item race with rollovers closing the active segment
+// handle, every read has to see the item written at its offset.
+func TestReadLogItemDuringRollover(t *testing.T) {
+	l := NewSegmentedDataLog(filepath.Join(t.TempDir(), "data_log.txt"), 256)
+	defer l.Close()
+
+	var mutex sync.Mutex
+	var offsets []int64
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				mutex.Lock()
+				last := len(offsets) - 1
+				if last < 0 {
+					mutex.Unlock()
+					continue
+				}
+				offset := offsets[last]
+				mutex.Unlock()
+
+				item, err := l.ReadLogItem(offset)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if want := fmt.Sprintf("key-%d", last); item.Key() != want {
+					errs <- fmt.Errorf("offset %d holds %s, want %s", offset, item.Key(), want)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3000; i++ {
+		offset, err := l.AddLogItem(NewLogItem(fmt.Sprintf("key-%d", i), "value", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = l.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		mutex.Lock()
+		offsets = append(offsets, offset)
+		mutex.Unlock()
+	}
+	close(done)
+	readers.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+
+	if n := len(l.Segments()); n < 10 {
+		t.Fatalf("expected the log to roll over, it has %d segments", n)
+	}
+}
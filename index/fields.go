@@ -0,0 +1,51 @@
+package index
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ENCODED_SIZE starts the size field of a record whose key and value are
+// base64 encoded. The csv reader drops a carriage return that comes before
+// a line feed even inside a quoted field, so records holding a carriage
+// return are written encoded to read back unchanged.
+const ENCODED_SIZE string = "b"
+
+// encodeFields returns the key, value and size fields of a record as they
+// are written to a csv file.
+func encodeFields(key string, value string, size int64) (string, string, string) {
+	if !strings.ContainsRune(key, '\r') && !strings.ContainsRune(value, '\r') {
+		return key, value, strconv.FormatInt(size, 10)
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(key)),
+		base64.StdEncoding.EncodeToString([]byte(value)),
+		ENCODED_SIZE + strconv.FormatInt(size, 10)
+}
+
+// decodeFields reverses encodeFields.
+func decodeFields(key string, value string, size string) (string, string, int64, error) {
+	encoded := strings.HasPrefix(size, ENCODED_SIZE)
+	n, err := strconv.ParseInt(strings.TrimPrefix(size, ENCODED_SIZE), 10, 64)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	if !encoded {
+		return key, value, n, nil
+	}
+
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid encoded key %q", key)
+	}
+
+	v, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid encoded value of key %q", k)
+	}
+
+	return string(k), string(v), n, nil
+}
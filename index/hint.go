@@ -0,0 +1,160 @@
+package index
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	HINT_HEADER  string = "hint"
+	HINT_SEGMENT string = "segment"
+)
+
+// HintEntry is one live key of a data log as recorded in a hint file.
+type HintEntry struct {
+	Key      string
+	Offset   int64
+	Size     int64
+	Sequence int64
+}
+
+// Hint is a compact dump of an index. CoveredOffset is the data log offset
+// up to which the entries are complete, anything after it must be replayed
+// from the data log.
+type Hint struct {
+	CoveredOffset int64
+	Sequence      int64
+	Segments      []SegmentInfo
+	Entries       []HintEntry
+}
+
+func WriteHintFile(filePath string, hint Hint) error {
+	tmpPath := filePath + ".tmp"
+	log.Infof("Writing hint with %d entries to %s.", len(hint.Entries), tmpPath)
+	file, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{HINT_HEADER, fmt.Sprintf("%d", hint.CoveredOffset),
+		fmt.Sprintf("%d", hint.Sequence), fmt.Sprintf("%d", len(hint.Segments))})
+	for _, seg := range hint.Segments {
+		w.Write([]string{HINT_SEGMENT, fmt.Sprintf("%d", seg.Base),
+			fmt.Sprintf("%d", seg.Size), ""})
+	}
+	for _, e := range hint.Entries {
+		key, _, size := encodeFields(e.Key, "", e.Size)
+		w.Write([]string{key, fmt.Sprintf("%d", e.Offset), size, fmt.Sprintf("%d", e.Sequence)})
+	}
+	w.Flush()
+
+	if err = w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Swapping hint file into %s.", filePath)
+	return os.Rename(tmpPath, filePath)
+}
+
+// ReadHintFile loads a hint file, it returns os.ErrNotExist when there is
+// none.
+func ReadHintFile(filePath string) (hint *Hint, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = 4
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read hint header from %s: %v", filePath, err)
+	}
+
+	if header[0] != HINT_HEADER {
+		return nil, errors.New(fmt.Sprintf("File %s is not a hint file.", filePath))
+	}
+
+	hint = &Hint{}
+	if hint.CoveredOffset, err = strconv.ParseInt(header[1], 10, 64); err != nil {
+		return nil, err
+	}
+
+	if hint.Sequence, err = strconv.ParseInt(header[2], 10, 64); err != nil {
+		return nil, err
+	}
+
+	segmentCount := 0
+	if header[3] != "" {
+		if segmentCount, err = strconv.Atoi(header[3]); err != nil {
+			return nil, err
+		}
+	}
+
+	for n := 0; n < segmentCount; n++ {
+		record, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		if record[0] != HINT_SEGMENT {
+			return nil, fmt.Errorf("Expected segment record in hint file %s.", filePath)
+		}
+
+		var seg SegmentInfo
+		if seg.Base, err = strconv.ParseInt(record[1], 10, 64); err != nil {
+			return nil, err
+		}
+
+		if seg.Size, err = strconv.ParseInt(record[2], 10, 64); err != nil {
+			return nil, err
+		}
+		hint.Segments = append(hint.Segments, seg)
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var e HintEntry
+		if e.Key, _, e.Size, err = decodeFields(record[0], "", record[2]); err != nil {
+			return nil, fmt.Errorf("Corrupt hint entry in %s: %v", filePath, err)
+		}
+
+		if e.Offset, err = strconv.ParseInt(record[1], 10, 64); err != nil {
+			return nil, err
+		}
+
+		if e.Sequence, err = strconv.ParseInt(record[3], 10, 64); err != nil {
+			return nil, err
+		}
+		hint.Entries = append(hint.Entries, e)
+	}
+
+	log.Infof("Read hint with %d entries covering data log up to %d.", len(hint.Entries),
+		hint.CoveredOffset)
+	return hint, nil
+}
@@ -1,10 +1,9 @@
 package index
 
 import (
-	"fmt"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"math/rand"
 	"os"
 	"sort"
 )
@@ -13,11 +12,17 @@ type IndexItem struct {
 	partialKey string
 	offset     int64
 	size       int64
+	sequence   int64
 }
 
 func NewIndexItem(key string, offset int64, size int64) IndexItem {
 	pk := getPartialKey(key)
-	return IndexItem{pk, offset, size}
+	return IndexItem{pk, offset, size, 0}
+}
+
+// Sequence is the write sequence number the index assigned to the item.
+func (i *IndexItem) Sequence() int64 {
+	return i.sequence
 }
 
 func (i *IndexItem) Size() int64 {
@@ -36,9 +41,19 @@ type Index interface {
 	Get(key string) (indexItems []IndexItem, ok bool)
 	Put(indexItem IndexItem)
 	Del(key string)
+	Items() []IndexItem
 	DataLog() DataLog
 	Save() error
 	Load() error
+	Merge() error
+}
+
+// segmentedLog is implemented by data logs split into segment files that
+// can be merged.
+type segmentedLog interface {
+	Segments() []SegmentInfo
+	segmentHint(base int64) (hint *Hint, seg SegmentInfo, ok bool)
+	merge(items []mergedItem, sequence int64) ([]mergedItem, error)
 }
 
 func getPartialKey(key string) string {
@@ -54,50 +69,45 @@ type LocalIndex struct {
 	storageFilePath string
 	indexItems      map[string][]IndexItem
 	localDataLog    DataLog
+	sequence        int64
 }
 
 func (i *LocalIndex) DataLog() DataLog {
 	return i.localDataLog
 }
 
+// Save writes a hint file holding every live key with its data log offset,
+// so Load only has to replay the part of the log written afterwards.
 func (i *LocalIndex) Save() error {
-	var items []IndexItem
-	iitems := i.indexItems
 	log.Infof("Saving index file to %s", i.storageFilePath)
-	log.Infof("Collecting index items from index map of size %d.", len(iitems))
-	for _, value := range iitems {
-		for _, it := range value {
-			items = append(items, it)
-		}
+	covered, err := i.localDataLog.Size()
+	if err != nil {
+		return err
 	}
 
+	items := i.Items()
 	sort.Slice(items, func(i, j int) bool {
 		return items[i].Offset() < items[j].Offset()
 	})
 	log.Info("Sorted index items by offset.")
 
-	log.Info("Creating temp index file.")
-	fileName := fmt.Sprintf("./index_swap%d.csv", rand.Int())
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		log.Error("Could not create tmp index file.", err)
-		return err
+	hint := Hint{covered, i.sequence, nil, make([]HintEntry, 0, len(items))}
+	if segmented, ok := i.localDataLog.(segmentedLog); ok {
+		hint.Segments = segmented.Segments()
 	}
-	defer file.Close()
 
-	log.Infof("Writing %d records to index.", len(items))
 	for _, item := range items {
-		_, write_err := file.WriteString(fmt.Sprintf("%s,%d,%d\n", item.PartialKey(), item.Offset(), item.Size()))
-		if write_err != nil {
-			return write_err
+		logItem, err := i.localDataLog.ReadLogItem(item.Offset())
+		if err != nil {
+			log.Errorf("Could not read log item at %d for hint: %v", item.Offset(), err)
+			return err
 		}
-	}
 
-	//Create index file if no exist
-	log.Infof("Swapping tmp index file as replacement.")
-	err = os.Rename(fileName, i.storageFilePath)
+		hint.Entries = append(hint.Entries, HintEntry{logItem.Key(), item.Offset(),
+			item.Size(), item.Sequence()})
+	}
 
-	return err
+	return WriteHintFile(i.storageFilePath, hint)
 }
 
 func (i *LocalIndex) Get(key string) (indexItems []IndexItem, ok bool) {
@@ -114,32 +124,69 @@ func (i *LocalIndex) Put(indexItem IndexItem) {
 		indexItems = make([]IndexItem, 0)
 	}
 
+	i.sequence++
+	indexItem.sequence = i.sequence
 	indexItems = append(indexItems, indexItem)
 	i.indexItems[indexItem.PartialKey()] = indexItems
 	log.Infof("Added index item for partial key %s.", indexItem.PartialKey())
 }
 
-func (i *LocalIndex) getLastIndex() int64 {
-	storeFile, err := os.OpenFile(i.storageFilePath, os.O_RDONLY, 0644)
+// sameSealedSegments reports whether the segments a hint was saved against
+// are still in place. Only the last of them may have grown since.
+func sameSealedSegments(saved []SegmentInfo, current []SegmentInfo) bool {
+	if len(saved) > len(current) {
+		return false
+	}
+
+	for n, seg := range saved {
+		if seg.Base != current[n].Base {
+			return false
+		}
+
+		if n < len(saved)-1 && seg.Size != current[n].Size {
+			return false
+		}
+	}
+
+	return true
+}
 
-	if _, er := os.Stat(i.storageFilePath); os.IsNotExist(er) {
+// loadHint fills the index from the hint file and returns the data log
+// offset replay has to start from.
+func (i *LocalIndex) loadHint() int64 {
+	hint, err := ReadHintFile(i.storageFilePath)
+	if os.IsNotExist(err) {
+		log.Info("No hint file, replaying whole data log.")
 		return 0
 	}
 
 	if err != nil {
-		log.Errorf("Unable to open index file at %s.", i.storageFilePath)
+		log.Errorf("Ignoring unreadable hint file %s: %v", i.storageFilePath, err)
 		return 0
 	}
 
-	defer storeFile.Close()
+	size, err := i.localDataLog.Size()
+	if err != nil || size < hint.CoveredOffset {
+		log.Warnf("Hint file %s covers more than the data log holds, ignoring it.",
+			i.storageFilePath)
+		return 0
+	}
 
-	stat, err := storeFile.Stat()
-	if err != nil {
-		log.Errorf("Unable to seek to offset in index file at %s", i.storageFilePath, err)
+	if segmented, ok := i.localDataLog.(segmentedLog); ok &&
+		!sameSealedSegments(hint.Segments, segmented.Segments()) {
+		log.Warnf("Data log segments changed since hint file %s was saved, ignoring it.",
+			i.storageFilePath)
 		return 0
 	}
 
-	return stat.Size()
+	for _, e := range hint.Entries {
+		item := NewIndexItem(e.Key, e.Offset, e.Size)
+		item.sequence = e.Sequence
+		i.indexItems[item.PartialKey()] = append(i.indexItems[item.PartialKey()], item)
+	}
+	i.sequence = hint.Sequence
+
+	return hint.CoveredOffset
 }
 
 func (i *LocalIndex) Del(key string) {
@@ -151,30 +198,56 @@ func (i *LocalIndex) Del(key string) {
 		return
 	}
 
-	for index, item := range indexItems {
+	kept := make([]IndexItem, 0, len(indexItems))
+	for _, item := range indexItems {
 		log.Infof("Look %d", item.Offset())
 		logItem, err := i.localDataLog.ReadLogItem(item.Offset())
-		if err != nil {
-			break
-		}
-
-		if logItem.Key() == key {
+		if err == nil && logItem.Key() == key {
 			log.Infof("Log item found deleting for %s.", key)
-			indexItems[index] = indexItems[len(indexItems)-1]
-			i.indexItems[getPartialKey(key)] = indexItems[:len(indexItems)-1]
 			continue
 		}
+
+		kept = append(kept, item)
+	}
+
+	if len(kept) == 0 {
+		delete(i.indexItems, getPartialKey(key))
+	} else {
+		i.indexItems[getPartialKey(key)] = kept
+	}
+}
+
+func (i *LocalIndex) Items() []IndexItem {
+	items := make([]IndexItem, 0, len(i.indexItems))
+	for _, value := range i.indexItems {
+		items = append(items, value...)
 	}
+
+	return items
 }
 
 func (i *LocalIndex) Load() error {
 	log.Infof("Loading index data from %s", i.storageFilePath)
-	indexItems := i.indexItems
 	dataLog := i.localDataLog
 
-	var offset int64 = i.getLastIndex()
-	log.Infof("Last index is %d", offset)
+	var offset int64 = i.loadHint()
+	log.Infof("Replaying data log from offset %d", offset)
+	latest := make(map[string]IndexItem)
+	deleted := make(map[string]bool)
+	segmented, isSegmented := dataLog.(segmentedLog)
 	for true {
+		if isSegmented {
+			if hint, seg, ok := segmented.segmentHint(offset); ok {
+				log.Infof("Loading segment at %d from its hint file.", seg.Base)
+				for _, e := range hint.Entries {
+					latest[e.Key] = NewIndexItem(e.Key, e.Offset, e.Size)
+					delete(deleted, e.Key)
+				}
+				offset = seg.End()
+				continue
+			}
+		}
+
 		logItem, err := dataLog.ReadLogItem(offset)
 		if err == io.EOF {
 			log.Infof("Reached end of data log file.")
@@ -186,12 +259,38 @@ func (i *LocalIndex) Load() error {
 			return err
 		}
 
-		item := NewIndexItem(logItem.Key(), logItem.Offset(), logItem.Size())
-		indexItems[item.PartialKey()] = append(indexItems[item.PartialKey()], item)
-		offset = item.offset + item.size
+		if logItem.IsTombstone() {
+			delete(latest, logItem.Key())
+			deleted[logItem.Key()] = true
+		} else {
+			latest[logItem.Key()] = NewIndexItem(logItem.Key(), logItem.Offset(), logItem.Size())
+			delete(deleted, logItem.Key())
+		}
+		offset = logItem.Offset() + logItem.Length()
+	}
+
+	for key := range deleted {
+		i.Del(key)
+	}
+
+	replayed := make([]IndexItem, 0, len(latest))
+	for _, item := range latest {
+		replayed = append(replayed, item)
 	}
 
-	i.indexItems = indexItems
+	sort.Slice(replayed, func(i, j int) bool {
+		return replayed[i].Offset() < replayed[j].Offset()
+	})
+
+	for _, item := range replayed {
+		logItem, err := dataLog.ReadLogItem(item.Offset())
+		if err != nil {
+			return err
+		}
+
+		i.Del(logItem.Key())
+		i.Put(item)
+	}
 
 	log.Infof("Loaded index data from %s", i.storageFilePath)
 	return nil
@@ -199,7 +298,64 @@ func (i *LocalIndex) Load() error {
 
 func NewLocalIndex(storageFilePath string, dataLog DataLog) Index {
 	indexItems := make(map[string][]IndexItem)
-	localIndex := LocalIndex{storageFilePath, indexItems, dataLog}
+	localIndex := LocalIndex{storageFilePath, indexItems, dataLog, 0}
 
 	return &localIndex
 }
+
+// Merge rewrites the live items of every sealed data log segment into one
+// segment, points the index at their new offsets and saves a new hint.
+func (i *LocalIndex) Merge() error {
+	segmented, ok := i.localDataLog.(segmentedLog)
+	if !ok {
+		return errors.New("Data log does not support merging.")
+	}
+
+	segments := segmented.Segments()
+	if len(segments) < 2 {
+		log.Info("No sealed data log segments to merge.")
+		return nil
+	}
+
+	limit := segments[len(segments)-1].Base
+	var live []mergedItem
+	for _, item := range i.Items() {
+		if item.Offset() >= limit {
+			continue
+		}
+
+		logItem, err := i.localDataLog.ReadLogItem(item.Offset())
+		if err != nil {
+			return err
+		}
+
+		live = append(live, mergedItem{logItem.Key(), item.Offset(), 0, item.Size(),
+			item.Sequence()})
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].oldOffset < live[j].oldOffset
+	})
+
+	merged, err := segmented.merge(live, i.sequence)
+	if err != nil {
+		return err
+	}
+
+	moved := make(map[int64]int64, len(merged))
+	for _, it := range merged {
+		moved[it.oldOffset] = it.newOffset
+	}
+
+	for pk, items := range i.indexItems {
+		for n, item := range items {
+			if newOffset, ok := moved[item.Offset()]; ok {
+				items[n].offset = newOffset
+			}
+		}
+		i.indexItems[pk] = items
+	}
+
+	log.Infof("Merged data log, %d live items moved.", len(merged))
+	return i.Save()
+}
@@ -0,0 +1,333 @@
+package index
+
+import (
+	"encoding/csv"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CURRENT_FILE     string = "CURRENT"
+	MANIFEST_PREFIX  string = "MANIFEST-"
+	TABLE_SUFFIX     string = ".sst"
+	TEMP_SUFFIX      string = ".tmp"
+	EDIT_ADD_TABLE   string = "add_table"
+	EDIT_DEL_TABLE   string = "remove_table"
+	EDIT_NEXT_FILE   string = "next_file"
+	EDIT_LAST_SEQ    string = "last_sequence"
+	EDIT_VALUE_LOG   string = "value_log"
+	LEGACY_DATA_FILE string = "data_records.txt"
+)
+
+// Version is the set of live files of a store directory.
+type Version struct {
+	Tables             []uint64
+	NextFile           uint64
+	LastSequence       int64
+	ValueLogGeneration int
+}
+
+// VersionEdit is one atomic change to the version, recorded as a single
+// line of the MANIFEST.
+type VersionEdit struct {
+	AddTables          []uint64
+	RemoveTables       []uint64
+	NextFile           uint64
+	LastSequence       int64
+	ValueLogGeneration int
+}
+
+func (e VersionEdit) encode() []string {
+	fields := make([]string, 0, 8)
+	for _, num := range e.AddTables {
+		fields = append(fields, EDIT_ADD_TABLE, strconv.FormatUint(num, 10))
+	}
+
+	for _, num := range e.RemoveTables {
+		fields = append(fields, EDIT_DEL_TABLE, strconv.FormatUint(num, 10))
+	}
+
+	return append(fields, EDIT_NEXT_FILE, strconv.FormatUint(e.NextFile, 10),
+		EDIT_LAST_SEQ, strconv.FormatInt(e.LastSequence, 10),
+		EDIT_VALUE_LOG, strconv.Itoa(e.ValueLogGeneration))
+}
+
+func (v *Version) apply(record []string) error {
+	if len(record)%2 != 0 {
+		return fmt.Errorf("Version edit has an odd number of fields.")
+	}
+
+	edit := *v
+	live := make(map[uint64]bool)
+	for _, num := range v.Tables {
+		live[num] = true
+	}
+
+	for i := 0; i < len(record); i += 2 {
+		name, value := record[i], record[i+1]
+		switch name {
+		case EDIT_ADD_TABLE, EDIT_DEL_TABLE, EDIT_NEXT_FILE:
+			num, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return err
+			}
+
+			if name == EDIT_ADD_TABLE {
+				live[num] = true
+			} else if name == EDIT_DEL_TABLE {
+				delete(live, num)
+			} else {
+				edit.NextFile = num
+			}
+		case EDIT_LAST_SEQ:
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			edit.LastSequence = seq
+		case EDIT_VALUE_LOG:
+			gen, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			edit.ValueLogGeneration = gen
+		default:
+			return fmt.Errorf("Unknown version edit field %q.", name)
+		}
+	}
+
+	v.Tables = v.Tables[:0]
+	for num := range live {
+		v.Tables = append(v.Tables, num)
+	}
+	sort.Slice(v.Tables, func(i, j int) bool { return v.Tables[i] < v.Tables[j] })
+	v.NextFile = edit.NextFile
+	v.LastSequence = edit.LastSequence
+	v.ValueLogGeneration = edit.ValueLogGeneration
+	return nil
+}
+
+// Manifest records the version of a store directory as a log of edits. The
+// CURRENT file names the manifest in use.
+type Manifest struct {
+	dir     string
+	file    *os.File
+	version Version
+}
+
+func TablePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, TABLE_SUFFIX))
+}
+
+func manifestName(num uint64) string {
+	return fmt.Sprintf("%s%06d", MANIFEST_PREFIX, num)
+}
+
+// OpenManifest recovers the version of dir by replaying its manifest, then
+// starts a new manifest holding a snapshot of it and removes every file
+// that is not part of the version.
+func OpenManifest(dir string) (*Manifest, error) {
+	version, err := recoverVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{dir: dir, version: version}
+	num := m.NewFileNumber()
+	if err = m.create(num); err != nil {
+		return nil, err
+	}
+
+	m.removeObsoleteFiles(manifestName(num))
+	log.Infof("Opened %s with %d live tables.", manifestName(num), len(m.version.Tables))
+	return m, nil
+}
+
+func recoverVersion(dir string) (Version, error) {
+	version, problems, err := ReadVersion(dir)
+	if os.IsNotExist(err) {
+		return adoptLegacyTable(dir, Version{NextFile: 1})
+	}
+
+	for _, p := range problems {
+		log.Warnf("Ignoring %s", p)
+	}
+
+	return version, err
+}
+
+// ReadVersion replays the manifest CURRENT names without changing any file.
+// It returns an os.ErrNotExist error when dir has no CURRENT file. A torn
+// edit at the end of the manifest is left out and reported as a problem.
+func ReadVersion(dir string) (version Version, problems []Problem, err error) {
+	version = Version{NextFile: 1}
+	current, err := ioutil.ReadFile(filepath.Join(dir, CURRENT_FILE))
+	if err != nil {
+		return version, nil, err
+	}
+
+	name := strings.TrimSpace(string(current))
+	log.Infof("Replaying version edits from %s.", name)
+	path := filepath.Join(dir, name)
+	file, err := os.Open(path)
+	if err != nil {
+		return version, nil, fmt.Errorf("CURRENT names missing manifest %s: %v", name, err)
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	for {
+		offset := r.InputOffset()
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			problems = append(problems, Problem{path, offset,
+				fmt.Sprintf("torn edit at the end of the manifest: %v", err)})
+			break
+		}
+
+		if err = version.apply(record); err != nil {
+			return version, problems, fmt.Errorf("Corrupt edit in %s: %v", name, err)
+		}
+	}
+
+	return version, problems, nil
+}
+
+// adoptLegacyTable turns the single data file older stores used into the
+// first table of a new version.
+func adoptLegacyTable(dir string, version Version) (Version, error) {
+	legacy := filepath.Join(dir, LEGACY_DATA_FILE)
+	if _, err := os.Stat(legacy); err != nil {
+		return version, nil
+	}
+
+	if err := checkTableFormat(legacy); err != nil {
+		return version, err
+	}
+
+	num := version.NextFile
+	log.Infof("Adopting %s as table %d.", legacy, num)
+	if err := os.Rename(legacy, TablePath(dir, num)); err != nil {
+		return version, err
+	}
+
+	version.Tables = []uint64{num}
+	version.NextFile = num + 1
+	return version, nil
+}
+
+// create starts a new manifest with a snapshot of the version and points
+// CURRENT at it.
+func (m *Manifest) create(num uint64) error {
+	path := filepath.Join(m.dir, manifestName(num))
+	file, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	old := m.file
+	m.file = file
+	snapshot := VersionEdit{AddTables: m.version.Tables}
+	if err = m.LogEdit(snapshot); err != nil {
+		file.Close()
+		m.file = old
+		return err
+	}
+
+	tmpPath := filepath.Join(m.dir, CURRENT_FILE+TEMP_SUFFIX)
+	if err = ioutil.WriteFile(tmpPath, []byte(manifestName(num)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(m.dir, CURRENT_FILE)); err != nil {
+		return err
+	}
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+// removeObsoleteFiles deletes tables and manifests the version does not
+// reference, along with leftover temporary files.
+func (m *Manifest) removeObsoleteFiles(manifest string) {
+	live := make(map[string]bool)
+	for _, num := range m.version.Tables {
+		live[filepath.Base(TablePath(m.dir, num))] = true
+	}
+
+	entries, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		log.Errorf("Could not list %s: %v", m.dir, err)
+		return
+	}
+
+	for _, fi := range entries {
+		name := fi.Name()
+		obsolete := strings.HasSuffix(name, TEMP_SUFFIX) ||
+			(strings.HasSuffix(name, TABLE_SUFFIX) && !live[name]) ||
+			(strings.HasPrefix(name, MANIFEST_PREFIX) && name != manifest)
+		if obsolete {
+			log.Infof("Removing obsolete file %s.", name)
+			os.Remove(filepath.Join(m.dir, name))
+		}
+	}
+}
+
+func (m *Manifest) Version() Version {
+	v := m.version
+	v.Tables = append([]uint64(nil), m.version.Tables...)
+	return v
+}
+
+// NewFileNumber reserves a file number, it is persisted with the next edit.
+func (m *Manifest) NewFileNumber() uint64 {
+	num := m.version.NextFile
+	m.version.NextFile++
+	return num
+}
+
+// LogEdit appends the edit to the manifest and syncs it. Once it returns
+// the edit survives a crash.
+func (m *Manifest) LogEdit(edit VersionEdit) error {
+	edit.NextFile = m.version.NextFile
+	if edit.LastSequence < m.version.LastSequence {
+		edit.LastSequence = m.version.LastSequence
+	}
+
+	if edit.ValueLogGeneration < m.version.ValueLogGeneration {
+		edit.ValueLogGeneration = m.version.ValueLogGeneration
+	}
+
+	record := edit.encode()
+	w := csv.NewWriter(m.file)
+	w.Write(record)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+
+	return m.version.apply(record)
+}
+
+func (m *Manifest) Close() error {
+	return m.file.Close()
+}
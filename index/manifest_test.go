@@ -0,0 +1,119 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func touchFile(t *testing.T, path string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func currentManifest(t *testing.T, dir string) string {
+	t.Helper()
+	current, err := ioutil.ReadFile(filepath.Join(dir, CURRENT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(current))
+}
+
+// openTwoTables opens a manifest in dir that swapped a first table for a
+// second one at sequence 7.
+func openTwoTables(t *testing.T, dir string) (m *Manifest, live uint64) {
+	t.Helper()
+	m, err := OpenManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, live := m.NewFileNumber(), m.NewFileNumber()
+	touchFile(t, TablePath(dir, first))
+	touchFile(t, TablePath(dir, live))
+	if err = m.LogEdit(VersionEdit{AddTables: []uint64{first}, LastSequence: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := VersionEdit{AddTables: []uint64{live}, RemoveTables: []uint64{first},
+		LastSequence: 7, ValueLogGeneration: 2}
+	if err = m.LogEdit(edit); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, live
+}
+
+func checkReopened(t *testing.T, dir string, live uint64) {
+	t.Helper()
+	m, err := OpenManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	v := m.Version()
+	if !reflect.DeepEqual(v.Tables, []uint64{live}) || v.LastSequence != 7 ||
+		v.ValueLogGeneration != 2 {
+		t.Fatalf("reopened version is %+v", v)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Base(TablePath(dir, live)), CURRENT_FILE, currentManifest(t, dir)}
+	var got []string
+	for _, name := range names {
+		got = append(got, filepath.Base(name))
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("directory holds %v, want %v", got, want)
+	}
+}
+
+func TestManifestReopensAfterCrashBeforeCurrentIsRenamed(t *testing.T) {
+	dir := t.TempDir()
+	m, live := openTwoTables(t, dir)
+	m.Close()
+
+	// The next open wrote its manifest and the new CURRENT, but died
+	// before the rename. The old manifest is still the one in use.
+	stray := manifestName(m.Version().NextFile)
+	if err := ioutil.WriteFile(filepath.Join(dir, stray),
+		[]byte("add_table,1,next_file,9\nadd_ta"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := filepath.Join(dir, CURRENT_FILE+TEMP_SUFFIX)
+	if err := ioutil.WriteFile(tmp, []byte(stray+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReopened(t, dir, live)
+}
+
+func TestManifestReopensAfterCrashBeforeOldOneIsRemoved(t *testing.T) {
+	dir := t.TempDir()
+	m, live := openTwoTables(t, dir)
+	old := currentManifest(t, dir)
+	m.Close()
+
+	// A reopen that died after the rename leaves the old manifest behind.
+	checkReopened(t, dir, live)
+	touchFile(t, filepath.Join(dir, old))
+	checkReopened(t, dir, live)
+
+	if _, err := os.Stat(filepath.Join(dir, old)); !os.IsNotExist(err) {
+		t.Fatalf("old manifest %s is left behind: %v", old, err)
+	}
+}
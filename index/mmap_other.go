@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package index
+
+// openMmapReader falls back to plain file reads where mmap is not
+// supported.
+func openMmapReader(path string) (FileReader, error) {
+	return openFileReader(path)
+}
@@ -0,0 +1,62 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package index
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+type mmapReader struct {
+	data []byte
+}
+
+func (m *mmapReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (m *mmapReader) Size() int64 {
+	return int64(len(m.data))
+}
+
+func (m *mmapReader) Close() error {
+	return syscall.Munmap(m.data)
+}
+
+// openMmapReader maps the whole file read only. Empty files cannot be
+// mapped and are read through a plain file instead.
+func openMmapReader(path string) (FileReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		return openFileReader(path)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mmapReader{data}, nil
+}
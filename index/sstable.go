@@ -1,7 +1,10 @@
 package index
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/csv"
 	"fmt"
 	"github.com/elliotchance/orderedmap"
@@ -11,16 +14,85 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 const (
-	BlockSizeBytes int64  = 4000
-	KeySizeChar    int    = 8
-	GET_COMMAND    string = "get"
-	PUT_COMMAND    string = "put"
-	DEL_COMMAND    string = "del"
+	DEFAULT_BLOCK_SIZE_BYTES int64  = 4000
+	DEFAULT_BLOCK_CACHE_SIZE int    = 3 * int(DEFAULT_BLOCK_SIZE_BYTES)
+	MIN_BLOCK_SIZE_BYTES     int64  = 256
+	KeySizeChar              int    = 8
+	BlockRecordFields        int    = 5
+	INLINE_VALUE             string = "v"
+	VALUE_POINTER            string = "p"
+	GET_COMMAND              string = "get"
+	PUT_COMMAND              string = "put"
+	DEL_COMMAND              string = "del"
+	COMPRESSION_NONE         string = "none"
+	COMPRESSION_FLATE        string = "flate"
+	COMPRESSED_BLOCK         string = "z"
+
+	// TABLE_MAGIC starts the header line of a table, followed by the
+	// TABLE_FORMAT its blocks are written in. Format 1 blocks hold the size,
+	// hash and value of each item, format 2 adds the key and format 3 the
+	// item kind. Format 4 keeps the blocks of format 3 and may follow the
+	// header with a RANGE_TOMBSTONES line. Tables from before the header are
+	// told apart by their first block.
+	TABLE_MAGIC  string = "sstable"
+	TABLE_FORMAT int    = 4
+
+	// RANGE_TOMBSTONES starts the line of a table that lists the start and
+	// end of each of its range tombstones.
+	RANGE_TOMBSTONES string = "r"
+
+	// INTERNAL_KEY_PREFIX starts the keys a store keeps for itself, range
+	// tombstones never cover them.
+	INTERNAL_KEY_PREFIX string = "\x00"
 )
 
+// formatFields is the number of fields an item takes in each block format.
+var formatFields = map[int]int{1: 3, 2: 4, 3: BlockRecordFields, 4: BlockRecordFields}
+
+// RangeTombstone deletes the keys a scan between Start and End selects. The
+// tombstones of a table cover the items of the tables written before it,
+// the items of its own were merged with them already.
+type RangeTombstone struct {
+	Start string
+	End   string
+}
+
+func (t RangeTombstone) Covers(key string) bool {
+	return !strings.HasPrefix(key, INTERNAL_KEY_PREFIX) && InScanRange(key, t.Start, t.End)
+}
+
+// TableOptions tune how ss tables are written and read. Compression only
+// applies to tables written with it, readers detect compressed blocks.
+type TableOptions struct {
+	BlockSizeBytes int64
+	BlockCacheSize int
+	Compression    string
+}
+
+func DefaultTableOptions() TableOptions {
+	return TableOptions{DEFAULT_BLOCK_SIZE_BYTES, DEFAULT_BLOCK_CACHE_SIZE, COMPRESSION_NONE}
+}
+
+func (o TableOptions) Validate() error {
+	if o.BlockSizeBytes < MIN_BLOCK_SIZE_BYTES {
+		return fmt.Errorf("Block size has to be at least %d bytes.", MIN_BLOCK_SIZE_BYTES)
+	}
+
+	if o.BlockCacheSize <= 0 {
+		return fmt.Errorf("Block cache needs room for at least one block.")
+	}
+
+	if o.Compression != COMPRESSION_NONE && o.Compression != COMPRESSION_FLATE {
+		return fmt.Errorf("Unknown compression %q.", o.Compression)
+	}
+
+	return nil
+}
+
 type Command struct {
 	Type string
 	Item KeyValueItem
@@ -37,6 +109,7 @@ func keyHash(key string) string {
 type KeyValueItem struct {
 	key     string
 	keyHash string
+	kind    string
 	value   string
 	size    int64
 }
@@ -57,11 +130,59 @@ func (k *KeyValueItem) Size() int64 {
 	return k.size
 }
 
+func (k *KeyValueItem) Kind() string {
+	return k.kind
+}
+
+// IsPointer reports whether the value lives in a value log and this item
+// only holds a pointer to it.
+func (k *KeyValueItem) IsPointer() bool {
+	return k.kind == VALUE_POINTER
+}
+
+// Pointer decodes the value log pointer held by a pointer item.
+func (k *KeyValueItem) Pointer() (pointer ValuePointer, err error) {
+	if !k.IsPointer() {
+		return pointer, fmt.Errorf("Item for key %s is not a value pointer.", k.key)
+	}
+
+	return ParseValuePointer(k.value)
+}
+
 func NewKeyValueItem(key string, value string) KeyValueItem {
-	s := KeySizeChar + len([]byte(value))
+	s := KeySizeChar + len([]byte(key)) + len([]byte(value))
 	size := int64(s)
 	kh := keyHash(key)
-	return KeyValueItem{key, kh, value, size}
+	return KeyValueItem{key, kh, INLINE_VALUE, value, size}
+}
+
+// NewValuePointerItem creates an item whose value is stored in a value log
+// at the given pointer.
+func NewValuePointerItem(key string, pointer ValuePointer) KeyValueItem {
+	item := NewKeyValueItem(key, pointer.String())
+	item.kind = VALUE_POINTER
+	return item
+}
+
+// ValuePointer locates a value inside a generation of the value log.
+type ValuePointer struct {
+	Generation int
+	Offset     int64
+	Size       int64
+}
+
+func (p ValuePointer) String() string {
+	return fmt.Sprintf("%d:%d:%d", p.Generation, p.Offset, p.Size)
+}
+
+func ParseValuePointer(s string) (pointer ValuePointer, err error) {
+	_, err = fmt.Sscanf(s, "%d:%d:%d", &pointer.Generation, &pointer.Offset,
+		&pointer.Size)
+	if err != nil {
+		return pointer, fmt.Errorf("Invalid value pointer %q: %v", s, err)
+	}
+
+	return pointer, nil
 }
 
 type Block struct {
@@ -86,6 +207,19 @@ func (b *Block) Keys() []string {
 	return keys
 }
 
+func (b *Block) Items() []KeyValueItem {
+	items := make([]KeyValueItem, 0, b.items.Len())
+	for _, k := range b.items.Keys() {
+		v, _ := b.items.Get(k)
+		kv, ok := v.(KeyValueItem)
+		if ok {
+			items = append(items, kv)
+		}
+	}
+
+	return items
+}
+
 func (b *Block) GetH(key string) (value string, ok bool) {
 	hk := key
 	v, ok := b.items.Get(hk)
@@ -102,6 +236,15 @@ func (b *Block) GetH(key string) (value string, ok bool) {
 	return value, ok
 }
 
+func (b *Block) GetItem(key string) (item KeyValueItem, ok bool) {
+	v, ok := b.items.Get(keyHash(key))
+	if ok {
+		item, ok = v.(KeyValueItem)
+	}
+
+	return item, ok
+}
+
 func (b *Block) Get(key string) (value string, ok bool) {
 	hk := keyHash(key)
 	v, ok := b.items.Get(hk)
@@ -122,36 +265,178 @@ func (b *Block) Size() int64 {
 	return b.size
 }
 
-func NewBlock(blockKey string, items orderedmap.OrderedMap) Block {
-	return Block{blockKey, items, BlockSizeBytes}
+func NewBlock(blockKey string, items orderedmap.OrderedMap, size int64) Block {
+	return Block{blockKey, items, size}
 }
 
 type BlockStorage interface {
 	ReadBlock(key string) (block *Block, err error)
-	WriteKvItems(commands []Command) (BlockStorage, error)
-	RangeSearch(key1 string, key2 string) (values []string, err error)
+	GetItems(keys []string) (items map[string]KeyValueItem, err error)
+	WriteKvItems(commands []Command, tombstones []RangeTombstone, filePath string) (BlockStorage, error)
+	FilePath() string
+	RangeTombstones() []RangeTombstone
+	RangeSearch(key1 string, key2 string) (items []KeyValueItem, err error)
+	Items() (items []KeyValueItem, err error)
+	ItemsAfter(hash string) (items []KeyValueItem, err error)
 }
 
 type SsBlockStorage struct {
 	filePath   string
 	index      []string
-	blockCache lru.ARCCache
+	blockCache *lru.ARCCache
+	options    TableOptions
+	format     int
+	tombstones []RangeTombstone
 }
 
-func newSsBlockStorage(filepath string, index []string) BlockStorage {
-	cacheSize := 3 * BlockSizeBytes
+func newSsBlockStorage(filepath string, index []string, tombstones []RangeTombstone,
+	options TableOptions, format int) BlockStorage {
 	var cache *lru.ARCCache
-	cache, err := lru.NewARC(int(cacheSize))
+	cache, err := lru.NewARC(options.BlockCacheSize)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return &SsBlockStorage{filepath, index, *cache}
+	return &SsBlockStorage{filepath, index, cache, options, format, tombstones}
 }
 
+func isTableHeader(record []string) bool {
+	return len(record) == 2 && record[0] == TABLE_MAGIC
+}
+
+func isTombstoneRecord(record []string) bool {
+	return len(record)%2 == 1 && record[0] == RANGE_TOMBSTONES
+}
+
+func encodeTombstoneRecord(tombstones []RangeTombstone) []string {
+	record := make([]string, 0, 1+2*len(tombstones))
+	record = append(record, RANGE_TOMBSTONES)
+	for _, t := range tombstones {
+		record = append(record, t.Start, t.End)
+	}
+
+	return record
+}
+
+func decodeTombstoneRecord(record []string) (tombstones []RangeTombstone) {
+	for i := 1; i+1 < len(record); i += 2 {
+		tombstones = append(tombstones, RangeTombstone{record[i], record[i+1]})
+	}
+
+	return tombstones
+}
+
+// tableFormat returns the block format of a table given its first record,
+// the header or, for tables written before it, the first block.
+func tableFormat(path string, first []string) (format int, err error) {
+	if isTableHeader(first) {
+		format, err = strconv.Atoi(first[1])
+		if err != nil || formatFields[format] == 0 {
+			return 0, fmt.Errorf("Table %s has unknown format %q.", path, first[1])
+		}
+		return format, nil
+	}
+
+	fields, err := decodeBlockRecord(first)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, format = range []int{3, 2} {
+		if matchesFormat(fields, format) {
+			return format, nil
+		}
+	}
+
+	if len(fields)%formatFields[1] == 0 {
+		return 1, nil
+	}
+
+	return 0, fmt.Errorf("Table %s has blocks of an unknown format.", path)
+}
+
+// checkTableFormat reports a table whose blocks cannot be read.
+func checkTableFormat(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	first, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	format, err := tableFormat(path, first)
+	if err == nil {
+		_, err = upgradeBlockFields(path, nil, format)
+	}
+
+	return err
+}
+
+// matchesFormat checks the recorded hash of every item against the field
+// the key sits in for format.
+func matchesFormat(fields []string, format int) bool {
+	n := formatFields[format]
+	if len(fields) == 0 || len(fields)%n != 0 {
+		return false
+	}
+
+	for i := 0; i < len(fields); i += n {
+		if keyHash(fields[i+n-2]) != fields[i+1] {
+			return false
+		}
+
+		if format == 3 && fields[i+2] != INLINE_VALUE && fields[i+2] != VALUE_POINTER {
+			return false
+		}
+	}
+
+	return true
+}
+
+// upgradeBlockFields turns the item fields of a block in format into the
+// fields of the current format. Format 1 tables never recorded their keys,
+// they cannot be read.
+func upgradeBlockFields(path string, fields []string, format int) ([]string, error) {
+	switch format {
+	case TABLE_FORMAT, 3:
+		return fields, nil
+	case 2:
+		if len(fields)%formatFields[2] != 0 {
+			return nil, fmt.Errorf("Block has %d fields, expected a multiple of %d.",
+				len(fields), formatFields[2])
+		}
+
+		upgraded := make([]string, 0, len(fields)/4*BlockRecordFields)
+		for i := 0; i < len(fields); i += 4 {
+			upgraded = append(upgraded, fields[i], fields[i+1], INLINE_VALUE, fields[i+2],
+				fields[i+3])
+		}
+		return upgraded, nil
+	}
+
+	return nil, fmt.Errorf("Table %s is in format %d, which does not record keys. "+
+		"It cannot be read, load its data again from the source.", path, format)
+}
+
+// searchIndex returns the offset of the block that would hold key, the
+// first block for keys hashed before every block key.
 func searchIndex(index []string, key string) (offset int64) {
 	h := keyHash(key)
+	if len(index) >= 2 {
+		offset, _ = strconv.ParseInt(index[1], 10, 64)
+	}
+
 	for i, key := range index {
 		if i%2 == 0 && key > h {
 			break
@@ -166,65 +451,193 @@ func searchIndex(index []string, key string) (offset int64) {
 	return offset
 }
 
-func readBlock(filePath string, offset int64) (block *Block, err error) {
-	csvfile, err := os.Open(filePath)
+// decodeBlockRecord returns the item fields of a block line, inflating it
+// first when the block was written compressed.
+func decodeBlockRecord(record []string) ([]string, error) {
+	if len(record) != 2 || record[0] != COMPRESSED_BLOCK {
+		return record, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(record[1])
 	if err != nil {
-		log.Fatal("Could not open csvfile", err)
+		return nil, fmt.Errorf("Compressed block is not valid base64: %v", err)
 	}
 
-	defer csvfile.Close()
+	r := csv.NewReader(flate.NewReader(bytes.NewReader(data)))
+	return r.Read()
+}
+
+// encodeBlockRecord deflates the item fields of a block into a line of
+// its own when compression is on.
+func encodeBlockRecord(record []string, compression string) ([]string, error) {
+	if compression != COMPRESSION_FLATE {
+		return record, nil
+	}
 
-	_, err = csvfile.Seek(offset, 0)
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
 	if err != nil {
 		return nil, err
 	}
 
+	w := csv.NewWriter(fw)
+	w.Write(record)
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return nil, err
+	}
+
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+
+	return []string{COMPRESSED_BLOCK, base64.StdEncoding.EncodeToString(buf.Bytes())}, nil
+}
+
+func (s *SsBlockStorage) readBlock(offset int64) (block *Block, err error) {
+	filePath := s.filePath
+	csvfile, err := tables.Open(filePath)
+	if err != nil {
+		log.Fatal("Could not open csvfile", err)
+	}
+
+	defer tables.Release(csvfile)
+
+	if offset >= csvfile.Size() {
+		return nil, fmt.Errorf("Block offset %d is past the end of %s.", offset, filePath)
+	}
+
 	log.Info("Reading block line that holds index.")
-	r := csv.NewReader(csvfile)
+	r := csv.NewReader(io.NewSectionReader(csvfile, offset, csvfile.Size()-offset))
 	record, err := r.Read()
+	if err == nil {
+		record, err = decodeBlockRecord(record)
+	}
+
+	if err == nil {
+		record, err = upgradeBlockFields(filePath, record, s.format)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 	log.Info("Record is read from block offset.")
 
+	if len(record)%BlockRecordFields != 0 {
+		return nil, fmt.Errorf("Block at offset %d has %d fields, expected a multiple of %d.",
+			offset, len(record), BlockRecordFields)
+	}
+
 	var blockKey string
 	var om *orderedmap.OrderedMap = orderedmap.NewOrderedMap()
-	for i, _ := range record {
+	for i := 0; i < len(record); i += BlockRecordFields {
 		if i == 0 {
 			blockKey = record[i+1]
 		}
 
-		if i == 0 || i%3 == 0 {
-			size, err := strconv.ParseInt(record[i], 10, 64)
-			if err != nil {
-				return nil, err
-			}
-
-			key := record[i+1]
-			log.Infof("Reading in kv item %s", key)
-			value := record[i+2]
-			kv := KeyValueItem{"", key, value, size}
-			om.Set(key, kv)
+		key, value, size, err := decodeFields(record[i+3], record[i+4], record[i])
+		if err != nil {
+			return nil, fmt.Errorf("Block at offset %d of %s: %v", offset, filePath, err)
 		}
+
+		hash := record[i+1]
+		log.Infof("Reading in kv item %s", hash)
+		kind := record[i+2]
+		kv := KeyValueItem{key, hash, kind, value, size}
+		om.Set(hash, kv)
 	}
 
-	block = &Block{blockKey, *om, BlockSizeBytes}
+	block = &Block{blockKey, *om, s.options.BlockSizeBytes}
 	return block, nil
 }
 
 func (s *SsBlockStorage) ReadBlock(key string) (block *Block, err error) {
 	log.Infof("Reading block that contains key %s, hash is %s", key, keyHash(key))
+	if len(s.index) == 0 {
+		log.Info("Index is empty, returning empty block.")
+		empty := NewBlock("", *orderedmap.NewOrderedMap(), s.options.BlockSizeBytes)
+		return &empty, nil
+	}
+
 	offset := searchIndex(s.index, key)
 
 	log.Infof("Found block index is %d", offset)
+	return s.cachedBlock(offset)
+}
 
+// cachedBlock returns the block at offset from the block cache, reading
+// and caching it when it is not there.
+func (s *SsBlockStorage) cachedBlock(offset int64) (block *Block, err error) {
 	b, ok := s.blockCache.Get(offset)
 	if ok {
 		log.Info("Block found in block cache.")
 		block, _ = b.(*Block)
-		return block, err
+		return block, nil
 	}
-	return readBlock(s.filePath, offset)
+
+	block, err = s.readBlock(offset)
+	if err == nil {
+		s.blockCache.Add(offset, block)
+	}
+
+	return block, err
+}
+
+// GetItems looks up many keys at once. The keys are grouped by the block
+// that would hold them, so each block is read at most once. Keys that are
+// not stored are left out of items.
+func (s *SsBlockStorage) GetItems(keys []string) (items map[string]KeyValueItem, err error) {
+	items = make(map[string]KeyValueItem, len(keys))
+	if len(s.index) == 0 {
+		return items, nil
+	}
+
+	var offsets []int64
+	byBlock := make(map[int64][]string)
+	for _, key := range keys {
+		offset := searchIndex(s.index, key)
+		if _, seen := byBlock[offset]; !seen {
+			offsets = append(offsets, offset)
+		}
+		byBlock[offset] = append(byBlock[offset], key)
+	}
+
+	log.Infof("Looking up %d keys in %d blocks.", len(keys), len(offsets))
+	for _, offset := range offsets {
+		block, err := s.cachedBlock(offset)
+		if err != nil {
+			return items, err
+		}
+
+		for _, key := range byBlock[offset] {
+			if item, ok := block.GetItem(key); ok {
+				items[key] = item
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// KeyHash returns the hash tables order key by, scans select ranges of it.
+func KeyHash(key string) string {
+	return keyHash(key)
+}
+
+// InScanRange reports whether key is selected by a scan between key1 and
+// key2. Scans compare key hashes, the same way the ss table orders keys.
+func InScanRange(key string, key1 string, key2 string) bool {
+	return inHashRange(keyHash(key), key1, key2)
+}
+
+func inHashRange(hash string, key1 string, key2 string) bool {
+	h1 := keyHash(key1)
+	h2 := keyHash(key2)
+	if h2 > h1 {
+		h1, h2 = h2, h1
+	}
+
+	return hash >= h1 || hash <= h2
 }
 
 func searchIndexRange(index []string, key1 string, key2 string) (offsets []int64) {
@@ -236,13 +649,16 @@ func searchIndexRange(index []string, key1 string, key2 string) (offsets []int64
 		h2 = tmp
 	}
 
+	// A block holds the hashes from its block key up to the key of the
+	// next block, it is read when that span reaches into the range.
 	var offset int64
 	for i, key := range index {
 		if i%2 != 0 {
 			continue
 		}
 
-		if key >= h1 || key <= h2 {
+		last := i+2 >= len(index)
+		if key <= h2 || last || index[i+2] > h1 {
 			offI := i + 1
 			offset, _ = strconv.ParseInt(index[offI], 10, 64)
 			offsets = append(offsets, offset)
@@ -252,54 +668,92 @@ func searchIndexRange(index []string, key1 string, key2 string) (offsets []int64
 	return offsets
 
 }
-func (s *SsBlockStorage) RangeSearch(key1 string, key2 string) (values []string, err error) {
+func (s *SsBlockStorage) RangeSearch(key1 string, key2 string) (items []KeyValueItem, err error) {
 	log.Infof("Searching index for blocks that contain keys between %s and %s.", key1, key2)
 	offsets := searchIndexRange(s.index, key1, key2)
 	log.Infof("Found %d blocks that contain keys between %s and %s", len(offsets), key1, key2)
 	for _, offs := range offsets {
 		log.Infof("Reading in block.")
-		block, err := readBlock(s.filePath, offs)
+		block, err := s.readBlock(offs)
 		if err != nil {
-			return values, err
+			return items, err
+		}
+
+		log.Infof("Checking if key from read blocks falls inclusively between keys %s and %s", key1, key2)
+		for _, it := range block.Items() {
+			if inHashRange(it.KeyHash(), key1, key2) {
+				log.Infof("Scan value is %s", it.Value())
+
+				items = append(items, it)
+			}
 		}
+		log.Infof("Checked keys inbetween %s and %s, current list of values is %d", key1, key2, len(items))
+	}
+
+	return items, nil
+}
 
-		h1 := keyHash(key1)
-		h2 := keyHash(key2)
-		if h2 > h1 {
-			log.Info("Keys hash cause out of order search, adjusting.")
-			tmp := h1
-			h1 = h2
-			h2 = tmp
+func (s *SsBlockStorage) Items() (items []KeyValueItem, err error) {
+	log.Infof("Reading all key value items from %s.", s.filePath)
+	for _, offset := range getIndexOffsets(s.index) {
+		block, err := s.readBlock(offset)
+		if err != nil {
+			return items, err
 		}
 
-		log.Infof("Checking if key from read blocks falls inclusively between keys %s and %s", key1, key2)
-		for _, key := range block.Keys() {
-			if key >= h1 || key <= h2 {
-				value, _ := block.GetH(key)
-				log.Infof("Scan value is %s", value)
+		items = append(items, block.Items()...)
+	}
+
+	return items, nil
+}
 
-				values = append(values, value)
+// ItemsAfter returns the items of the first block holding key hashes
+// greater than hash, those hashes only, so a table is read a block at a
+// time by passing the last hash returned. Following blocks starting with
+// the last hash are read too, a hash is never split between calls. No
+// items means no hash follows.
+func (s *SsBlockStorage) ItemsAfter(hash string) (items []KeyValueItem, err error) {
+	for i := 0; i+1 < len(s.index); i += 2 {
+		if len(items) > 0 {
+			if s.index[i] > items[len(items)-1].KeyHash() {
+				break
+			}
+		} else if i+2 < len(s.index) && s.index[i+2] <= hash {
+			continue
+		}
+
+		offset, _ := strconv.ParseInt(s.index[i+1], 10, 64)
+		block, err := s.readBlock(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, it := range block.Items() {
+			if it.KeyHash() > hash {
+				items = append(items, it)
 			}
 		}
-		log.Infof("Checked keys inbetween %s and %s, current list of values is %d", key1, key2, len(values))
 	}
 
-	return values, nil
+	sortKeyValueItemsByHash(items)
+	return items, nil
 }
 
-func loadIndex(filePath string) []string {
+func loadIndex(filePath string) ([]string, []RangeTombstone, int, error) {
 	log.Infof("Loading index from %s", filePath)
 	ind := make([]string, 0, 0)
-	csvfile, err := os.Open(filePath)
+	csvfile, err := tables.Open(filePath)
 	if err != nil {
 		log.Fatal("Could not open csvfile", err)
 	}
-	defer csvfile.Close()
+	defer tables.Release(csvfile)
 	log.Info("Reading second line that holds index.")
-	r := csv.NewReader(csvfile)
+	r := csv.NewReader(io.NewSectionReader(csvfile, 0, csvfile.Size()))
 	r.FieldsPerRecord = -1
 	var rec []string
-	for {
+	var tombstones []RangeTombstone
+	format := TABLE_FORMAT
+	for n := 0; ; n++ {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
@@ -308,9 +762,32 @@ func loadIndex(filePath string) []string {
 			log.Fatal(err)
 		}
 
+		if n == 0 {
+			if format, err = tableFormat(filePath, record); err != nil {
+				return nil, nil, 0, err
+			}
+
+			if _, err = upgradeBlockFields(filePath, nil, format); err != nil {
+				return nil, nil, 0, err
+			}
+
+			if isTableHeader(record) {
+				continue
+			}
+		}
+
+		if n == 1 && format >= 4 && isTombstoneRecord(record) {
+			tombstones = decodeTombstoneRecord(record)
+			continue
+		}
+
 		rec = record
 	}
 
+	if len(rec) > 0 && !isIndexRecord(rec) {
+		return nil, nil, 0, fmt.Errorf("Table %s has no index line.", filePath)
+	}
+
 	log.Info("Second line retrieved, parsing index.")
 	for i, key := range rec {
 		if i%2 == 0 {
@@ -323,24 +800,26 @@ func loadIndex(filePath string) []string {
 	}
 
 	log.Info("Index is loaded.")
-	return ind
+	return ind, tombstones, format, nil
 }
 
-func NewSsBlockStorage(filePath string) BlockStorage {
+// NewSsBlockStorage opens the table at filePath, an empty filePath gives an
+// empty storage.
+func NewSsBlockStorage(filePath string, options TableOptions) (BlockStorage, error) {
 	ind := make([]string, 0, 0)
+	var tombstones []RangeTombstone
+	format := TABLE_FORMAT
 	_, err := os.Stat(filePath)
-	if err == nil {
+	if filePath != "" && err == nil {
 		log.Info("Existing data file detected loading in index.")
-		ind = loadIndex(filePath)
+		if ind, tombstones, format, err = loadIndex(filePath); err != nil {
+			return nil, err
+		}
 	} else {
 		log.Info("No data file detected using empty index.")
 	}
 
-	cacheSize := 3 * BlockSizeBytes
-	var cache *lru.ARCCache
-	cache, _ = lru.NewARC(int(cacheSize))
-
-	return &SsBlockStorage{filePath, ind, *cache}
+	return newSsBlockStorage(filePath, ind, tombstones, options, format), nil
 }
 
 type By func(i1, i2 *KeyValueItem) bool
@@ -388,19 +867,20 @@ func keyValueItemsOrderedMap(items []KeyValueItem) *orderedmap.OrderedMap {
 	return m
 }
 
-// items are assumed ordered
-func createBlock(items []KeyValueItem, startingIndex int) (block Block, nextIndex int) {
+// items are assumed ordered, a block always holds at least one item even
+// when it alone is larger than blockSize.
+func createBlock(items []KeyValueItem, startingIndex int, blockSize int64) (block Block, nextIndex int) {
 	var currentSizeBytes int64 = 0
 	endIndex := startingIndex
 	log.Infof("Calculating indexes from items of length %d, to create block.", len(items))
 	first := true
 
 	// minus one is for newline
-	for endIndex < len(items) && currentSizeBytes+items[endIndex].Size() <= BlockSizeBytes-1 {
+	for endIndex < len(items) && (first || currentSizeBytes+items[endIndex].Size() <= blockSize-1) {
 		it := items[endIndex]
-		meta := 3
+		meta := BlockRecordFields
 		if first {
-			meta = 2
+			meta = BlockRecordFields - 1
 			first = false
 		}
 
@@ -412,7 +892,7 @@ func createBlock(items []KeyValueItem, startingIndex int) (block Block, nextInde
 	log.Info("Creating ordered map for block.")
 	m := keyValueItemsOrderedMap(items[startingIndex:endIndex])
 	log.Info("Created ordered map for block.")
-	block = NewBlock(items[startingIndex].keyHash, *m)
+	block = NewBlock(items[startingIndex].keyHash, *m, blockSize)
 	nextIndex = endIndex
 
 	return block, endIndex
@@ -430,7 +910,7 @@ func getLastIndex(filepath string) (offset int64, err error) {
 	return offset, err
 }
 
-func writeBlock(filepath string, block Block) (offset int64, err error) {
+func writeBlock(filepath string, block Block, compression string) (offset int64, err error) {
 	offset, err = getLastIndex(filepath)
 	if err != nil {
 		return -1, err
@@ -442,34 +922,51 @@ func writeBlock(filepath string, block Block) (offset int64, err error) {
 	}
 	defer f.Close()
 
-	firstRecord := true
-	for _, k := range block.Keys() {
-		i, _ := block.items.Get(k)
-		it, _ := i.(KeyValueItem)
+	record := make([]string, 0, BlockRecordFields*block.items.Len())
+	for _, it := range block.Items() {
+		key, value, size := encodeFields(it.Key(), it.Value(), it.Size())
+		record = append(record, size, it.KeyHash(), it.Kind(), key, value)
+	}
 
-		var s string
-		if firstRecord {
-			s = fmt.Sprintf("%d,%s,%s", it.Size(), it.KeyHash(), it.Value())
-			firstRecord = false
-		} else {
-			s = fmt.Sprintf(",%d,%s,%s", it.Size(), it.KeyHash(), it.Value())
-		}
-		_, werr := f.WriteString(s)
-		if werr != nil {
-			return -1, werr
-		}
+	record, err = encodeBlockRecord(record, compression)
+	if err != nil {
+		return -1, err
 	}
 
-	_, werr := f.WriteString("\n")
+	w := csv.NewWriter(f)
+	werr := w.Write(record)
 	if werr != nil {
 		return -1, werr
 	}
 
+	w.Flush()
+	if werr = w.Error(); werr != nil {
+		return -1, werr
+	}
+
 	return offset, nil
 }
 
+// writeTableHeader starts a table with its format line, followed by the
+// range tombstones when there are any.
+func writeTableHeader(filepath string, tombstones []RangeTombstone) error {
+	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{TABLE_MAGIC, strconv.Itoa(TABLE_FORMAT)})
+	if len(tombstones) > 0 {
+		w.Write(encodeTombstoneRecord(tombstones))
+	}
+	w.Flush()
+	return w.Error()
+}
+
 func writeIndex(filepath string, index []string) error {
-	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -488,8 +985,11 @@ func writeIndex(filepath string, index []string) error {
 	}
 
 	_, err = f.WriteString(indexString)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return f.Sync()
 }
 
 func getIndexOffsets(index []string) (offsets []int64) {
@@ -504,7 +1004,8 @@ func getIndexOffsets(index []string) (offsets []int64) {
 	return offsets
 }
 
-func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
+func collectItemsToWrite(s *SsBlockStorage, commands []Command,
+	tombstones []RangeTombstone) []KeyValueItem {
 	log.Info("Collecting items to write to new sstable.")
 	var items []KeyValueItem
 	itemMap := make(map[string]KeyValueItem)
@@ -513,7 +1014,7 @@ func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
 	log.Info("reading blocks for collection")
 	var blocks []Block
 	for _, offset := range offsets {
-		block, err := readBlock(s.filePath, offset)
+		block, err := s.readBlock(offset)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -525,13 +1026,10 @@ func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
 
 	log.Info("Collecting key value items from blocks.")
 	for _, block := range blocks {
-		for _, k := range block.Keys() {
-			key := k
-			value, _ := block.GetH(key)
-			it := NewKeyValueItem(key, value)
-			it.keyHash = key
-			it.key = ""
-			itemMap[key] = it
+		for _, it := range block.Items() {
+			if !coveredBy(tombstones, it.Key()) {
+				itemMap[it.KeyHash()] = it
+			}
 		}
 	}
 
@@ -557,23 +1055,43 @@ func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
 	return items
 }
 
-func (s *SsBlockStorage) WriteKvItems(commands []Command) (BlockStorage, error) {
+func coveredBy(tombstones []RangeTombstone, key string) bool {
+	for _, t := range tombstones {
+		if t.Covers(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteKvItems merges the commands into the items of this table and writes
+// the result as a new table at filePath, leaving this table untouched. The
+// tombstones drop the items of this table they cover and are recorded in
+// the new table, the commands are newer than them.
+func (s *SsBlockStorage) WriteKvItems(commands []Command, tombstones []RangeTombstone,
+	filePath string) (BlockStorage, error) {
 	log.Info("Sorting key value items for write.")
 
-	items := collectItemsToWrite(*s, commands)
+	items := collectItemsToWrite(s, commands, tombstones)
 	sortKeyValueItemsByHash(items)
 	log.Info("Key value items sorted for write.")
 	startingIndex := 0
 
-	log.Info("Removing old sstable file if exists.")
-	tmpFilePath := "./temp_data.txt"
+	log.Infof("Removing leftover sstable file %s if exists.", filePath)
+	tables.Evict(filePath)
+	os.Remove(filePath)
+
+	if err := writeTableHeader(filePath, tombstones); err != nil {
+		return nil, err
+	}
 
 	index := make([]string, 0, 5000)
 	for startingIndex < len(items) {
-		block, nextIndex := createBlock(items, startingIndex)
+		block, nextIndex := createBlock(items, startingIndex, s.options.BlockSizeBytes)
 		startingIndex = nextIndex
 		log.Infof("Created block %s, next index of items are %d", block.BlockKey(), startingIndex)
-		off, err := writeBlock(tmpFilePath, block)
+		off, err := writeBlock(filePath, block, s.options.Compression)
 		index = append(index, block.BlockKey())
 		index = append(index, fmt.Sprintf("%d", off))
 		if err != nil {
@@ -584,20 +1102,30 @@ func (s *SsBlockStorage) WriteKvItems(commands []Command) (BlockStorage, error)
 		log.Infof("Block %s is written", block.BlockKey())
 	}
 
-	err := writeIndex(tmpFilePath, index)
-	if err != nil {
-		log.Errorf("Unable to write index to file %s.", s.filePath)
-		return nil, err
-	}
-
-	log.Info("Swapping old data file with new one.")
-	err = os.Rename(tmpFilePath, s.filePath)
+	err := writeIndex(filePath, index)
 	if err != nil {
-		log.Fatal("Could not swap data files.")
+		log.Errorf("Unable to write index to file %s.", filePath)
 		return nil, err
 	}
 
 	log.Info("Index written to file. Creating new Block storage to return.")
-	var storage BlockStorage = newSsBlockStorage(s.filePath, index)
+	var storage BlockStorage = newSsBlockStorage(filePath, index, tombstones, s.options,
+		TABLE_FORMAT)
 	return storage, nil
 }
+
+// FilePath is the table file this storage reads from.
+func (s *SsBlockStorage) FilePath() string {
+	return s.filePath
+}
+
+// RangeTombstones are the range tombstones recorded in the table.
+func (s *SsBlockStorage) RangeTombstones() []RangeTombstone {
+	return s.tombstones
+}
+
+// RemoveTable closes the cached handle of a replaced table and deletes it.
+func RemoveTable(filePath string) error {
+	tables.Evict(filePath)
+	return os.Remove(filePath)
+}
@@ -0,0 +1,207 @@
+package index
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestCreateBlockTakesOversizedItem(t *testing.T) {
+	items := []KeyValueItem{NewKeyValueItem("big", strings.Repeat("x", 5000)),
+		NewKeyValueItem("small", "y")}
+	sortKeyValueItemsByHash(items)
+
+	var blocks int
+	for next := 0; next < len(items); blocks++ {
+		if blocks > len(items) {
+			t.Fatal("createBlock does not advance past an oversized item")
+		}
+		_, next = createBlock(items, next, MIN_BLOCK_SIZE_BYTES)
+	}
+
+	if blocks != 2 {
+		t.Fatalf("got %d blocks, want 2", blocks)
+	}
+}
+
+// writeLegacyTable writes one block of items in the given field layout
+// followed by the index line, without a header.
+func writeLegacyTable(t *testing.T, path string, items [][]string) {
+	var block []string
+	for _, fields := range items {
+		block = append(block, fields...)
+	}
+
+	data := strings.Join(block, ",") + "\n" + keyHash("a") + ",0"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadsFormatTwoTables(t *testing.T) {
+	path := t.TempDir() + "/000001.sst"
+	writeLegacyTable(t, path, [][]string{{"10", keyHash("a"), "a", "1"},
+		{"10", keyHash("b"), "b", "2"}})
+
+	storage, err := NewSsBlockStorage(path, DefaultTableOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := storage.ReadBlock("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item, ok := block.GetItem("b"); !ok || item.Value() != "2" || item.Kind() != INLINE_VALUE {
+		t.Fatalf("got %+v, %v", item, ok)
+	}
+
+	rewritten, err := storage.WriteKvItems(nil, nil, t.TempDir()+"/000002.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(rewritten.FilePath())
+	if !strings.HasPrefix(string(data), "sstable,4\n") {
+		t.Fatalf("rewritten table starts with %q", data[:12])
+	}
+
+	items, _, problems, err := ScanTable(rewritten.FilePath())
+	if err != nil || len(problems) != 0 || len(items) != 2 {
+		t.Fatalf("scan found %d items, %v, %v", len(items), problems, err)
+	}
+}
+
+func TestRejectsFormatOneTables(t *testing.T) {
+	path := t.TempDir() + "/data_records.txt"
+	writeLegacyTable(t, path, [][]string{{"9", keyHash("a"), "1"}})
+
+	if _, err := NewSsBlockStorage(path, DefaultTableOptions()); err == nil ||
+		!strings.Contains(err.Error(), "format 1") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func putCommands(pairs ...string) (commands []Command) {
+	for i := 0; i < len(pairs); i += 2 {
+		commands = append(commands, Command{PUT_COMMAND, NewKeyValueItem(pairs[i], pairs[i+1])})
+	}
+
+	return commands
+}
+
+func TestTableRecordsRangeTombstones(t *testing.T) {
+	dir := t.TempDir()
+	empty, _ := NewSsBlockStorage("", DefaultTableOptions())
+	first, err := empty.WriteKvItems(putCommands("a", "1", "b", "2", "\x00internal", "3"), nil,
+		dir+"/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tombstone over every hash drops the old items, but not the internal
+	// key or the items written with it.
+	all := RangeTombstone{"a", "a"}
+	if !all.Covers("a") || !all.Covers("b") || all.Covers("\x00internal") {
+		t.Fatal("tombstone covers the wrong keys")
+	}
+
+	second, err := first.WriteKvItems(putCommands("c", "4"), []RangeTombstone{all},
+		dir+"/000002.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewSsBlockStorage(second.FilePath(), DefaultTableOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := reopened.RangeTombstones(); len(got) != 1 || got[0] != all {
+		t.Fatalf("reopened table has tombstones %v", got)
+	}
+
+	items, tombstones, problems, err := ScanTable(second.FilePath())
+	if err != nil || len(problems) != 0 || len(tombstones) != 1 {
+		t.Fatalf("scan found %v, %v, %v", tombstones, problems, err)
+	}
+
+	keys := make(map[string]bool)
+	for _, it := range items {
+		keys[it.Key()] = true
+	}
+
+	if len(keys) != 2 || !keys["c"] || !keys["\x00internal"] {
+		t.Fatalf("table holds %v", keys)
+	}
+
+	// A table left without blocks still reads back.
+	third, err := second.WriteKvItems([]Command{{DEL_COMMAND, NewKeyValueItem("c", "")},
+		{DEL_COMMAND, NewKeyValueItem("\x00internal", "")}}, []RangeTombstone{all},
+		dir+"/000003.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewSsBlockStorage(third.FilePath(), DefaultTableOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, _, problems, err = ScanTable(third.FilePath()); err != nil ||
+		len(problems) != 0 || len(items) != 0 {
+		t.Fatalf("scan found %d items, %v, %v", len(items), problems, err)
+	}
+}
+
+func TestItemsAfterPagesThroughBlocks(t *testing.T) {
+	var pairs []string
+	for i := 0; i < 200; i++ {
+		pairs = append(pairs, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	options := DefaultTableOptions()
+	options.BlockSizeBytes = MIN_BLOCK_SIZE_BYTES
+	empty, _ := NewSsBlockStorage("", options)
+	if items, err := empty.ItemsAfter(""); err != nil || len(items) != 0 {
+		t.Fatalf("empty table returned %d items, %v", len(items), err)
+	}
+
+	table, err := empty.WriteKvItems(putCommands(pairs...), nil, t.TempDir()+"/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	var pages int
+	for hash := ""; ; pages++ {
+		items, err := table.ItemsAfter(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) == 0 {
+			break
+		}
+
+		for _, it := range items {
+			if it.KeyHash() <= hash || seen[it.Key()] {
+				t.Fatalf("page after %s returned %s again", hash, it.Key())
+			}
+			seen[it.Key()] = true
+		}
+		hash = items[len(items)-1].KeyHash()
+	}
+
+	if len(seen) != 200 || pages < 10 {
+		t.Fatalf("read %d items in %d pages", len(seen), pages)
+	}
+}
@@ -0,0 +1,167 @@
+package index
+
+import (
+	"errors"
+	"github.com/hashicorp/golang-lru/simplelru"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_OPEN_FILES int = 64
+)
+
+// FileReader gives random access to an immutable file.
+type FileReader interface {
+	io.ReaderAt
+	Size() int64
+	Close() error
+}
+
+type fileReader struct {
+	file *os.File
+	size int64
+}
+
+func (f *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.file.ReadAt(p, off)
+}
+
+func (f *fileReader) Size() int64 {
+	return f.size
+}
+
+func (f *fileReader) Close() error {
+	return f.file.Close()
+}
+
+func openFileReader(path string) (FileReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileReader{file, fi.Size()}, nil
+}
+
+// TableHandle is an open file borrowed from a TableCache, it has to be
+// released once the read is done.
+type TableHandle struct {
+	FileReader
+	path    string
+	refs    int
+	evicted bool
+}
+
+// TableCache keeps ss table and sealed data log files open between reads,
+// closing the least recently used ones once more than maxOpenFiles are
+// open. Files are expected not to change while cached, writers replacing
+// a file have to Evict it.
+type TableCache struct {
+	mutex   sync.Mutex
+	handles *simplelru.LRU
+	useMmap bool
+}
+
+func NewTableCache(maxOpenFiles int, useMmap bool) (*TableCache, error) {
+	if maxOpenFiles <= 0 {
+		return nil, errors.New("Table cache needs room for at least one open file.")
+	}
+
+	c := &TableCache{useMmap: useMmap}
+	handles, err := simplelru.NewLRU(maxOpenFiles, c.onEvict)
+	if err != nil {
+		return nil, err
+	}
+
+	c.handles = handles
+	return c, nil
+}
+
+var tables, _ = NewTableCache(DEFAULT_MAX_OPEN_FILES, false)
+
+// ConfigureTableCache replaces the process wide table cache every ss table
+// and data log reads through.
+func ConfigureTableCache(maxOpenFiles int, useMmap bool) error {
+	c, err := NewTableCache(maxOpenFiles, useMmap)
+	if err != nil {
+		return err
+	}
+
+	old := tables
+	tables = c
+	old.Purge()
+	log.Infof("Table cache keeps up to %d open files, mmap is %t.", maxOpenFiles, useMmap)
+	return nil
+}
+
+// onEvict is called with the cache mutex held.
+func (c *TableCache) onEvict(key interface{}, value interface{}) {
+	h := value.(*TableHandle)
+	h.evicted = true
+	if h.refs == 0 {
+		log.Infof("Closing table file %s.", h.path)
+		h.Close()
+	}
+}
+
+func (c *TableCache) Open(path string) (*TableHandle, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if v, ok := c.handles.Get(path); ok {
+		h := v.(*TableHandle)
+		h.refs++
+		return h, nil
+	}
+
+	var reader FileReader
+	var err error
+	if c.useMmap {
+		reader, err = openMmapReader(path)
+	} else {
+		reader, err = openFileReader(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Opened table file %s.", path)
+	h := &TableHandle{reader, path, 1, false}
+	c.handles.Add(path, h)
+	return h, nil
+}
+
+func (c *TableCache) Release(h *TableHandle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	h.refs--
+	if h.refs == 0 && h.evicted {
+		log.Infof("Closing table file %s.", h.path)
+		h.Close()
+	}
+}
+
+// Evict closes the cached handle of a file that is about to be replaced
+// or removed.
+func (c *TableCache) Evict(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handles.Remove(path)
+}
+
+func (c *TableCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handles.Purge()
+}
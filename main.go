@@ -2,14 +2,73 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/shimanekb/project2-A/controller"
+	"github.com/shimanekb/project2-A/index"
+	"github.com/shimanekb/project2-A/server"
+	"github.com/shimanekb/project2-A/store"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 func main() {
+	defaults := store.DefaultOptions()
 	var logFlag *bool = flag.Bool("logs", false, "Enable logs")
+	var engineFlag *string = flag.String("engine", store.SS_ENGINE,
+		"Storage engine, sstable, hash or sharded")
+	var dirFlag *string = flag.String("dir", defaults.Dir,
+		"Directory the store keeps its files in")
+	var blockSizeFlag *int64 = flag.Int64("block-size", defaults.BlockSizeBytes,
+		"Size in bytes ss table blocks are cut at")
+	var blockCacheFlag *int = flag.Int("block-cache", defaults.BlockCacheSize,
+		"Number of decoded blocks each ss table keeps cached")
+	var compressionFlag *string = flag.String("compression", defaults.Compression,
+		"Ss table block compression, none or flate")
+	var memtableEntriesFlag *int = flag.Int("memtable-entries", defaults.MemtableEntries,
+		"Number of keys the memtable holds before it is flushed")
+	var memtableBytesFlag *int64 = flag.Int64("memtable-bytes", defaults.MemtableBytes,
+		"Bytes of keys and values the memtable holds before it is flushed")
+	var readCacheFlag *int = flag.Int("read-cache", defaults.ReadCacheSize,
+		"Number of values the sstable engine caches for gets, 0 turns it off")
+	var segmentSizeFlag *int64 = flag.Int64("segment-size", defaults.SegmentSizeBytes,
+		"Size in bytes the hash engine data log rolls over at, 0 keeps one file")
+	var mergeFlag *time.Duration = flag.Duration("merge-interval", 0,
+		"Merge the hash engine data log in the background at this interval")
+	var syncFlag *string = flag.String("sync", defaults.SyncPolicy.Mode,
+		"Data log sync policy, always, interval or none")
+	var syncIntervalFlag *time.Duration = flag.Duration("sync-interval",
+		defaults.SyncPolicy.Interval, "Time between data log syncs for the interval sync policy")
+	var maxOpenFilesFlag *int = flag.Int("max-open-files", index.DEFAULT_MAX_OPEN_FILES,
+		"Number of ss table and data log files kept open")
+	var mmapFlag *bool = flag.Bool("mmap", false,
+		"Read ss tables and sealed data log segments through mmap")
+	var formatFlag *string = flag.String("format", controller.FORMAT_AUTO,
+		"Input and output format, csv, json or auto to go by the input file extension")
+	var strictFlag *bool = flag.Bool("strict", false,
+		"Report bad input rows with their line numbers and exit 1 instead of writing error rows")
+	var unorderedFlag *bool = flag.Bool("unordered", false,
+		"Have verify compare scan values without regard to their order")
+	var respAddrFlag *string = flag.String("resp-addr", server.DEFAULT_RESP_ADDR,
+		"Address serve listens on for the Redis protocol")
+	var httpAddrFlag *string = flag.String("http-addr", "",
+		"Address serve listens on for the http api, e.g. "+server.DEFAULT_HTTP_ADDR)
+	var memcachedAddrFlag *string = flag.String("memcached-addr", "",
+		"Address serve listens on for the memcached protocol, e.g. "+
+			server.DEFAULT_MEMCACHED_ADDR)
+	var followFlag *string = flag.String("follow", "",
+		"Http address of a leader for serve to follow as a read only replica")
+	var shardsFlag *int = flag.Int("shards", defaults.Shards,
+		"Shards a new sharded store is split into, or the count rebalance moves to")
+	var walRecordsFlag *int = flag.Int("wal-records", defaults.WalRecords,
+		"Write-ahead log records a flush rotates the log at, it keeps up to twice as many")
+	var raftIdFlag *string = flag.String("raft-id", "",
+		"Id serve runs under as a member of a raft cluster")
+	var raftAddrFlag *string = flag.String("raft-addr", "",
+		"Address the raft member listens on for the other members")
+	var raftPeersFlag *string = flag.String("raft-peers", "",
+		"Initial raft members as id=host:port,..., empty to join a running cluster")
 	flag.Parse()
 
 	if *logFlag {
@@ -20,12 +79,131 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	options := store.Options{
+		Dir:              *dirFlag,
+		BlockSizeBytes:   *blockSizeFlag,
+		BlockCacheSize:   *blockCacheFlag,
+		Compression:      *compressionFlag,
+		MemtableEntries:  *memtableEntriesFlag,
+		MemtableBytes:    *memtableBytesFlag,
+		ReadCacheSize:    *readCacheFlag,
+		SegmentSizeBytes: *segmentSizeFlag,
+		SyncPolicy:       index.SyncPolicy{Mode: *syncFlag, Interval: *syncIntervalFlag},
+		MergeInterval:    *mergeFlag,
+		Shards:           *shardsFlag,
+		WalRecords:       *walRecordsFlag,
+	}
+
+	if err := options.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	args := flag.Args()
+	switch flag.Arg(0) {
+	case controller.CHECK_COMMAND:
+		dir := options.Dir
+		if flag.NArg() > 1 {
+			dir = flag.Arg(1)
+		}
+
+		ok, err := controller.CheckStore(dir, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case controller.REPL_COMMAND:
+		if flag.NArg() > 1 {
+			options.Dir = flag.Arg(1)
+		}
+
+		if err := index.ConfigureTableCache(*maxOpenFilesFlag, *mmapFlag); err != nil {
+			log.Fatalln(err)
+		}
+
+		if err := controller.RunRepl(*engineFlag, options); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case controller.VERIFY_COMMAND:
+		if flag.NArg() < 3 {
+			log.Fatalln("Verify needs an input file and an expected output file.")
+		}
+
+		ok, err := controller.VerifyCommands(flag.Arg(1), flag.Arg(2), *formatFlag,
+			*engineFlag, options, *unorderedFlag, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case controller.SERVE_COMMAND:
+		if flag.NArg() > 1 {
+			options.Dir = flag.Arg(1)
+		}
+
+		if err := index.ConfigureTableCache(*maxOpenFilesFlag, *mmapFlag); err != nil {
+			log.Fatalln(err)
+		}
+
+		config := server.Config{RespAddr: *respAddrFlag, HttpAddr: *httpAddrFlag,
+			MemcachedAddr: *memcachedAddrFlag, Follow: *followFlag}
+		cluster := controller.ClusterConfig{ID: *raftIdFlag, Addr: *raftAddrFlag,
+			Peers: *raftPeersFlag}
+		if err := controller.RunServer(*engineFlag, options, config, cluster); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case controller.REBALANCE_COMMAND:
+		if flag.NArg() > 1 {
+			options.Dir = flag.Arg(1)
+		}
+
+		if err := index.ConfigureTableCache(*maxOpenFilesFlag, *mmapFlag); err != nil {
+			log.Fatalln(err)
+		}
+
+		if err := controller.RebalanceStore(options, *shardsFlag, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case controller.REPAIR_COMMAND:
+		dir := options.Dir
+		if flag.NArg() > 1 {
+			dir = flag.Arg(1)
+		}
+
+		if err := controller.RepairStore(dir, flag.Arg(2), options, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if flag.NArg() < 2 {
 		log.Fatalln("Missing file path argument for input.")
 	}
 
 	filePath := args[0]
 	outputPath := args[1]
-	controller.ReadCsvCommands(filePath, outputPath)
+	if err := index.ConfigureTableCache(*maxOpenFilesFlag, *mmapFlag); err != nil {
+		log.Fatalln(err)
+	}
+
+	err := controller.ReadCommands(filePath, outputPath, *formatFlag, *strictFlag, *engineFlag,
+		options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
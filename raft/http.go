@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	VOTE_PATH     string = "/raft/vote"
+	APPEND_PATH   string = "/raft/append"
+	SNAPSHOT_PATH string = "/raft/snapshot"
+	STATUS_PATH   string = "/raft/status"
+	MEMBERS_PATH  string = "/raft/members"
+
+	// MEMBERSHIP_TIMEOUT bounds how long a membership request waits for the
+	// change to commit.
+	MEMBERSHIP_TIMEOUT time.Duration = 30 * time.Second
+)
+
+type httpError struct {
+	Error  string `json:"error"`
+	Leader *Peer  `json:"leader,omitempty"`
+}
+
+// HttpTransport reaches peers over http, Addr is their host and port.
+type HttpTransport struct {
+	client *http.Client
+}
+
+func NewHttpTransport() *HttpTransport {
+	return &HttpTransport{client: &http.Client{}}
+}
+
+func (t *HttpTransport) call(ctx context.Context, peer Peer, path string, req interface{},
+	reply interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer.Addr+path,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Peer %s answered %s: %s", peer.ID, resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (t *HttpTransport) RequestVote(ctx context.Context, peer Peer, req VoteRequest) (reply VoteReply, err error) {
+	err = t.call(ctx, peer, VOTE_PATH, req, &reply)
+	return reply, err
+}
+
+func (t *HttpTransport) AppendEntries(ctx context.Context, peer Peer, req AppendRequest) (reply AppendReply, err error) {
+	err = t.call(ctx, peer, APPEND_PATH, req, &reply)
+	return reply, err
+}
+
+func (t *HttpTransport) InstallSnapshot(ctx context.Context, peer Peer, req SnapshotRequest) (reply SnapshotReply, err error) {
+	err = t.call(ctx, peer, SNAPSHOT_PATH, req, &reply)
+	return reply, err
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Could not write http response: %v", err)
+	}
+}
+
+// writeError answers with err, 421 naming the leader when this node is not
+// it.
+func writeError(w http.ResponseWriter, status int, err error) {
+	var notLeader NotLeaderError
+	if errors.As(err, &notLeader) {
+		body := httpError{Error: err.Error()}
+		if notLeader.Leader.ID != "" {
+			body.Leader = &notLeader.Leader
+		}
+		writeJson(w, http.StatusMisdirectedRequest, body)
+		return
+	}
+
+	writeJson(w, status, httpError{Error: err.Error()})
+}
+
+// NewHandler serves the requests of HttpTransport for node, its status on
+// GET /raft/status and membership changes: POST /raft/members with a peer
+// adds it, DELETE /raft/members/{id} removes one.
+func NewHandler(node *Node) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(VOTE_PATH, func(w http.ResponseWriter, r *http.Request) {
+		var req VoteRequest
+		serveRpc(w, r, &req, func() (interface{}, error) {
+			return node.HandleRequestVote(req)
+		})
+	})
+	mux.HandleFunc(APPEND_PATH, func(w http.ResponseWriter, r *http.Request) {
+		var req AppendRequest
+		serveRpc(w, r, &req, func() (interface{}, error) {
+			return node.HandleAppendEntries(req)
+		})
+	})
+	mux.HandleFunc(SNAPSHOT_PATH, func(w http.ResponseWriter, r *http.Request) {
+		var req SnapshotRequest
+		serveRpc(w, r, &req, func() (interface{}, error) {
+			return node.HandleInstallSnapshot(req)
+		})
+	})
+	mux.HandleFunc(STATUS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, node.Status())
+	})
+	mux.HandleFunc(MEMBERS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed,
+				fmt.Errorf("Method %s is not allowed.", r.Method))
+			return
+		}
+
+		var peer Peer
+		if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid peer: %v", err))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), MEMBERSHIP_TIMEOUT)
+		defer cancel()
+		if err := node.AddPeer(ctx, peer); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJson(w, http.StatusOK, node.Status())
+	})
+	mux.HandleFunc(MEMBERS_PATH+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			writeError(w, http.StatusMethodNotAllowed,
+				fmt.Errorf("Method %s is not allowed.", r.Method))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), MEMBERSHIP_TIMEOUT)
+		defer cancel()
+		id := strings.TrimPrefix(r.URL.Path, MEMBERS_PATH+"/")
+		if err := node.RemovePeer(ctx, id); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJson(w, http.StatusOK, node.Status())
+	})
+	return mux
+}
+
+func serveRpc(w http.ResponseWriter, r *http.Request, req interface{},
+	handle func() (interface{}, error)) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("Method %s is not allowed.", r.Method))
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request: %v", err))
+		return
+	}
+
+	reply, err := handle()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, reply)
+}
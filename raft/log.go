@@ -0,0 +1,367 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	STATE_FILE    string = "raft_state.json"
+	LOG_FILE      string = "raft_log.jsonl"
+	SNAPSHOT_FILE string = "raft_snapshot.json"
+
+	ENTRY_COMMAND string = "command"
+	ENTRY_CONFIG  string = "config"
+	ENTRY_NOOP    string = "noop"
+)
+
+// Peer is a member of the cluster, Addr is where its transport reaches it.
+type Peer struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// Command is a write to apply to the store of every replica. Op is one of
+// the store command names, mput carries Items and index carries the index
+// name in Key, its type in Value and PrefixLength. Keys and values are
+// bytes, json keeps them in base64 so any bytes are replicated unchanged.
+type Command struct {
+	Op           string `json:"op"`
+	Key          []byte `json:"key,omitempty"`
+	Value        []byte `json:"value,omitempty"`
+	Items        []Item `json:"items,omitempty"`
+	PrefixLength int    `json:"prefix_length,omitempty"`
+}
+
+// Item is a key and its value as commands and snapshots carry them.
+type Item struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func toItems(kvs []store.KeyValue) []Item {
+	items := make([]Item, 0, len(kvs))
+	for _, kv := range kvs {
+		items = append(items, Item{[]byte(kv.Key), []byte(kv.Value)})
+	}
+
+	return items
+}
+
+func fromItems(items []Item) []store.KeyValue {
+	kvs := make([]store.KeyValue, 0, len(items))
+	for _, item := range items {
+		kvs = append(kvs, store.KeyValue{Key: string(item.Key), Value: string(item.Value)})
+	}
+
+	return kvs
+}
+
+// Entry is a record of the replicated log. A config entry holds the whole
+// membership that takes effect from it on.
+type Entry struct {
+	Index   int64    `json:"index"`
+	Term    int64    `json:"term"`
+	Type    string   `json:"type"`
+	Command *Command `json:"command,omitempty"`
+	Peers   []Peer   `json:"peers,omitempty"`
+}
+
+// hardState is what a node must remember across restarts to vote safely.
+type hardState struct {
+	Term int64  `json:"term"`
+	Vote string `json:"vote"`
+}
+
+// snapshotMeta describes the last snapshot, the store holds every entry up
+// to Index once it is written.
+type snapshotMeta struct {
+	Index int64  `json:"index"`
+	Term  int64  `json:"term"`
+	Peers []Peer `json:"peers"`
+}
+
+// writeJsonFile replaces path with v, synced before the rename so a crash
+// leaves either the old or the new content.
+func writeJsonFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// readJsonFile reads path into v and reports whether it exists.
+func readJsonFile(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return true, fmt.Errorf("Could not read %s: %v", path, err)
+	}
+
+	return true, nil
+}
+
+// raftLog holds the entries after the last snapshot, one json object per
+// line in the log file. Appends are synced before they are acknowledged.
+type raftLog struct {
+	path      string
+	file      *os.File
+	entries   []Entry
+	snapIndex int64
+	snapTerm  int64
+}
+
+// openRaftLog reads the entries after snapIndex from dir. A torn last line,
+// the tail of an append a crash interrupted, is cut off. Any other bad line
+// means the log lost entries it acknowledged and is an error.
+func openRaftLog(dir string, snapIndex int64, snapTerm int64) (*raftLog, error) {
+	l := &raftLog{path: filepath.Join(dir, LOG_FILE), snapIndex: snapIndex,
+		snapTerm: snapTerm}
+	f, err := os.Open(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		err = l.read(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return l, err
+}
+
+// read loads the entries of the log file f, truncating it after the last
+// intact line when the line after it is torn.
+func (l *raftLog) read(f *os.File) error {
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var e Entry
+		bad := json.Unmarshal(line, &e)
+		if err == io.EOF && bad == nil {
+			bad = errors.New("entry is cut short")
+		}
+
+		if bad != nil {
+			if _, err = r.Peek(1); err != io.EOF {
+				return fmt.Errorf("Raft log %s is corrupt at byte %d: %v", l.path, good, bad)
+			}
+
+			log.Warnf("Raft log %s ends in a torn entry at byte %d, truncating: %v",
+				l.path, good, bad)
+			return os.Truncate(l.path, good)
+		}
+
+		good += int64(len(line))
+		if e.Index <= l.snapIndex {
+			continue
+		}
+
+		if e.Index != l.lastIndex()+1 {
+			return fmt.Errorf("Raft log %s skips from %d to %d.", l.path, l.lastIndex(), e.Index)
+		}
+		l.entries = append(l.entries, e)
+	}
+}
+
+func (l *raftLog) lastIndex() int64 {
+	return l.snapIndex + int64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() int64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term is the term of the entry at index, ok is false for compacted or
+// missing entries other than the snapshot's last one.
+func (l *raftLog) term(index int64) (term int64, ok bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+func (l *raftLog) entry(index int64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// slice copies the entries from index from up to, not including, to.
+func (l *raftLog) slice(from int64, to int64) []Entry {
+	if from <= l.snapIndex {
+		from = l.snapIndex + 1
+	}
+
+	if to > l.lastIndex()+1 {
+		to = l.lastIndex() + 1
+	}
+
+	if from >= to {
+		return nil
+	}
+
+	return append([]Entry(nil), l.entries[from-l.snapIndex-1:to-l.snapIndex-1]...)
+}
+
+func (l *raftLog) append(entries ...Entry) error {
+	if l.file == nil {
+		return fmt.Errorf("Raft log %s is not open, it could not be rewritten.", l.path)
+	}
+
+	w := bufio.NewWriter(l.file)
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// truncate drops the entries from index on, they conflict with the leader.
+func (l *raftLog) truncate(index int64) error {
+	l.entries = l.entries[:index-l.snapIndex-1]
+	return l.rewrite()
+}
+
+// compact drops the entries up to index, a snapshot covers them.
+func (l *raftLog) compact(index int64, term int64) error {
+	if index >= l.lastIndex() {
+		l.entries = nil
+	} else if index > l.snapIndex {
+		l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	}
+
+	l.snapIndex, l.snapTerm = index, term
+	return l.rewrite()
+}
+
+// reset drops every entry, used when an installed snapshot replaces a log
+// that does not match it.
+func (l *raftLog) reset(index int64, term int64) error {
+	l.entries = nil
+	l.snapIndex, l.snapTerm = index, term
+	return l.rewrite()
+}
+
+// rewrite replaces the log file with the entries in memory. Until it
+// succeeds the file no longer matches them, so it stays closed and appends
+// fail rather than add to it.
+func (l *raftLog) rewrite() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, e := range l.entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (l *raftLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.Close()
+}
@@ -0,0 +1,113 @@
+package raft
+
+import (
+	"bytes"
+	store "github.com/shimanekb/project2-A/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dir string) *raftLog {
+	t.Helper()
+	l, err := openRaftLog(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.close() })
+	return l
+}
+
+func putEntry(index int64, key string, value string) Entry {
+	return Entry{Index: index, Term: 1, Type: ENTRY_COMMAND,
+		Command: &Command{Op: store.PUT_COMMAND, Key: []byte(key), Value: []byte(value)}}
+}
+
+func TestRaftLogCutsOnlyTornTail(t *testing.T) {
+	dir := t.TempDir()
+	want := []Entry{putEntry(1, "a", "1"), putEntry(2, "b\xff", "\xff\xfe"), putEntry(3, "c", "3")}
+	if err := openTestLog(t, dir).append(want...); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, LOG_FILE)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An append cut short, with or without the start of its line feed.
+	for _, tail := range []string{`{"index":4,"te`, `{"index":4,"term":1,"type":"noop"}`} {
+		if err = ioutil.WriteFile(path, append(append([]byte(nil), data...), tail...), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		l := openTestLog(t, dir)
+		if !reflect.DeepEqual(l.entries, want) {
+			t.Fatalf("log after a torn %q holds %v", tail, l.entries)
+		}
+
+		if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+			t.Fatalf("log is %d bytes after the torn entry was cut, want %d", info.Size(), len(data))
+		}
+		l.close()
+	}
+
+	// A bad entry with intact ones after it is not a torn tail.
+	corrupt := bytes.Replace(data, []byte(`"index":2`), []byte(`"index":2x`), 1)
+	if err = ioutil.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = openRaftLog(dir, 0, 0); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("open of a corrupt log returned %v", err)
+	}
+
+	if after, _ := ioutil.ReadFile(path); !bytes.Equal(after, corrupt) {
+		t.Fatal("open of a corrupt log changed it")
+	}
+}
+
+func TestRaftLogRefusesAppendsAfterFailedRewrite(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir)
+	if err := l.append(putEntry(1, "a", "1"), putEntry(2, "b", "2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary file cannot be created while a directory is in its way.
+	tmp := filepath.Join(dir, LOG_FILE+".tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.truncate(2); err == nil {
+		t.Fatal("rewrite over a directory succeeded")
+	}
+
+	if err := l.append(putEntry(2, "c", "3")); err == nil {
+		t.Fatal("append after a failed rewrite succeeded")
+	}
+
+	if err := os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.truncate(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.append(putEntry(2, "c", "3")); err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+
+	want := []Entry{putEntry(1, "a", "1"), putEntry(2, "c", "3")}
+	if reopened := openTestLog(t, dir); !reflect.DeepEqual(reopened.entries, want) {
+		t.Fatalf("reopened log holds %v", reopened.entries)
+	}
+}
@@ -0,0 +1,1044 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	FOLLOWER  string = "follower"
+	CANDIDATE string = "candidate"
+	LEADER    string = "leader"
+
+	DEFAULT_ELECTION_TIMEOUT   time.Duration = 300 * time.Millisecond
+	DEFAULT_HEARTBEAT_INTERVAL time.Duration = 50 * time.Millisecond
+
+	// DEFAULT_SNAPSHOT_ENTRIES is the number of applied entries after which
+	// the store is flushed to its tables and the log compacted.
+	DEFAULT_SNAPSHOT_ENTRIES int = 1000
+
+	MAX_APPEND_ENTRIES int           = 500
+	TICK_INTERVAL      time.Duration = 10 * time.Millisecond
+	SNAPSHOT_TIMEOUT   time.Duration = 30 * time.Second
+
+	// SNAPSHOT_RETRY is how long a leader waits before sending a snapshot
+	// again to a peer that failed to take one.
+	SNAPSHOT_RETRY time.Duration = time.Second
+)
+
+var (
+	ErrStopped          = errors.New("Raft node is stopped.")
+	ErrNotReady         = errors.New("Leader has not committed an entry of its term yet.")
+	ErrChangeInProgress = errors.New("A membership change is still in progress.")
+	ErrLeadershipLost   = errors.New("Could not confirm leadership with a quorum.")
+	ErrLostEntry        = errors.New("Lost track of the entry after a change of leader, it may or may not have been applied.")
+)
+
+// NotLeaderError is returned for requests a follower cannot serve, Leader
+// is the node it last heard from, if any.
+type NotLeaderError struct {
+	Leader Peer
+}
+
+func (e NotLeaderError) Error() string {
+	if e.Leader.ID == "" {
+		return "Not the leader, no leader is known."
+	}
+
+	return fmt.Sprintf("Not the leader, the leader is %s at %s.", e.Leader.ID, e.Leader.Addr)
+}
+
+// Config sets up a node. Peers is the initial cluster and only used when
+// Dir holds no raft state yet, a node joining an existing cluster starts
+// with none and waits for the leader to add it.
+type Config struct {
+	ID                string
+	Dir               string
+	Peers             []Peer
+	Transport         Transport
+	Store             store.Store
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	SnapshotEntries   int
+}
+
+// Status describes a node for monitoring.
+type Status struct {
+	ID            string `json:"id"`
+	State         string `json:"state"`
+	Term          int64  `json:"term"`
+	Leader        string `json:"leader"`
+	LastIndex     int64  `json:"last_index"`
+	CommitIndex   int64  `json:"commit_index"`
+	LastApplied   int64  `json:"last_applied"`
+	SnapshotIndex int64  `json:"snapshot_index"`
+	Peers         []Peer `json:"peers"`
+}
+
+type waiter struct {
+	term int64
+	done chan error
+}
+
+// Node is one replica of a raft cluster. Committed commands are applied to
+// its store in log order, writes are proposed to the leader's log and reads
+// are served by the leader once a quorum confirms it still leads.
+//
+// mutex guards the raft state, storeMutex the store. Whoever needs both
+// takes storeMutex first.
+type Node struct {
+	config     Config
+	transport  Transport
+	storage    store.Store
+	replicated store.Replicated
+	random     *rand.Rand
+
+	storeMutex sync.Mutex
+	mutex      sync.Mutex
+
+	state            string
+	term             int64
+	vote             string
+	leader           string
+	log              *raftLog
+	snapPeers        []Peer
+	peers            []Peer
+	configIndex      int64
+	commitIndex      int64
+	lastApplied      int64
+	nextIndex        map[string]int64
+	matchIndex       map[string]int64
+	inflight         map[string]bool
+	contact          map[string]time.Time
+	snapshotRetry    map[string]time.Time
+	votes            map[string]bool
+	lastContact      time.Time
+	electionDeadline time.Time
+	nextHeartbeat    time.Time
+	waiters          map[int64]waiter
+	applied          chan struct{}
+	commitSignal     chan struct{}
+
+	stopped bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewNode opens the raft state in config.Dir and starts the node. The store
+// has to support snapshots, as the sstable engine does. On a restart the
+// entries after the last snapshot are applied again, every command writes
+// its keys regardless of their value so the store ends up the same.
+func NewNode(config Config) (*Node, error) {
+	if config.ID == "" || config.Dir == "" {
+		return nil, errors.New("Raft node needs an id and a directory.")
+	}
+
+	if config.Transport == nil || config.Store == nil {
+		return nil, errors.New("Raft node needs a transport and a store.")
+	}
+
+	replicated, ok := config.Store.(store.Replicated)
+	if !ok {
+		return nil, fmt.Errorf("Raft needs a store with snapshots, use the %s engine.",
+			store.SS_ENGINE)
+	}
+
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DEFAULT_ELECTION_TIMEOUT
+	}
+
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+
+	if config.SnapshotEntries <= 0 {
+		config.SnapshotEntries = DEFAULT_SNAPSHOT_ENTRIES
+	}
+
+	if err := os.MkdirAll(config.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var meta snapshotMeta
+	found, err := readJsonFile(filepath.Join(config.Dir, SNAPSHOT_FILE), &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		meta.Peers = config.Peers
+		if err = writeJsonFile(filepath.Join(config.Dir, SNAPSHOT_FILE), meta); err != nil {
+			return nil, err
+		}
+	}
+
+	var hard hardState
+	if _, err = readJsonFile(filepath.Join(config.Dir, STATE_FILE), &hard); err != nil {
+		return nil, err
+	}
+
+	raftLog, err := openRaftLog(config.Dir, meta.Index, meta.Term)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{config: config, transport: config.Transport, storage: config.Store,
+		replicated: replicated, state: FOLLOWER, term: hard.Term, vote: hard.Vote,
+		log: raftLog, snapPeers: meta.Peers, commitIndex: meta.Index,
+		lastApplied: meta.Index, nextIndex: make(map[string]int64),
+		matchIndex: make(map[string]int64), inflight: make(map[string]bool),
+		contact: make(map[string]time.Time), snapshotRetry: make(map[string]time.Time),
+		waiters: make(map[int64]waiter), applied: make(chan struct{}),
+		commitSignal: make(chan struct{}, 1), ctx: ctx, cancel: cancel,
+		random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	n.updateConfig()
+	n.resetElectionDeadline()
+
+	log.Infof("Raft node %s starts at term %d with entries %d to %d and %d peers.",
+		config.ID, n.term, meta.Index, raftLog.lastIndex(), len(n.peers))
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Stop ends the node's loops and waits for its requests in flight. The
+// store is left open for the caller to close.
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return
+	}
+
+	n.stopped = true
+	n.state, n.leader = FOLLOWER, ""
+	n.cancel()
+	for index, w := range n.waiters {
+		w.done <- ErrStopped
+		delete(n.waiters, index)
+	}
+	n.mutex.Unlock()
+
+	n.wg.Wait()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if err := n.log.close(); err != nil {
+		log.Errorf("Could not close raft log of %s: %v", n.config.ID, err)
+	}
+}
+
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return Status{ID: n.config.ID, State: n.state, Term: n.term, Leader: n.leader,
+		LastIndex: n.log.lastIndex(), CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied, SnapshotIndex: n.log.snapIndex,
+		Peers: append([]Peer(nil), n.peers...)}
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case now := <-ticker.C:
+			n.tick(now)
+		}
+	}
+}
+
+func (n *Node) tick(now time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.state == LEADER {
+		if !n.quorumContact(now) {
+			log.Warnf("Raft node %s lost contact with a quorum.", n.config.ID)
+			n.leader = ""
+			n.stepDown(n.term)
+			return
+		}
+
+		if !now.Before(n.nextHeartbeat) {
+			n.nextHeartbeat = now.Add(n.config.HeartbeatInterval)
+			n.broadcast()
+		}
+		return
+	}
+
+	if !now.Before(n.electionDeadline) {
+		n.campaign()
+	}
+}
+
+// goTracked runs f in a goroutine Stop waits for.
+func (n *Node) goTracked(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.config.ElectionTimeout
+	n.electionDeadline = time.Now().Add(timeout +
+		time.Duration(n.random.Int63n(int64(timeout))))
+}
+
+func (n *Node) setHardState(term int64, vote string) error {
+	hard := hardState{Term: term, Vote: vote}
+	if err := writeJsonFile(filepath.Join(n.config.Dir, STATE_FILE), hard); err != nil {
+		return err
+	}
+
+	n.term, n.vote = term, vote
+	return nil
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, p := range n.peers {
+		if p.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Node) peer(id string) Peer {
+	for _, p := range n.peers {
+		if p.ID == id {
+			return p
+		}
+	}
+
+	return Peer{ID: id}
+}
+
+// quorumContact reports whether a quorum answered the leader within an
+// election timeout. A leader cut off from it steps down rather than keep
+// accepting writes it cannot commit.
+func (n *Node) quorumContact(now time.Time) bool {
+	acks := map[string]bool{n.config.ID: true}
+	for id, at := range n.contact {
+		if now.Sub(at) < n.config.ElectionTimeout {
+			acks[id] = true
+		}
+	}
+
+	return n.hasQuorum(acks)
+}
+
+// hasQuorum reports whether acks holds a majority of the members.
+func (n *Node) hasQuorum(acks map[string]bool) bool {
+	count := 0
+	for _, p := range n.peers {
+		if acks[p.ID] {
+			count++
+		}
+	}
+
+	return len(n.peers) > 0 && count > len(n.peers)/2
+}
+
+// configAt returns the membership in effect at index, the latest config
+// entry up to it or the snapshot's.
+func (n *Node) configAt(index int64) (peers []Peer, configIndex int64) {
+	if index > n.log.lastIndex() {
+		index = n.log.lastIndex()
+	}
+
+	for i := index; i > n.log.snapIndex; i-- {
+		if e := n.log.entry(i); e.Type == ENTRY_CONFIG {
+			return e.Peers, i
+		}
+	}
+
+	return n.snapPeers, n.log.snapIndex
+}
+
+// updateConfig takes the membership from the log, a config entry counts as
+// soon as it is appended.
+func (n *Node) updateConfig() {
+	n.peers, n.configIndex = n.configAt(n.log.lastIndex())
+}
+
+// stepDown makes the node a follower, of a new term when term is higher.
+func (n *Node) stepDown(term int64) {
+	if term > n.term {
+		if err := n.setHardState(term, ""); err != nil {
+			log.Errorf("Could not save raft state of %s: %v", n.config.ID, err)
+		}
+		n.leader = ""
+	}
+
+	if n.state != FOLLOWER {
+		log.Infof("Raft node %s steps down to follower at term %d.", n.config.ID, n.term)
+		n.state = FOLLOWER
+		n.resetElectionDeadline()
+	}
+}
+
+func (n *Node) campaign() {
+	n.resetElectionDeadline()
+	if !n.isMember(n.config.ID) {
+		return
+	}
+
+	if err := n.setHardState(n.term+1, n.config.ID); err != nil {
+		log.Errorf("Could not save raft state of %s: %v", n.config.ID, err)
+		return
+	}
+
+	n.state = CANDIDATE
+	n.leader = ""
+	n.votes = map[string]bool{n.config.ID: true}
+	log.Infof("Raft node %s starts an election for term %d.", n.config.ID, n.term)
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+		return
+	}
+
+	req := VoteRequest{Term: n.term, Candidate: n.config.ID,
+		LastIndex: n.log.lastIndex(), LastTerm: n.log.lastTerm()}
+	for _, p := range n.peers {
+		if p.ID != n.config.ID {
+			p := p
+			n.goTracked(func() { n.requestVote(p, req) })
+		}
+	}
+}
+
+func (n *Node) requestVote(p Peer, req VoteRequest) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+	defer cancel()
+	reply, err := n.transport.RequestVote(ctx, p, req)
+	if err != nil {
+		log.Debugf("Vote request from %s to %s failed: %v", n.config.ID, p.ID, err)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return
+	}
+
+	if n.state != CANDIDATE || n.term != req.Term || !reply.Granted {
+		return
+	}
+
+	n.votes[p.ID] = true
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+	}
+}
+
+// becomeLeader starts the term with a no-op entry, once it commits the
+// entries of earlier terms are known committed too.
+func (n *Node) becomeLeader() {
+	n.state = LEADER
+	n.leader = n.config.ID
+	n.nextIndex = make(map[string]int64)
+	n.matchIndex = make(map[string]int64)
+	n.inflight = make(map[string]bool)
+	n.snapshotRetry = make(map[string]time.Time)
+	n.contact = make(map[string]time.Time)
+	for id := range n.votes {
+		n.contact[id] = time.Now()
+	}
+	log.Infof("Raft node %s is the leader of term %d.", n.config.ID, n.term)
+
+	if _, err := n.appendLocal(Entry{Type: ENTRY_NOOP}); err != nil {
+		log.Errorf("Could not append to raft log of %s: %v", n.config.ID, err)
+		n.stepDown(n.term)
+		return
+	}
+
+	n.nextHeartbeat = time.Now().Add(n.config.HeartbeatInterval)
+	n.broadcast()
+}
+
+// appendLocal adds an entry of the current term to the leader's log.
+func (n *Node) appendLocal(e Entry) (index int64, err error) {
+	e.Index, e.Term = n.log.lastIndex()+1, n.term
+	if err = n.log.append(e); err != nil {
+		return 0, err
+	}
+
+	if e.Type == ENTRY_CONFIG {
+		n.updateConfig()
+	}
+
+	n.maybeCommit()
+	return e.Index, nil
+}
+
+func (n *Node) broadcast() {
+	for _, p := range n.peers {
+		if p.ID != n.config.ID {
+			n.replicate(p)
+		}
+	}
+}
+
+// replicate sends a peer the entries it is missing, or a snapshot when they
+// are compacted. A peer has at most one request in flight.
+func (n *Node) replicate(p Peer) {
+	if n.state != LEADER || n.inflight[p.ID] || !n.isMember(p.ID) {
+		return
+	}
+
+	next, ok := n.nextIndex[p.ID]
+	if !ok {
+		next = n.log.lastIndex() + 1
+		n.nextIndex[p.ID] = next
+	}
+
+	if next <= n.log.snapIndex {
+		if time.Now().Before(n.snapshotRetry[p.ID]) {
+			return
+		}
+
+		n.inflight[p.ID] = true
+		term := n.term
+		n.goTracked(func() { n.sendSnapshot(p, term) })
+		return
+	}
+
+	n.inflight[p.ID] = true
+	prevTerm, _ := n.log.term(next - 1)
+	req := AppendRequest{Term: n.term, Leader: n.config.ID, PrevIndex: next - 1,
+		PrevTerm: prevTerm, Entries: n.log.slice(next, next+int64(MAX_APPEND_ENTRIES)),
+		LeaderCommit: n.commitIndex}
+	n.goTracked(func() { n.sendAppend(p, req) })
+}
+
+func (n *Node) sendAppend(p Peer, req AppendRequest) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+	defer cancel()
+	reply, err := n.transport.AppendEntries(ctx, p, req)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.inflight[p.ID] = false
+	if err != nil {
+		log.Debugf("Append from %s to %s failed: %v", n.config.ID, p.ID, err)
+		return
+	}
+
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return
+	}
+
+	if n.state != LEADER || n.term != req.Term {
+		return
+	}
+
+	n.contact[p.ID] = time.Now()
+	if !reply.Success {
+		next := reply.ConflictIndex
+		if next < 1 {
+			next = 1
+		}
+
+		if next > n.log.lastIndex()+1 {
+			next = n.log.lastIndex() + 1
+		}
+
+		if next < n.nextIndex[p.ID] {
+			n.nextIndex[p.ID] = next
+			n.replicate(p)
+		}
+		return
+	}
+
+	if reply.MatchIndex > n.matchIndex[p.ID] {
+		n.matchIndex[p.ID] = reply.MatchIndex
+	}
+	n.nextIndex[p.ID] = n.matchIndex[p.ID] + 1
+	n.maybeCommit()
+	if n.nextIndex[p.ID] <= n.log.lastIndex() {
+		n.replicate(p)
+	}
+}
+
+// sendSnapshot flushes the store so its tables hold every applied entry and
+// ships their content to a peer that is behind the compacted log.
+func (n *Node) sendSnapshot(p Peer, term int64) {
+	n.storeMutex.Lock()
+	n.storage.Flush()
+	snapshot, err := n.replicated.Snapshot()
+	n.mutex.Lock()
+	index := n.lastApplied
+	lastTerm, _ := n.log.term(index)
+	peers, _ := n.configAt(index)
+	n.mutex.Unlock()
+	n.storeMutex.Unlock()
+
+	if err != nil {
+		log.Errorf("Could not snapshot store for %s: %v", p.ID, err)
+		n.mutex.Lock()
+		n.inflight[p.ID] = false
+		n.snapshotRetry[p.ID] = time.Now().Add(SNAPSHOT_RETRY)
+		n.mutex.Unlock()
+		return
+	}
+
+	log.Infof("Raft node %s sends %s a snapshot up to %d with %d keys.", n.config.ID,
+		p.ID, index, len(snapshot.Items))
+	req := SnapshotRequest{Term: term, Leader: n.config.ID, Index: index,
+		LastTerm: lastTerm, Peers: peers, Sequence: snapshot.Sequence,
+		Indexes: snapshot.Indexes, Items: toItems(snapshot.Items)}
+	ctx, cancel := context.WithTimeout(n.ctx, SNAPSHOT_TIMEOUT)
+	defer cancel()
+	reply, err := n.transport.InstallSnapshot(ctx, p, req)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.inflight[p.ID] = false
+	if err != nil {
+		log.Warnf("Could not send snapshot from %s to %s: %v", n.config.ID, p.ID, err)
+		n.snapshotRetry[p.ID] = time.Now().Add(SNAPSHOT_RETRY)
+		return
+	}
+
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return
+	}
+
+	if n.state != LEADER || n.term != term {
+		return
+	}
+
+	n.contact[p.ID] = time.Now()
+	if index > n.matchIndex[p.ID] {
+		n.matchIndex[p.ID] = index
+	}
+	n.nextIndex[p.ID] = n.matchIndex[p.ID] + 1
+	n.maybeCommit()
+	n.replicate(p)
+}
+
+// maybeCommit advances the commit index to the last entry of the current
+// term a quorum holds. A leader that is no longer a member steps down once
+// the config entry removing it is committed.
+func (n *Node) maybeCommit() {
+	if n.state != LEADER {
+		return
+	}
+
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.log.term(index); term != n.term {
+			break
+		}
+
+		acks := make(map[string]bool)
+		for _, p := range n.peers {
+			if p.ID == n.config.ID || n.matchIndex[p.ID] >= index {
+				acks[p.ID] = true
+			}
+		}
+
+		if n.hasQuorum(acks) {
+			n.setCommitIndex(index)
+			break
+		}
+	}
+
+	if !n.isMember(n.config.ID) && n.configIndex <= n.commitIndex {
+		log.Infof("Raft node %s was removed from the cluster.", n.config.ID)
+		n.leader = ""
+		n.stepDown(n.term)
+	}
+}
+
+func (n *Node) setCommitIndex(index int64) {
+	n.commitIndex = index
+	select {
+	case n.commitSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.commitSignal:
+			n.applyCommitted()
+		}
+	}
+}
+
+// applyCommitted applies the committed entries to the store in order. An
+// installed snapshot may overtake a batch, its entries are then skipped.
+func (n *Node) applyCommitted() {
+	for n.ctx.Err() == nil {
+		n.mutex.Lock()
+		from := n.lastApplied + 1
+		to := n.commitIndex + 1
+		if to > from+int64(MAX_APPEND_ENTRIES) {
+			to = from + int64(MAX_APPEND_ENTRIES)
+		}
+		entries := n.log.slice(from, to)
+		n.mutex.Unlock()
+		if len(entries) == 0 {
+			return
+		}
+
+		n.storeMutex.Lock()
+		for _, e := range entries {
+			n.mutex.Lock()
+			stale := e.Index != n.lastApplied+1
+			n.mutex.Unlock()
+			if stale {
+				break
+			}
+
+			var err error
+			if e.Type == ENTRY_COMMAND {
+				if err = applyCommand(n.storage, e.Command); err != nil {
+					log.Errorf("Could not apply raft entry %d: %v", e.Index, err)
+				}
+			}
+
+			n.mutex.Lock()
+			n.lastApplied = e.Index
+			n.notifyApplied(e, err)
+			n.mutex.Unlock()
+		}
+		n.maybeSnapshot()
+		n.storeMutex.Unlock()
+	}
+}
+
+// notifyApplied hands the outcome of an entry to whoever proposed it and
+// wakes the reads waiting for it.
+func (n *Node) notifyApplied(e Entry, err error) {
+	if w, ok := n.waiters[e.Index]; ok {
+		delete(n.waiters, e.Index)
+		if w.term != e.Term {
+			err = ErrLostEntry
+		}
+		w.done <- err
+	}
+
+	close(n.applied)
+	n.applied = make(chan struct{})
+}
+
+// maybeSnapshot compacts the log once SnapshotEntries entries are applied
+// since the last snapshot. The store is flushed first so its tables hold
+// everything the dropped entries wrote. Called with storeMutex held.
+func (n *Node) maybeSnapshot() {
+	n.mutex.Lock()
+	index := n.lastApplied
+	due := index-n.log.snapIndex >= int64(n.config.SnapshotEntries)
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	n.storage.Flush()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	term, _ := n.log.term(index)
+	peers, _ := n.configAt(index)
+	meta := snapshotMeta{Index: index, Term: term, Peers: peers}
+	if err := writeJsonFile(filepath.Join(n.config.Dir, SNAPSHOT_FILE), meta); err != nil {
+		log.Errorf("Could not save raft snapshot of %s: %v", n.config.ID, err)
+		return
+	}
+
+	n.snapPeers = peers
+	if err := n.log.compact(index, term); err != nil {
+		log.Errorf("Could not compact raft log of %s: %v", n.config.ID, err)
+	}
+	n.updateConfig()
+	log.Infof("Raft node %s compacted its log up to %d.", n.config.ID, index)
+}
+
+func (n *Node) notLeader() error {
+	return NotLeaderError{Leader: n.peer(n.leader)}
+}
+
+// propose appends an entry to the leader's log and waits until it is
+// applied.
+func (n *Node) propose(ctx context.Context, e Entry) error {
+	index, err := n.appendLocal(e)
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+
+	done := make(chan error, 1)
+	n.waiters[index] = waiter{term: n.term, done: done}
+	n.broadcast()
+	n.mutex.Unlock()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		delete(n.waiters, index)
+		n.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// leading locks the node when it is the running leader, otherwise it
+// returns why not and leaves it unlocked.
+func (n *Node) leading() error {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return ErrStopped
+	}
+
+	if n.state != LEADER {
+		err := n.notLeader()
+		n.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// Apply replicates a command and returns once the leader applied it to its
+// store, with the store's error if any.
+func (n *Node) Apply(ctx context.Context, cmd Command) error {
+	if err := n.leading(); err != nil {
+		return err
+	}
+
+	return n.propose(ctx, Entry{Type: ENTRY_COMMAND, Command: &cmd})
+}
+
+// changeMembership proposes the membership change returns. One server is
+// added or removed at a time, the next change waits for this one to commit.
+func (n *Node) changeMembership(ctx context.Context,
+	change func(peers []Peer) (changed []Peer, ok bool, err error)) error {
+	if err := n.leading(); err != nil {
+		return err
+	}
+
+	if term, _ := n.log.term(n.commitIndex); term != n.term {
+		n.mutex.Unlock()
+		return ErrNotReady
+	}
+
+	if n.configIndex > n.commitIndex {
+		n.mutex.Unlock()
+		return ErrChangeInProgress
+	}
+
+	peers, ok, err := change(append([]Peer(nil), n.peers...))
+	if err != nil || !ok {
+		n.mutex.Unlock()
+		return err
+	}
+
+	return n.propose(ctx, Entry{Type: ENTRY_CONFIG, Peers: peers})
+}
+
+// AddPeer adds a server to the cluster. It counts towards the quorum as
+// soon as the change is appended, so add servers one at a time while the
+// others are up.
+func (n *Node) AddPeer(ctx context.Context, peer Peer) error {
+	if peer.ID == "" || peer.Addr == "" {
+		return errors.New("A peer needs an id and an address.")
+	}
+
+	return n.changeMembership(ctx, func(peers []Peer) ([]Peer, bool, error) {
+		for _, p := range peers {
+			if p.ID == peer.ID && p.Addr == peer.Addr {
+				return nil, false, nil
+			}
+
+			if p.ID == peer.ID {
+				return nil, false, fmt.Errorf("Peer %s is already a member at %s.", p.ID, p.Addr)
+			}
+		}
+
+		log.Infof("Adding %s at %s to the cluster.", peer.ID, peer.Addr)
+		return append(peers, peer), true, nil
+	})
+}
+
+// RemovePeer removes a server from the cluster, the leader itself included.
+func (n *Node) RemovePeer(ctx context.Context, id string) error {
+	return n.changeMembership(ctx, func(peers []Peer) ([]Peer, bool, error) {
+		for i, p := range peers {
+			if p.ID != id {
+				continue
+			}
+
+			if len(peers) == 1 {
+				return nil, false, errors.New("Cannot remove the last member.")
+			}
+
+			log.Infof("Removing %s from the cluster.", id)
+			return append(peers[:i], peers[i+1:]...), true, nil
+		}
+
+		return nil, false, nil
+	})
+}
+
+// ReadIndex returns the commit index once a quorum confirmed this node is
+// still the leader. A read served after the store applied that index sees
+// every write acknowledged before the read began.
+func (n *Node) ReadIndex(ctx context.Context) (int64, error) {
+	if err := n.leading(); err != nil {
+		return 0, err
+	}
+
+	for {
+		if term, _ := n.log.term(n.commitIndex); term == n.term {
+			break
+		}
+
+		applied := n.applied
+		n.mutex.Unlock()
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+
+		if err := n.leading(); err != nil {
+			return 0, err
+		}
+	}
+
+	index, term := n.commitIndex, n.term
+	acks := map[string]bool{n.config.ID: true}
+	if n.hasQuorum(acks) {
+		n.mutex.Unlock()
+		return index, nil
+	}
+
+	var reqs []AppendRequest
+	var peers []Peer
+	for _, p := range n.peers {
+		if p.ID == n.config.ID {
+			continue
+		}
+
+		prevIndex := n.nextIndex[p.ID] - 1
+		if prevIndex < 0 {
+			prevIndex = 0
+		}
+		prevTerm, _ := n.log.term(prevIndex)
+		reqs = append(reqs, AppendRequest{Term: term, Leader: n.config.ID,
+			PrevIndex: prevIndex, PrevTerm: prevTerm, LeaderCommit: n.commitIndex})
+		peers = append(peers, p)
+	}
+	n.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.ElectionTimeout)
+	defer cancel()
+	results := make(chan string, len(reqs))
+	for i := range reqs {
+		p, req := peers[i], reqs[i]
+		go func() {
+			reply, err := n.transport.AppendEntries(ctx, p, req)
+			if err == nil && reply.Term > term {
+				n.mutex.Lock()
+				n.stepDown(reply.Term)
+				n.mutex.Unlock()
+			}
+
+			if err == nil && reply.Term == term {
+				results <- p.ID
+				return
+			}
+			results <- ""
+		}()
+	}
+
+	for range reqs {
+		select {
+		case id := <-results:
+			if id == "" {
+				continue
+			}
+			acks[id] = true
+			n.mutex.Lock()
+			confirmed := n.state == LEADER && n.term == term && n.hasQuorum(acks)
+			n.mutex.Unlock()
+			if confirmed {
+				return index, nil
+			}
+		case <-ctx.Done():
+			return 0, ErrLeadershipLost
+		}
+	}
+
+	return 0, ErrLeadershipLost
+}
+
+// Read runs f on the store once it is up to date with a read index, so f
+// observes a linearizable state. Only the leader serves reads.
+func (n *Node) Read(ctx context.Context, f func(storage store.Store)) error {
+	index, err := n.ReadIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		n.mutex.Lock()
+		done := n.lastApplied >= index
+		applied := n.applied
+		n.mutex.Unlock()
+		if done {
+			break
+		}
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.ctx.Done():
+			return ErrStopped
+		}
+	}
+
+	n.local(f)
+	return nil
+}
+
+// local runs f on the store without consulting the cluster, for
+// maintenance that does not change the content.
+func (n *Node) local(f func(storage store.Store)) {
+	n.storeMutex.Lock()
+	defer n.storeMutex.Unlock()
+	f(n.storage)
+}
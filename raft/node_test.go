@@ -0,0 +1,459 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_ELECTION_TIMEOUT   time.Duration = 100 * time.Millisecond
+	TEST_HEARTBEAT_INTERVAL time.Duration = 20 * time.Millisecond
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	if os.Getenv("TEST_LOGS") != "" {
+		log.SetOutput(os.Stderr)
+	}
+	os.Exit(m.Run())
+}
+
+// waitFor polls cond until it holds, failing the test after ten seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// testCluster runs nodes of one process over a MemoryNetwork, the peers
+// are reached at their ids.
+type testCluster struct {
+	t               *testing.T
+	dir             string
+	network         *MemoryNetwork
+	nodes           map[string]*Node
+	snapshotEntries int
+}
+
+func peersOf(ids ...string) (peers []Peer) {
+	for _, id := range ids {
+		peers = append(peers, Peer{ID: id, Addr: id})
+	}
+
+	return peers
+}
+
+func newTestCluster(t *testing.T, size int, snapshotEntries int) *testCluster {
+	c := &testCluster{t: t, dir: t.TempDir(), network: NewMemoryNetwork(),
+		nodes: make(map[string]*Node), snapshotEntries: snapshotEntries}
+	var ids []string
+	for i := 1; i <= size; i++ {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+
+	for _, id := range ids {
+		c.start(id, peersOf(ids...))
+	}
+	return c
+}
+
+// start runs a node with its own store, with no peers it waits to be
+// added to the cluster.
+func (c *testCluster) start(id string, peers []Peer) *Node {
+	options := store.DefaultOptions()
+	options.Dir = filepath.Join(c.dir, id, "store")
+	if err := os.MkdirAll(options.Dir, os.ModePerm); err != nil {
+		c.t.Fatal(err)
+	}
+
+	storage, err := store.NewSsStore(options)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	node, err := NewNode(Config{ID: id, Dir: filepath.Join(c.dir, id, "raft"), Peers: peers,
+		Transport: c.network.Transport(id), Store: storage,
+		ElectionTimeout: TEST_ELECTION_TIMEOUT, HeartbeatInterval: TEST_HEARTBEAT_INTERVAL,
+		SnapshotEntries: c.snapshotEntries})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.network.Add(node)
+	c.nodes[id] = node
+	c.t.Cleanup(node.Stop)
+	return node
+}
+
+func (c *testCluster) connected(id string) bool {
+	c.network.mutex.Lock()
+	defer c.network.mutex.Unlock()
+	return !c.network.disconnected[id]
+}
+
+// leader waits until a connected node leads and returns the one of the
+// highest term.
+func (c *testCluster) leader() *Node {
+	c.t.Helper()
+	var leader *Node
+	waitFor(c.t, "a leader", func() bool {
+		leader = nil
+		var term int64
+		for id, n := range c.nodes {
+			status := n.Status()
+			if c.connected(id) && status.State == LEADER && status.Term > term {
+				leader, term = n, status.Term
+			}
+		}
+		return leader != nil
+	})
+
+	return leader
+}
+
+func (c *testCluster) put(n *Node, key string, value string) {
+	c.t.Helper()
+	if err := n.Apply(testContext(c.t), Command{Op: store.PUT_COMMAND, Key: []byte(key),
+		Value: []byte(value)}); err != nil {
+		c.t.Fatalf("put %s through %s: %v", key, n.ID(), err)
+	}
+}
+
+// putOnLeader puts through whichever node leads, again when the
+// leadership moves before the put commits. A put may be repeated safely.
+func (c *testCluster) putOnLeader(key string, value string) {
+	c.t.Helper()
+	var err error
+	waitFor(c.t, fmt.Sprintf("%s to commit", key), func() bool {
+		err = c.leader().Apply(testContext(c.t), Command{Op: store.PUT_COMMAND,
+			Key: []byte(key), Value: []byte(value)})
+		_, moved := err.(NotLeaderError)
+		return !moved && err != ErrLeadershipLost && err != ErrLostEntry
+	})
+
+	if err != nil {
+		c.t.Fatalf("put %s: %v", key, err)
+	}
+}
+
+func localGet(n *Node, key string) (value string, ok bool) {
+	n.local(func(storage store.Store) {
+		value, ok = storage.Get(key)
+	})
+	return value, ok
+}
+
+// waitValue waits until the store of n holds value at key.
+func (c *testCluster) waitValue(n *Node, key string, value string) {
+	c.t.Helper()
+	waitFor(c.t, fmt.Sprintf("%s to hold %s", n.ID(), key), func() bool {
+		got, ok := localGet(n, key)
+		return ok && got == value
+	})
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	c := newTestCluster(t, 5, 0)
+	leader := c.leader()
+	waitFor(t, "every node to follow the leader", func() bool {
+		for _, n := range c.nodes {
+			status := n.Status()
+			if status.Leader != leader.ID() || status.Term != leader.Status().Term {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, n := range c.nodes {
+		if n != leader && n.Status().State == LEADER {
+			t.Fatalf("%s and %s both lead", n.ID(), leader.ID())
+		}
+	}
+
+	// Losing the leader makes the others elect a new one of a later term.
+	term := leader.Status().Term
+	c.network.Disconnect(leader.ID())
+	next := c.leader()
+	if next == leader || next.Status().Term <= term {
+		t.Fatalf("%s leads term %d after %s led term %d", next.ID(), next.Status().Term,
+			leader.ID(), term)
+	}
+
+	c.put(next, "k", "v")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*TEST_ELECTION_TIMEOUT)
+	defer cancel()
+	if err := leader.Apply(ctx, Command{Op: store.PUT_COMMAND, Key: []byte("x"),
+		Value: []byte("y")}); err == nil {
+		t.Fatal("the cut off leader committed a write")
+	}
+}
+
+func TestReplicatesToHealedFollower(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	var lagging *Node
+	for _, n := range c.nodes {
+		if n != leader {
+			lagging = n
+			break
+		}
+	}
+
+	err := lagging.Apply(testContext(t), Command{Op: store.PUT_COMMAND, Key: []byte("k"),
+		Value: []byte("v")})
+	if _, ok := err.(NotLeaderError); !ok {
+		t.Fatalf("follower answered a write with %v", err)
+	}
+
+	c.network.Disconnect(lagging.ID())
+	for i := 0; i < 50; i++ {
+		c.put(leader, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	if _, ok := localGet(lagging, "key-0"); ok {
+		t.Fatal("partitioned follower received a write")
+	}
+
+	for _, n := range c.nodes {
+		if n != lagging {
+			c.waitValue(n, "key-49", "value-49")
+		}
+	}
+
+	c.network.Reconnect(lagging.ID())
+	c.waitValue(lagging, "key-49", "value-49")
+	for i := 0; i < 50; i++ {
+		if value, ok := localGet(lagging, fmt.Sprintf("key-%d", i)); !ok ||
+			value != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("healed follower has key-%d = %q, %v", i, value, ok)
+		}
+	}
+
+	waitFor(t, "the follower to apply the leader's log", func() bool {
+		return lagging.Status().LastApplied == leader.Status().CommitIndex
+	})
+}
+
+func TestReadIndexOnDeposedLeader(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.leader()
+	c.put(old, "k", "1")
+
+	var read string
+	if err := old.Read(testContext(t), func(storage store.Store) {
+		read, _ = storage.Get("k")
+	}); err != nil || read != "1" {
+		t.Fatalf("leader read %q, %v", read, err)
+	}
+
+	// Cut off from the quorum the old leader cannot confirm it still leads.
+	c.network.Disconnect(old.ID())
+	ran := false
+	if err := old.Read(testContext(t), func(storage store.Store) {
+		ran = true
+	}); err == nil || ran {
+		t.Fatalf("deposed leader served a read: %v", err)
+	}
+
+	next := c.leader()
+	c.put(next, "k", "2")
+	if err := next.Read(testContext(t), func(storage store.Store) {
+		read, _ = storage.Get("k")
+	}); err != nil || read != "2" {
+		t.Fatalf("new leader read %q, %v", read, err)
+	}
+
+	if _, err := old.ReadIndex(testContext(t)); err == nil {
+		t.Fatal("deposed leader returned a read index")
+	}
+
+	c.network.Reconnect(old.ID())
+	c.waitValue(old, "k", "2")
+	waitFor(t, "the old leader to follow", func() bool {
+		return old.Status().Leader == next.ID()
+	})
+}
+
+func TestInstallsSnapshotOnLaggingNode(t *testing.T) {
+	c := newTestCluster(t, 3, 20)
+	leader := c.leader()
+	var lagging *Node
+	for _, n := range c.nodes {
+		if n != leader {
+			lagging = n
+			break
+		}
+	}
+
+	c.put(leader, "before", "1")
+	c.waitValue(lagging, "before", "1")
+	c.network.Disconnect(lagging.ID())
+	for i := 0; i < 100; i++ {
+		c.put(leader, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	c.put(leader, "bin\xff", "\xff\xfe")
+	if err := leader.Apply(testContext(t), Command{Op: store.DEL_COMMAND,
+		Key: []byte("before")}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the leader to compact its log", func() bool {
+		return leader.Status().SnapshotIndex > lagging.Status().LastIndex
+	})
+
+	c.network.Reconnect(lagging.ID())
+	waitFor(t, "the lagging node to install a snapshot", func() bool {
+		return lagging.Status().SnapshotIndex > 0
+	})
+	c.waitValue(lagging, "key-99", "value-99")
+	for i := 0; i < 100; i++ {
+		if value, ok := localGet(lagging, fmt.Sprintf("key-%d", i)); !ok ||
+			value != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("lagging node has key-%d = %q, %v", i, value, ok)
+		}
+	}
+
+	if value, ok := localGet(lagging, "bin\xff"); !ok || value != "\xff\xfe" {
+		t.Fatalf("lagging node has a binary value of %q, %v", value, ok)
+	}
+
+	// The snapshot replaces the content, so keys deleted since are gone.
+	if _, ok := localGet(lagging, "before"); ok {
+		t.Fatal("key deleted on the leader survived the snapshot")
+	}
+
+	// The returning node may have started an election while it was cut off.
+	c.putOnLeader("after", "\xff\xfe")
+	c.waitValue(lagging, "after", "\xff\xfe")
+}
+
+// changeMembership retries a change until the leader is ready for it.
+func changeMembership(t *testing.T, change func(ctx context.Context) error) {
+	t.Helper()
+	var err error
+	waitFor(t, "the membership change", func() bool {
+		err = change(testContext(t))
+		return err != ErrNotReady && err != ErrChangeInProgress
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddsAndRemovesMembers(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	c.put(leader, "before", "1")
+
+	joining := c.start("n4", nil)
+	changeMembership(t, func(ctx context.Context) error {
+		return leader.AddPeer(ctx, Peer{ID: "n4", Addr: "n4"})
+	})
+	c.waitValue(joining, "before", "1")
+	c.put(leader, "after", "2")
+	c.waitValue(joining, "after", "2")
+	if peers := joining.Status().Peers; len(peers) != 4 {
+		t.Fatalf("new member knows %d peers", len(peers))
+	}
+
+	// With four members a write needs three of them, one may be removed.
+	var removed *Node
+	for _, n := range c.nodes {
+		if n != leader && n != joining {
+			removed = n
+			break
+		}
+	}
+
+	changeMembership(t, func(ctx context.Context) error {
+		return leader.RemovePeer(ctx, removed.ID())
+	})
+	removed.Stop()
+	c.network.Remove(removed.ID())
+	delete(c.nodes, removed.ID())
+
+	c.put(leader, "three", "3")
+	if peers := leader.Status().Peers; len(peers) != 3 {
+		t.Fatalf("leader knows %d peers after a removal", len(peers))
+	}
+
+	// A leader removing itself hands over to one of the others.
+	changeMembership(t, func(ctx context.Context) error {
+		return leader.RemovePeer(ctx, leader.ID())
+	})
+	waitFor(t, "the removed leader to step down", func() bool {
+		return leader.Status().State != LEADER
+	})
+	c.network.Remove(leader.ID())
+	delete(c.nodes, leader.ID())
+
+	next := c.leader()
+	c.put(next, "two", "2")
+	for _, n := range c.nodes {
+		c.waitValue(n, "two", "2")
+		c.waitValue(n, "three", "3")
+	}
+}
+
+func TestReplicaWatchesAppliedWrites(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	var follower *Node
+	for _, n := range c.nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+
+	watchable, ok := NewReplica(follower, 0).(store.Watchable)
+	if !ok {
+		t.Fatal("replica is not watchable")
+	}
+
+	watcher, err := watchable.Watch(store.WatchFilter{Prefix: "w"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.put(leader, "w1", "a")
+	c.put(leader, "x", "b")
+	c.put(leader, "w2", "c")
+
+	var keys []string
+	waitFor(t, "the follower to report the writes", func() bool {
+		events, err := watcher.Next(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range events {
+			keys = append(keys, e.Key)
+		}
+		return len(keys) >= 2
+	})
+
+	if fmt.Sprint(keys) != "[w1 w2]" {
+		t.Fatalf("follower reported %v", keys)
+	}
+}
@@ -0,0 +1,243 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"time"
+)
+
+const (
+	MPUT_COMMAND string = "mput"
+
+	// DEFAULT_REQUEST_TIMEOUT bounds each call of a Replica.
+	DEFAULT_REQUEST_TIMEOUT time.Duration = 10 * time.Second
+)
+
+// applyCommand writes a committed command to a replica's store.
+func applyCommand(storage store.Store, cmd *Command) error {
+	if cmd == nil {
+		return nil
+	}
+
+	switch cmd.Op {
+	case store.PUT_COMMAND:
+		return storage.Put(string(cmd.Key), string(cmd.Value))
+	case store.DEL_COMMAND:
+		storage.Del(string(cmd.Key))
+		return nil
+	case MPUT_COMMAND:
+		return storage.MultiPut(fromItems(cmd.Items))
+	case store.DELRANGE_COMMAND:
+		return storage.DeleteRange(string(cmd.Key), string(cmd.Value))
+	case store.INDEX_COMMAND:
+		return storage.DefineIndex(store.IndexDefinition{Name: string(cmd.Key),
+			Type: string(cmd.Value), PrefixLength: cmd.PrefixLength})
+	}
+
+	return fmt.Errorf("Unknown raft command %q.", cmd.Op)
+}
+
+// Replica is a store.Store backed by a raft node, so the server front ends
+// serve a replicated store unchanged. Writes go through the log and reads
+// through a read index, both only on the leader. Each call gets its own
+// timeout, errors of the calls that cannot return one are logged.
+type Replica struct {
+	node    *Node
+	timeout time.Duration
+}
+
+// NewReplica wraps node, a zero timeout takes DEFAULT_REQUEST_TIMEOUT.
+func NewReplica(node *Node, timeout time.Duration) store.Store {
+	if timeout <= 0 {
+		timeout = DEFAULT_REQUEST_TIMEOUT
+	}
+
+	return &Replica{node, timeout}
+}
+
+func (r *Replica) apply(cmd Command) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.node.Apply(ctx, cmd)
+}
+
+func (r *Replica) read(f func(storage store.Store)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.node.Read(ctx, f)
+}
+
+func (r *Replica) Put(key string, value string) error {
+	return r.apply(Command{Op: store.PUT_COMMAND, Key: []byte(key), Value: []byte(value)})
+}
+
+func (r *Replica) Get(key string) (value string, ok bool) {
+	err := r.read(func(storage store.Store) {
+		value, ok = storage.Get(key)
+	})
+
+	if err != nil {
+		log.Errorf("Could not get %s: %v", key, err)
+		return "", false
+	}
+
+	return value, ok
+}
+
+func (r *Replica) Del(key string) {
+	if err := r.apply(Command{Op: store.DEL_COMMAND, Key: []byte(key)}); err != nil {
+		log.Errorf("Could not delete %s: %v", key, err)
+	}
+}
+
+func (r *Replica) Scan(keyone string, keytwo string) (items []store.KeyValue, ok bool) {
+	err := r.read(func(storage store.Store) {
+		items, ok = storage.Scan(keyone, keytwo)
+	})
+
+	if err != nil {
+		log.Errorf("Could not scan %s to %s: %v", keyone, keytwo, err)
+		return nil, false
+	}
+
+	return items, ok
+}
+
+func (r *Replica) MultiGet(keys []string) (items []store.KeyValue) {
+	err := r.read(func(storage store.Store) {
+		items = storage.MultiGet(keys)
+	})
+
+	if err != nil {
+		log.Errorf("Could not get %d keys: %v", len(keys), err)
+	}
+
+	return items
+}
+
+func (r *Replica) MultiPut(items []store.KeyValue) error {
+	return r.apply(Command{Op: MPUT_COMMAND, Items: toItems(items)})
+}
+
+func (r *Replica) Exists(key string) (found bool) {
+	err := r.read(func(storage store.Store) {
+		found = storage.Exists(key)
+	})
+
+	if err != nil {
+		log.Errorf("Could not check %s: %v", key, err)
+	}
+
+	return found
+}
+
+func (r *Replica) Count(keyone string, keytwo string) (count int, ok bool) {
+	err := r.read(func(storage store.Store) {
+		count, ok = storage.Count(keyone, keytwo)
+	})
+
+	if err != nil {
+		log.Errorf("Could not count %s to %s: %v", keyone, keytwo, err)
+		return 0, false
+	}
+
+	return count, ok
+}
+
+func (r *Replica) DeleteRange(start string, end string) error {
+	return r.apply(Command{Op: store.DELRANGE_COMMAND, Key: []byte(start),
+		Value: []byte(end)})
+}
+
+// Flush flushes the local store only, it does not change its content.
+func (r *Replica) Flush() {
+	r.node.local(func(storage store.Store) {
+		storage.Flush()
+	})
+}
+
+func (r *Replica) DefineIndex(def store.IndexDefinition) error {
+	if err := def.Validate(); err != nil {
+		return err
+	}
+
+	return r.apply(Command{Op: store.INDEX_COMMAND, Key: []byte(def.Name),
+		Value: []byte(def.Type), PrefixLength: def.PrefixLength})
+}
+
+func (r *Replica) QueryIndex(indexName string, value string) (keys []string, err error) {
+	readErr := r.read(func(storage store.Store) {
+		keys, err = storage.QueryIndex(indexName, value)
+	})
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	return keys, err
+}
+
+// RebuildIndexes rebuilds the local indexes, they are derived from the
+// replicated content.
+func (r *Replica) RebuildIndexes() (err error) {
+	r.node.local(func(storage store.Store) {
+		err = storage.RebuildIndexes()
+	})
+
+	return err
+}
+
+// Stats reports the raft state followed by the local store's figures.
+func (r *Replica) Stats() []store.Stat {
+	status := r.node.Status()
+	stats := []store.Stat{
+		{Name: "raft id", Value: status.ID},
+		{Name: "raft state", Value: status.State},
+		{Name: "raft term", Value: fmt.Sprintf("%d", status.Term)},
+		{Name: "raft leader", Value: status.Leader},
+		{Name: "raft peers", Value: fmt.Sprintf("%d", len(status.Peers))},
+		{Name: "raft last index", Value: fmt.Sprintf("%d", status.LastIndex)},
+		{Name: "raft commit index", Value: fmt.Sprintf("%d", status.CommitIndex)},
+		{Name: "raft last applied", Value: fmt.Sprintf("%d", status.LastApplied)},
+		{Name: "raft snapshot index", Value: fmt.Sprintf("%d", status.SnapshotIndex)},
+	}
+
+	r.node.local(func(storage store.Store) {
+		if inspector, ok := storage.(store.Inspector); ok {
+			stats = append(stats, inspector.Stats()...)
+		}
+	})
+
+	return stats
+}
+
+func (r *Replica) Files() []string {
+	var files []string
+	r.node.local(func(storage store.Store) {
+		if inspector, ok := storage.(store.Inspector); ok {
+			files = inspector.Files()
+		}
+	})
+
+	dir := r.node.config.Dir
+	return append(files, filepath.Join(dir, STATE_FILE), filepath.Join(dir, LOG_FILE),
+		filepath.Join(dir, SNAPSHOT_FILE))
+}
+
+// Watch follows the writes this member applies to its local store, on
+// followers too. A snapshot installed in between cuts the local log, the
+// watcher then returns store.ErrLogTruncated.
+func (r *Replica) Watch(filter store.WatchFilter, from store.WatchPosition) (*store.Watcher, error) {
+	watchable, ok := r.node.storage.(store.Watchable)
+	if !ok {
+		return nil, errors.New("Local store keeps no write-ahead log to watch.")
+	}
+
+	return store.LockedWatch(watchable, filter, from, func(f func()) {
+		r.node.local(func(storage store.Store) { f() })
+	})
+}
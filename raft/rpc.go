@@ -0,0 +1,252 @@
+package raft
+
+import (
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"time"
+)
+
+type VoteRequest struct {
+	Term      int64  `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex int64  `json:"last_index"`
+	LastTerm  int64  `json:"last_term"`
+}
+
+type VoteReply struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+// AppendRequest carries entries after PrevIndex, without any it is a
+// heartbeat.
+type AppendRequest struct {
+	Term         int64   `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevIndex    int64   `json:"prev_index"`
+	PrevTerm     int64   `json:"prev_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit int64   `json:"leader_commit"`
+}
+
+// AppendReply tells a leader how far the follower's log matches. On a
+// mismatch ConflictIndex is where the leader should retry from.
+type AppendReply struct {
+	Term          int64 `json:"term"`
+	Success       bool  `json:"success"`
+	MatchIndex    int64 `json:"match_index"`
+	ConflictIndex int64 `json:"conflict_index"`
+}
+
+// SnapshotRequest replaces a follower's store with the leader's as of
+// Index, Peers is the membership in effect there. Sequence, Indexes and
+// Items are the store.Snapshot, its items as bytes.
+type SnapshotRequest struct {
+	Term     int64                   `json:"term"`
+	Leader   string                  `json:"leader"`
+	Index    int64                   `json:"index"`
+	LastTerm int64                   `json:"last_term"`
+	Peers    []Peer                  `json:"peers"`
+	Sequence int64                   `json:"sequence"`
+	Indexes  []store.IndexDefinition `json:"indexes"`
+	Items    []Item                  `json:"items"`
+}
+
+func (r SnapshotRequest) snapshot() store.Snapshot {
+	return store.Snapshot{Sequence: r.Sequence, Indexes: r.Indexes, Items: fromItems(r.Items)}
+}
+
+type SnapshotReply struct {
+	Term int64 `json:"term"`
+}
+
+// observeLeader records a request from the leader of term.
+func (n *Node) observeLeader(term int64, leader string) {
+	n.stepDown(term)
+	n.leader = leader
+	n.lastContact = time.Now()
+	n.resetElectionDeadline()
+}
+
+// HandleRequestVote answers a candidate. While the node hears from a
+// leader it ignores candidates, so a removed server timing out cannot
+// disrupt the cluster.
+func (n *Node) HandleRequestVote(req VoteRequest) (VoteReply, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return VoteReply{}, ErrStopped
+	}
+
+	reply := VoteReply{Term: n.term}
+	if req.Term < n.term {
+		return reply, nil
+	}
+
+	if n.state == LEADER || (n.leader != "" &&
+		time.Since(n.lastContact) < n.config.ElectionTimeout) {
+		return reply, nil
+	}
+
+	n.stepDown(req.Term)
+	reply.Term = n.term
+	upToDate := req.LastTerm > n.log.lastTerm() ||
+		(req.LastTerm == n.log.lastTerm() && req.LastIndex >= n.log.lastIndex())
+	if !upToDate || (n.vote != "" && n.vote != req.Candidate) {
+		return reply, nil
+	}
+
+	if err := n.setHardState(n.term, req.Candidate); err != nil {
+		log.Errorf("Could not save raft state of %s: %v", n.config.ID, err)
+		return reply, nil
+	}
+
+	n.resetElectionDeadline()
+	reply.Granted = true
+	return reply, nil
+}
+
+// HandleAppendEntries appends the leader's entries after the point where
+// the logs match, dropping any of its own that conflict.
+func (n *Node) HandleAppendEntries(req AppendRequest) (AppendReply, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return AppendReply{}, ErrStopped
+	}
+
+	reply := AppendReply{Term: n.term}
+	if req.Term < n.term {
+		return reply, nil
+	}
+
+	n.observeLeader(req.Term, req.Leader)
+	reply.Term = n.term
+	if req.PrevIndex > n.log.lastIndex() {
+		reply.ConflictIndex = n.log.lastIndex() + 1
+		return reply, nil
+	}
+
+	if req.PrevIndex > n.log.snapIndex {
+		if term, _ := n.log.term(req.PrevIndex); term != req.PrevTerm {
+			conflict := req.PrevIndex
+			for conflict > n.log.snapIndex+1 {
+				if before, _ := n.log.term(conflict - 1); before != term {
+					break
+				}
+				conflict--
+			}
+			reply.ConflictIndex = conflict
+			return reply, nil
+		}
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= n.log.snapIndex {
+			continue
+		}
+
+		if e.Index <= n.log.lastIndex() {
+			if term, _ := n.log.term(e.Index); term == e.Term {
+				continue
+			}
+
+			if e.Index <= n.commitIndex {
+				return reply, fmt.Errorf("Leader %s conflicts with committed entry %d.",
+					req.Leader, e.Index)
+			}
+
+			if err := n.log.truncate(e.Index); err != nil {
+				return reply, err
+			}
+		}
+
+		if err := n.log.append(req.Entries[i:]...); err != nil {
+			return reply, err
+		}
+		break
+	}
+	n.updateConfig()
+
+	last := req.PrevIndex + int64(len(req.Entries))
+	if req.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		commit := req.LeaderCommit
+		if commit > last {
+			commit = last
+		}
+		n.setCommitIndex(commit)
+	}
+
+	reply.Success = true
+	reply.MatchIndex = last
+	return reply, nil
+}
+
+// HandleInstallSnapshot restores the store from a leader's snapshot. Log
+// entries past it are kept when the log matches at its index.
+func (n *Node) HandleInstallSnapshot(req SnapshotRequest) (SnapshotReply, error) {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return SnapshotReply{}, ErrStopped
+	}
+
+	if req.Term < n.term {
+		reply := SnapshotReply{Term: n.term}
+		n.mutex.Unlock()
+		return reply, nil
+	}
+	n.observeLeader(req.Term, req.Leader)
+	n.mutex.Unlock()
+
+	n.storeMutex.Lock()
+	defer n.storeMutex.Unlock()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	reply := SnapshotReply{Term: n.term}
+	if req.Index <= n.lastApplied {
+		return reply, nil
+	}
+
+	if err := n.replicated.Restore(req.snapshot()); err != nil {
+		return reply, err
+	}
+
+	meta := snapshotMeta{Index: req.Index, Term: req.LastTerm, Peers: req.Peers}
+	if err := writeJsonFile(filepath.Join(n.config.Dir, SNAPSHOT_FILE), meta); err != nil {
+		return reply, err
+	}
+
+	var err error
+	if term, ok := n.log.term(req.Index); ok && term == req.LastTerm {
+		err = n.log.compact(req.Index, req.LastTerm)
+	} else {
+		err = n.log.reset(req.Index, req.LastTerm)
+	}
+
+	if err != nil {
+		return reply, err
+	}
+
+	n.snapPeers = req.Peers
+	n.updateConfig()
+	for index, w := range n.waiters {
+		if index <= req.Index {
+			w.done <- ErrLostEntry
+			delete(n.waiters, index)
+		}
+	}
+
+	n.lastApplied = req.Index
+	if n.commitIndex < req.Index {
+		n.commitIndex = req.Index
+	}
+	close(n.applied)
+	n.applied = make(chan struct{})
+
+	log.Infof("Raft node %s installed a snapshot up to %d from %s.", n.config.ID,
+		req.Index, req.Leader)
+	return reply, nil
+}
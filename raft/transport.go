@@ -0,0 +1,144 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Transport carries the requests of a node to its peers.
+type Transport interface {
+	RequestVote(ctx context.Context, peer Peer, req VoteRequest) (VoteReply, error)
+	AppendEntries(ctx context.Context, peer Peer, req AppendRequest) (AppendReply, error)
+	InstallSnapshot(ctx context.Context, peer Peer, req SnapshotRequest) (SnapshotReply, error)
+}
+
+// MemoryNetwork connects nodes of one process, for running a whole cluster
+// in tests. Nodes are reached by their id, and can be cut off to simulate
+// crashes and partitions. Messages go through json as they would on the
+// wire, so nodes share no memory.
+type MemoryNetwork struct {
+	mutex        sync.Mutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*Node),
+		disconnected: make(map[string]bool)}
+}
+
+// Transport returns the transport for the node with id.
+func (m *MemoryNetwork) Transport(id string) Transport {
+	return &memoryTransport{network: m, from: id}
+}
+
+// Add makes a node reachable, replacing an earlier node with its id.
+func (m *MemoryNetwork) Add(node *Node) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nodes[node.ID()] = node
+}
+
+func (m *MemoryNetwork) Remove(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.nodes, id)
+}
+
+// Disconnect drops every message from or to the node with id.
+func (m *MemoryNetwork) Disconnect(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.disconnected[id] = true
+}
+
+func (m *MemoryNetwork) Reconnect(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.disconnected, id)
+}
+
+func (m *MemoryNetwork) route(from string, to string) (*Node, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, ok := m.nodes[to]
+	if !ok || m.disconnected[from] || m.disconnected[to] {
+		return nil, fmt.Errorf("Node %s cannot reach %s.", from, to)
+	}
+
+	return node, nil
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    string
+}
+
+// roundTrip copies req and the reply through json around handle.
+func roundTrip(ctx context.Context, req interface{}, in interface{}, reply interface{},
+	handle func() (interface{}, error)) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, in); err != nil {
+		return err
+	}
+
+	out, err := handle()
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if data, err = json.Marshal(out); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, reply)
+}
+
+func (t *memoryTransport) RequestVote(ctx context.Context, peer Peer, req VoteRequest) (reply VoteReply, err error) {
+	node, err := t.network.route(t.from, peer.ID)
+	if err != nil {
+		return reply, err
+	}
+
+	var in VoteRequest
+	err = roundTrip(ctx, req, &in, &reply, func() (interface{}, error) {
+		return node.HandleRequestVote(in)
+	})
+	return reply, err
+}
+
+func (t *memoryTransport) AppendEntries(ctx context.Context, peer Peer, req AppendRequest) (reply AppendReply, err error) {
+	node, err := t.network.route(t.from, peer.ID)
+	if err != nil {
+		return reply, err
+	}
+
+	var in AppendRequest
+	err = roundTrip(ctx, req, &in, &reply, func() (interface{}, error) {
+		return node.HandleAppendEntries(in)
+	})
+	return reply, err
+}
+
+func (t *memoryTransport) InstallSnapshot(ctx context.Context, peer Peer, req SnapshotRequest) (reply SnapshotReply, err error) {
+	node, err := t.network.route(t.from, peer.ID)
+	if err != nil {
+		return reply, err
+	}
+
+	var in SnapshotRequest
+	err = roundTrip(ctx, req, &in, &reply, func() (interface{}, error) {
+		return node.HandleInstallSnapshot(in)
+	})
+	return reply, err
+}
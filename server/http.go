@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_HTTP_ADDR string = "127.0.0.1:8080"
+
+	// MAX_HTTP_BODY_BYTES bounds the value of a put, larger bodies are
+	// refused with 413.
+	MAX_HTTP_BODY_BYTES int64 = 16 << 20
+
+	KV_PATH    string = "/kv"
+	FLUSH_PATH string = "/admin/flush"
+	STATS_PATH string = "/admin/stats"
+)
+
+// httpItem is a key and its value, json encodes both in base64 so any
+// bytes come back unchanged.
+type httpItem struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+type httpStat struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Could not write http response: %v", err)
+	}
+}
+
+func writeHttpError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJson(w, status, httpError{fmt.Sprintf(format, args...)})
+}
+
+// allowMethods answers 405 when the request method is not one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeHttpError(w, http.StatusMethodNotAllowed, "Method %s is not allowed.", r.Method)
+	return false
+}
+
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(KV_PATH, s.handleRange)
+	mux.HandleFunc(KV_PATH+"/", s.handleKey)
+	mux.HandleFunc(FLUSH_PATH, s.handleFlush)
+	mux.HandleFunc(STATS_PATH, s.handleStats)
+	mux.HandleFunc(REPLICATION_LOG_PATH, s.handleLog)
+	mux.HandleFunc(REPLICATION_SNAPSHOT_PATH, s.handleSnapshot)
+	mux.HandleFunc(REPLICATION_STATUS_PATH, s.handleStatus)
+	mux.HandleFunc(WATCH_PATH, s.handleWatch)
+	return mux
+}
+
+// handleKey serves GET, PUT and DELETE on /kv/{key}. The body of a put is
+// the value as is.
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, KV_PATH+"/")
+	if key == "" {
+		writeHttpError(w, http.StatusBadRequest, "Missing key.")
+		return
+	}
+
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	if r.Method != http.MethodGet && s.readOnly() {
+		writeHttpError(w, http.StatusForbidden, "%v", errReadOnly)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var value string
+		var ok bool
+		s.withStore(func(storage store.Store) {
+			value, ok = storage.Get(key)
+		})
+
+		if !ok {
+			writeHttpError(w, http.StatusNotFound, "Key %s not found.", key)
+			return
+		}
+
+		writeJson(w, http.StatusOK, httpItem{[]byte(key), []byte(value)})
+	case http.MethodPut:
+		if store.IsReservedKey(key) {
+			writeHttpError(w, http.StatusBadRequest, "Key %q is reserved for internal use.", key)
+			return
+		}
+
+		// One byte past the limit tells a body that is too large from one
+		// that is just as large.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_HTTP_BODY_BYTES+1))
+		if err != nil {
+			writeHttpError(w, http.StatusBadRequest, "Could not read value: %v", err)
+			return
+		}
+
+		if int64(len(body)) > MAX_HTTP_BODY_BYTES {
+			writeHttpError(w, http.StatusRequestEntityTooLarge,
+				"Value is larger than %d bytes.", MAX_HTTP_BODY_BYTES)
+			return
+		}
+
+		s.withStore(func(storage store.Store) {
+			err = storage.Put(key, string(body))
+		})
+
+		if err != nil {
+			writeHttpError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		var found bool
+		s.withStoreExclusive(func(storage store.Store) {
+			if found = storage.Exists(key); found {
+				storage.Del(key)
+			}
+		})
+
+		if !found {
+			writeHttpError(w, http.StatusNotFound, "Key %s not found.", key)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRange serves GET /kv?start=&end=&limit=, the keys a scan between
+// start and end selects. The array is streamed out one item at a time.
+func (s *Server) handleRange(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	start, end := query.Get("start"), query.Get("end")
+	if start == "" || end == "" {
+		writeHttpError(w, http.StatusBadRequest, "Range reads need start and end.")
+		return
+	}
+
+	limit := -1
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeHttpError(w, http.StatusBadRequest, "Invalid limit %q.", l)
+			return
+		}
+		limit = n
+	}
+
+	var items []store.KeyValue
+	var ok bool
+	s.withStore(func(storage store.Store) {
+		items, ok = storage.Scan(start, end)
+	})
+
+	if !ok {
+		writeHttpError(w, http.StatusInternalServerError,
+			"Could not read keys between %s and %s.", start, end)
+		return
+	}
+
+	if limit >= 0 && len(items) > limit {
+		items = items[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	w.Write([]byte("["))
+	for n, kv := range items {
+		item, err := json.Marshal(httpItem{[]byte(kv.Key), []byte(kv.Value)})
+		if n > 0 {
+			item = append([]byte(","), item...)
+		}
+
+		if err == nil {
+			_, err = w.Write(item)
+		}
+
+		if err != nil {
+			log.Errorf("Could not stream range to %s: %v", r.RemoteAddr, err)
+			return
+		}
+
+		if flusher != nil && n%100 == 99 {
+			flusher.Flush()
+		}
+	}
+	w.Write([]byte("]\n"))
+}
+
+func (s *Server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	s.withStore(func(storage store.Store) {
+		storage.Flush()
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var stats []store.Stat
+	var ok bool
+	s.withStore(func(storage store.Store) {
+		var inspector store.Inspector
+		if inspector, ok = storage.(store.Inspector); ok {
+			stats = inspector.Stats()
+		}
+	})
+
+	if !ok {
+		writeHttpError(w, http.StatusNotImplemented, "Store does not report stats.")
+		return
+	}
+
+	body := make([]httpStat, 0, len(stats))
+	for _, stat := range stats {
+		body = append(body, httpStat{stat.Name, stat.Value})
+	}
+	writeJson(w, http.StatusOK, body)
+}
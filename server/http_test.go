@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// failingPut is a store whose puts fail.
+type failingPut struct {
+	store.Store
+}
+
+func (failingPut) Put(key string, value string) error {
+	return errors.New("disk gone")
+}
+
+type failingBody struct{}
+
+func (failingBody) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func serveHttp(s *Server, method string, target string, body io.Reader) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(w, httptest.NewRequest(method, target, body))
+	return w
+}
+
+func TestHttpStatusCodes(t *testing.T) {
+	s := NewServer(openTestStore(t, t.TempDir()))
+	failing := NewServer(failingPut{openTestStore(t, t.TempDir())})
+	tooLarge := strings.Repeat("v", int(MAX_HTTP_BODY_BYTES)+1)
+
+	tests := []struct {
+		name   string
+		server *Server
+		method string
+		target string
+		body   io.Reader
+		status int
+	}{
+		{"put", s, http.MethodPut, KV_PATH + "/a", strings.NewReader("1"), http.StatusNoContent},
+		{"get", s, http.MethodGet, KV_PATH + "/a", nil, http.StatusOK},
+		{"missing key", s, http.MethodGet, KV_PATH + "/", nil, http.StatusBadRequest},
+		{"unknown key", s, http.MethodGet, KV_PATH + "/b", nil, http.StatusNotFound},
+		{"post", s, http.MethodPost, KV_PATH + "/a", nil, http.StatusMethodNotAllowed},
+		{"reserved key", s, http.MethodPut, KV_PATH + "/%00idxdefs", strings.NewReader("1"),
+			http.StatusBadRequest},
+		{"largest value", s, http.MethodPut, KV_PATH + "/c", strings.NewReader(tooLarge[1:]),
+			http.StatusNoContent},
+		{"too large", s, http.MethodPut, KV_PATH + "/c", strings.NewReader(tooLarge),
+			http.StatusRequestEntityTooLarge},
+		{"read error", s, http.MethodPut, KV_PATH + "/c", failingBody{}, http.StatusBadRequest},
+		{"store error", failing, http.MethodPut, KV_PATH + "/a", strings.NewReader("1"),
+			http.StatusInternalServerError},
+		{"delete", s, http.MethodDelete, KV_PATH + "/a", nil, http.StatusNoContent},
+		{"delete again", s, http.MethodDelete, KV_PATH + "/a", nil, http.StatusNotFound},
+		{"range without end", s, http.MethodGet, KV_PATH + "?start=a", nil, http.StatusBadRequest},
+		{"invalid limit", s, http.MethodGet, KV_PATH + "?start=a&end=b&limit=x", nil,
+			http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if w := serveHttp(test.server, test.method, test.target, test.body); w.Code != test.status {
+			t.Errorf("%s answered %d %s, want %d", test.name, w.Code, w.Body, test.status)
+		}
+	}
+
+	if value, _ := s.storage.Get("c"); len(value) != int(MAX_HTTP_BODY_BYTES) {
+		t.Fatalf("value as large as the limit is stored as %d bytes", len(value))
+	}
+}
+
+func TestHttpValuesAreBinarySafe(t *testing.T) {
+	s := NewServer(openTestStore(t, t.TempDir()))
+	w := serveHttp(s, http.MethodPut, KV_PATH+"/b%FF", strings.NewReader("\xff\xfe"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("put answered %d %s", w.Code, w.Body)
+	}
+
+	var item httpItem
+	w = serveHttp(s, http.MethodGet, KV_PATH+"/b%FF", nil)
+	if err := json.NewDecoder(w.Body).Decode(&item); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(item.Key) != "b\xff" || string(item.Value) != "\xff\xfe" {
+		t.Fatalf("get returned %q = %q", item.Key, item.Value)
+	}
+}
+
+func TestHttpRangeStreamsEveryItem(t *testing.T) {
+	s := NewServer(openTestStore(t, t.TempDir()))
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		serveHttp(s, http.MethodPut, KV_PATH+"/"+key, strings.NewReader("\xff"+key))
+	}
+
+	// Scans select keys by hash, the range is whatever the store scans.
+	scanned, ok := s.storage.Scan("k000", "k999")
+	if !ok || len(scanned) < 200 {
+		t.Fatalf("store scanned %d keys", len(scanned))
+	}
+
+	var want []httpItem
+	for _, kv := range scanned {
+		want = append(want, httpItem{[]byte(kv.Key), []byte(kv.Value)})
+	}
+
+	for _, test := range []struct {
+		limit string
+		n     int
+	}{{"", len(want)}, {"0", 0}, {"7", 7}, {"1000", len(want)}} {
+		w := serveHttp(s, http.MethodGet, KV_PATH+"?start=k000&end=k999&limit="+test.limit, nil)
+		var items []httpItem
+		if err := json.NewDecoder(w.Body).Decode(&items); err != nil {
+			t.Fatalf("range with limit %q: %v", test.limit, err)
+		}
+
+		if len(items) != test.n || !reflect.DeepEqual(items, want[:len(items)]) {
+			t.Fatalf("range with limit %q returned %d items, want %d", test.limit, len(items), test.n)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_MEMCACHED_ADDR string = "127.0.0.1:11211"
+
+	// MEMCACHED_RELATIVE_EXPTIME is the longest exptime taken as seconds
+	// from now, larger ones are unix times.
+	MEMCACHED_RELATIVE_EXPTIME int64 = 60 * 60 * 24 * 30
+	MAX_MEMCACHED_KEY_LENGTH   int   = 250
+	MAX_MEMCACHED_VALUE_BYTES  int   = 16 << 20
+
+	// MEMCACHED_CAS_BATCH is the number of cas tokens reserved with one
+	// write of the token counter.
+	MEMCACHED_CAS_BATCH uint64 = 1000
+)
+
+// memcachedCasKey holds the end of the last reserved batch of cas tokens,
+// memcached keys are never empty.
+var memcachedCasKey = store.MetaKey("")
+
+// memcachedItem is a value with the memcached fields kept alongside it.
+// The data is the value of the key, so every front end reads the same
+// value. The other fields are kept under its meta key as "<flags>
+// <exptime> <cas> <checksum>". Exptime is a unix time, zero never expires.
+type memcachedItem struct {
+	flags   uint32
+	exptime int64
+	cas     uint64
+	data    string
+}
+
+func (i memcachedItem) meta() string {
+	return fmt.Sprintf("%d %d %d %d", i.flags, i.exptime, i.cas,
+		crc32.ChecksumIEEE([]byte(i.data)))
+}
+
+// decodeMemcachedItem joins the value of a key with its meta. The checksum
+// ties the meta to the data it was written with, a value written since by
+// another front end reads with no flags, no expiry and cas 0.
+func decodeMemcachedItem(data string, meta string, hasMeta bool) memcachedItem {
+	item := memcachedItem{data: data}
+	if !hasMeta {
+		return item
+	}
+
+	var checksum uint32
+	var withMeta memcachedItem
+	if _, err := fmt.Sscanf(meta, "%d %d %d %d", &withMeta.flags, &withMeta.exptime,
+		&withMeta.cas, &checksum); err != nil || checksum != crc32.ChecksumIEEE([]byte(data)) {
+		return item
+	}
+
+	withMeta.data = data
+	return withMeta
+}
+
+func (i memcachedItem) expired(now time.Time) bool {
+	return i.exptime != 0 && i.exptime <= now.Unix()
+}
+
+// memcachedExptime turns the exptime of a command into a unix time,
+// negative ones expire at once.
+func memcachedExptime(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now.Unix() - 1
+	case exptime <= MEMCACHED_RELATIVE_EXPTIME:
+		return now.Unix() + exptime
+	}
+
+	return exptime
+}
+
+// memcachedGet returns the live item of key. Expired items are deleted on
+// the way.
+func memcachedGet(storage store.Store, key string, now time.Time) (item memcachedItem, ok bool) {
+	value, ok := storage.Get(key)
+	if !ok {
+		return item, false
+	}
+
+	meta, hasMeta := storage.Get(store.MetaKey(key))
+	item = decodeMemcachedItem(value, meta, hasMeta)
+	if item.expired(now) {
+		memcachedDel(storage, key)
+		return item, false
+	}
+
+	return item, true
+}
+
+// memcachedPut writes the data before the meta, so a crash in between
+// leaves the new data with no flags rather than the old data with the new
+// flags. An item spans two keys, so memcached commands hold the store lock
+// alone.
+func memcachedPut(storage store.Store, key string, item memcachedItem) error {
+	return storage.MultiPut([]store.KeyValue{{Key: key, Value: item.data},
+		{Key: store.MetaKey(key), Value: item.meta()}})
+}
+
+func memcachedDel(storage store.Store, key string) {
+	storage.Del(key)
+	storage.Del(store.MetaKey(key))
+}
+
+// nextCas hands out the next cas token, tokens only ever grow. A batch of
+// them is reserved in the store at a time, so a restart continues after
+// the last batch instead of reusing tokens. It runs with the store lock
+// held alone.
+func (s *Server) nextCas(storage store.Store) (uint64, error) {
+	if s.casNext >= s.casLimit {
+		last := s.casNext
+		if v, ok := storage.Get(memcachedCasKey); ok {
+			if n, err := strconv.ParseUint(v, 10, 64); err == nil && n > last {
+				last = n
+			}
+		}
+
+		limit := last + MEMCACHED_CAS_BATCH
+		if err := storage.Put(memcachedCasKey, strconv.FormatUint(limit, 10)); err != nil {
+			return 0, err
+		}
+		s.casNext, s.casLimit = last, limit
+	}
+
+	s.casNext++
+	return s.casNext, nil
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > MAX_MEMCACHED_KEY_LENGTH {
+		return false
+	}
+
+	for _, c := range []byte(key) {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serveMemcached answers the commands of one connection until it is
+// closed, sends quit or the server shuts down.
+func (s *Server) serveMemcached(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if netErr, ok := err.(net.Error); err != io.EOF && !(ok && netErr.Timeout()) {
+				log.Errorf("Could not read from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if quit := s.memcachedCommand(fields, r, w); quit {
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 {
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// memcachedCommand runs one command line, reading the data block of the
+// storage commands from r, and reports whether the connection should be
+// closed.
+func (s *Server) memcachedCommand(fields []string, r *bufio.Reader, w *bufio.Writer) (quit bool) {
+	name := strings.ToLower(fields[0])
+	args := fields[1:]
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	reply := func(line string) {
+		if !noreply {
+			w.WriteString(line + "\r\n")
+		}
+	}
+
+	switch name {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			return false
+		}
+		s.memcachedRetrieve(args, name == "gets", w)
+	case "set", "add", "replace", "cas":
+		return s.memcachedStore(name, args, noreply, r, w)
+	case "delete":
+		if s.readOnly() {
+			w.WriteString("SERVER_ERROR read only follower\r\n")
+			return false
+		}
+
+		if len(args) < 1 || !validMemcachedKey(args[0]) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+
+		found := false
+		s.withStoreExclusive(func(storage store.Store) {
+			if _, found = memcachedGet(storage, args[0], time.Now()); found {
+				memcachedDel(storage, args[0])
+			}
+		})
+
+		if found {
+			reply("DELETED")
+		} else {
+			reply("NOT_FOUND")
+		}
+	case "incr", "decr":
+		if s.readOnly() {
+			w.WriteString("SERVER_ERROR read only follower\r\n")
+			return false
+		}
+
+		if len(args) < 2 || !validMemcachedKey(args[0]) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return false
+		}
+		reply(s.memcachedIncr(args[0], delta, name == "incr"))
+	case "version":
+		w.WriteString("VERSION project2-A\r\n")
+	case "quit":
+		return true
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return false
+}
+
+// memcachedRetrieve answers get and gets, looking the keys up together.
+func (s *Server) memcachedRetrieve(keys []string, withCas bool, w *bufio.Writer) {
+	now := time.Now()
+	items := make(map[string]memcachedItem, len(keys))
+	s.withStoreExclusive(func(storage store.Store) {
+		lookup := make([]string, 0, 2*len(keys))
+		for _, key := range keys {
+			lookup = append(lookup, key, store.MetaKey(key))
+		}
+
+		values := make(map[string]string, len(lookup))
+		for _, kv := range storage.MultiGet(lookup) {
+			values[kv.Key] = kv.Value
+		}
+
+		for _, key := range keys {
+			data, ok := values[key]
+			if !ok {
+				continue
+			}
+
+			meta, hasMeta := values[store.MetaKey(key)]
+			item := decodeMemcachedItem(data, meta, hasMeta)
+			if item.expired(now) {
+				if !s.readOnly() {
+					memcachedDel(storage, key)
+				}
+				continue
+			}
+			items[key] = item
+		}
+	})
+
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			continue
+		}
+
+		if withCas {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.data),
+				item.cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.flags, len(item.data))
+		}
+		w.WriteString(item.data + "\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// memcachedStore answers set, add, replace and cas. The data block is read
+// even when the command line is bad, when its length is known.
+func (s *Server) memcachedStore(name string, args []string, noreply bool, r *bufio.Reader,
+	w *bufio.Writer) (quit bool) {
+	want := 4
+	if name == "cas" {
+		want = 5
+	}
+
+	if noreply {
+		args = args[:len(args)-1]
+	}
+
+	if len(args) != want {
+		w.WriteString("ERROR\r\n")
+		return false
+	}
+
+	key := args[0]
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+	var casUnique uint64
+	var casErr error
+	if name == "cas" {
+		casUnique, casErr = strconv.ParseUint(args[4], 10, 64)
+	}
+
+	if sizeErr != nil || size < 0 || size > MAX_MEMCACHED_VALUE_BYTES {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return true
+	}
+
+	if data[size] != '\r' || data[size+1] != '\n' {
+		if data[size+1] != '\n' {
+			r.ReadString('\n')
+		}
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+
+	if flagsErr != nil || exptimeErr != nil || casErr != nil || !validMemcachedKey(key) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+
+	if s.readOnly() {
+		w.WriteString("SERVER_ERROR read only follower\r\n")
+		return false
+	}
+
+	now := time.Now()
+	item := memcachedItem{flags: uint32(flags), exptime: memcachedExptime(exptime, now),
+		data: string(data[:size])}
+	result := "STORED"
+	var err error
+	s.withStoreExclusive(func(storage store.Store) {
+		old, exists := memcachedGet(storage, key, now)
+		switch {
+		case name == "add" && exists:
+			result = "NOT_STORED"
+		case name == "replace" && !exists:
+			result = "NOT_STORED"
+		case name == "cas" && !exists:
+			result = "NOT_FOUND"
+		case name == "cas" && old.cas != casUnique:
+			result = "EXISTS"
+		default:
+			if item.cas, err = s.nextCas(storage); err == nil {
+				err = memcachedPut(storage, key, item)
+			}
+		}
+	})
+
+	if err != nil {
+		log.Errorf("Could not store memcached item %s: %v", key, err)
+		w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return false
+	}
+
+	if !noreply {
+		w.WriteString(result + "\r\n")
+	}
+	return false
+}
+
+// memcachedIncr adds delta to the decimal value of key, wrapping at 64
+// bits, or subtracts it stopping at 0. The reply is the new value.
+func (s *Server) memcachedIncr(key string, delta uint64, incr bool) string {
+	var reply string
+	s.withStoreExclusive(func(storage store.Store) {
+		item, ok := memcachedGet(storage, key, time.Now())
+		if !ok {
+			reply = "NOT_FOUND"
+			return
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSpace(item.data), 10, 64)
+		if err != nil {
+			reply = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+			return
+		}
+
+		switch {
+		case incr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+
+		item.data = strconv.FormatUint(n, 10)
+		if item.cas, err = s.nextCas(storage); err == nil {
+			err = memcachedPut(storage, key, item)
+		}
+
+		if err != nil {
+			reply = "SERVER_ERROR " + err.Error()
+			return
+		}
+		reply = item.data
+	})
+
+	return reply
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mcConn is a minimal memcached text protocol client for tests.
+type mcConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialMemcached(t *testing.T, addr string) *mcConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &mcConn{t, conn, bufio.NewReader(conn)}
+}
+
+func (c *mcConn) line() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// do sends a command line, and the data block when there is one, and
+// returns the reply line.
+func (c *mcConn) do(command string, data ...string) string {
+	raw := command + "\r\n"
+	for _, block := range data {
+		raw += block + "\r\n"
+	}
+
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.line()
+}
+
+func (c *mcConn) expect(want string, command string, data ...string) {
+	c.t.Helper()
+	if got := c.do(command, data...); got != want {
+		c.t.Fatalf("%q answered %q, want %q", command, got, want)
+	}
+}
+
+type mcValue struct {
+	flags uint32
+	cas   uint64
+	data  string
+}
+
+// gets returns the item of key, ok is false when there is none.
+func (c *mcConn) gets(key string) (value mcValue, ok bool) {
+	c.t.Helper()
+	header := c.do("gets " + key)
+	if header == "END" {
+		return value, false
+	}
+
+	var name string
+	var size int
+	if _, err := fmt.Sscanf(header, "VALUE %s %d %d %d", &name, &value.flags, &size,
+		&value.cas); err != nil {
+		c.t.Fatalf("gets %s answered %q", key, header)
+	}
+
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.t.Fatal(err)
+	}
+	value.data = string(buf[:size])
+
+	if end := c.line(); end != "END" {
+		c.t.Fatalf("gets %s ended with %q", key, end)
+	}
+	return value, true
+}
+
+// startMemcachedServer serves dir over RESP and memcached and returns the
+// addresses in that order.
+func startMemcachedServer(t *testing.T, dir string) (*Server, string, string) {
+	s := NewServer(openTestStore(t, dir))
+	if err := s.Start(Config{RespAddr: "127.0.0.1:0", MemcachedAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Shutdown)
+	addrs := s.Addrs()
+	return s, addrs[0].String(), addrs[1].String()
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	_, _, addr := startMemcachedServer(t, t.TempDir())
+	c := dialMemcached(t, addr)
+
+	c.expect("STORED", "set a 3 0 1", "1")
+	c.expect("NOT_STORED", "add a 0 0 1", "2")
+	c.expect("NOT_STORED", "replace b 0 0 1", "2")
+	c.expect("STORED", "add b 0 0 1", "2")
+	c.expect("11", "incr a 10")
+	c.expect("0", "decr b 5")
+	c.expect("DELETED", "delete b")
+	c.expect("NOT_FOUND", "delete b")
+	c.expect("STORED", "set gone 0 -1 1", "x")
+	if _, ok := c.gets("gone"); ok {
+		t.Fatal("expired item is still found")
+	}
+
+	if value, ok := c.gets("a"); !ok || value.flags != 3 || value.data != "11" {
+		t.Fatalf("a is %+v, %v", value, ok)
+	}
+}
+
+func TestMemcachedMetadataStaysOutOfValue(t *testing.T) {
+	_, respAddr, addr := startMemcachedServer(t, t.TempDir())
+	c := dialMemcached(t, addr)
+	resp := dialResp(t, respAddr)
+
+	c.expect("STORED", "set k 42 0 5", "hello")
+	resp.expect("hello", "GET", "k")
+	resp.expect(1, "COUNT", "a", "a")
+
+	if value, ok := c.gets("k"); !ok || value.flags != 42 || value.cas == 0 {
+		t.Fatalf("k is %+v, %v", value, ok)
+	}
+
+	// A write through another front end leaves the old flags behind.
+	resp.expect("OK", "SET", "k", "\x00mc 1 2 3\nlooks like a header")
+	if value, ok := c.gets("k"); !ok || value.flags != 0 || value.cas != 0 ||
+		value.data != "\x00mc 1 2 3\nlooks like a header" {
+		t.Fatalf("k is %+v, %v", value, ok)
+	}
+
+	c.expect("DELETED", "delete k")
+	resp.expect(0, "COUNT", "a", "a")
+}
+
+func TestMemcachedCasTokensAreNotReused(t *testing.T) {
+	dir := t.TempDir()
+	s, _, addr := startMemcachedServer(t, dir)
+	c := dialMemcached(t, addr)
+
+	c.expect("STORED", "set k 0 0 1", "a")
+	first, _ := c.gets("k")
+	c.expect("DELETED", "delete k")
+	c.expect("STORED", "set k 0 0 1", "b")
+	second, _ := c.gets("k")
+	if second.cas <= first.cas {
+		t.Fatalf("cas went from %d to %d across a delete", first.cas, second.cas)
+	}
+
+	c.expect("EXISTS", "cas k 0 0 1 "+strconv.FormatUint(first.cas, 10), "c")
+	c.expect("STORED", "cas k 0 0 1 "+strconv.FormatUint(second.cas, 10), "c")
+	s.Shutdown()
+
+	_, _, addr = startMemcachedServer(t, dir)
+	c = dialMemcached(t, addr)
+	c.expect("STORED", "set k 0 0 1", "d")
+	if third, _ := c.gets("k"); third.cas <= second.cas+1 {
+		t.Fatalf("cas went from %d to %d across a restart", second.cas+1, third.cas)
+	}
+}
+
+func TestMemcachedDataIsBinarySafe(t *testing.T) {
+	dir := t.TempDir()
+	s, _, addr := startMemcachedServer(t, dir)
+	c := dialMemcached(t, addr)
+
+	data := "line one\r\nline two\r\n\x00\xff"
+	c.expect("STORED", "set k 0 0 "+strconv.Itoa(len(data)), data)
+	s.Shutdown()
+
+	_, _, addr = startMemcachedServer(t, dir)
+	c = dialMemcached(t, addr)
+	if value, ok := c.gets("k"); !ok || value.data != data {
+		t.Fatalf("k is %q, %v", value.data, ok)
+	}
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REPLICATION_LOG_PATH      string = "/replication/log"
+	REPLICATION_SNAPSHOT_PATH string = "/replication/snapshot"
+	REPLICATION_STATUS_PATH   string = "/replication/status"
+
+	// A log stream sends at most REPLICATION_BATCH records per store lock,
+	// looks for new ones every REPLICATION_POLL and sends the leader's
+	// sequence at least every REPLICATION_HEARTBEAT.
+	REPLICATION_BATCH     int           = 1000
+	REPLICATION_POLL      time.Duration = 50 * time.Millisecond
+	REPLICATION_HEARTBEAT time.Duration = time.Second
+	REPLICATION_RETRY     time.Duration = time.Second
+
+	HEARTBEAT_RECORD string = "heartbeat"
+)
+
+var errReadOnly = errors.New("Store is a read only follower.")
+
+// replicationRecord is a line of the log stream, a store.LogRecord or a
+// heartbeat carrying the leader's sequence. Key and value are base64 in
+// the json, so any bytes reach the follower unchanged.
+type replicationRecord struct {
+	Sequence int64  `json:"sequence"`
+	Type     string `json:"type"`
+	Key      []byte `json:"key,omitempty"`
+	Value    []byte `json:"value,omitempty"`
+}
+
+// snapshotHeader is the first line of a snapshot, the items follow one per
+// line.
+type snapshotHeader struct {
+	Sequence int64           `json:"sequence"`
+	Indexes  []snapshotIndex `json:"indexes"`
+}
+
+type snapshotIndex struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	PrefixLength int    `json:"prefix_length"`
+}
+
+type replicationStatus struct {
+	Role           string `json:"role"`
+	Leader         string `json:"leader,omitempty"`
+	Sequence       int64  `json:"sequence"`
+	LeaderSequence int64  `json:"leader_sequence,omitempty"`
+	Lag            int64  `json:"lag"`
+	Connected      bool   `json:"connected"`
+	LastContact    string `json:"last_contact,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// replicated returns the store as a store.Replicated, answering 501 when
+// its engine keeps no write-ahead log.
+func (s *Server) replicated(w http.ResponseWriter) (rep store.Replicated, ok bool) {
+	s.withStore(func(storage store.Store) {
+		rep, ok = storage.(store.Replicated)
+	})
+
+	if !ok {
+		writeHttpError(w, http.StatusNotImplemented, "Store keeps no write-ahead log.")
+	}
+
+	return rep, ok
+}
+
+// handleLog serves GET /replication/log?from=, the records after from as
+// they are written, one json object per line. 410 tells the follower the
+// log no longer reaches back to from and a snapshot is needed.
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	if err != nil || from < 0 {
+		writeHttpError(w, http.StatusBadRequest, "Invalid from %q.", r.URL.Query().Get("from"))
+		return
+	}
+
+	rep, ok := s.replicated(w)
+	if !ok {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	started := false
+	var heartbeat time.Time
+	for !s.isClosing() && r.Context().Err() == nil {
+		var records []store.LogRecord
+		var sequence int64
+		s.withStore(func(storage store.Store) {
+			records, err = rep.LogSince(from, REPLICATION_BATCH)
+			sequence = rep.Sequence()
+		})
+
+		if err == store.ErrLogTruncated && !started {
+			writeHttpError(w, http.StatusGone, "Log does not reach back to sequence %d.", from)
+			return
+		}
+
+		if err != nil {
+			log.Errorf("Could not read log after %d for %s: %v", from, r.RemoteAddr, err)
+			return
+		}
+
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+
+		for _, rec := range records {
+			if err = enc.Encode(replicationRecord{rec.Sequence, rec.Type, []byte(rec.Key),
+				[]byte(rec.Value)}); err != nil {
+				return
+			}
+			from = rec.Sequence
+		}
+
+		if len(records) > 0 || time.Since(heartbeat) >= REPLICATION_HEARTBEAT {
+			if err = enc.Encode(replicationRecord{Sequence: sequence,
+				Type: HEARTBEAT_RECORD}); err != nil {
+				return
+			}
+			heartbeat = time.Now()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if len(records) < REPLICATION_BATCH {
+			time.Sleep(REPLICATION_POLL)
+		}
+	}
+}
+
+// handleSnapshot serves GET /replication/snapshot, a header line with the
+// sequence and the indexes followed by one line per key.
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	rep, ok := s.replicated(w)
+	if !ok {
+		return
+	}
+
+	var snapshot store.Snapshot
+	var err error
+	s.withStore(func(storage store.Store) {
+		snapshot, err = rep.Snapshot()
+	})
+
+	if err != nil {
+		writeHttpError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	header := snapshotHeader{Sequence: snapshot.Sequence, Indexes: []snapshotIndex{}}
+	for _, def := range snapshot.Indexes {
+		header.Indexes = append(header.Indexes, snapshotIndex{def.Name, def.Type,
+			def.PrefixLength})
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(header); err != nil {
+		return
+	}
+
+	for _, kv := range snapshot.Items {
+		if err = enc.Encode(httpItem{[]byte(kv.Key), []byte(kv.Value)}); err != nil {
+			log.Errorf("Could not send snapshot to %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	if s.follower != nil {
+		writeJson(w, http.StatusOK, s.follower.status())
+		return
+	}
+
+	rep, ok := s.replicated(w)
+	if !ok {
+		return
+	}
+
+	status := replicationStatus{Role: "leader", Connected: true}
+	s.withStore(func(storage store.Store) {
+		status.Sequence = rep.Sequence()
+	})
+	writeJson(w, http.StatusOK, status)
+}
+
+// follower keeps the store a copy of a leader's. It streams the leader's
+// log from the last applied sequence and restores a snapshot when the log
+// has moved on.
+type follower struct {
+	server *Server
+	leader string
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	rep    store.Replicated
+
+	mutex       sync.Mutex
+	applied     int64
+	leaderSeq   int64
+	connected   bool
+	lastContact time.Time
+	lastErr     error
+}
+
+// newFollower makes the server a read only follower of the leader at the
+// http address or url leader, startFollower starts following it.
+func (s *Server) newFollower(leader string) error {
+	if !strings.Contains(leader, "://") {
+		leader = "http://" + leader
+	}
+
+	if _, err := url.Parse(leader); err != nil {
+		return fmt.Errorf("Invalid leader address %q: %v", leader, err)
+	}
+
+	var rep store.Replicated
+	var ok bool
+	s.withStore(func(storage store.Store) {
+		rep, ok = storage.(store.Replicated)
+	})
+
+	if !ok {
+		return errors.New("Followers need a store with a write-ahead log.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{server: s, leader: strings.TrimSuffix(leader, "/"),
+		client: &http.Client{}, ctx: ctx, cancel: cancel, rep: rep}
+	s.withStore(func(storage store.Store) {
+		f.applied = rep.Sequence()
+	})
+	s.follower = f
+	return nil
+}
+
+func (s *Server) startFollower() {
+	f := s.follower
+	log.Infof("Following %s from sequence %d.", f.leader, f.applied)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f.run(f.ctx, f.rep)
+	}()
+}
+
+func (f *follower) status() replicationStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	status := replicationStatus{Role: "follower", Leader: f.leader, Sequence: f.applied,
+		LeaderSequence: f.leaderSeq, Connected: f.connected}
+	if f.leaderSeq > f.applied {
+		status.Lag = f.leaderSeq - f.applied
+	}
+
+	if !f.lastContact.IsZero() {
+		status.LastContact = f.lastContact.Format(time.RFC3339)
+	}
+
+	if f.lastErr != nil {
+		status.Error = f.lastErr.Error()
+	}
+
+	return status
+}
+
+func (f *follower) update(fn func()) {
+	f.mutex.Lock()
+	fn()
+	f.mutex.Unlock()
+}
+
+func (f *follower) run(ctx context.Context, rep store.Replicated) {
+	for ctx.Err() == nil {
+		err := f.stream(ctx, rep)
+		if err == store.ErrLogTruncated {
+			log.Infof("Log of %s has moved past sequence %d, restoring a snapshot.",
+				f.leader, f.applied)
+			err = f.restore(ctx, rep)
+			if err == nil {
+				continue
+			}
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Errorf("Replication from %s stopped: %v", f.leader, err)
+		f.update(func() {
+			f.connected = false
+			f.lastErr = err
+		})
+
+		select {
+		case <-time.After(REPLICATION_RETRY):
+		case <-ctx.Done():
+		}
+	}
+
+	f.update(func() { f.connected = false })
+}
+
+func (f *follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.client.Do(req.WithContext(ctx))
+}
+
+// stream applies the leader's records until the connection ends. It
+// returns store.ErrLogTruncated when the leader answers 410.
+func (f *follower) stream(ctx context.Context, rep store.Replicated) error {
+	f.mutex.Lock()
+	from := f.applied
+	f.mutex.Unlock()
+
+	resp, err := f.get(ctx, fmt.Sprintf("%s?from=%d", REPLICATION_LOG_PATH, from))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return store.ErrLogTruncated
+	default:
+		return fmt.Errorf("Leader answered %s.", resp.Status)
+	}
+
+	log.Infof("Streaming the log of %s from sequence %d.", f.leader, from)
+	f.update(func() {
+		f.connected = true
+		f.lastErr = nil
+	})
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rec replicationRecord
+		if err = dec.Decode(&rec); err != nil {
+			return err
+		}
+
+		if rec.Type == HEARTBEAT_RECORD {
+			f.update(func() {
+				f.leaderSeq = rec.Sequence
+				f.lastContact = time.Now()
+			})
+			continue
+		}
+
+		f.server.withStore(func(storage store.Store) {
+			err = rep.Apply(store.LogRecord{Sequence: rec.Sequence, Type: rec.Type,
+				Key: string(rec.Key), Value: string(rec.Value)})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		f.update(func() {
+			f.applied = rec.Sequence
+			if f.leaderSeq < rec.Sequence {
+				f.leaderSeq = rec.Sequence
+			}
+		})
+	}
+}
+
+// restore replaces the store with a snapshot of the leader.
+func (f *follower) restore(ctx context.Context, rep store.Replicated) error {
+	resp, err := f.get(ctx, REPLICATION_SNAPSHOT_PATH)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Leader answered %s to a snapshot request.", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	var header snapshotHeader
+	if err = dec.Decode(&header); err != nil {
+		return err
+	}
+
+	snapshot := store.Snapshot{Sequence: header.Sequence}
+	for _, def := range header.Indexes {
+		snapshot.Indexes = append(snapshot.Indexes, store.IndexDefinition{Name: def.Name,
+			Type: def.Type, PrefixLength: def.PrefixLength})
+	}
+
+	for dec.More() {
+		var item httpItem
+		if err = dec.Decode(&item); err != nil {
+			return err
+		}
+		snapshot.Items = append(snapshot.Items, store.KeyValue{Key: string(item.Key),
+			Value: string(item.Value)})
+	}
+
+	f.server.withStore(func(storage store.Store) {
+		err = rep.Restore(snapshot)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restored snapshot of %s with %d keys at sequence %d.", f.leader,
+		len(snapshot.Items), snapshot.Sequence)
+	f.update(func() {
+		f.applied = snapshot.Sequence
+		f.leaderSeq = snapshot.Sequence
+		f.lastContact = time.Now()
+	})
+
+	return nil
+}
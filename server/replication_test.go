@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after ten seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serverPut(t *testing.T, s *Server, key string, value string) {
+	t.Helper()
+	var err error
+	s.withStore(func(storage store.Store) {
+		err = storage.Put(key, value)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serverGet(s *Server, key string) (value string, ok bool) {
+	s.withStore(func(storage store.Store) {
+		value, ok = storage.Get(key)
+	})
+	return value, ok
+}
+
+func serverSequence(s *Server) (sequence int64) {
+	s.withStore(func(storage store.Store) {
+		sequence = storage.(store.Replicated).Sequence()
+	})
+	return sequence
+}
+
+// startFollower follows the leader's http address, serving RESP and http
+// itself, in that order.
+func startFollower(t *testing.T, leader *Server) *Server {
+	f := NewServer(openTestStore(t, t.TempDir()))
+	if err := f.Start(Config{RespAddr: "127.0.0.1:0", HttpAddr: "127.0.0.1:0",
+		Follow: leader.Addrs()[0].String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(f.Shutdown)
+	return f
+}
+
+func replicationStatusOf(t *testing.T, s *Server) (status replicationStatus) {
+	t.Helper()
+	resp, err := http.Get("http://" + s.Addrs()[1].String() + REPLICATION_STATUS_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestFollowerStreamsLog(t *testing.T) {
+	leader := startServer(t, Config{HttpAddr: "127.0.0.1:0"})
+	serverPut(t, leader, "a", "1")
+	serverPut(t, leader, "b", "has\r\ncrlf")
+
+	f := startFollower(t, leader)
+	waitFor(t, "b to reach the follower", func() bool {
+		value, _ := serverGet(f, "b")
+		return value == "has\r\ncrlf"
+	})
+
+	serverPut(t, leader, "c", "3")
+	serverPut(t, leader, "bin\xff", "\xff\xfe")
+	leader.withStore(func(storage store.Store) {
+		storage.Del("a")
+	})
+
+	waitFor(t, "the follower to catch up", func() bool {
+		return serverSequence(f) == serverSequence(leader)
+	})
+
+	if value, ok := serverGet(f, "bin\xff"); !ok || value != "\xff\xfe" {
+		t.Fatalf("binary value is %q, %v on the follower", value, ok)
+	}
+
+	if _, ok := serverGet(f, "a"); ok {
+		t.Fatal("deleted key a is still on the follower")
+	}
+
+	c := dialResp(t, f.Addrs()[0].String())
+	c.expect("3", "GET", "c")
+	if reply := c.do("SET", "x", "1"); !isRespError(reply, "read only") {
+		t.Fatalf("write to the follower answered %v", reply)
+	}
+
+	waitFor(t, "the status to show no lag", func() bool {
+		status := replicationStatusOf(t, f)
+		return status.Role == "follower" && status.Connected && status.Lag == 0 &&
+			status.Sequence == serverSequence(leader)
+	})
+}
+
+func TestFollowerRestoresSnapshot(t *testing.T) {
+	leader := startServer(t, Config{HttpAddr: "127.0.0.1:0"})
+	serverPut(t, leader, "bin\xff", "\xff\xfe")
+	for round := 0; round < 2; round++ {
+		for i := 0; i <= store.WAL_ROTATE_RECORDS; i++ {
+			serverPut(t, leader, fmt.Sprintf("key-%d", i), fmt.Sprintf("%d-%d", round, i))
+		}
+		leader.withStore(func(storage store.Store) {
+			storage.Flush()
+		})
+	}
+	serverPut(t, leader, "after", "two\r\nlines")
+
+	leader.withStore(func(storage store.Store) {
+		if _, err := storage.(store.Replicated).LogSince(0, 1); err != store.ErrLogTruncated {
+			t.Fatalf("log still reaches back to the start: %v", err)
+		}
+	})
+
+	f := startFollower(t, leader)
+	waitFor(t, "the follower to restore a snapshot", func() bool {
+		return serverSequence(f) == serverSequence(leader)
+	})
+
+	if value, ok := serverGet(f, "after"); !ok || value != "two\r\nlines" {
+		t.Fatalf("after is %q, %v on the follower", value, ok)
+	}
+
+	if value, ok := serverGet(f, "key-7"); !ok || value != "1-7" {
+		t.Fatalf("key-7 is %q, %v on the follower", value, ok)
+	}
+
+	if value, ok := serverGet(f, "bin\xff"); !ok || value != "\xff\xfe" {
+		t.Fatalf("binary value is %q, %v on the follower", value, ok)
+	}
+
+	// The follower streams the log again from the snapshot on.
+	serverPut(t, leader, "later", "x")
+	waitFor(t, "later to reach the follower", func() bool {
+		_, ok := serverGet(f, "later")
+		return ok
+	})
+}
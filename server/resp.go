@@ -0,0 +1,413 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MAX_RESP_ARGS and MAX_RESP_BULK_BYTES bound a single command, larger
+	// ones are answered with a protocol error and the connection is closed.
+	MAX_RESP_ARGS       int = 1024 * 1024
+	MAX_RESP_BULK_BYTES int = 512 << 20
+
+	// RESP_INITIAL_ARGS and RESP_READ_CHUNK_BYTES bound what is allocated
+	// before the data a header announces has arrived, the rest grows as it
+	// is read.
+	RESP_INITIAL_ARGS     int = 16
+	RESP_READ_CHUNK_BYTES int = 64 << 10
+)
+
+// respProtocolError is input that is not RESP, the connection cannot be
+// read any further after one.
+type respProtocolError struct {
+	reason string
+}
+
+func (e respProtocolError) Error() string {
+	return "Protocol error: " + e.reason
+}
+
+func readRespLine(r *bufio.Reader) (line string, err error) {
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readRespCommand reads one command, either an array of bulk strings or an
+// inline line of space separated words as typed into telnet.
+func readRespCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := readRespLine(r)
+	if err != nil || line == "" {
+		return nil, err
+	}
+
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > MAX_RESP_ARGS {
+		return nil, respProtocolError{fmt.Sprintf("invalid multibulk length %q", line[1:])}
+	}
+
+	initial := n
+	if initial > RESP_INITIAL_ARGS {
+		initial = RESP_INITIAL_ARGS
+	}
+
+	args = make([]string, 0, initial)
+	for i := 0; i < n; i++ {
+		line, err = readRespLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "" || line[0] != '$' {
+			return nil, respProtocolError{fmt.Sprintf("expected '$', got %q", line)}
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MAX_RESP_BULK_BYTES {
+			return nil, respProtocolError{fmt.Sprintf("invalid bulk length %q", line[1:])}
+		}
+
+		buf, err := readRespBulk(r, size+2)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, respProtocolError{"bulk string is not followed by CRLF"}
+		}
+
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+// readRespBulk reads size bytes in chunks of at most RESP_READ_CHUNK_BYTES,
+// so a length no data follows costs no more than one chunk.
+func readRespBulk(r *bufio.Reader, size int) ([]byte, error) {
+	var buf []byte
+	for len(buf) < size {
+		chunk := size - len(buf)
+		if chunk > RESP_READ_CHUNK_BYTES {
+			chunk = RESP_READ_CHUNK_BYTES
+		}
+
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			if err == io.EOF && start > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func (w respWriter) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) error(format string, args ...interface{}) {
+	w.w.WriteString("-ERR " + fmt.Sprintf(format, args...) + "\r\n")
+}
+
+func (w respWriter) integer(n int) {
+	w.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w respWriter) bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w respWriter) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// serveResp answers the commands of one connection until it is closed,
+// sends QUIT or the server shuts down. Replies to pipelined commands are
+// written out together.
+func (s *Server) serveResp(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readRespCommand(r)
+		if perr, ok := err.(respProtocolError); ok {
+			w.error("%s", perr.Error())
+			w.w.Flush()
+			return
+		}
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); err != io.EOF && !(ok && netErr.Timeout()) {
+				log.Errorf("Could not read from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.respCommand(args, w)
+		if quit || r.Buffered() == 0 {
+			if err = w.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+type arity struct {
+	min int
+	max int
+}
+
+// respArity is the number of arguments each command takes after its name,
+// a max of -1 takes any number.
+var respArity = map[string]arity{
+	"PING":     {0, 1},
+	"GET":      {1, 1},
+	"SET":      {2, 2},
+	"DEL":      {1, -1},
+	"EXISTS":   {1, -1},
+	"MGET":     {1, -1},
+	"RANGE":    {2, 2},
+	"MSET":     {2, -1},
+	"COUNT":    {2, 2},
+	"DELRANGE": {2, 2},
+	"FLUSH":    {0, 0},
+	"INDEX":    {2, 3},
+	"QUERY":    {2, 2},
+	"REINDEX":  {0, 0},
+	"QUIT":     {0, 0},
+	"COMMAND":  {0, -1},
+}
+
+// respWrites are the commands a read only follower refuses.
+var respWrites = map[string]bool{"SET": true, "DEL": true, "MSET": true, "DELRANGE": true,
+	"INDEX": true}
+
+// respCommand runs one command and writes its reply, it reports whether
+// the connection should be closed.
+func (s *Server) respCommand(args []string, w respWriter) (quit bool) {
+	name := strings.ToUpper(args[0])
+	want, ok := respArity[name]
+	if !ok {
+		w.error("unknown command '%s'", args[0])
+		return false
+	}
+
+	args = args[1:]
+	if len(args) < want.min || (want.max >= 0 && len(args) > want.max) {
+		w.error("wrong number of arguments for '%s' command", strings.ToLower(name))
+		return false
+	}
+
+	if respWrites[name] && s.readOnly() {
+		w.error("%v", errReadOnly)
+		return false
+	}
+
+	switch name {
+	case "PING":
+		if len(args) == 0 {
+			w.simple("PONG")
+		} else {
+			w.bulk(args[0])
+		}
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "COMMAND":
+		// Sent by redis-cli on connect, there are no command docs to give.
+		w.array(0)
+	case "GET":
+		var value string
+		s.withStore(func(storage store.Store) {
+			value, ok = storage.Get(args[0])
+		})
+
+		if ok {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+	case "SET":
+		var err error
+		s.withStore(func(storage store.Store) {
+			err = storage.Put(args[0], args[1])
+		})
+		s.respStatus(w, err)
+	case "DEL", "EXISTS":
+		n := 0
+		with := s.withStore
+		if name == "DEL" {
+			with = s.withStoreExclusive
+		}
+
+		with(func(storage store.Store) {
+			for _, key := range args {
+				if !storage.Exists(key) {
+					continue
+				}
+
+				if name == "DEL" {
+					storage.Del(key)
+				}
+				n++
+			}
+		})
+		w.integer(n)
+	case "MGET":
+		var items []store.KeyValue
+		s.withStore(func(storage store.Store) {
+			items = storage.MultiGet(args)
+		})
+
+		found := make(map[string]string, len(items))
+		for _, kv := range items {
+			found[kv.Key] = kv.Value
+		}
+
+		w.array(len(args))
+		for _, key := range args {
+			if value, ok := found[key]; ok {
+				w.bulk(value)
+			} else {
+				w.null()
+			}
+		}
+	case "RANGE":
+		var items []store.KeyValue
+		s.withStore(func(storage store.Store) {
+			items, ok = storage.Scan(args[0], args[1])
+		})
+
+		if !ok {
+			w.error("could not read keys between %s and %s", args[0], args[1])
+			break
+		}
+
+		w.array(2 * len(items))
+		for _, kv := range items {
+			w.bulk(kv.Key)
+			w.bulk(kv.Value)
+		}
+	case "MSET":
+		if len(args)%2 != 0 {
+			w.error("wrong number of arguments for 'mset' command")
+			break
+		}
+
+		items := make([]store.KeyValue, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			items = append(items, store.KeyValue{Key: args[i], Value: args[i+1]})
+		}
+
+		var err error
+		s.withStore(func(storage store.Store) {
+			err = storage.MultiPut(items)
+		})
+		s.respStatus(w, err)
+	case "COUNT":
+		var n int
+		s.withStore(func(storage store.Store) {
+			n, ok = storage.Count(args[0], args[1])
+		})
+
+		if !ok {
+			w.error("could not count keys between %s and %s", args[0], args[1])
+		} else {
+			w.integer(n)
+		}
+	case "DELRANGE":
+		var err error
+		s.withStore(func(storage store.Store) {
+			err = storage.DeleteRange(args[0], args[1])
+		})
+		s.respStatus(w, err)
+	case "FLUSH":
+		s.withStore(func(storage store.Store) {
+			storage.Flush()
+		})
+		w.simple("OK")
+	case "INDEX":
+		def := store.IndexDefinition{Name: args[0], Type: args[1]}
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil {
+				w.error("invalid prefix length %q", args[2])
+				break
+			}
+			def.PrefixLength = n
+		}
+
+		var err error
+		s.withStore(func(storage store.Store) {
+			err = storage.DefineIndex(def)
+		})
+		s.respStatus(w, err)
+	case "QUERY":
+		var keys []string
+		var err error
+		s.withStore(func(storage store.Store) {
+			keys, err = storage.QueryIndex(args[0], args[1])
+		})
+
+		if err != nil {
+			w.error("%v", err)
+			break
+		}
+
+		w.array(len(keys))
+		for _, key := range keys {
+			w.bulk(key)
+		}
+	case "REINDEX":
+		var err error
+		s.withStore(func(storage store.Store) {
+			err = storage.RebuildIndexes()
+		})
+		s.respStatus(w, err)
+	}
+
+	return false
+}
+
+// respStatus answers OK, or the error of a command that returns nothing
+// else.
+func (s *Server) respStatus(w respWriter, err error) {
+	if err != nil {
+		w.error("%v", err)
+	} else {
+		w.simple("OK")
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RESP_ADDR string = "127.0.0.1:6380"
+
+	MAX_HTTP_HEADER_BYTES int           = 64 << 10
+	HTTP_HEADER_TIMEOUT   time.Duration = 10 * time.Second
+)
+
+// Config names the addresses the server listens on, an empty address
+// leaves that protocol off. With Follow set the store follows the leader
+// serving http there and takes no writes of its own.
+type Config struct {
+	RespAddr      string
+	HttpAddr      string
+	MemcachedAddr string
+	Follow        string
+}
+
+// Server shares one store between the connections of all its listeners.
+// Most stores are not safe for concurrent use, so every command runs with
+// the store lock held. Stores that are Concurrent share the lock between
+// commands, only those that read and then write hold it alone.
+type Server struct {
+	storage   store.Store
+	mutex     sync.RWMutex
+	connMutex sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	https     []*http.Server
+	follower  *follower
+	closing   bool
+	wg        sync.WaitGroup
+
+	// casNext is the last memcached cas token handed out and casLimit the
+	// end of the reserved batch, both guarded by the exclusive store lock.
+	casNext  uint64
+	casLimit uint64
+}
+
+func NewServer(storage store.Store) *Server {
+	return &Server{storage: storage, conns: make(map[net.Conn]struct{})}
+}
+
+// Start listens on every address of config and serves each connection on
+// its own goroutine.
+func (s *Server) Start(config Config) error {
+	if config.RespAddr == "" && config.HttpAddr == "" && config.MemcachedAddr == "" {
+		return errors.New("No address to listen on.")
+	}
+
+	if config.Follow != "" {
+		if err := s.newFollower(config.Follow); err != nil {
+			return err
+		}
+	}
+
+	if config.RespAddr != "" {
+		if err := s.listen(config.RespAddr, "resp", s.serveResp); err != nil {
+			return err
+		}
+	}
+
+	if config.MemcachedAddr != "" {
+		if err := s.listen(config.MemcachedAddr, "memcached", s.serveMemcached); err != nil {
+			return err
+		}
+	}
+
+	if config.HttpAddr != "" {
+		if err := s.listenHttp(config.HttpAddr); err != nil {
+			return err
+		}
+	}
+
+	if s.follower != nil {
+		s.startFollower()
+	}
+
+	return nil
+}
+
+// listenHttp serves the REST api on addr. net/http runs the connections,
+// Shutdown waits for the requests in flight.
+func (s *Server) listenHttp(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	hs := &http.Server{Handler: s.httpHandler(), MaxHeaderBytes: MAX_HTTP_HEADER_BYTES,
+		ReadHeaderTimeout: HTTP_HEADER_TIMEOUT}
+	s.connMutex.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.https = append(s.https, hs)
+	s.connMutex.Unlock()
+
+	log.Infof("Serving http on %s.", listener.Addr())
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := hs.Serve(listener); err != http.ErrServerClosed {
+			log.Errorf("Http server on %s stopped: %v", listener.Addr(), err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) listen(addr string, protocol string, serve func(conn net.Conn)) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.connMutex.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.connMutex.Unlock()
+
+	log.Infof("Serving %s on %s.", protocol, listener.Addr())
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !s.isClosing() {
+					log.Errorf("Could not accept %s connection: %v", protocol, err)
+				}
+				return
+			}
+
+			if !s.track(conn) {
+				conn.Close()
+				return
+			}
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer s.untrack(conn)
+				serve(conn)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// Addrs are the addresses the server listens on, in the order started.
+func (s *Server) Addrs() []net.Addr {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+
+	return addrs
+}
+
+func (s *Server) isClosing() bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.closing
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.closing {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.connMutex.Lock()
+	delete(s.conns, conn)
+	s.connMutex.Unlock()
+	conn.Close()
+}
+
+// readOnly reports whether the store follows a leader and refuses writes.
+func (s *Server) readOnly() bool {
+	return s.follower != nil
+}
+
+// withStore runs f with the store lock held, shared with other commands
+// when the store is Concurrent.
+func (s *Server) withStore(f func(storage store.Store)) {
+	if _, ok := s.storage.(store.Concurrent); !ok {
+		s.withStoreExclusive(f)
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	f(s.storage)
+}
+
+// withStoreExclusive runs f with the store lock held alone, for commands
+// whose writes depend on what they read.
+func (s *Server) withStoreExclusive(f func(storage store.Store)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(s.storage)
+}
+
+// Shutdown stops accepting connections, lets the commands in flight finish,
+// closes the connections and flushes the store. Later calls do nothing.
+func (s *Server) Shutdown() {
+	s.connMutex.Lock()
+	if s.closing {
+		s.connMutex.Unlock()
+		return
+	}
+	s.closing = true
+	https := s.https
+	s.connMutex.Unlock()
+
+	if s.follower != nil {
+		s.follower.cancel()
+	}
+
+	// An http server closes its own listener and waits for its requests.
+	for _, hs := range https {
+		if err := hs.Shutdown(context.Background()); err != nil {
+			log.Errorf("Could not shut down http server: %v", err)
+		}
+	}
+
+	s.connMutex.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+
+	// Waking blocked reads lets each connection finish its current command
+	// and leave on its own.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connMutex.Unlock()
+
+	s.wg.Wait()
+	log.Info("Connections closed, flushing store.")
+	s.withStore(func(storage store.Store) {
+		storage.Flush()
+	})
+}
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	if os.Getenv("TEST_LOGS") != "" {
+		log.SetOutput(os.Stderr)
+	}
+	os.Exit(m.Run())
+}
+
+func openTestStore(t *testing.T, dir string) store.Store {
+	options := store.DefaultOptions()
+	options.Dir = dir
+	storage, err := store.NewSsStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+// startServer serves a fresh store on loopback ports the OS picks, the
+// server is shut down when the test ends.
+func startServer(t *testing.T, config Config) *Server {
+	s := NewServer(openTestStore(t, t.TempDir()))
+	if err := s.Start(config); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func startRespServer(t *testing.T) (*Server, string) {
+	s := startServer(t, Config{RespAddr: "127.0.0.1:0"})
+	return s, s.Addrs()[0].String()
+}
+
+// respConn is a minimal RESP client for driving the server in tests.
+type respConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialResp(t *testing.T, addr string) *respConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &respConn{t, conn, bufio.NewReader(conn)}
+}
+
+func encodeResp(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	return b.String()
+}
+
+func (c *respConn) send(raw string) {
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next reply, a string for simple and bulk strings, nil
+// for a null, an int, an error or a slice of replies.
+func (c *respConn) read() interface{} {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return errors.New(line[1:])
+	case ':':
+		n, _ := strconv.Atoi(line[1:])
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		replies := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			replies = append(replies, c.read())
+		}
+		return replies
+	}
+
+	c.t.Fatalf("unexpected reply line %q", line)
+	return nil
+}
+
+func (c *respConn) do(args ...string) interface{} {
+	c.send(encodeResp(args...))
+	return c.read()
+}
+
+func (c *respConn) expect(want interface{}, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%v answered %#v, want %#v", args, got, want)
+	}
+}
+
+func isRespError(reply interface{}, text string) bool {
+	err, ok := reply.(error)
+	return ok && strings.Contains(err.Error(), text)
+}
+
+func TestRespCommands(t *testing.T) {
+	_, addr := startRespServer(t)
+	c := dialResp(t, addr)
+
+	c.expect("PONG", "PING")
+	c.expect("hi", "PING", "hi")
+	c.expect("OK", "SET", "a", "1")
+	c.expect("OK", "set", "b", "two words\r\nand a line")
+	c.expect("1", "GET", "a")
+	c.expect("two words\r\nand a line", "GET", "b")
+	c.expect(nil, "GET", "missing")
+	c.expect(2, "EXISTS", "a", "b", "missing")
+	c.expect([]interface{}{"1", nil, "two words\r\nand a line"}, "MGET", "a", "missing", "b")
+	c.expect("OK", "MSET", "c", "3", "d", "4")
+	c.expect(4, "COUNT", "a", "a")
+	c.expect(1, "DEL", "c", "missing")
+	c.expect(nil, "GET", "c")
+
+	items, ok := c.do("RANGE", "a", "a").([]interface{})
+	if !ok || len(items) != 6 {
+		t.Fatalf("range answered %v", items)
+	}
+
+	c.expect("OK", "DELRANGE", "a", "a")
+	c.expect(0, "COUNT", "a", "a")
+
+	if reply := c.do("NOPE"); !isRespError(reply, "unknown command") {
+		t.Fatalf("unknown command answered %v", reply)
+	}
+
+	if reply := c.do("GET"); !isRespError(reply, "wrong number of arguments") {
+		t.Fatalf("get without key answered %v", reply)
+	}
+
+	if reply := c.do("GET", "\x00idxdefs"); reply != nil {
+		t.Fatalf("internal key answered %v", reply)
+	}
+
+	c.expect("OK", "QUIT")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after quit: %v", err)
+	}
+}
+
+func TestRespInlineCommands(t *testing.T) {
+	_, addr := startRespServer(t)
+	c := dialResp(t, addr)
+
+	c.send("SET k v\r\n")
+	if reply := c.read(); reply != "OK" {
+		t.Fatalf("inline set answered %v", reply)
+	}
+
+	c.send("\r\nGET k\n")
+	if reply := c.read(); reply != "v" {
+		t.Fatalf("inline get answered %v", reply)
+	}
+}
+
+func TestRespPipelinedRepliesInOrder(t *testing.T) {
+	_, addr := startRespServer(t)
+	c := dialResp(t, addr)
+
+	var batch strings.Builder
+	for i := 0; i < 200; i++ {
+		batch.WriteString(encodeResp("SET", fmt.Sprintf("key-%d", i), strconv.Itoa(i)))
+		batch.WriteString(encodeResp("GET", fmt.Sprintf("key-%d", i)))
+	}
+	c.send(batch.String())
+
+	for i := 0; i < 200; i++ {
+		if reply := c.read(); reply != "OK" {
+			t.Fatalf("set %d answered %v", i, reply)
+		}
+
+		if reply := c.read(); reply != strconv.Itoa(i) {
+			t.Fatalf("get %d answered %v", i, reply)
+		}
+	}
+}
+
+func TestRespProtocolErrorClosesConnection(t *testing.T) {
+	_, addr := startRespServer(t)
+	c := dialResp(t, addr)
+
+	c.send("*1\r\n+GET\r\n")
+	if reply := c.read(); !isRespError(reply, "Protocol error") {
+		t.Fatalf("bad bulk answered %v", reply)
+	}
+
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after a protocol error: %v", err)
+	}
+}
+
+func TestRespHeadersDoNotAllocateAhead(t *testing.T) {
+	headers := []string{
+		fmt.Sprintf("*%d\r\n$3\r\nGET\r\n", MAX_RESP_ARGS),
+		fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\nab", MAX_RESP_BULK_BYTES),
+	}
+
+	for _, header := range headers {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		args, err := readRespCommand(bufio.NewReader(strings.NewReader(header)))
+		runtime.ReadMemStats(&after)
+
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.Fatalf("%q read %v, %v", header, args, err)
+		}
+
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Fatalf("%q allocated %d bytes", header, allocated)
+		}
+	}
+}
+
+func TestRespConcurrentConnections(t *testing.T) {
+	_, addr := startRespServer(t)
+
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			c := dialResp(t, addr)
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("conn-%d-%d", n, i)
+				if reply := c.do("SET", key, key); reply != "OK" {
+					t.Errorf("set %s answered %v", key, reply)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	c := dialResp(t, addr)
+	c.expect(400, "COUNT", "a", "a")
+}
+
+func TestShutdownFlushesStore(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer(openTestStore(t, dir))
+	if err := s.Start(Config{RespAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialResp(t, s.Addrs()[0].String())
+	c.expect("OK", "SET", "a", "1")
+
+	// An idle connection must not hold up the shutdown.
+	idle := dialResp(t, s.Addrs()[0].String())
+	idle.expect("PONG", "PING")
+
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return")
+	}
+
+	if _, err := net.Dial("tcp", s.Addrs()[0].String()); err == nil {
+		t.Fatal("server still accepts connections after shutdown")
+	}
+
+	for _, stat := range s.storage.(store.Inspector).Stats() {
+		if stat.Name == "memtable entries" && !strings.HasPrefix(stat.Value, "0/") {
+			t.Fatalf("memtable holds %s entries after shutdown", stat.Value)
+		}
+	}
+
+	if value, ok := openTestStore(t, dir).Get("a"); !ok || value != "1" {
+		t.Fatalf("reopened store has a = %q, %v", value, ok)
+	}
+}
+
+// overlapStore counts the gets running at once and lets each wait a
+// little, so gets that may overlap do.
+type overlapStore struct {
+	store.Store
+	mutex   sync.Mutex
+	running int
+	most    int
+}
+
+func (o *overlapStore) Get(key string) (string, bool) {
+	o.mutex.Lock()
+	o.running++
+	if o.running > o.most {
+		o.most = o.running
+	}
+	o.mutex.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	o.mutex.Lock()
+	o.running--
+	o.mutex.Unlock()
+	return o.Store.Get(key)
+}
+
+type concurrentOverlapStore struct {
+	*overlapStore
+}
+
+func (concurrentOverlapStore) ConcurrentSafe() {}
+
+// mostAtOnce runs gets from many connections and returns the most that
+// ran at once.
+func mostAtOnce(t *testing.T, storage store.Store, o *overlapStore) int {
+	s := NewServer(storage)
+	if err := s.Start(Config{RespAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dialResp(t, s.Addrs()[0].String())
+			for i := 0; i < 5; i++ {
+				c.expect(nil, "GET", "missing")
+			}
+		}()
+	}
+	wg.Wait()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.most
+}
+
+func TestConcurrentStoresSkipTheStoreLock(t *testing.T) {
+	serial := &overlapStore{Store: openTestStore(t, t.TempDir())}
+	if most := mostAtOnce(t, serial, serial); most != 1 {
+		t.Fatalf("%d gets ran at once on a store that is not Concurrent", most)
+	}
+
+	shared := &overlapStore{Store: openTestStore(t, t.TempDir())}
+	if most := mostAtOnce(t, concurrentOverlapStore{shared}, shared); most < 2 {
+		t.Fatal("gets on a Concurrent store did not run at once")
+	}
+}
+
+func TestRespOnShardedStore(t *testing.T) {
+	options := store.DefaultOptions()
+	options.Dir = t.TempDir()
+	storage, err := store.NewShardedStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(storage)
+	if err = s.Start(Config{RespAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			c := dialResp(t, s.Addrs()[0].String())
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("conn-%d-%d", n, i)
+				if reply := c.do("SET", key, key); reply != "OK" {
+					t.Errorf("set %s answered %v", key, reply)
+					return
+				}
+
+				if i%2 == 1 {
+					if reply := c.do("DEL", key); reply != 1 {
+						t.Errorf("del %s answered %v", key, reply)
+						return
+					}
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	c := dialResp(t, s.Addrs()[0].String())
+	c.expect(200, "COUNT", "a", "a")
+	c.expect("conn-3-8", "GET", "conn-3-8")
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	store "github.com/shimanekb/project2-A/store"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	WATCH_PATH string = "/watch"
+
+	// A watch stream sends the position it reached at least every
+	// WATCH_HEARTBEAT, so consumers of rarely matching filters can resume
+	// from close to where they stopped.
+	WATCH_HEARTBEAT time.Duration = time.Second
+)
+
+// watchEvent is a line of a watch stream, a store.ChangeEvent or a
+// heartbeat carrying the watcher's position. The heartbeat of a store
+// with one log also has the position as its sequence. Key and value are
+// base64 in the json, so any bytes reach the consumer unchanged.
+type watchEvent struct {
+	Shard    int    `json:"shard,omitempty"`
+	Sequence int64  `json:"sequence,omitempty"`
+	Type     string `json:"type"`
+	Key      []byte `json:"key,omitempty"`
+	Value    []byte `json:"value,omitempty"`
+	Position string `json:"position,omitempty"`
+}
+
+func heartbeatEvent(position store.WatchPosition) watchEvent {
+	e := watchEvent{Type: HEARTBEAT_RECORD, Position: position.String()}
+	if len(position) == 1 {
+		e.Sequence = position[0]
+	}
+
+	return e
+}
+
+// handleWatch serves GET /watch?from=&prefix=&start=&end=, the changes
+// after from that match the filter as they are written, one json object
+// per line. Without from the stream starts with the next write. 410 tells
+// the consumer the log no longer reaches back to from.
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := store.WatchFilter{Prefix: query.Get("prefix"), Start: query.Get("start"),
+		End: query.Get("end")}
+	var from store.WatchPosition
+	if f := query.Get("from"); f != "" {
+		var err error
+		if from, err = store.ParseWatchPosition(f); err != nil {
+			writeHttpError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+
+	var watcher *store.Watcher
+	var ok bool
+	var err error
+	s.withStore(func(storage store.Store) {
+		var watchable store.Watchable
+		if watchable, ok = storage.(store.Watchable); ok {
+			watcher, err = watchable.Watch(filter, from)
+		}
+	})
+
+	if !ok {
+		writeHttpError(w, http.StatusNotImplemented, "Store keeps no write-ahead log.")
+		return
+	}
+
+	if err == store.ErrLogTruncated {
+		writeHttpError(w, http.StatusGone, "Log does not reach back to position %s.", from)
+		return
+	}
+
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var heartbeat time.Time
+	for !s.isClosing() && r.Context().Err() == nil {
+		var events []store.ChangeEvent
+		var before, position store.WatchPosition
+		var caughtUp bool
+		s.withStore(func(storage store.Store) {
+			before = watcher.Position()
+			events, err = watcher.Next(REPLICATION_BATCH)
+			position = watcher.Position()
+			caughtUp = watcher.CaughtUp()
+		})
+
+		if err != nil {
+			log.Errorf("Could not read changes after %s for %s: %v", before, r.RemoteAddr, err)
+			return
+		}
+
+		for _, e := range events {
+			if err = enc.Encode(watchEvent{Shard: e.Shard, Sequence: e.Sequence, Type: e.Type,
+				Key: []byte(e.Key), Value: []byte(e.Value)}); err != nil {
+				return
+			}
+		}
+
+		if len(events) > 0 || time.Since(heartbeat) >= WATCH_HEARTBEAT {
+			if err = enc.Encode(heartbeatEvent(position)); err != nil {
+				return
+			}
+			heartbeat = time.Now()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if caughtUp {
+			time.Sleep(REPLICATION_POLL)
+		}
+	}
+}
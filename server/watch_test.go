@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	store "github.com/shimanekb/project2-A/store"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// watchStream reads the lines of a watch stream.
+type watchStream struct {
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+func openWatch(t *testing.T, s *Server, query string) *watchStream {
+	t.Helper()
+	resp, err := http.Get("http://" + s.Addrs()[0].String() + WATCH_PATH + "?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch answered %s", resp.Status)
+	}
+
+	return &watchStream{resp, bufio.NewScanner(resp.Body)}
+}
+
+// until reads events up to the first heartbeat that follows n of them.
+func (w *watchStream) until(t *testing.T, n int) (events []watchEvent, heartbeat watchEvent) {
+	t.Helper()
+	for w.scanner.Scan() {
+		var e watchEvent
+		if err := json.Unmarshal(w.scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Type != HEARTBEAT_RECORD {
+			events = append(events, e)
+		} else if len(events) >= n {
+			return events, e
+		}
+	}
+
+	t.Fatalf("stream ended after %d events: %v", len(events), w.scanner.Err())
+	return nil, heartbeat
+}
+
+func TestWatchStreamsShardedStore(t *testing.T) {
+	options := store.DefaultOptions()
+	options.Dir = t.TempDir()
+	options.Shards = 3
+	storage, err := store.NewShardedStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(storage)
+	if err = s.Start(Config{HttpAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	// A connection the client dialed but never used holds up the shutdown.
+	t.Cleanup(http.DefaultClient.CloseIdleConnections)
+
+	serverPut(t, s, "before", "x")
+	stream := openWatch(t, s, "prefix=k")
+	_, start := stream.until(t, 0)
+	for i := 0; i < 20; i++ {
+		serverPut(t, s, fmt.Sprintf("k%d\xff", i), "\xff\xfe")
+		serverPut(t, s, fmt.Sprintf("other%d", i), "v")
+	}
+
+	events, heartbeat := stream.until(t, 20)
+	if len(events) != 20 || strings.Count(heartbeat.Position, ",") != 2 {
+		t.Fatalf("stream sent %d events and heartbeat %+v", len(events), heartbeat)
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range events {
+		key := string(e.Key)
+		if e.Type != store.PUT_COMMAND || !strings.HasPrefix(key, "k") ||
+			!strings.HasSuffix(key, "\xff") || string(e.Value) != "\xff\xfe" || seen[key] {
+			t.Fatalf("stream sent %+v", e)
+		}
+		seen[key] = true
+	}
+
+	// Resuming from the first heartbeat sends the same events again.
+	again, _ := openWatch(t, s, "prefix=k&from="+start.Position).until(t, 20)
+	if len(again) != 20 {
+		t.Fatalf("resumed stream sent %d events", len(again))
+	}
+
+	serverPut(t, s, "k-after", "v")
+	after, _ := openWatch(t, s, "from="+heartbeat.Position).until(t, 1)
+	if string(after[0].Key) != "k-after" {
+		t.Fatalf("stream resumed with %+v", after[0])
+	}
+
+	for _, from := range []string{"1", "x"} {
+		resp, err := http.Get("http://" + s.Addrs()[0].String() + WATCH_PATH + "?from=" + from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("watch from %s answered %s", from, resp.Status)
+		}
+	}
+}
@@ -65,15 +65,20 @@ func (l *LruCache) Remove(key string) {
 }
 
 func (l *LruCache) Keys() []string {
-	return l.Keys()
+	keys := make([]string, 0, l.Lru.Len())
+	for _, k := range l.Lru.Keys() {
+		keys = append(keys, k.(string))
+	}
+
+	return keys
 }
 
 func (l *LruCache) Size() int {
 	return l.Lru.Len()
 }
 
-func NewLruCache() (Cache, error) {
+func NewLruCache(size int) (Cache, error) {
 	var cache *lru.ARCCache
-	cache, err := lru.NewARC(1000)
+	cache, err := lru.NewARC(size)
 	return &LruCache{cache}, err
 }
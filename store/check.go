@@ -0,0 +1,457 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// storeFiles are the files of a store directory a check or repair reads.
+// LastSequence is the last write the tables hold, the write-ahead log
+// holds the ones after it.
+type storeFiles struct {
+	tables       []string
+	lastSequence int64
+	wal          bool
+	hashLog      string
+	problems     []index.Problem
+}
+
+// listStoreFiles finds the live tables of dir from its manifest and whether
+// it holds a write-ahead log or a hash engine data log. When the manifest
+// cannot be read every table file is listed, oldest first.
+func listStoreFiles(dir string) (files storeFiles, err error) {
+	version, problems, err := index.ReadVersion(dir)
+	files.problems = problems
+	switch {
+	case err == nil:
+		for _, num := range version.Tables {
+			files.tables = append(files.tables, index.TablePath(dir, num))
+		}
+		files.lastSequence = version.LastSequence
+	case os.IsNotExist(err):
+		legacy := filepath.Join(dir, index.LEGACY_DATA_FILE)
+		if _, err := os.Stat(legacy); err == nil {
+			files.tables = append(files.tables, legacy)
+		}
+	default:
+		files.problems = append(files.problems, index.Problem{
+			Path: filepath.Join(dir, index.CURRENT_FILE), Message: err.Error()})
+		files.tables, err = tableFiles(dir)
+		if err != nil {
+			return files, err
+		}
+	}
+
+	live := make(map[string]bool)
+	for _, path := range files.tables {
+		live[path] = true
+	}
+
+	all, err := tableFiles(dir)
+	if err != nil {
+		return files, err
+	}
+
+	for _, path := range all {
+		if !live[path] {
+			files.problems = append(files.problems, index.Problem{Path: path,
+				Message: "table is not in the manifest, it is left over from an interrupted flush"})
+		}
+	}
+
+	for _, path := range []string{walPreviousPath(dir), walPath(dir)} {
+		if _, err := os.Stat(path); err == nil {
+			files.wal = true
+		}
+	}
+
+	hashLog := filepath.Join(dir, HASH_DATA_LOG_FILE)
+	if matches, _ := filepath.Glob(hashLog + "*"); len(matches) > 0 {
+		files.hashLog = hashLog
+	}
+
+	return files, nil
+}
+
+// tableFiles lists the numbered table files of dir, oldest first.
+func tableFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+index.TABLE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	nums := make([]uint64, 0, len(paths))
+	for _, p := range paths {
+		num, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(p),
+			index.TABLE_SUFFIX), 10, 64)
+		if err == nil {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	tables := make([]string, 0, len(nums))
+	for _, num := range nums {
+		tables = append(tables, index.TablePath(dir, num))
+	}
+
+	return tables, nil
+}
+
+// salvagedValues indexes the readable entries of every value log generation
+// by their pointer.
+type salvagedValues map[index.ValuePointer]index.LogItem
+
+func scanValueLogs(dir string) (values salvagedValues, problems []index.Problem, err error) {
+	gens, err := valueLogGenerations(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values = make(salvagedValues)
+	for _, gen := range gens {
+		items, ps, err := index.ScanDataLog(valueLogPath(dir, gen))
+		if err != nil {
+			return values, problems, err
+		}
+
+		problems = append(problems, ps...)
+		for _, it := range items {
+			pointer := index.ValuePointer{Generation: gen, Offset: it.Offset(), Size: it.Size()}
+			values[pointer] = it
+		}
+	}
+
+	return values, problems, nil
+}
+
+// resolve returns the value the salvaged value logs hold for a pointer item.
+func (v salvagedValues) resolve(item index.KeyValueItem) (value string, err error) {
+	if !item.IsPointer() {
+		return item.Value(), nil
+	}
+
+	pointer, err := item.Pointer()
+	if err != nil {
+		return "", err
+	}
+
+	entry, ok := v[pointer]
+	if !ok || entry.Key() != item.Key() {
+		return "", fmt.Errorf("value log entry %s of key %q is missing", pointer, item.Key())
+	}
+
+	return entry.Value(), nil
+}
+
+// salvageTables reads every readable item of the tables, later tables
+// taking precedence and their range tombstones deleting the items of the
+// earlier ones, and resolves value pointers.
+func salvageTables(dir string, tables []string) (items map[string]string, problems []index.Problem, err error) {
+	values, problems, err := scanValueLogs(dir)
+	if err != nil {
+		return nil, problems, err
+	}
+
+	items = make(map[string]string)
+	for _, path := range tables {
+		tableItems, tombstones, ps, err := index.ScanTable(path)
+		if os.IsNotExist(err) {
+			problems = append(problems, index.Problem{Path: path,
+				Message: "table named by the manifest is missing"})
+			continue
+		}
+
+		if err != nil {
+			return items, problems, err
+		}
+
+		problems = append(problems, ps...)
+		for _, t := range tombstones {
+			for key := range items {
+				if t.Covers(key) {
+					delete(items, key)
+				}
+			}
+		}
+
+		for _, it := range tableItems {
+			value, err := values.resolve(it)
+			if err != nil {
+				problems = append(problems, index.Problem{Path: path, Message: err.Error()})
+				continue
+			}
+			items[it.Key()] = value
+		}
+	}
+
+	return items, problems, nil
+}
+
+// salvageWal applies the intact records of the write-ahead log that follow
+// lastSequence to items. A bad record ends the log, the records after it
+// are lost. Gaps in the sequence are reported.
+func salvageWal(dir string, lastSequence int64, items map[string]string) (problems []index.Problem, err error) {
+	previous := int64(-1)
+	for _, path := range []string{walPreviousPath(dir), walPath(dir)} {
+		scan, err := scanWalFile(path)
+		if err != nil {
+			return problems, err
+		}
+
+		for _, record := range scan.records {
+			// Moves change no value, the salvaged values are resolved
+			// from every generation.
+			if record.Type == MOVE_COMMAND {
+				continue
+			}
+
+			if previous < 0 && record.Sequence > lastSequence+1 {
+				problems = append(problems, index.Problem{Path: path, Message: fmt.Sprintf(
+					"log starts at record %d but the tables end at %d, the writes between are lost",
+					record.Sequence, lastSequence)})
+			} else if previous >= 0 && record.Sequence != previous+1 {
+				problems = append(problems, index.Problem{Path: path, Message: fmt.Sprintf(
+					"record %d does not follow record %d", record.Sequence, previous)})
+			}
+			previous = record.Sequence
+
+			if record.Sequence <= lastSequence {
+				continue
+			}
+
+			if err = applyToItems(items, record); err != nil {
+				problems = append(problems, index.Problem{Path: path,
+					Message: fmt.Sprintf("record %d: %v", record.Sequence, err)})
+			}
+		}
+
+		if scan.torn {
+			problems = append(problems, index.Problem{Path: path, Message: fmt.Sprintf(
+				"torn record at byte %d, the next open cuts it off: %v", scan.good, scan.bad)})
+		} else if scan.bad != nil {
+			problems = append(problems, index.Problem{Path: path, Message: fmt.Sprintf(
+				"bad record at byte %d, the records after it are lost: %v", scan.good, scan.bad)})
+			return problems, nil
+		}
+	}
+
+	return problems, nil
+}
+
+// applyToItems applies a logged write to salvaged items. An index record
+// adds its definition, the postings are rebuilt on restore.
+func applyToItems(items map[string]string, record LogRecord) error {
+	switch record.Type {
+	case PUT_COMMAND:
+		items[record.Key] = record.Value
+	case DEL_COMMAND:
+		delete(items, record.Key)
+	case DELRANGE_COMMAND:
+		tombstone := index.RangeTombstone{Start: record.Key, End: record.Value}
+		for key := range items {
+			if tombstone.Covers(key) {
+				delete(items, key)
+			}
+		}
+	case INDEX_COMMAND:
+		def, err := record.indexDefinition()
+		if err != nil {
+			return err
+		}
+
+		defs := make(map[string]IndexDefinition)
+		if s, ok := items[indexDefsKey]; ok {
+			if defs, err = decodeIndexDefinitions(s); err != nil {
+				return err
+			}
+		}
+
+		defs[def.Name] = def
+		items[indexDefsKey] = encodeIndexDefinitions(defs)
+	default:
+		return fmt.Errorf("unknown record type %q", record.Type)
+	}
+
+	return nil
+}
+
+// salvageSsStore reads the tables of files and applies the write-ahead log
+// to them.
+func salvageSsStore(dir string, files storeFiles) (items map[string]string, problems []index.Problem, err error) {
+	items = make(map[string]string)
+	if len(files.tables) > 0 {
+		if items, problems, err = salvageTables(dir, files.tables); err != nil {
+			return items, problems, err
+		}
+	}
+
+	if files.wal {
+		ps, err := salvageWal(dir, files.lastSequence, items)
+		problems = append(problems, ps...)
+		if err != nil {
+			return items, problems, err
+		}
+	}
+
+	return items, problems, nil
+}
+
+// salvageHashLog replays every readable item of the hash engine data log.
+func salvageHashLog(dir string, dataLog string) (items map[string]string, problems []index.Problem, err error) {
+	logItems, problems, err := index.ScanDataLog(dataLog, filepath.Join(dir, HASH_INDEX_FILE))
+	if err != nil {
+		return nil, problems, err
+	}
+
+	items = make(map[string]string)
+	for _, it := range logItems {
+		if it.IsTombstone() {
+			delete(items, it.Key())
+		} else {
+			items[it.Key()] = it.Value()
+		}
+	}
+
+	return items, problems, nil
+}
+
+// CheckDir walks the tables, value logs, write-ahead log, data log and hint
+// files of a store directory and reports every problem found. It changes
+// no file.
+func CheckDir(dir string) (problems []index.Problem, err error) {
+	shards, sharded, err := ShardDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if sharded {
+		for _, shardDir := range shards {
+			ps, err := CheckDir(shardDir)
+			problems = append(problems, ps...)
+			if err != nil {
+				return problems, err
+			}
+		}
+		return problems, nil
+	}
+
+	files, err := listStoreFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	problems = files.problems
+	if len(files.tables) > 0 || files.wal {
+		_, ps, err := salvageSsStore(dir, files)
+		problems = append(problems, ps...)
+		if err != nil {
+			return problems, err
+		}
+	}
+
+	if files.hashLog != "" {
+		_, ps, err := salvageHashLog(dir, files.hashLog)
+		problems = append(problems, ps...)
+		if err != nil {
+			return problems, err
+		}
+	}
+
+	log.Infof("Checked %s, found %d problems.", dir, len(problems))
+	return problems, nil
+}
+
+// restore writes salvaged items into a fresh store. Posting lists are not
+// copied, the secondary indexes are rebuilt from the restored values.
+func restore(kv kvStore, items map[string]string) (restored int, err error) {
+	for key, value := range items {
+		if IsReservedKey(key) && key != indexDefsKey {
+			continue
+		}
+
+		if err = kv.rawPut(key, value); err != nil {
+			return restored, err
+		}
+		restored++
+	}
+
+	indexes, err := loadSecondaryIndexes(kv)
+	if err != nil {
+		return restored, err
+	}
+
+	return restored, indexes.rebuild()
+}
+
+// Repair salvages every readable record of the store in dir into a fresh
+// store opened with options, whose directory must not exist yet. Tables
+// are written anew, so their indexes are rebuilt from the salvaged blocks,
+// and hold the writes of the write-ahead log up to its first bad record.
+// It returns the number of keys salvaged and the problems found on the way.
+func Repair(dir string, options Options) (salvaged int, problems []index.Problem, err error) {
+	dstDir := options.Dir
+	if _, err := os.Stat(dstDir); err == nil {
+		return 0, nil, fmt.Errorf("Repair target %s already exists.", dstDir)
+	}
+
+	files, err := listStoreFiles(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	problems = files.problems
+
+	if err = os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return 0, problems, err
+	}
+
+	if len(files.tables) > 0 || files.wal {
+		items, ps, err := salvageSsStore(dir, files)
+		problems = append(problems, ps...)
+		if err != nil {
+			return salvaged, problems, err
+		}
+
+		fresh, err := NewSsStore(options)
+		if err != nil {
+			return salvaged, problems, err
+		}
+
+		log.Infof("Restoring %d ss table keys into %s.", len(items), dstDir)
+		restored, err := restore(fresh.(*SsStore), items)
+		salvaged += restored
+		if err != nil {
+			return salvaged, problems, err
+		}
+		fresh.Flush()
+	}
+
+	if files.hashLog != "" {
+		items, ps, err := salvageHashLog(dir, files.hashLog)
+		problems = append(problems, ps...)
+		if err != nil {
+			return salvaged, problems, err
+		}
+
+		fresh, err := NewHashStore(options)
+		if err != nil {
+			return salvaged, problems, err
+		}
+
+		log.Infof("Restoring %d hash engine keys into %s.", len(items), dstDir)
+		restored, err := restore(fresh.(*HashStore), items)
+		salvaged += restored
+		if err != nil {
+			return salvaged, problems, err
+		}
+		fresh.Flush()
+	}
+
+	return salvaged, problems, nil
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// corruptFile replaces the first old in the file at path with new.
+func corruptFile(t *testing.T, path string, old string, new string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(data, []byte(old)) {
+		t.Fatalf("%s does not hold %q", path, old)
+	}
+
+	if err = ioutil.WriteFile(path, bytes.Replace(data, []byte(old), []byte(new), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairSalvagesAroundCorruptTableAndWal(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	var want []string
+	for i := 0; i < 10; i++ {
+		putAll(t, s, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		if i != 3 {
+			want = append(want, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+	}
+	s.Flush()
+	putAll(t, s, "w1", "a", "w2", "b", "w3", "c")
+
+	// key-3 no longer matches its hash and the record of w2 its checksum.
+	tables, err := tableFiles(options.Dir)
+	if err != nil || len(tables) != 1 {
+		t.Fatalf("store has tables %v, %v", tables, err)
+	}
+	corruptFile(t, tables[0], "key-3", "kez-3")
+	corruptFile(t, walPath(options.Dir), "dzI=", "dzJ=")
+
+	problems, err := CheckDir(options.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]bool)
+	for _, p := range problems {
+		found[filepath.Base(p.Path)] = true
+	}
+
+	if len(problems) != 2 || !found[filepath.Base(tables[0])] || !found[WAL_FILE] {
+		t.Fatalf("check found %v", problems)
+	}
+
+	if _, err = NewSsStore(options); err == nil {
+		t.Fatal("store with a corrupt write-ahead log opened")
+	}
+
+	repaired := testOptions(t)
+	repaired.Dir = filepath.Join(repaired.Dir, "repaired")
+	salvaged, problems, err := Repair(options.Dir, repaired)
+	if err != nil || salvaged != 10 || len(problems) != 2 {
+		t.Fatalf("repair salvaged %d keys with %v, %v", salvaged, problems, err)
+	}
+
+	r := openSsStore(t, repaired)
+	expectValues(t, r, append(want, "w1", "a")...)
+	for _, key := range []string{"key-3", "kez-3", "w2", "w3"} {
+		if _, ok := r.Get(key); ok {
+			t.Fatalf("repaired store holds %s", key)
+		}
+	}
+
+	if problems, err = CheckDir(repaired.Dir); err != nil || len(problems) != 0 {
+		t.Fatalf("check of the repaired store found %v, %v", problems, err)
+	}
+}
@@ -0,0 +1,297 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	HASH_DATA_LOG_FILE string = "hash_data_log.txt"
+	HASH_INDEX_FILE    string = "hash_index.hint"
+
+	HASH_SEGMENT_SIZE_BYTES int64 = 1 << 20
+)
+
+// HashStore is a bitcask style engine. Every write is appended to the data
+// log and the in memory index points at the latest log offset of each key.
+type HashStore struct {
+	options Options
+	index   index.Index
+	dataLog *index.LocalDataLog
+	indexes *secondaryIndexes
+	mutex   sync.Mutex
+
+	// stopMerge stops the merge MergeInterval started.
+	stopMerge func()
+}
+
+func (h *HashStore) Put(key string, value string) error {
+	if IsReservedKey(key) {
+		return fmt.Errorf("Key %q is reserved for internal use.", key)
+	}
+
+	h.mutex.Lock()
+	old, hadOld := h.indexedValue(key)
+	err := h.rawPut(key, value)
+	if err == nil {
+		err = h.indexes.update(key, old, hadOld, value, true)
+	}
+	h.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return h.index.DataLog().Commit()
+}
+
+// indexedValue returns the value key holds before a write, which the
+// secondary indexes move the key away from. Without indexes it is not read.
+func (h *HashStore) indexedValue(key string) (value string, ok bool) {
+	if len(h.indexes.defs) == 0 {
+		return "", false
+	}
+
+	return h.rawGet(key)
+}
+
+func (h *HashStore) rawPut(key string, value string) error {
+	item := index.NewLogItem(key, value, 0)
+	offset, err := h.index.DataLog().AddLogItem(item)
+	if err != nil {
+		return err
+	}
+
+	h.index.Del(key)
+	h.index.Put(index.NewIndexItem(key, offset, item.Size()))
+	return nil
+}
+
+func (h *HashStore) Get(key string) (value string, ok bool) {
+	if IsReservedKey(key) {
+		return "", false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.rawGet(key)
+}
+
+func (h *HashStore) rawGet(key string) (value string, ok bool) {
+	logItem, ok := h.find(key)
+	if !ok {
+		return "", false
+	}
+
+	return logItem.Value(), true
+}
+
+// find reads the data log entries the index holds for the partial key of
+// key and returns the one written for key.
+func (h *HashStore) find(key string) (logItem *index.LogItem, ok bool) {
+	indexItems, ok := h.index.Get(key)
+	if !ok {
+		log.Infof("Key %s not found in hash index.", key)
+		return nil, false
+	}
+
+	for _, it := range indexItems {
+		logItem, err := h.index.DataLog().ReadLogItem(it.Offset())
+		if err != nil {
+			log.Errorf("Could not read data log at offset %d: %v", it.Offset(), err)
+			continue
+		}
+
+		if logItem.Key() == key {
+			return logItem, true
+		}
+	}
+
+	return nil, false
+}
+
+func (h *HashStore) Del(key string) {
+	if IsReservedKey(key) {
+		log.Errorf("Refusing to delete internal key %q.", key)
+		return
+	}
+
+	h.mutex.Lock()
+	old, hadOld := h.indexedValue(key)
+	h.rawDel(key)
+
+	if err := h.indexes.update(key, old, hadOld, "", false); err != nil {
+		log.Errorf("Could not update secondary indexes for deleted key %s: %v", key, err)
+	}
+	h.mutex.Unlock()
+
+	if err := h.index.DataLog().Commit(); err != nil {
+		log.Errorf("Could not commit delete of key %s: %v", key, err)
+	}
+}
+
+func (h *HashStore) rawDel(key string) {
+	if _, ok := h.find(key); !ok {
+		return
+	}
+
+	_, err := h.index.DataLog().AddLogItem(index.NewTombstoneLogItem(key))
+	if err != nil {
+		log.Errorf("Could not write tombstone for key %s: %v", key, err)
+		return
+	}
+
+	h.index.Del(key)
+}
+
+func (h *HashStore) rawItems() (items map[string]string, err error) {
+	items = make(map[string]string)
+	for _, it := range h.index.Items() {
+		logItem, err := h.index.DataLog().ReadLogItem(it.Offset())
+		if err != nil {
+			return items, err
+		}
+
+		items[logItem.Key()] = logItem.Value()
+	}
+
+	return items, nil
+}
+
+func (h *HashStore) Scan(keyone string, keytwo string) (items []KeyValue, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	all, err := h.rawItems()
+	if err != nil {
+		log.Error(err)
+		return items, false
+	}
+
+	for key, value := range all {
+		if !IsInternalKey(key) && index.InScanRange(key, keyone, keytwo) {
+			items = append(items, KeyValue{key, value})
+		}
+	}
+
+	return items, true
+}
+
+// Flush syncs the data log and saves a hint file for the index. The hint
+// only speeds up the next startup.
+func (h *HashStore) Flush() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.index.DataLog().Sync(); err != nil {
+		log.Errorln("Could not sync hash data log.", err)
+	}
+
+	if err := h.index.Save(); err != nil {
+		log.Errorln("Could not save hash index hint file.", err)
+	}
+}
+
+func (h *HashStore) DefineIndex(def IndexDefinition) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.indexes.define(def)
+}
+
+func (h *HashStore) QueryIndex(indexName string, value string) (keys []string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.indexes.query(indexName, value)
+}
+
+func (h *HashStore) RebuildIndexes() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.indexes.rebuild()
+}
+
+// CollectGarbage merges the sealed data log segments, dropping overwritten
+// and deleted entries.
+func (h *HashStore) CollectGarbage() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.index.Merge()
+}
+
+// MergeEvery starts merging the data log in the background at the given
+// interval. Calling the returned function stops it, waiting for a merge
+// in progress to finish.
+func (h *HashStore) MergeEvery(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				log.Info("Starting background data log merge.")
+				if err := h.CollectGarbage(); err != nil {
+					log.Errorln("Background data log merge failed.", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// Close stops the background merge, flushes the store and closes its data
+// log, stopping an interval sync. The store cannot be used afterwards.
+func (h *HashStore) Close() error {
+	if h.stopMerge != nil {
+		h.stopMerge()
+	}
+
+	h.Flush()
+	return h.dataLog.Close()
+}
+
+// NewHashStore opens the hash store in options.Dir, loading its index from
+// the hint file and the tail of the data log.
+func NewHashStore(options Options) (Store, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	dataLog := index.NewSegmentedDataLog(filepath.Join(options.Dir, HASH_DATA_LOG_FILE),
+		options.SegmentSizeBytes)
+	if err := dataLog.SetSyncPolicy(options.SyncPolicy); err != nil {
+		return nil, err
+	}
+
+	localIndex := index.NewLocalIndex(filepath.Join(options.Dir, HASH_INDEX_FILE), dataLog)
+
+	log.Info("Loading hash index from hint file and data log.")
+	if err := localIndex.Load(); err != nil {
+		return nil, err
+	}
+
+	store := HashStore{options: options, index: localIndex, dataLog: dataLog}
+	indexes, err := loadSecondaryIndexes(&store)
+	if err != nil {
+		return nil, err
+	}
+	store.indexes = indexes
+
+	if options.MergeInterval > 0 {
+		store.stopMerge = store.MergeEvery(options.MergeInterval)
+	}
+
+	log.Info("Created new HashStore")
+	return &store, nil
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func openHashStore(t *testing.T, options Options) *HashStore {
+	storage, err := NewHashStore(options)
+	if err != nil {
+		t.Fatalf("open %s: %v", options.Dir, err)
+	}
+
+	return storage.(*HashStore)
+}
+
+// fillHashStore writes n keys three times over and deletes every fifth,
+// returning what the store should hold.
+func fillHashStore(t *testing.T, h *HashStore, n int) map[string]string {
+	want := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < n; i++ {
+			key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", i, round)
+			if err := h.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = value
+		}
+	}
+
+	for i := 0; i < n; i += 5 {
+		key := fmt.Sprintf("key-%d", i)
+		h.Del(key)
+		delete(want, key)
+	}
+
+	return want
+}
+
+func checkHashStore(t *testing.T, h *HashStore, want map[string]string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		value, ok := h.Get(key)
+		if wantValue, live := want[key]; ok != live || value != wantValue {
+			t.Fatalf("%s is %q, %v, want %q, %v", key, value, ok, wantValue, live)
+		}
+	}
+}
+
+func segmentedOptions(t *testing.T) Options {
+	options := testOptions(t)
+	options.SegmentSizeBytes = 512
+	return options
+}
+
+func TestHashStoreRollsSegments(t *testing.T) {
+	options := segmentedOptions(t)
+	h := openHashStore(t, options)
+	want := fillHashStore(t, h, 100)
+	if n := len(h.dataLog.Segments()); n < 10 {
+		t.Fatalf("data log has %d segments", n)
+	}
+	checkHashStore(t, h, want, 100)
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkHashStore(t, openHashStore(t, options), want, 100)
+}
+
+func TestHashStoreMerge(t *testing.T) {
+	options := segmentedOptions(t)
+	h := openHashStore(t, options)
+	want := fillHashStore(t, h, 100)
+	before, _ := h.index.DataLog().Size()
+
+	if err := h.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := h.dataLog.Segments()
+	if len(segments) != 2 || segments[0].Size >= before/2 {
+		t.Fatalf("merge left segments %v of a %d byte log", segments, before)
+	}
+	checkHashStore(t, h, want, 100)
+	h.Close()
+
+	checkHashStore(t, openHashStore(t, options), want, 100)
+}
+
+// A crash after the merged segment is renamed into place but before the
+// merged segments are removed leaves both behind, with or without the
+// hint of the merged segment.
+func TestHashStoreMergeInterrupted(t *testing.T) {
+	for _, keepHint := range []bool{true, false} {
+		options := segmentedOptions(t)
+		h := openHashStore(t, options)
+		want := fillHashStore(t, h, 100)
+		h.Flush()
+
+		segments := h.dataLog.Segments()
+		saved := make(map[string][]byte)
+		for _, seg := range segments[1 : len(segments)-1] {
+			path := h.dataLog.Files()[0] + fmt.Sprintf(".%d", seg.Base)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved[path] = data
+		}
+
+		if err := h.CollectGarbage(); err != nil {
+			t.Fatal(err)
+		}
+		h.Close()
+
+		for path, data := range saved {
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !keepHint {
+			os.Remove(h.dataLog.Files()[0] + ".hint")
+		}
+
+		reopened := openHashStore(t, options)
+		checkHashStore(t, reopened, want, 100)
+		reopened.Close()
+	}
+}
+
+func TestHashStoreCloseStopsBackgroundWork(t *testing.T) {
+	options := segmentedOptions(t)
+	options.MergeInterval = time.Millisecond
+	options.SyncPolicy = index.SyncPolicy{Mode: index.SYNC_INTERVAL, Interval: time.Millisecond}
+	running := runtime.NumGoroutine()
+	h := openHashStore(t, options)
+	want := fillHashStore(t, h, 100)
+	time.Sleep(20 * time.Millisecond)
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > running; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running after close, %d before open",
+				runtime.NumGoroutine(), running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	reopened := openHashStore(t, options)
+	checkHashStore(t, reopened, want, 100)
+	reopened.Close()
+}
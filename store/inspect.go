@@ -0,0 +1,87 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Stat is one named figure a store reports about itself.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// Inspector is implemented by stores that can describe their state for
+// debugging.
+type Inspector interface {
+	Stats() []Stat
+	Files() []string
+}
+
+func (s *SsStore) Stats() []Stat {
+	table := "none"
+	if path := s.blockStorage.FilePath(); path != "" {
+		table = path
+	}
+
+	readCache := 0
+	if s.readCache != nil {
+		readCache = s.readCache.Size()
+	}
+
+	return []Stat{
+		{"engine", SS_ENGINE},
+		{"dir", s.options.Dir},
+		{"sequence", fmt.Sprintf("%d", s.sequence)},
+		{"memtable entries", fmt.Sprintf("%d/%d", s.cache.Size(), s.options.MemtableEntries)},
+		{"memtable bytes", fmt.Sprintf("%d/%d", s.cacheBytes, s.options.MemtableBytes)},
+		{"range tombstones", fmt.Sprintf("%d", len(s.rangeDels))},
+		{"table range tombstones", fmt.Sprintf("%d", len(s.blockStorage.RangeTombstones()))},
+		{"table", table},
+		{"value log generation", fmt.Sprintf("%d", s.values.generation)},
+		{"read cache entries", fmt.Sprintf("%d/%d", readCache, s.options.ReadCacheSize)},
+		{"secondary indexes", fmt.Sprintf("%d", len(s.indexes.defs))},
+		{"wal records", fmt.Sprintf("%d", s.wal.records())},
+	}
+}
+
+// Files lists the live table, the value log generations and the
+// write-ahead log.
+func (s *SsStore) Files() []string {
+	var files []string
+	if path := s.blockStorage.FilePath(); path != "" {
+		files = append(files, path)
+	}
+
+	gens := make([]int, 0, len(s.values.logs))
+	for gen := range s.values.logs {
+		gens = append(gens, gen)
+	}
+	sort.Ints(gens)
+
+	for _, gen := range gens {
+		files = append(files, valueLogPath(s.values.dir, gen))
+	}
+
+	return append(files, s.wal.path())
+}
+
+func (h *HashStore) Stats() []Stat {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	size, _ := h.index.DataLog().Size()
+	return []Stat{
+		{"engine", HASH_ENGINE},
+		{"dir", h.options.Dir},
+		{"keys", fmt.Sprintf("%d", len(h.index.Items()))},
+		{"data log bytes", fmt.Sprintf("%d", size)},
+		{"data log segments", fmt.Sprintf("%d", len(h.dataLog.Segments()))},
+		{"sync policy", h.options.SyncPolicy.Mode},
+		{"secondary indexes", fmt.Sprintf("%d", len(h.indexes.defs))},
+	}
+}
+
+// Files lists the data log segments, oldest first.
+func (h *HashStore) Files() []string {
+	return h.dataLog.Files()
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkPutKeys rejects a batch that holds an internal key before any of it
+// is written.
+func checkPutKeys(items []KeyValue) error {
+	for _, kv := range items {
+		if IsReservedKey(kv.Key) {
+			return fmt.Errorf("Key %q is reserved for internal use.", kv.Key)
+		}
+	}
+
+	return nil
+}
+
+// MultiGet returns the found keys in the order asked for. Keys that miss
+// the memtable and the read cache are looked up together, each table block
+// is read at most once.
+func (s *SsStore) MultiGet(keys []string) (items []KeyValue) {
+	found := make(map[string]string, len(keys))
+	seen := make(map[string]bool, len(keys))
+	var stored []string
+	for _, key := range keys {
+		if seen[key] || IsReservedKey(key) {
+			continue
+		}
+		seen[key] = true
+
+		if v, ok := s.cache.Get(key); ok {
+			cmd, _ := v.(index.Command)
+			if cmd.Type == DEL_COMMAND {
+				continue
+			}
+
+			if value, err := s.resolve(cmd.Item); err != nil {
+				log.Errorf("Could not read value for key %s: %v", key, err)
+			} else {
+				found[key] = value
+			}
+			continue
+		}
+
+		if s.deletedByRange(key) {
+			continue
+		}
+
+		if s.readCache != nil {
+			if v, ok := s.readCache.Get(key); ok {
+				found[key] = v.(string)
+				continue
+			}
+		}
+
+		stored = append(stored, key)
+	}
+
+	tableItems, err := s.blockStorage.GetItems(stored)
+	if err != nil {
+		log.Errorf("Could not read blocks for %d keys: %v", len(stored), err)
+	}
+
+	for key, item := range tableItems {
+		value, err := s.resolve(item)
+		if err != nil {
+			log.Errorf("Could not read value for key %s: %v", key, err)
+			continue
+		}
+
+		found[key] = value
+		if s.readCache != nil {
+			s.readCache.Add(key, value)
+		}
+	}
+
+	for _, key := range keys {
+		if value, ok := found[key]; ok {
+			items = append(items, KeyValue{key, value})
+		}
+	}
+
+	return items
+}
+
+func (s *SsStore) MultiPut(items []KeyValue) error {
+	if err := checkPutKeys(items); err != nil {
+		return err
+	}
+
+	for _, kv := range items {
+		if err := s.Put(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exists reports whether key is live without reading a value log entry.
+func (s *SsStore) Exists(key string) bool {
+	if IsReservedKey(key) {
+		return false
+	}
+
+	if _, inMemtable := s.cache.Get(key); !inMemtable && s.readCache != nil {
+		if _, ok := s.readCache.Get(key); ok {
+			return true
+		}
+	}
+
+	_, ok := s.lookupItem(key)
+	return ok
+}
+
+// Count returns the number of live keys a scan between keyone and keytwo
+// would select, counting memtable writes, deletes and range deletes.
+func (s *SsStore) Count(keyone string, keytwo string) (count int, ok bool) {
+	items, err := s.rangeItems(keyone, keytwo)
+	if err != nil {
+		log.Error(err)
+		return 0, false
+	}
+
+	for _, it := range items {
+		if !IsInternalKey(it.Key()) {
+			count++
+		}
+	}
+
+	return count, true
+}
+
+func (h *HashStore) MultiGet(keys []string) (items []KeyValue) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range keys {
+		if IsReservedKey(key) {
+			continue
+		}
+
+		if value, ok := h.rawGet(key); ok {
+			items = append(items, KeyValue{key, value})
+		}
+	}
+
+	return items
+}
+
+// MultiPut appends every pair to the data log and commits them once.
+func (h *HashStore) MultiPut(items []KeyValue) error {
+	if err := checkPutKeys(items); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	var err error
+	for _, kv := range items {
+		old, hadOld := h.indexedValue(kv.Key)
+		if err = h.rawPut(kv.Key, kv.Value); err != nil {
+			break
+		}
+
+		if err = h.indexes.update(kv.Key, old, hadOld, kv.Value, true); err != nil {
+			break
+		}
+	}
+	h.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return h.index.DataLog().Commit()
+}
+
+func (h *HashStore) Exists(key string) bool {
+	if IsReservedKey(key) {
+		return false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, ok := h.find(key)
+	return ok
+}
+
+func (h *HashStore) Count(keyone string, keytwo string) (count int, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, it := range h.index.Items() {
+		logItem, err := h.index.DataLog().ReadLogItem(it.Offset())
+		if err != nil {
+			log.Error(err)
+			return count, false
+		}
+
+		key := logItem.Key()
+		if !IsInternalKey(key) && index.InScanRange(key, keyone, keytwo) {
+			count++
+		}
+	}
+
+	return count, true
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	"time"
+)
+
+const (
+	DEFAULT_STORAGE_DIR      string = "storage"
+	DEFAULT_MEMTABLE_ENTRIES int    = 100
+	DEFAULT_MEMTABLE_BYTES   int64  = 4 << 20
+	DEFAULT_READ_CACHE_SIZE  int    = 1000
+	DEFAULT_SHARDS           int    = 4
+)
+
+// Options are the tunables of a store. Start from DefaultOptions and change
+// what is needed, Validate reports settings the stores cannot work with.
+type Options struct {
+	// Dir is the directory the store keeps its files in.
+	Dir string
+
+	// BlockSizeBytes is the size ss table blocks are cut at.
+	BlockSizeBytes int64
+
+	// BlockCacheSize is the number of blocks each table keeps decoded.
+	BlockCacheSize int
+
+	// Compression is COMPRESSION_NONE or COMPRESSION_FLATE, it applies to
+	// ss table blocks written from now on.
+	Compression string
+
+	// The memtable is flushed into a new ss table once it holds
+	// MemtableEntries keys or MemtableBytes of keys and values.
+	MemtableEntries int
+	MemtableBytes   int64
+
+	// ReadCacheSize is the number of values the ss table engine keeps for
+	// repeated gets, zero turns the cache off.
+	ReadCacheSize int
+
+	// SegmentSizeBytes is the size the hash engine data log rolls over to
+	// a new segment at, zero keeps it in one file.
+	SegmentSizeBytes int64
+
+	// SyncPolicy decides when the hash engine data log is fsynced.
+	SyncPolicy index.SyncPolicy
+
+	// MergeInterval merges the hash engine data log in the background, zero
+	// leaves merging to gc commands.
+	MergeInterval time.Duration
+
+	// Shards is the number of ss table stores a new sharded store is split
+	// into, an existing one keeps its count until it is rebalanced.
+	Shards int
+
+	// WalRecords is the number of records the current write-ahead log file
+	// holds before a flush starts a new one. The log keeps about one to two
+	// times as many, followers and watchers further behind start over.
+	WalRecords int
+}
+
+func DefaultOptions() Options {
+	table := index.DefaultTableOptions()
+	return Options{
+		Dir:              DEFAULT_STORAGE_DIR,
+		BlockSizeBytes:   table.BlockSizeBytes,
+		BlockCacheSize:   table.BlockCacheSize,
+		Compression:      table.Compression,
+		MemtableEntries:  DEFAULT_MEMTABLE_ENTRIES,
+		MemtableBytes:    DEFAULT_MEMTABLE_BYTES,
+		ReadCacheSize:    DEFAULT_READ_CACHE_SIZE,
+		SegmentSizeBytes: HASH_SEGMENT_SIZE_BYTES,
+		SyncPolicy:       index.SyncPolicy{Mode: index.SYNC_NONE, Interval: time.Second},
+		Shards:           DEFAULT_SHARDS,
+		WalRecords:       WAL_ROTATE_RECORDS,
+	}
+}
+
+func (o Options) tableOptions() index.TableOptions {
+	return index.TableOptions{BlockSizeBytes: o.BlockSizeBytes,
+		BlockCacheSize: o.BlockCacheSize, Compression: o.Compression}
+}
+
+func (o Options) Validate() error {
+	if o.Dir == "" {
+		return errors.New("Store directory is not set.")
+	}
+
+	if err := o.tableOptions().Validate(); err != nil {
+		return err
+	}
+
+	if o.MemtableEntries <= 0 || o.MemtableBytes <= 0 {
+		return fmt.Errorf("Memtable limits have to be positive, got %d entries and %d bytes.",
+			o.MemtableEntries, o.MemtableBytes)
+	}
+
+	if o.ReadCacheSize < 0 {
+		return fmt.Errorf("Read cache size %d is negative.", o.ReadCacheSize)
+	}
+
+	if o.SegmentSizeBytes < 0 {
+		return fmt.Errorf("Segment size %d is negative.", o.SegmentSizeBytes)
+	}
+
+	if o.Shards < 0 {
+		return fmt.Errorf("Shard count %d is negative.", o.Shards)
+	}
+
+	if o.WalRecords <= 0 {
+		return fmt.Errorf("Write-ahead log records have to be positive, got %d.", o.WalRecords)
+	}
+
+	if o.MergeInterval < 0 {
+		return fmt.Errorf("Merge interval %s is negative.", o.MergeInterval)
+	}
+
+	return o.SyncPolicy.Validate()
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-A/index"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOptionsRejectInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *Options)
+	}{
+		{"no dir", func(o *Options) { o.Dir = "" }},
+		{"small blocks", func(o *Options) { o.BlockSizeBytes = index.MIN_BLOCK_SIZE_BYTES - 1 }},
+		{"no block cache", func(o *Options) { o.BlockCacheSize = 0 }},
+		{"unknown compression", func(o *Options) { o.Compression = "zip" }},
+		{"no memtable entries", func(o *Options) { o.MemtableEntries = 0 }},
+		{"no memtable bytes", func(o *Options) { o.MemtableBytes = -1 }},
+		{"negative read cache", func(o *Options) { o.ReadCacheSize = -1 }},
+		{"negative segment size", func(o *Options) { o.SegmentSizeBytes = -1 }},
+		{"negative shards", func(o *Options) { o.Shards = -1 }},
+		{"no wal records", func(o *Options) { o.WalRecords = 0 }},
+		{"negative merge interval", func(o *Options) { o.MergeInterval = -time.Second }},
+		{"unknown sync policy", func(o *Options) { o.SyncPolicy.Mode = "sometimes" }},
+		{"interval sync without interval", func(o *Options) {
+			o.SyncPolicy = index.SyncPolicy{Mode: index.SYNC_INTERVAL}
+		}},
+	}
+
+	if err := testOptions(t).Validate(); err != nil {
+		t.Fatalf("default options are rejected: %v", err)
+	}
+
+	for _, test := range tests {
+		options := testOptions(t)
+		options.Dir = filepath.Join(options.Dir, "store")
+		test.change(&options)
+		if err := options.Validate(); err == nil {
+			t.Errorf("%s: options are accepted", test.name)
+		}
+
+		if _, err := NewSsStore(options); err == nil {
+			t.Errorf("%s: ss table store opened", test.name)
+		}
+
+		if _, err := NewHashStore(options); err == nil {
+			t.Errorf("%s: hash store opened", test.name)
+		}
+
+		if _, err := NewShardedStore(options); err == nil {
+			t.Errorf("%s: sharded store opened", test.name)
+		}
+
+		// Rejected options leave no directory behind.
+		if options.Dir != "" {
+			if _, err := os.Stat(options.Dir); !os.IsNotExist(err) {
+				t.Errorf("%s: store directory was created: %v", test.name, err)
+			}
+		}
+	}
+}
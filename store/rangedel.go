@@ -0,0 +1,179 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// DeleteRange deletes the keys between start and end with one range
+// tombstone in the memtable. Memtable entries it covers are dropped, so
+// every entry left in the memtable is newer than the tombstones. The next
+// flush drops the table keys it covers while merging and records it in the
+// new table. Secondary indexes are not touched here, queries skip the keys
+// the tombstones cover until the flush takes them off.
+func (s *SsStore) DeleteRange(start string, end string) error {
+	if err := s.logWrite(LogRecord{Type: DELRANGE_COMMAND, Key: start, Value: end}); err != nil {
+		return err
+	}
+
+	tombstone := index.RangeTombstone{Start: start, End: end}
+	for _, key := range s.cache.Keys() {
+		if !tombstone.Covers(key) {
+			continue
+		}
+
+		v, _ := s.cache.Get(key)
+		cmd, _ := v.(index.Command)
+		s.cacheBytes -= cmd.Item.Size()
+		s.cache.Remove(key)
+	}
+
+	if s.readCache != nil {
+		for _, key := range s.readCache.Keys() {
+			if tombstone.Covers(key) {
+				s.readCache.Remove(key)
+			}
+		}
+	}
+
+	log.Infof("Adding range tombstone for keys between %s and %s.", start, end)
+	s.rangeDels = append(s.rangeDels, tombstone)
+	s.cacheBytes += int64(len(start) + len(end))
+	return nil
+}
+
+// deletedByRange reports whether a table key is covered by a tombstone in
+// the memtable.
+func (s *SsStore) deletedByRange(key string) bool {
+	for _, t := range s.rangeDels {
+		if t.Covers(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prunePostings takes the table keys the memtable tombstones cover off the
+// secondary indexes before a flush, so the new table holds their postings
+// as they are once the tombstones are merged. Keys written again since are
+// moved to the postings of their new value.
+func (s *SsStore) prunePostings() error {
+	if len(s.indexes.defs) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range s.rangeDels {
+		stored, err := s.blockStorage.RangeSearch(t.Start, t.End)
+		if err != nil {
+			return err
+		}
+
+		for _, it := range stored {
+			key := it.Key()
+			if seen[key] || !t.Covers(key) {
+				continue
+			}
+			seen[key] = true
+
+			old, err := s.resolve(it)
+			if err != nil {
+				return err
+			}
+
+			current, ok := s.rawGet(key)
+			if err = s.indexes.update(key, old, true, current, ok); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Infof("Took %d range deleted keys off the secondary indexes.", len(seen))
+	return nil
+}
+
+// liveInIndex filters the keys a query found under term, dropping those a
+// memtable tombstone deleted and that were not written again with a value
+// filed under the same term.
+func (s *SsStore) liveInIndex(def IndexDefinition, term string, keys []string) []string {
+	if len(s.rangeDels) == 0 {
+		return keys
+	}
+
+	live := keys[:0]
+	for _, key := range keys {
+		if s.deletedByRange(key) {
+			value, ok := s.rawGet(key)
+			if !ok || def.IndexedValue(value) != term {
+				continue
+			}
+		}
+		live = append(live, key)
+	}
+
+	return live
+}
+
+// rangeItems returns the live items between keyone and keytwo in table
+// order, memtable entries and range tombstones included.
+func (s *SsStore) rangeItems(keyone string, keytwo string) (items []index.KeyValueItem, err error) {
+	stored, err := s.blockStorage.RangeSearch(keyone, keytwo)
+	for _, it := range stored {
+		_, inMemtable := s.cache.Get(it.Key())
+		if !inMemtable && !s.deletedByRange(it.Key()) {
+			items = append(items, it)
+		}
+	}
+
+	for _, key := range s.cache.Keys() {
+		if !index.InScanRange(key, keyone, keytwo) {
+			continue
+		}
+
+		v, _ := s.cache.Get(key)
+		if cmd, _ := v.(index.Command); cmd.Type != DEL_COMMAND {
+			items = append(items, cmd.Item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].KeyHash() < items[j].KeyHash()
+	})
+
+	return items, err
+}
+
+// DeleteRange writes a tombstone for every live key between start and end
+// and commits them once. The data log has no range records, so unlike the
+// ss table engine this costs a write per key.
+func (h *HashStore) DeleteRange(start string, end string) error {
+	tombstone := index.RangeTombstone{Start: start, End: end}
+	h.mutex.Lock()
+	var err error
+	for _, it := range h.index.Items() {
+		logItem, readErr := h.index.DataLog().ReadLogItem(it.Offset())
+		if readErr != nil {
+			err = readErr
+			break
+		}
+
+		key := logItem.Key()
+		if !tombstone.Covers(key) {
+			continue
+		}
+
+		h.rawDel(key)
+		if err = h.indexes.update(key, logItem.Value(), true, "", false); err != nil {
+			break
+		}
+	}
+	h.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return h.index.DataLog().Commit()
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func queryKeys(t *testing.T, s *SsStore, value string) []string {
+	keys, err := s.QueryIndex("color", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeleteRangeIsOneWrite(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	if err := s.DefineIndex(IndexDefinition{Name: "color", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := s.Put(fmt.Sprintf("key-%02d", i), "red"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Flush()
+
+	// A scan between the same key selects every hash.
+	entries := s.cache.Size()
+	if err := s.DeleteRange("key-00", "key-00"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.cache.Size() != entries {
+		t.Fatalf("delete range added %d memtable entries", s.cache.Size()-entries)
+	}
+
+	if err := s.Put("key-07", "red"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("key-08", "blue"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(s *SsStore) {
+		if items, ok := s.Scan("key-00", "key-00"); !ok || len(items) != 2 {
+			t.Fatalf("scan returned %v, %v", items, ok)
+		}
+
+		if _, ok := s.Get("key-01"); ok {
+			t.Fatal("range deleted key-01 is still found")
+		}
+
+		if keys := queryKeys(t, s, "red"); len(keys) != 1 || keys[0] != "key-07" {
+			t.Fatalf("red holds %v", keys)
+		}
+
+		if keys := queryKeys(t, s, "blue"); len(keys) != 1 || keys[0] != "key-08" {
+			t.Fatalf("blue holds %v", keys)
+		}
+	}
+
+	check(s)
+	s.Flush()
+	check(s)
+	if got := s.blockStorage.RangeTombstones(); len(got) != 1 {
+		t.Fatalf("flushed table records %d range tombstones", len(got))
+	}
+
+	if items, err := s.blockStorage.Items(); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, it := range items {
+			if !IsInternalKey(it.Key()) && it.Key() != "key-07" && it.Key() != "key-08" {
+				t.Fatalf("flushed table still holds %s", it.Key())
+			}
+		}
+	}
+
+	check(openSsStore(t, options))
+	if problems, err := CheckDir(options.Dir); err != nil || len(problems) != 0 {
+		t.Fatalf("check found %v, %v", problems, err)
+	}
+}
+
+func TestDeleteRangeIsReplayed(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	for i := 0; i < 10; i++ {
+		if err := s.Put(fmt.Sprintf("key-%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Flush()
+
+	if err := s.DeleteRange("key-0", "key-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openSsStore(t, options)
+	if items, ok := reopened.Scan("key-0", "key-0"); !ok || len(items) != 0 {
+		t.Fatalf("scan after replay returned %v, %v", items, ok)
+	}
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// Replicated is implemented by stores whose writes can be shipped to a
+// follower, either record by record from the write-ahead log or as a
+// snapshot when the log no longer reaches back far enough.
+type Replicated interface {
+	Sequence() int64
+	LogSince(sequence int64, max int) ([]LogRecord, error)
+	Apply(record LogRecord) error
+	Snapshot() (Snapshot, error)
+	Restore(snapshot Snapshot) error
+}
+
+// Snapshot is the whole content of a store as of Sequence.
+type Snapshot struct {
+	Sequence int64
+	Indexes  []IndexDefinition
+	Items    []KeyValue
+}
+
+// Sequence is the number of the last write applied.
+func (s *SsStore) Sequence() int64 {
+	return s.sequence
+}
+
+// LogSince returns up to max records following sequence, ErrLogTruncated
+// when the write-ahead log no longer holds them.
+func (s *SsStore) LogSince(sequence int64, max int) ([]LogRecord, error) {
+	return s.wal.since(sequence, s.sequence, max)
+}
+
+// replay applies the logged writes the live table does not hold yet.
+func (s *SsStore) replay(records []LogRecord) error {
+	var replayed int
+	for _, record := range records {
+		if record.Type == MOVE_COMMAND {
+			// A move following a write the tables hold may be in them
+			// already, moving the value again changes nothing.
+			if record.Sequence < s.sequence {
+				continue
+			}
+
+			if err := s.replayMove(record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if record.Sequence <= s.sequence {
+			continue
+		}
+
+		s.replaying = true
+		s.sequence = record.Sequence
+		err := s.applyRecord(record)
+		s.replaying = false
+		if err != nil {
+			return fmt.Errorf("Could not replay write-ahead log record %d: %v",
+				record.Sequence, err)
+		}
+		replayed++
+	}
+
+	log.Infof("Replayed %d write-ahead log records, sequence is %d.", replayed, s.sequence)
+	return nil
+}
+
+func (s *SsStore) replayMove(record LogRecord) error {
+	pointer, err := index.ParseValuePointer(record.Value)
+	if err != nil {
+		return fmt.Errorf("Could not replay move of key %s: %v", record.Key, err)
+	}
+
+	return s.putItem(index.NewValuePointerItem(record.Key, pointer))
+}
+
+func (s *SsStore) applyRecord(record LogRecord) error {
+	switch record.Type {
+	case PUT_COMMAND:
+		return s.Put(record.Key, record.Value)
+	case DEL_COMMAND:
+		s.Del(record.Key)
+		return nil
+	case DELRANGE_COMMAND:
+		return s.DeleteRange(record.Key, record.Value)
+	case INDEX_COMMAND:
+		def, err := record.indexDefinition()
+		if err != nil {
+			return err
+		}
+		return s.DefineIndex(def)
+	}
+
+	return fmt.Errorf("Unknown write-ahead log record type %q.", record.Type)
+}
+
+// Apply applies a record shipped from a leader. It has to follow the last
+// applied one, it is logged under the leader's sequence number.
+func (s *SsStore) Apply(record LogRecord) error {
+	if record.Sequence != s.sequence+1 {
+		return fmt.Errorf("Record %d does not follow sequence %d.", record.Sequence,
+			s.sequence)
+	}
+
+	return s.applyRecord(record)
+}
+
+// Snapshot returns every key with its value, sorted by key.
+func (s *SsStore) Snapshot() (snapshot Snapshot, err error) {
+	items, err := s.rawItems()
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.Sequence = s.sequence
+	snapshot.Indexes = s.indexDefinitions()
+
+	for key, value := range items {
+		if !IsReservedKey(key) {
+			snapshot.Items = append(snapshot.Items, KeyValue{key, value})
+		}
+	}
+
+	sort.Slice(snapshot.Items, func(i, j int) bool {
+		return snapshot.Items[i].Key < snapshot.Items[j].Key
+	})
+
+	return snapshot, nil
+}
+
+// Restore makes the store hold exactly the snapshot, writing only the keys
+// that differ. Nothing of it is logged, a full memtable is flushed as the
+// keys are written and the result once more at the end. The write-ahead
+// log is then emptied and the store continues from the snapshot's sequence.
+func (s *SsStore) Restore(snapshot Snapshot) error {
+	current, err := s.rawItems()
+	if err != nil {
+		return err
+	}
+
+	s.replaying = true
+	defer func() { s.replaying = false }()
+	for _, def := range snapshot.Indexes {
+		if old, ok := s.indexes.defs[def.Name]; ok && old == def {
+			continue
+		}
+
+		if err = s.DefineIndex(def); err != nil {
+			return err
+		}
+	}
+
+	wanted := make(map[string]bool, len(snapshot.Items))
+	var written, deleted int
+	for _, kv := range snapshot.Items {
+		wanted[kv.Key] = true
+		if value, ok := current[kv.Key]; ok && value == kv.Value {
+			continue
+		}
+
+		if err = s.Put(kv.Key, kv.Value); err != nil {
+			return err
+		}
+		written++
+
+		if err = s.flushIfFull(); err != nil {
+			return err
+		}
+	}
+
+	for key := range current {
+		if !IsReservedKey(key) && !wanted[key] {
+			s.Del(key)
+			deleted++
+
+			if err = s.flushIfFull(); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.sequence = snapshot.Sequence
+	if err = s.flushMemtable(); err != nil {
+		return err
+	}
+
+	log.Infof("Restored snapshot at sequence %d, wrote %d keys and deleted %d.",
+		snapshot.Sequence, written, deleted)
+	return s.wal.reset()
+}
@@ -0,0 +1,425 @@
+package store
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	VALUE_INDEX         string = "value"
+	PREFIX_INDEX        string = "prefix"
+	INTERNAL_KEY_PREFIX string = index.INTERNAL_KEY_PREFIX
+	indexDefsKey        string = INTERNAL_KEY_PREFIX + "idxdefs"
+	indexEntryPrefix    string = INTERNAL_KEY_PREFIX + "idx" + INTERNAL_KEY_PREFIX
+	metaKeyPrefix       string = INTERNAL_KEY_PREFIX + "meta" + INTERNAL_KEY_PREFIX
+
+	POSTING_PAGE_KEYS  int = 100
+	POSTING_PAGE_BYTES int = 1024
+)
+
+// IndexDefinition declares a secondary index over values. A value index
+// matches whole values, a prefix index matches the first PrefixLength
+// characters of a value.
+type IndexDefinition struct {
+	Name         string
+	Type         string
+	PrefixLength int
+}
+
+func (d IndexDefinition) Validate() error {
+	if d.Name == "" || strings.Contains(d.Name, INTERNAL_KEY_PREFIX) {
+		return fmt.Errorf("Invalid index name %q.", d.Name)
+	}
+
+	switch d.Type {
+	case VALUE_INDEX:
+		return nil
+	case PREFIX_INDEX:
+		if d.PrefixLength <= 0 {
+			return fmt.Errorf("Prefix index %s needs a positive prefix length.", d.Name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown index type %q for index %s.", d.Type, d.Name)
+}
+
+// IndexedValue returns the term a value is filed under in this index.
+func (d IndexDefinition) IndexedValue(value string) string {
+	if d.Type == PREFIX_INDEX && len(value) > d.PrefixLength {
+		return value[:d.PrefixLength]
+	}
+
+	return value
+}
+
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, INTERNAL_KEY_PREFIX)
+}
+
+// MetaKey is the key a front end keeps metadata of key under, such as the
+// memcached flags. Meta keys are internal, so scans, counts and range
+// deletes pass over them, but Get, Put and Del take them.
+func MetaKey(key string) string {
+	return metaKeyPrefix + key
+}
+
+// IsReservedKey reports whether key is one only the store itself writes,
+// writes of it are refused.
+func IsReservedKey(key string) bool {
+	return IsInternalKey(key) && !strings.HasPrefix(key, metaKeyPrefix)
+}
+
+// indexEntryKey doubles every INTERNAL_KEY_PREFIX in term, so a lone one
+// after the term only ever separates it from a posting page number.
+func indexEntryKey(indexName string, term string) string {
+	term = strings.ReplaceAll(term, INTERNAL_KEY_PREFIX, INTERNAL_KEY_PREFIX+INTERNAL_KEY_PREFIX)
+	return indexEntryPrefix + indexName + INTERNAL_KEY_PREFIX + term
+}
+
+func encodeList(values []string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(values)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func decodeList(s string) ([]string, error) {
+	if s == "" {
+		return []string{}, nil
+	}
+
+	r := csv.NewReader(strings.NewReader(s))
+	return r.Read()
+}
+
+func encodeIndexDefinitions(defs map[string]IndexDefinition) string {
+	fields := make([]string, 0, 3*len(defs))
+	for _, name := range sortedIndexNames(defs) {
+		d := defs[name]
+		fields = append(fields, d.Name, d.Type, strconv.Itoa(d.PrefixLength))
+	}
+
+	return encodeList(fields)
+}
+
+func decodeIndexDefinitions(s string) (map[string]IndexDefinition, error) {
+	defs := make(map[string]IndexDefinition)
+	fields, err := decodeList(s)
+	if err != nil {
+		return defs, err
+	}
+
+	if len(fields)%3 != 0 {
+		return defs, errors.New("Corrupt index definition record.")
+	}
+
+	for i := 0; i < len(fields); i += 3 {
+		prefixLength, err := strconv.Atoi(fields[i+2])
+		if err != nil {
+			return defs, err
+		}
+
+		d := IndexDefinition{fields[i], fields[i+1], prefixLength}
+		defs[d.Name] = d
+	}
+
+	return defs, nil
+}
+
+func sortedIndexNames(defs map[string]IndexDefinition) []string {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// secondaryIndexes maintains index posting lists inside the internal
+// keyspace of a kvStore.
+type secondaryIndexes struct {
+	kv   kvStore
+	defs map[string]IndexDefinition
+}
+
+// kvStore is the raw keyspace the secondary indexes are stored in.
+type kvStore interface {
+	rawGet(key string) (value string, ok bool)
+	rawPut(key string, value string) error
+	rawDel(key string)
+	rawItems() (items map[string]string, err error)
+}
+
+func loadSecondaryIndexes(kv kvStore) (*secondaryIndexes, error) {
+	defs := make(map[string]IndexDefinition)
+	if s, ok := kv.rawGet(indexDefsKey); ok {
+		var err error
+		defs, err = decodeIndexDefinitions(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infof("Loaded %d secondary index definitions.", len(defs))
+	return &secondaryIndexes{kv, defs}, nil
+}
+
+func (x *secondaryIndexes) define(def IndexDefinition) error {
+	if err := def.Validate(); err != nil {
+		return err
+	}
+
+	x.defs[def.Name] = def
+	if err := x.kv.rawPut(indexDefsKey, encodeIndexDefinitions(x.defs)); err != nil {
+		return err
+	}
+
+	log.Infof("Defined %s index %s, rebuilding.", def.Type, def.Name)
+	return x.rebuild(def.Name)
+}
+
+// A posting list is kept in pages of at most POSTING_PAGE_KEYS keys and
+// POSTING_PAGE_BYTES bytes so no single value grows with the number of
+// keys sharing a term. The entry key of a term holds the number of pages,
+// stores written before paging hold the whole list there instead.
+func postingPageKey(indexName string, term string, page int) string {
+	return indexEntryKey(indexName, term) + INTERNAL_KEY_PREFIX + strconv.Itoa(page)
+}
+
+func (x *secondaryIndexes) pages(indexName string, term string) [][]string {
+	head, ok := x.kv.rawGet(indexEntryKey(indexName, term))
+	if !ok {
+		return nil
+	}
+
+	count, err := strconv.Atoi(head)
+	if err != nil {
+		keys, err := decodeList(head)
+		if err != nil {
+			log.Errorf("Corrupt posting list for index %s: %v", indexName, err)
+			return nil
+		}
+		return [][]string{keys}
+	}
+
+	pages := make([][]string, 0, count)
+	for i := 0; i < count; i++ {
+		s, _ := x.kv.rawGet(postingPageKey(indexName, term, i))
+		keys, err := decodeList(s)
+		if err != nil {
+			log.Errorf("Corrupt posting page %d for index %s: %v", i, indexName, err)
+			continue
+		}
+		pages = append(pages, keys)
+	}
+
+	return pages
+}
+
+// setPages replaces the pages of a term, dropping the pages past the new
+// count.
+func (x *secondaryIndexes) setPages(indexName string, term string, pages [][]string) error {
+	entryKey := indexEntryKey(indexName, term)
+	old := 0
+	if head, ok := x.kv.rawGet(entryKey); ok {
+		old, _ = strconv.Atoi(head)
+	}
+
+	kept := pages[:0]
+	for _, keys := range pages {
+		if len(keys) > 0 {
+			kept = append(kept, keys)
+		}
+	}
+
+	for i, keys := range kept {
+		if err := x.kv.rawPut(postingPageKey(indexName, term, i), encodeList(keys)); err != nil {
+			return err
+		}
+	}
+
+	for i := len(kept); i < old; i++ {
+		x.kv.rawDel(postingPageKey(indexName, term, i))
+	}
+
+	if len(kept) == 0 {
+		x.kv.rawDel(entryKey)
+		return nil
+	}
+
+	return x.kv.rawPut(entryKey, strconv.Itoa(len(kept)))
+}
+
+func (x *secondaryIndexes) postings(indexName string, term string) []string {
+	keys := []string{}
+	for _, page := range x.pages(indexName, term) {
+		keys = append(keys, page...)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// paginate cuts sorted keys into pages.
+func paginate(keys []string) (pages [][]string) {
+	var page []string
+	var size int
+	for _, key := range keys {
+		if len(page) > 0 && (len(page) >= POSTING_PAGE_KEYS || size+len(key) > POSTING_PAGE_BYTES) {
+			pages = append(pages, page)
+			page, size = nil, 0
+		}
+
+		page = append(page, key)
+		size += len(key) + 1
+	}
+
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+
+	return pages
+}
+
+func (x *secondaryIndexes) setPostings(indexName string, term string, keys []string) error {
+	sort.Strings(keys)
+	return x.setPages(indexName, term, paginate(keys))
+}
+
+// add files key under term, writing only the last page unless a new one
+// has to be started.
+func (x *secondaryIndexes) add(indexName string, term string, key string) error {
+	pages := x.pages(indexName, term)
+	for _, page := range pages {
+		for _, k := range page {
+			if k == key {
+				return nil
+			}
+		}
+	}
+
+	last := len(pages) - 1
+	if last >= 0 && len(paginate(append(append([]string(nil), pages[last]...), key))) == 1 {
+		pages[last] = append(pages[last], key)
+		if head, _ := x.kv.rawGet(indexEntryKey(indexName, term)); head == strconv.Itoa(len(pages)) {
+			return x.kv.rawPut(postingPageKey(indexName, term, last), encodeList(pages[last]))
+		}
+		return x.setPages(indexName, term, pages)
+	}
+
+	return x.setPages(indexName, term, append(pages, []string{key}))
+}
+
+// remove takes key off the page holding it, an emptied page is replaced
+// by the last one.
+func (x *secondaryIndexes) remove(indexName string, term string, key string) error {
+	pages := x.pages(indexName, term)
+	for i, page := range pages {
+		for j, k := range page {
+			if k != key {
+				continue
+			}
+
+			pages[i] = append(page[:j], page[j+1:]...)
+			if len(pages[i]) == 0 {
+				last := len(pages) - 1
+				pages[i] = pages[last]
+				pages = pages[:last]
+			}
+			return x.setPages(indexName, term, pages)
+		}
+	}
+
+	return nil
+}
+
+// update moves key from the posting lists of its old value to those of its
+// new value. Either side may be absent for inserts and deletes.
+func (x *secondaryIndexes) update(key string, oldValue string, hadOld bool,
+	newValue string, hasNew bool) error {
+	for _, def := range x.defs {
+		oldTerm := def.IndexedValue(oldValue)
+		newTerm := def.IndexedValue(newValue)
+		if hadOld && hasNew && oldTerm == newTerm {
+			continue
+		}
+
+		if hadOld {
+			if err := x.remove(def.Name, oldTerm, key); err != nil {
+				return err
+			}
+		}
+
+		if hasNew {
+			if err := x.add(def.Name, newTerm, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (x *secondaryIndexes) query(indexName string, value string) ([]string, error) {
+	def, ok := x.defs[indexName]
+	if !ok {
+		return nil, fmt.Errorf("No index named %s.", indexName)
+	}
+
+	return x.postings(indexName, def.IndexedValue(value)), nil
+}
+
+// rebuild drops and recomputes the posting lists of the named indexes, or
+// of every index when no names are given.
+func (x *secondaryIndexes) rebuild(names ...string) error {
+	if len(names) == 0 {
+		names = sortedIndexNames(x.defs)
+	}
+
+	items, err := x.kv.rawItems()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		def, ok := x.defs[name]
+		if !ok {
+			return fmt.Errorf("No index named %s.", name)
+		}
+
+		log.Infof("Rebuilding secondary index %s.", name)
+		prefix := indexEntryPrefix + name + INTERNAL_KEY_PREFIX
+		postings := make(map[string][]string)
+		for key, value := range items {
+			if strings.HasPrefix(key, prefix) {
+				x.kv.rawDel(key)
+				continue
+			}
+
+			if IsInternalKey(key) {
+				continue
+			}
+
+			term := def.IndexedValue(value)
+			postings[term] = append(postings[term], key)
+		}
+
+		for term, keys := range postings {
+			if err := x.setPostings(name, term, keys); err != nil {
+				return err
+			}
+		}
+		log.Infof("Rebuilt secondary index %s with %d terms.", name, len(postings))
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	"strings"
+	"testing"
+)
+
+func TestPostingListIsPaged(t *testing.T) {
+	options := testOptions(t)
+	options.BlockSizeBytes = index.MIN_BLOCK_SIZE_BYTES
+	s := openSsStore(t, options)
+	if err := s.DefineIndex(IndexDefinition{Name: "color", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 700; i++ {
+		if err := s.Put(fmt.Sprintf("key-%03d", i), "red"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Flush()
+
+	keys, err := s.QueryIndex("color", "red")
+	if err != nil || len(keys) != 700 {
+		t.Fatalf("query returned %d keys, %v", len(keys), err)
+	}
+
+	items, err := s.rawItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range items {
+		if strings.HasPrefix(key, indexEntryPrefix) && len(value) > POSTING_PAGE_BYTES {
+			t.Errorf("posting value under %q is %d bytes", key, len(value))
+		}
+	}
+
+	for i := 0; i < 700; i += 2 {
+		s.Del(fmt.Sprintf("key-%03d", i))
+	}
+
+	if keys, _ = s.QueryIndex("color", "red"); len(keys) != 350 {
+		t.Fatalf("query after deletes returned %d keys", len(keys))
+	}
+
+	for _, key := range keys {
+		if key[len(key)-1]%2 == 0 {
+			t.Fatalf("deleted key %s still indexed", key)
+		}
+	}
+}
+
+func TestLegacyPostingListIsRead(t *testing.T) {
+	s := openSsStore(t, testOptions(t))
+	if err := s.DefineIndex(IndexDefinition{Name: "color", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.rawPut("a", "red")
+	s.rawPut("b", "red")
+	s.rawPut(indexEntryKey("color", "red"), encodeList([]string{"a", "b"}))
+	if err := s.Put("c", "red"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := s.QueryIndex("color", "red")
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("query returned %v", keys)
+	}
+}
+
+func TestTermsHoldingThePrefixKeepTheirPostings(t *testing.T) {
+	s := openSsStore(t, testOptions(t))
+	if err := s.DefineIndex(IndexDefinition{Name: "v", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The page key of term "a" would be the entry key of the second term
+	// if terms were not escaped.
+	terms := map[string]string{"a": "k1", "a" + INTERNAL_KEY_PREFIX + "0": "k2",
+		"a" + INTERNAL_KEY_PREFIX: "k3"}
+	for term, key := range terms {
+		if err := s.Put(key, term); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for term, key := range terms {
+		if keys, err := s.QueryIndex("v", term); err != nil || strings.Join(keys, ",") != key {
+			t.Fatalf("query for %q returned %v, %v, want %s", term, keys, err, key)
+		}
+	}
+}
+
+func TestInternalKeysAreRejected(t *testing.T) {
+	for _, engine := range []string{SS_ENGINE, HASH_ENGINE} {
+		options := testOptions(t)
+		var storage Store
+		var err error
+		if engine == SS_ENGINE {
+			storage, err = NewSsStore(options)
+		} else {
+			storage, err = NewHashStore(options)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = storage.DefineIndex(IndexDefinition{Name: "n", Type: VALUE_INDEX}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = storage.Put(indexDefsKey, "x"); err == nil {
+			t.Errorf("%s: put of an internal key succeeded", engine)
+		}
+
+		if _, ok := storage.Get(indexDefsKey); ok {
+			t.Errorf("%s: get returned an internal key", engine)
+		}
+
+		if storage.Exists(indexDefsKey) {
+			t.Errorf("%s: exists found an internal key", engine)
+		}
+
+		if items := storage.MultiGet([]string{indexDefsKey}); len(items) != 0 {
+			t.Errorf("%s: mget returned %v", engine, items)
+		}
+
+		storage.Del(indexDefsKey)
+		if err = storage.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+
+		if keys, err := storage.QueryIndex("n", "v"); err != nil || len(keys) != 1 {
+			t.Errorf("%s: index definitions lost after delete: %v %v", engine, keys, err)
+		}
+	}
+}
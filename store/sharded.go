@@ -0,0 +1,802 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	SHARDED_ENGINE   string = "sharded"
+	SHARDS_FILE      string = "SHARDS"
+	SHARDS_NEXT_FILE string = "SHARDS.next"
+	SHARD_PREFIX     string = "shard-"
+
+	// SHARD_VNODES is the number of points each shard has on the hash ring,
+	// more points spread the keys more evenly.
+	SHARD_VNODES int = 64
+
+	// REBALANCE_BATCH is the number of keys a rebalance moves at once.
+	REBALANCE_BATCH int = 1000
+)
+
+// ringPoint is a position on the hash ring owned by the shard at index
+// shard.
+type ringPoint struct {
+	hash  string
+	shard int
+}
+
+// hashRing maps key hashes to shards by consistent hashing. The points of
+// a shard follow from its name alone, so adding or removing a shard only
+// moves the keys next to its points.
+type hashRing struct {
+	points []ringPoint
+}
+
+func newHashRing(names []string) hashRing {
+	points := make([]ringPoint, 0, len(names)*SHARD_VNODES)
+	for i, name := range names {
+		for v := 0; v < SHARD_VNODES; v++ {
+			points = append(points, ringPoint{index.KeyHash(fmt.Sprintf("%s#%d", name, v)), i})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard
+	})
+
+	return hashRing{points}
+}
+
+// owner returns the shard of the first point at or after the key's hash.
+func (r hashRing) owner(key string) int {
+	hash := index.KeyHash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].shard
+}
+
+func shardNames(count int) []string {
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s%03d", SHARD_PREFIX, i)
+	}
+
+	return names
+}
+
+// readShardNames reads a shard list file, one name per line.
+func readShardNames(path string) (names []string, found bool, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, true, err
+	}
+
+	if len(names) == 0 {
+		return nil, true, fmt.Errorf("Shard list %s is empty.", path)
+	}
+
+	return names, true, nil
+}
+
+// writeShardNames replaces a shard list file, synced before the rename so
+// a crash leaves the old or the new list.
+func writeShardNames(path string, names []string) error {
+	tmp := path + index.TEMP_SUFFIX
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(strings.Join(names, "\n") + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func openShard(dir string, name string, options Options) (Store, error) {
+	options.Dir = filepath.Join(dir, name)
+	if err := os.MkdirAll(options.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return NewSsStore(options)
+}
+
+type shard struct {
+	name  string
+	store Store
+	mutex sync.Mutex
+}
+
+// ShardedStore spreads keys over independent ss table stores, each with
+// its own memtable and tables in a subdirectory and its own lock, so
+// writes to different shards do not wait on each other. It is safe for
+// concurrent use and says so through Concurrent, the server then does not
+// serialize its calls. Scans, counts and index queries ask every shard and
+// merge the answers. Batches spanning shards are not atomic across them.
+type ShardedStore struct {
+	options Options
+	shards  []*shard
+	ring    hashRing
+}
+
+// NewShardedStore opens the sharded store in options.Dir. A new store is
+// split into options.Shards shards, an existing one keeps the shards its
+// SHARDS file lists.
+func NewShardedStore(options Options) (Store, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	dir := options.Dir
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, SHARDS_NEXT_FILE)); err == nil {
+		return nil, fmt.Errorf("Store %s was left in the middle of a rebalance, run rebalance again to finish it.", dir)
+	}
+
+	names, found, err := readShardNames(filepath.Join(dir, SHARDS_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		count := options.Shards
+		if count == 0 {
+			count = DEFAULT_SHARDS
+		}
+
+		names = shardNames(count)
+		if err = writeShardNames(filepath.Join(dir, SHARDS_FILE), names); err != nil {
+			return nil, err
+		}
+	} else if options.Shards != 0 && options.Shards != len(names) {
+		log.Warnf("Store %s has %d shards, not %d, rebalance to change the count.", dir,
+			len(names), options.Shards)
+	}
+
+	s := &ShardedStore{options: options, ring: newHashRing(names)}
+	for _, name := range names {
+		storage, err := openShard(dir, name, options)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open shard %s: %v", name, err)
+		}
+		s.shards = append(s.shards, &shard{name: name, store: storage})
+	}
+
+	log.Infof("Opened sharded store %s with %d shards.", dir, len(names))
+	return s, nil
+}
+
+// ConcurrentSafe marks the store as safe for concurrent use.
+func (s *ShardedStore) ConcurrentSafe() {}
+
+func (s *ShardedStore) shardOf(key string) *shard {
+	return s.shards[s.ring.owner(key)]
+}
+
+func (sh *shard) with(f func(storage Store)) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	f(sh.store)
+}
+
+// fanOut runs f on every shard at once and waits for all of them.
+func (s *ShardedStore) fanOut(f func(i int, storage Store)) {
+	var wg sync.WaitGroup
+	for i, sh := range s.shards {
+		wg.Add(1)
+		go func(i int, sh *shard) {
+			defer wg.Done()
+			sh.with(func(storage Store) { f(i, storage) })
+		}(i, sh)
+	}
+	wg.Wait()
+}
+
+// firstError returns the first non nil error of errs.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardedStore) Put(key string, value string) (err error) {
+	s.shardOf(key).with(func(storage Store) {
+		err = storage.Put(key, value)
+	})
+
+	return err
+}
+
+func (s *ShardedStore) Get(key string) (value string, ok bool) {
+	s.shardOf(key).with(func(storage Store) {
+		value, ok = storage.Get(key)
+	})
+
+	return value, ok
+}
+
+func (s *ShardedStore) Del(key string) {
+	s.shardOf(key).with(func(storage Store) {
+		storage.Del(key)
+	})
+}
+
+func (s *ShardedStore) Exists(key string) (found bool) {
+	s.shardOf(key).with(func(storage Store) {
+		found = storage.Exists(key)
+	})
+
+	return found
+}
+
+// Scan merges the scans of every shard into key hash order, the order a
+// single store returns.
+func (s *ShardedStore) Scan(keyone string, keytwo string) (items []KeyValue, ok bool) {
+	results := make([][]KeyValue, len(s.shards))
+	oks := make([]bool, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		results[i], oks[i] = storage.Scan(keyone, keytwo)
+	})
+
+	ok = true
+	for i := range results {
+		items = append(items, results[i]...)
+		ok = ok && oks[i]
+	}
+
+	hashes := make(map[string]string, len(items))
+	for _, kv := range items {
+		hashes[kv.Key] = index.KeyHash(kv.Key)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return hashes[items[i].Key] < hashes[items[j].Key]
+	})
+
+	return items, ok
+}
+
+func (s *ShardedStore) Count(keyone string, keytwo string) (count int, ok bool) {
+	counts := make([]int, len(s.shards))
+	oks := make([]bool, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		counts[i], oks[i] = storage.Count(keyone, keytwo)
+	})
+
+	ok = true
+	for i := range counts {
+		count += counts[i]
+		ok = ok && oks[i]
+	}
+
+	return count, ok
+}
+
+// MultiGet looks the keys of each shard up together and returns the found
+// ones in the order asked for.
+func (s *ShardedStore) MultiGet(keys []string) (items []KeyValue) {
+	groups := make([][]string, len(s.shards))
+	for _, key := range keys {
+		i := s.ring.owner(key)
+		groups[i] = append(groups[i], key)
+	}
+
+	results := make([][]KeyValue, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		if len(groups[i]) > 0 {
+			results[i] = storage.MultiGet(groups[i])
+		}
+	})
+
+	found := make(map[string]string, len(keys))
+	for _, result := range results {
+		for _, kv := range result {
+			found[kv.Key] = kv.Value
+		}
+	}
+
+	for _, key := range keys {
+		if value, ok := found[key]; ok {
+			items = append(items, KeyValue{key, value})
+		}
+	}
+
+	return items
+}
+
+// MultiPut writes the items of each shard as one batch. The batches of
+// different shards are written independently.
+func (s *ShardedStore) MultiPut(items []KeyValue) error {
+	if err := checkPutKeys(items); err != nil {
+		return err
+	}
+
+	groups := make([][]KeyValue, len(s.shards))
+	for _, kv := range items {
+		i := s.ring.owner(kv.Key)
+		groups[i] = append(groups[i], kv)
+	}
+
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		if len(groups[i]) > 0 {
+			errs[i] = storage.MultiPut(groups[i])
+		}
+	})
+
+	return firstError(errs)
+}
+
+func (s *ShardedStore) DeleteRange(start string, end string) error {
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		errs[i] = storage.DeleteRange(start, end)
+	})
+
+	return firstError(errs)
+}
+
+func (s *ShardedStore) Flush() {
+	s.fanOut(func(i int, storage Store) {
+		storage.Flush()
+	})
+}
+
+// Close closes every shard, the store cannot be used afterwards.
+func (s *ShardedStore) Close() error {
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		errs[i] = Close(storage)
+	})
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DefineIndex defines the index on every shard, each indexes its own keys.
+func (s *ShardedStore) DefineIndex(def IndexDefinition) error {
+	if err := def.Validate(); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		errs[i] = storage.DefineIndex(def)
+	})
+
+	return firstError(errs)
+}
+
+// QueryIndex returns the sorted keys every shard finds.
+func (s *ShardedStore) QueryIndex(indexName string, value string) (keys []string, err error) {
+	results := make([][]string, len(s.shards))
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		results[i], errs[i] = storage.QueryIndex(indexName, value)
+	})
+
+	if err = firstError(errs); err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		keys = append(keys, result...)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *ShardedStore) RebuildIndexes() error {
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		errs[i] = storage.RebuildIndexes()
+	})
+
+	return firstError(errs)
+}
+
+func (s *ShardedStore) CollectGarbage() error {
+	errs := make([]error, len(s.shards))
+	s.fanOut(func(i int, storage Store) {
+		if collector, ok := storage.(GarbageCollector); ok {
+			errs[i] = collector.CollectGarbage()
+		}
+	})
+
+	return firstError(errs)
+}
+
+// Watch merges watchers of every shard, the position holds a sequence per
+// shard and the events of each shard come in its order. A position is only
+// valid for the shard count it was taken with.
+func (s *ShardedStore) Watch(filter WatchFilter, from WatchPosition) (*Watcher, error) {
+	if from != nil && len(from) != len(s.shards) {
+		return nil, fmt.Errorf("Position %s has %d sequences, the store has %d shards.", from,
+			len(from), len(s.shards))
+	}
+
+	var logs []watchedLog
+	for i, sh := range s.shards {
+		sh := sh
+		watchable, ok := sh.store.(Watchable)
+		if !ok {
+			return nil, errors.New("Shards have to keep a write-ahead log to be watched.")
+		}
+
+		var shardFrom WatchPosition
+		if from != nil {
+			shardFrom = from[i : i+1]
+		}
+
+		with := func(f func()) {
+			sh.with(func(storage Store) { f() })
+		}
+
+		watcher, err := LockedWatch(watchable, filter, shardFrom, with)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, watcher.logs...)
+	}
+
+	return newWatcher(filter, from, logs)
+}
+
+// Stats reports the shard count followed by the figures of every shard,
+// prefixed with its name.
+func (s *ShardedStore) Stats() []Stat {
+	stats := []Stat{
+		{"engine", SHARDED_ENGINE},
+		{"dir", s.options.Dir},
+		{"shards", fmt.Sprintf("%d", len(s.shards))},
+	}
+
+	for _, sh := range s.shards {
+		sh.with(func(storage Store) {
+			inspector, ok := storage.(Inspector)
+			if !ok {
+				return
+			}
+
+			for _, stat := range inspector.Stats() {
+				if stat.Name != "engine" && stat.Name != "dir" {
+					stats = append(stats, Stat{sh.name + " " + stat.Name, stat.Value})
+				}
+			}
+		})
+	}
+
+	return stats
+}
+
+func (s *ShardedStore) Files() []string {
+	files := []string{filepath.Join(s.options.Dir, SHARDS_FILE)}
+	for _, sh := range s.shards {
+		sh.with(func(storage Store) {
+			if inspector, ok := storage.(Inspector); ok {
+				files = append(files, inspector.Files()...)
+			}
+		})
+	}
+
+	return files
+}
+
+// ShardDirs returns the shard directories of the sharded store in dir,
+// found is false when dir holds no sharded store.
+func ShardDirs(dir string) (dirs []string, found bool, err error) {
+	names, found, err := readShardNames(filepath.Join(dir, SHARDS_FILE))
+	for _, name := range names {
+		dirs = append(dirs, filepath.Join(dir, name))
+	}
+
+	return dirs, found, err
+}
+
+// Rebalance changes the number of shards of the sharded store in
+// options.Dir to shards, moving every key whose owner changes. Shards are
+// streamed, not loaded whole. It works offline, the store must not be
+// open. The new layout is recorded in SHARDS.next first and the store
+// refuses to open until a rebalance completes, so an interrupted one is
+// finished by running it again.
+func Rebalance(options Options, shards int) (moved int, err error) {
+	if shards <= 0 {
+		return 0, fmt.Errorf("Shard count has to be positive, got %d.", shards)
+	}
+
+	dir := options.Dir
+	current, found, err := readShardNames(filepath.Join(dir, SHARDS_FILE))
+	if err != nil {
+		return 0, err
+	}
+
+	if !found {
+		return 0, fmt.Errorf("%s holds no sharded store.", dir)
+	}
+
+	target := shardNames(shards)
+	next, resuming, err := readShardNames(filepath.Join(dir, SHARDS_NEXT_FILE))
+	if err != nil {
+		return 0, err
+	}
+
+	if resuming && len(next) != shards {
+		return 0, fmt.Errorf("An interrupted rebalance to %d shards has to be finished first.",
+			len(next))
+	}
+
+	if resuming {
+		log.Infof("Resuming the rebalance of %s to %d shards.", dir, shards)
+		target = next
+	} else if err = writeShardNames(filepath.Join(dir, SHARDS_NEXT_FILE), target); err != nil {
+		return 0, err
+	}
+
+	// Shard directories left by an interrupted rebalance are drained too.
+	leftover, err := filepath.Glob(filepath.Join(dir, SHARD_PREFIX+"*"))
+	if err != nil {
+		return 0, err
+	}
+
+	all := append([]string(nil), target...)
+	for _, name := range current {
+		if !containsString(all, name) {
+			all = append(all, name)
+		}
+	}
+
+	for _, path := range leftover {
+		if info, err := os.Stat(path); err == nil && info.IsDir() &&
+			!containsString(all, filepath.Base(path)) {
+			all = append(all, filepath.Base(path))
+		}
+	}
+
+	// Stores still open when the rebalance fails are closed on the way out.
+	stores := make(map[string]*SsStore, len(all))
+	defer func() {
+		for _, storage := range stores {
+			storage.Close()
+		}
+	}()
+
+	for _, name := range all {
+		storage, err := openShard(dir, name, options)
+		if err != nil {
+			return moved, fmt.Errorf("Could not open shard %s: %v", name, err)
+		}
+		stores[name] = storage.(*SsStore)
+	}
+
+	// Every shard gets every index before keys move, so the moved keys are
+	// indexed where they land. Each definition is given to a shard once,
+	// unless the shard has it already.
+	defs := make(map[string]IndexDefinition)
+	var names []string
+	for _, name := range all {
+		for _, def := range stores[name].indexDefinitions() {
+			if _, ok := defs[def.Name]; !ok {
+				names = append(names, def.Name)
+			}
+			defs[def.Name] = def
+		}
+	}
+
+	for _, other := range target {
+		for _, name := range names {
+			if old, ok := stores[other].indexes.defs[name]; ok && old == defs[name] {
+				continue
+			}
+
+			if err = stores[other].DefineIndex(defs[name]); err != nil {
+				return moved, err
+			}
+		}
+	}
+
+	ring := newHashRing(target)
+	for _, name := range all {
+		count, err := moveShard(stores, name, ring, target)
+		moved += count
+		if err != nil {
+			return moved, err
+		}
+
+		if count > 0 {
+			log.Infof("Moved %d keys out of shard %s.", count, name)
+		}
+	}
+
+	// Closing flushes the shards, their tables then hold the moved keys.
+	for _, name := range all {
+		err = stores[name].Close()
+		delete(stores, name)
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	if err = writeShardNames(filepath.Join(dir, SHARDS_FILE), target); err != nil {
+		return moved, err
+	}
+
+	if err = os.Remove(filepath.Join(dir, SHARDS_NEXT_FILE)); err != nil {
+		return moved, err
+	}
+
+	for _, name := range all {
+		if !containsString(target, name) {
+			if err = os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return moved, err
+			}
+		}
+	}
+
+	log.Infof("Rebalanced %s from %d to %d shards, moved %d keys.", dir, len(current),
+		len(target), moved)
+	return moved, nil
+}
+
+// itemsAfter returns the live items of the next table block following the
+// key hash after, and the last hash of that block to continue from, empty
+// once the table is read. Writes in the memtable are seen for keys the
+// table holds, others only after a flush.
+func (s *SsStore) itemsAfter(after string) (items []KeyValue, last string, err error) {
+	stored, err := s.blockStorage.ItemsAfter(after)
+	if err != nil || len(stored) == 0 {
+		return nil, "", err
+	}
+
+	for _, it := range stored {
+		item, ok := s.lookupCached(it.Key(), it)
+		if !ok || IsReservedKey(it.Key()) {
+			continue
+		}
+
+		value, err := s.resolve(item)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, KeyValue{it.Key(), value})
+	}
+
+	return items, stored[len(stored)-1].KeyHash(), nil
+}
+
+// indexDefinitions returns the defined indexes sorted by name.
+func (s *SsStore) indexDefinitions() (defs []IndexDefinition) {
+	for _, name := range sortedIndexNames(s.indexes.defs) {
+		defs = append(defs, s.indexes.defs[name])
+	}
+
+	return defs
+}
+
+// syncLogs makes the logged writes durable without waiting for a flush.
+func (s *SsStore) syncLogs() error {
+	if err := s.values.sync(); err != nil {
+		return err
+	}
+
+	return s.wal.file.Sync()
+}
+
+// moveShard moves the keys of shard name that the ring gives to other
+// shards. The shard is read a table block at a time and the keys are moved
+// in batches of REBALANCE_BATCH, each written to its new shard and synced
+// there before it is deleted from the old one.
+func moveShard(stores map[string]*SsStore, name string, ring hashRing,
+	target []string) (moved int, err error) {
+	source := stores[name]
+	source.Flush()
+
+	batches := make(map[string][]KeyValue)
+	var pending int
+	for hash, done := "", false; !done; {
+		var items []KeyValue
+		if items, hash, err = source.itemsAfter(hash); err != nil {
+			return moved, err
+		}
+
+		done = hash == ""
+		for _, kv := range items {
+			if owner := target[ring.owner(kv.Key)]; owner != name {
+				batches[owner] = append(batches[owner], kv)
+				pending++
+			}
+		}
+
+		if pending < REBALANCE_BATCH && !done {
+			continue
+		}
+
+		for owner, items := range batches {
+			if err = stores[owner].MultiPut(items); err != nil {
+				return moved, err
+			}
+
+			if err = stores[owner].syncLogs(); err != nil {
+				return moved, err
+			}
+		}
+
+		for _, items := range batches {
+			for _, kv := range items {
+				source.Del(kv.Key)
+			}
+			moved += len(items)
+		}
+
+		batches, pending = make(map[string][]KeyValue), 0
+	}
+
+	return moved, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
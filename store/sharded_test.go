@@ -0,0 +1,224 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func openShardedStore(t *testing.T, options Options) *ShardedStore {
+	storage, err := NewShardedStore(options)
+	if err != nil {
+		t.Fatalf("open %s: %v", options.Dir, err)
+	}
+
+	return storage.(*ShardedStore)
+}
+
+func shardedValues(n int) map[string]string {
+	want := map[string]string{"crlf": "has\r\ncrlf",
+		"big": strings.Repeat("x", VALUE_LOG_THRESHOLD), MetaKey("crlf"): "meta"}
+	for i := 0; i < n; i++ {
+		want[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("value-%d", i%7)
+	}
+
+	return want
+}
+
+func checkShardedStore(t *testing.T, s *ShardedStore, want map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		if got, ok := s.Get(key); !ok || got != value {
+			t.Fatalf("%q is %q, %v, want %q", key, got, ok, value)
+		}
+	}
+
+	if count, ok := s.Count("a", "a"); !ok || count != len(want)-1 {
+		t.Fatalf("count is %d, %v, want %d", count, ok, len(want)-1)
+	}
+
+	var indexed int
+	for _, value := range want {
+		if value == "value-3" {
+			indexed++
+		}
+	}
+
+	if keys, err := s.QueryIndex("value", "value-3"); err != nil || len(keys) != indexed {
+		t.Fatalf("query found %d keys, %v, want %d", len(keys), err, indexed)
+	}
+}
+
+func TestRebalanceMovesKeysInBatches(t *testing.T) {
+	options := testOptions(t)
+	options.Shards = 3
+	options.MemtableEntries = 2000
+	s := openShardedStore(t, options)
+	if err := s.DefineIndex(IndexDefinition{Name: "value", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := shardedValues(4000)
+	for key, value := range want {
+		if err := s.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Flush()
+
+	moved, err := Rebalance(options, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved <= REBALANCE_BATCH {
+		t.Fatalf("rebalance moved %d keys, not more than one batch", moved)
+	}
+
+	if _, err = os.Stat(filepath.Join(options.Dir, SHARDS_NEXT_FILE)); !os.IsNotExist(err) {
+		t.Fatalf("%s is left behind: %v", SHARDS_NEXT_FILE, err)
+	}
+
+	options.Shards = 0
+	s = openShardedStore(t, options)
+	if len(s.shards) != 5 {
+		t.Fatalf("store has %d shards", len(s.shards))
+	}
+	checkShardedStore(t, s, want)
+
+	// Each key sits on the shard the ring gives it and on no other.
+	for _, sh := range s.shards {
+		items, _ := sh.store.Scan("a", "a")
+		for _, kv := range items {
+			if owner := s.shardOf(kv.Key); owner != sh {
+				t.Fatalf("%s is on %s, owned by %s", kv.Key, sh.name, owner.name)
+			}
+		}
+	}
+
+	if _, err = Rebalance(options, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, _, err := ShardDirs(options.Dir)
+	if err != nil || len(dirs) != 2 {
+		t.Fatalf("store has shard dirs %v, %v", dirs, err)
+	}
+
+	if _, err = os.Stat(filepath.Join(options.Dir, shardNames(5)[4])); !os.IsNotExist(err) {
+		t.Fatalf("removed shard is left behind: %v", err)
+	}
+	checkShardedStore(t, openShardedStore(t, options), want)
+}
+
+// openFiles counts the files the process has open, -1 where /proc does
+// not list them.
+func openFiles() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	return len(fds)
+}
+
+func TestRebalanceDefinesEachIndexOnceAndClosesShards(t *testing.T) {
+	options := testOptions(t)
+	options.Shards = 4
+	s := openShardedStore(t, options)
+	defs := []IndexDefinition{{Name: "value", Type: VALUE_INDEX},
+		{Name: "prefix", Type: PREFIX_INDEX, PrefixLength: 3}}
+	for _, def := range defs {
+		if err := s.DefineIndex(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := shardedValues(100)
+	for key, value := range want {
+		if err := s.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := openFiles()
+	if _, err := Rebalance(options, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := openFiles(); after != files {
+		t.Fatalf("rebalance left %d files open", after-files)
+	}
+
+	for _, name := range shardNames(6) {
+		defined := make(map[string]int)
+		for _, path := range []string{walPreviousPath(filepath.Join(options.Dir, name)),
+			walPath(filepath.Join(options.Dir, name))} {
+			scan, err := scanWalFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, record := range scan.records {
+				if record.Type == INDEX_COMMAND {
+					defined[record.Key]++
+				}
+			}
+		}
+
+		if !reflect.DeepEqual(defined, map[string]int{"value": 1, "prefix": 1}) {
+			t.Fatalf("shard %s logged index definitions %v", name, defined)
+		}
+	}
+
+	options.Shards = 0
+	checkShardedStore(t, openShardedStore(t, options), want)
+}
+
+func TestShardedStoreTakesConcurrentWrites(t *testing.T) {
+	var storage Store = openShardedStore(t, testOptions(t))
+	if _, ok := storage.(Concurrent); !ok {
+		t.Fatal("sharded store is not Concurrent")
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("k-%d-%d", n, i)
+				if err := storage.Put(key, key); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if value, ok := storage.Get(key); !ok || value != key {
+					t.Errorf("%s is %q, %v", key, value, ok)
+					return
+				}
+			}
+			storage.Scan("a", "b")
+		}(n)
+	}
+	wg.Wait()
+
+	if count, ok := storage.Count("a", "a"); !ok || count != 1600 {
+		t.Fatalf("count is %d, %v", count, ok)
+	}
+
+	items := storage.MultiGet([]string{"k-0-0", "missing", "k-7-199"})
+	want := []KeyValue{{"k-0-0", "k-0-0"}, {"k-7-199", "k-7-199"}}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("mget returned %v", items)
+	}
+}
@@ -1,28 +1,79 @@
 package store
 
 import (
+	"fmt"
 	"github.com/shimanekb/project2-A/index"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	DATA_FLUSH_THRESHOLD int    = 100
-	GET_COMMAND          string = "get"
-	PUT_COMMAND          string = "put"
-	DEL_COMMAND          string = "del"
+	GET_COMMAND string = "get"
+	PUT_COMMAND string = "put"
+	DEL_COMMAND string = "del"
+	SS_ENGINE   string = "sstable"
+	HASH_ENGINE string = "hash"
 )
 
 type Store interface {
 	Put(key string, value string) error
 	Get(key string) (value string, ok bool)
 	Del(key string)
-	Scan(keyone string, keytwo string) (values []string, ok bool)
+	Scan(keyone string, keytwo string) (items []KeyValue, ok bool)
+	MultiGet(keys []string) (items []KeyValue)
+	MultiPut(items []KeyValue) error
+	Exists(key string) bool
+	Count(keyone string, keytwo string) (count int, ok bool)
+	DeleteRange(start string, end string) error
 	Flush()
+	DefineIndex(def IndexDefinition) error
+	QueryIndex(indexName string, value string) (keys []string, err error)
+	RebuildIndexes() error
+}
+
+// Closer is implemented by stores with background work that has to stop
+// before they are dropped.
+type Closer interface {
+	Close() error
+}
+
+// Concurrent is implemented by stores that are safe for concurrent use,
+// so callers need not serialize their calls.
+type Concurrent interface {
+	ConcurrentSafe()
+}
+
+// Close flushes a store that is no longer used and stops its background
+// work.
+func Close(storage Store) error {
+	if closer, ok := storage.(Closer); ok {
+		return closer.Close()
+	}
+
+	storage.Flush()
+	return nil
+}
+
+// KeyValue is a key with its value, as returned by scans.
+type KeyValue struct {
+	Key   string
+	Value string
 }
 
 type SsStore struct {
+	options      Options
+	manifest     *index.Manifest
+	table        uint64
+	sequence     int64
 	blockStorage index.BlockStorage
 	cache        Cache
+	cacheBytes   int64
+	rangeDels    []index.RangeTombstone
+	readCache    Cache
+	indexes      *secondaryIndexes
+	values       *valueLog
+	wal          *writeAheadLog
+	replaying    bool
+	failed       error
 }
 
 func convertToKeyValueItems(cache Cache) []index.Command {
@@ -36,56 +87,301 @@ func convertToKeyValueItems(cache Cache) []index.Command {
 	return items
 }
 
-func (s *SsStore) Scan(keyone string, keytwo string) (values []string, ok bool) {
+func (s *SsStore) Scan(keyone string, keytwo string) (items []KeyValue, ok bool) {
 	ok = true
-	values, err := s.blockStorage.RangeSearch(keyone, keytwo)
+	stored, err := s.rangeItems(keyone, keytwo)
 	if err != nil {
 		log.Error(err)
 		ok = false
 	}
 
-	return values, ok
+	for _, it := range stored {
+		if IsInternalKey(it.Key()) {
+			continue
+		}
+
+		value, err := s.resolve(it)
+		if err != nil {
+			log.Error(err)
+			ok = false
+			continue
+		}
+		items = append(items, KeyValue{it.Key(), value})
+	}
+
+	return items, ok
 }
 
 func (s *SsStore) Flush() {
 	log.Infof("Writing %d items from memcache into new ss table.", s.cache.Size())
+	if err := s.flushMemtable(); err != nil {
+		log.Fatalln("Could not flush items into new ss table.", err)
+	}
+
+	log.Info("Written items from memcache into new ss table.")
+}
+
+// Close flushes the store and closes its value log, write-ahead log and
+// manifest files. The store cannot be used afterwards.
+func (s *SsStore) Close() error {
+	err := s.failed
+	if err == nil {
+		err = s.flushMemtable()
+	}
+
+	if closeErr := s.values.close(); err == nil {
+		err = closeErr
+	}
+
+	if closeErr := s.wal.close(); err == nil {
+		err = closeErr
+	}
+
+	if closeErr := s.manifest.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// flushMemtable merges the memtable and the live table into a new table,
+// records the swap in the manifest and removes the old table.
+func (s *SsStore) flushMemtable() error {
+	if err := s.prunePostings(); err != nil {
+		return err
+	}
+
+	if err := s.values.sync(); err != nil {
+		return err
+	}
+
+	num := s.manifest.NewFileNumber()
 	items := convertToKeyValueItems(s.cache)
-	str, err := s.blockStorage.WriteKvItems(items)
+	str, err := s.blockStorage.WriteKvItems(items, s.rangeDels, index.TablePath(s.options.Dir, num))
 	if err != nil {
-		log.Fatalf("Could not flush items into new ss table.", err)
+		return err
+	}
+
+	edit := index.VersionEdit{AddTables: []uint64{num}, LastSequence: s.sequence,
+		ValueLogGeneration: s.values.generation}
+	if s.table != 0 {
+		edit.RemoveTables = []uint64{s.table}
+	}
+
+	if err = s.manifest.LogEdit(edit); err != nil {
+		return err
+	}
+
+	if err = s.wal.rotate(); err != nil {
+		return err
 	}
 
 	log.Info("Created new index store.")
+	old := s.blockStorage.FilePath()
 	s.blockStorage = str
+	s.table = num
 	s.cache = NewMemTableCache()
-	log.Info("Written items from memcache into new ss table.")
+	s.cacheBytes = 0
+	s.rangeDels = nil
+	if old != "" {
+		log.Infof("Removing replaced table file %s.", old)
+		if err = index.RemoveTable(old); err != nil {
+			log.Errorf("Could not remove replaced table file %s: %v", old, err)
+		}
+	}
+
+	return nil
 }
 
 func (s *SsStore) Put(key string, value string) error {
-	log.Infof("Cache size is %d", s.cache.Size())
-	if s.cache.Size() >= DATA_FLUSH_THRESHOLD {
-		log.Info("Data threshold met, creating new index store.")
-		items := convertToKeyValueItems(s.cache)
-		str, err := s.blockStorage.WriteKvItems(items)
+	if IsReservedKey(key) {
+		return fmt.Errorf("Key %q is reserved for internal use.", key)
+	}
 
-		if err != nil {
-			return err
-		}
+	if err := s.logWrite(LogRecord{Type: PUT_COMMAND, Key: key, Value: value}); err != nil {
+		return err
+	}
+
+	old, hadOld := s.indexedValue(key)
+	if err := s.rawPut(key, value); err != nil {
+		return s.fail(err)
+	}
+
+	return s.fail(s.indexes.update(key, old, hadOld, value, true))
+}
+
+// indexedValue returns the value key holds before a write, which the
+// secondary indexes move the key away from. Without indexes it is not read.
+func (s *SsStore) indexedValue(key string) (value string, ok bool) {
+	if len(s.indexes.defs) == 0 {
+		return "", false
+	}
+
+	return s.Get(key)
+}
+
+func (s *SsStore) rawPut(key string, value string) error {
+	if len(value) < VALUE_LOG_THRESHOLD {
+		return s.putItem(index.NewKeyValueItem(key, value))
+	}
+
+	log.Infof("Value for key %s is %d bytes, moving it to the value log.", key, len(value))
+	pointer, err := s.values.append(key, value)
+	if err != nil {
+		return err
+	}
+
+	return s.putItem(index.NewValuePointerItem(key, pointer))
+}
 
-		log.Info("Created new index store.")
-		s.blockStorage = str
-		s.cache = NewMemTableCache()
-		log.Infof("Created new cache, size is %d", s.cache.Size())
+// flushIfFull flushes the memtable once it holds MemtableEntries items or
+// MemtableBytes bytes.
+func (s *SsStore) flushIfFull() error {
+	if s.cache.Size() < s.options.MemtableEntries && s.cacheBytes < s.options.MemtableBytes {
+		return nil
 	}
 
+	log.Info("Data threshold met, creating new index store.")
+	if err := s.flushMemtable(); err != nil {
+		return err
+	}
+
+	log.Infof("Created new cache, size is %d", s.cache.Size())
+	return nil
+}
+
+// logWrite records a write in the write-ahead log before it is applied and
+// gives it the next sequence number. A full memtable is flushed first, so a
+// table never holds part of a write. Replayed writes are not logged again.
+func (s *SsStore) logWrite(record LogRecord) error {
+	if s.replaying {
+		return nil
+	}
+
+	if s.failed != nil {
+		return s.failed
+	}
+
+	log.Infof("Cache size is %d, %d bytes", s.cache.Size(), s.cacheBytes)
+	if err := s.flushIfFull(); err != nil {
+		return err
+	}
+
+	record.Sequence = s.sequence + 1
+	if err := s.wal.append(record); err != nil {
+		return s.fail(err)
+	}
+
+	s.sequence = record.Sequence
+	return nil
+}
+
+// logMove records that garbage collection moved the value of key to
+// pointer. A move is no write of its own, it carries the sequence of the
+// write it follows and is replayed but neither shipped nor watched. Moves
+// never flush the memtable, a table only records the new generation once
+// every live value is moved.
+func (s *SsStore) logMove(key string, pointer index.ValuePointer) error {
+	if s.failed != nil {
+		return s.failed
+	}
+
+	record := LogRecord{Sequence: s.sequence, Type: MOVE_COMMAND, Key: key, Value: pointer.String()}
+	if err := s.wal.append(record); err != nil {
+		return s.fail(err)
+	}
+
+	return s.putItem(index.NewValuePointerItem(key, pointer))
+}
+
+// fail stops the store taking writes once a write may be logged in part or
+// was logged but could not be applied. The log and the memtable no longer
+// agree, reopening the store replays the log.
+func (s *SsStore) fail(err error) error {
+	if err == nil || s.replaying {
+		return err
+	}
+
+	s.failed = fmt.Errorf("Store refuses writes after a failed write, reopen it to replay the write-ahead log: %v", err)
+	log.Error(s.failed)
+	return s.failed
+}
+
+func (s *SsStore) putItem(kv index.KeyValueItem) error {
+	key := kv.Key()
 	log.Infof("Adding key %s to cache.", key)
-	kv := index.NewKeyValueItem(key, value)
-	cmd := index.Command{PUT_COMMAND, kv}
-	s.cache.Add(key, cmd)
+	cmd := index.Command{Type: PUT_COMMAND, Item: kv}
+	s.addCommand(cmd)
 	return nil
 }
 
+// addCommand puts a command into the memtable, keeping count of its size
+// and dropping the cached value of its key.
+func (s *SsStore) addCommand(cmd index.Command) {
+	key := cmd.Item.Key()
+	if v, ok := s.cache.Get(key); ok {
+		old, _ := v.(index.Command)
+		s.cacheBytes -= old.Item.Size()
+	}
+
+	if s.readCache != nil {
+		s.readCache.Remove(key)
+	}
+
+	s.cacheBytes += cmd.Item.Size()
+	s.cache.Add(key, cmd)
+}
+
 func (s *SsStore) Get(key string) (value string, ok bool) {
+	if IsReservedKey(key) {
+		return "", false
+	}
+
+	return s.rawGet(key)
+}
+
+func (s *SsStore) rawGet(key string) (value string, ok bool) {
+	_, inMemtable := s.cache.Get(key)
+	if !inMemtable && s.readCache != nil {
+		if v, ok := s.readCache.Get(key); ok {
+			log.Infof("Key %s found in read cache.", key)
+			return v.(string), true
+		}
+	}
+
+	item, ok := s.lookupItem(key)
+	if !ok {
+		return "", false
+	}
+
+	value, err := s.resolve(item)
+	if err != nil {
+		log.Errorf("Could not read value for key %s: %v", key, err)
+		return "", false
+	}
+
+	if !inMemtable && s.readCache != nil {
+		s.readCache.Add(key, value)
+	}
+
+	return value, true
+}
+
+// lookupCached returns the memtable entry for key when there is one,
+// otherwise the given stored item.
+func (s *SsStore) lookupCached(key string, stored index.KeyValueItem) (item index.KeyValueItem, ok bool) {
+	v, ok := s.cache.Get(key)
+	if !ok {
+		return stored, !s.deletedByRange(key)
+	}
+
+	cmd, _ := v.(index.Command)
+	return cmd.Item, cmd.Type != DEL_COMMAND
+}
+
+// lookupItem finds the newest item stored for key, which may hold a value
+// log pointer instead of the value.
+func (s *SsStore) lookupItem(key string) (item index.KeyValueItem, ok bool) {
 	v, ok := s.cache.Get(key)
 
 	if ok {
@@ -94,10 +390,15 @@ func (s *SsStore) Get(key string) (value string, ok bool) {
 		log.Infof("Current command for key %s, is %s", cmd.Item.Key(), cmd.Type)
 		if cmd.Type == DEL_COMMAND {
 			log.Infof("Key %s is a delete entry in cache.", key)
-			return "", false
+			return item, false
 		}
 
-		return cmd.Item.Value(), ok
+		return cmd.Item, ok
+	}
+
+	if s.deletedByRange(key) {
+		log.Infof("Key %s is covered by a range tombstone.", key)
+		return item, false
 	}
 
 	log.Infof("Key %s not found in cache, reading block.", key)
@@ -107,22 +408,171 @@ func (s *SsStore) Get(key string) (value string, ok bool) {
 	}
 	log.Info("Block loaded.")
 
-	value, ok = block.Get(key)
-	return value, ok
+	return block.GetItem(key)
+}
+
+// resolve returns the value of an item, following value log pointers.
+func (s *SsStore) resolve(item index.KeyValueItem) (value string, err error) {
+	if !item.IsPointer() {
+		return item.Value(), nil
+	}
+
+	pointer, err := item.Pointer()
+	if err != nil {
+		return "", err
+	}
+
+	return s.values.read(item.Key(), pointer)
 }
 
 func (s *SsStore) Del(key string) {
+	if IsReservedKey(key) {
+		log.Errorf("Refusing to delete internal key %q.", key)
+		return
+	}
+
+	if err := s.logWrite(LogRecord{Type: DEL_COMMAND, Key: key}); err != nil {
+		log.Errorf("Could not log delete of key %s: %v", key, err)
+		return
+	}
+
+	old, hadOld := s.indexedValue(key)
+	s.rawDel(key)
+
+	if err := s.indexes.update(key, old, hadOld, "", false); err != nil {
+		log.Errorf("Could not update secondary indexes for deleted key %s: %v", key, s.fail(err))
+	}
+}
+
+func (s *SsStore) rawDel(key string) {
 	kv := index.NewKeyValueItem(key, "")
-	cmd := index.Command{DEL_COMMAND, kv}
+	cmd := index.Command{Type: DEL_COMMAND, Item: kv}
 
-	s.cache.Add(key, cmd)
+	s.addCommand(cmd)
+}
+
+// rawItems returns every live key value pair, internal keys included, with
+// memtable entries taking precedence over the ss table.
+func (s *SsStore) rawItems() (items map[string]string, err error) {
+	items = make(map[string]string)
+	stored, err := s.blockStorage.Items()
+	if err != nil {
+		return items, err
+	}
+
+	for _, key := range s.cache.Keys() {
+		v, _ := s.cache.Get(key)
+		cmd, _ := v.(index.Command)
+		stored = append(stored, cmd.Item)
+	}
+
+	for _, it := range stored {
+		item, ok := s.lookupCached(it.Key(), it)
+		if !ok {
+			delete(items, it.Key())
+			continue
+		}
+
+		value, err := s.resolve(item)
+		if err != nil {
+			return items, err
+		}
+		items[it.Key()] = value
+	}
+
+	return items, nil
+}
+
+func (s *SsStore) DefineIndex(def IndexDefinition) error {
+	if err := def.Validate(); err != nil {
+		return err
+	}
+
+	if err := s.logWrite(indexRecord(def)); err != nil {
+		return err
+	}
+
+	return s.fail(s.indexes.define(def))
+}
+
+func (s *SsStore) QueryIndex(indexName string, value string) (keys []string, err error) {
+	keys, err = s.indexes.query(indexName, value)
+	if err != nil {
+		return keys, err
+	}
+
+	def := s.indexes.defs[indexName]
+	return s.liveInIndex(def, def.IndexedValue(value), keys), nil
 }
 
-func NewSsStore(dataPath string) (Store, error) {
-	cache := NewMemTableCache()
-	storage := index.NewSsBlockStorage(dataPath)
+func (s *SsStore) RebuildIndexes() error {
+	return s.indexes.rebuild()
+}
 
-	store := SsStore{storage, cache}
+// NewSsStore opens the ss table store in options.Dir. The manifest names
+// the live table, files it does not reference are left overs of an
+// interrupted flush and are removed.
+func NewSsStore(options Options) (Store, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	dir := options.Dir
+	manifest, err := index.OpenManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	version := manifest.Version()
+	var table uint64
+	tablePath := ""
+	if len(version.Tables) > 0 {
+		table = version.Tables[len(version.Tables)-1]
+		tablePath = index.TablePath(dir, table)
+	}
+
+	values, err := openValueLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	values.drop(version.ValueLogGeneration)
+
+	blockStorage, err := index.NewSsBlockStorage(tablePath, options.tableOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	store := SsStore{
+		options:      options,
+		manifest:     manifest,
+		table:        table,
+		sequence:     version.LastSequence,
+		blockStorage: blockStorage,
+		cache:        NewMemTableCache(),
+		values:       values,
+	}
+
+	if options.ReadCacheSize > 0 {
+		if store.readCache, err = NewLruCache(options.ReadCacheSize); err != nil {
+			return nil, err
+		}
+	}
+
+	indexes, err := loadSecondaryIndexes(&store)
+	if err != nil {
+		return nil, err
+	}
+	store.indexes = indexes
+
+	sync := options.SyncPolicy.Mode == index.SYNC_ALWAYS
+	var records []LogRecord
+	if store.wal, records, err = openWriteAheadLog(dir, sync, options.WalRecords); err != nil {
+		return nil, err
+	}
+
+	if err = store.replay(records); err != nil {
+		return nil, err
+	}
 
 	log.Info("Created new SsStore")
 	return &store, nil
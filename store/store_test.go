@@ -0,0 +1,67 @@
+package store
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	if os.Getenv("TEST_LOGS") != "" {
+		log.SetOutput(os.Stderr)
+	}
+	os.Exit(m.Run())
+}
+
+func testOptions(t *testing.T) Options {
+	options := DefaultOptions()
+	options.Dir = t.TempDir()
+	return options
+}
+
+func openSsStore(t *testing.T, options Options) *SsStore {
+	storage, err := NewSsStore(options)
+	if err != nil {
+		t.Fatalf("open %s: %v", options.Dir, err)
+	}
+
+	return storage.(*SsStore)
+}
+
+func TestCarriageReturnsSurviveReopen(t *testing.T) {
+	want := map[string]string{"plain": "v", "crlf": "has\r\ncrlf", "cr\rkey": "\r",
+		"tail": "ends\r\n"}
+	for _, engine := range []string{SS_ENGINE, HASH_ENGINE} {
+		options := testOptions(t)
+		open := func() Store {
+			if engine == SS_ENGINE {
+				return openSsStore(t, options)
+			}
+			return openHashStore(t, options)
+		}
+
+		storage := open()
+		for key, value := range want {
+			if err := storage.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		storage.Flush()
+		if closer, ok := storage.(Closer); ok {
+			closer.Close()
+		}
+
+		reopened := open()
+		for key, value := range want {
+			if got, ok := reopened.Get(key); !ok || got != value {
+				t.Errorf("%s: %q is %q, %v, want %q", engine, key, got, ok, value)
+			}
+		}
+
+		if problems, err := CheckDir(options.Dir); err != nil || len(problems) != 0 {
+			t.Errorf("%s: check found %v, %v", engine, problems, err)
+		}
+	}
+}
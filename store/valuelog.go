@@ -0,0 +1,264 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	VALUE_LOG_THRESHOLD int    = 1024
+	VALUE_LOG_PREFIX    string = "value_log_"
+	VALUE_LOG_SUFFIX    string = ".txt"
+)
+
+// GarbageCollector is implemented by stores that can reclaim space held by
+// overwritten or deleted values.
+type GarbageCollector interface {
+	CollectGarbage() error
+}
+
+// valueLog keeps large values out of the ss table. Values are appended to
+// the active generation of the log, garbage collection copies live values
+// into the next generation and drops the old ones.
+type valueLog struct {
+	dir        string
+	generation int
+	logs       map[int]index.DataLog
+}
+
+func valueLogPath(dir string, generation int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", VALUE_LOG_PREFIX, generation,
+		VALUE_LOG_SUFFIX))
+}
+
+func valueLogGenerations(dir string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, VALUE_LOG_PREFIX+"*"+VALUE_LOG_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	gens := make([]int, 0, len(paths))
+	for _, p := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), VALUE_LOG_PREFIX),
+			VALUE_LOG_SUFFIX)
+		gen, err := strconv.Atoi(name)
+		if err != nil {
+			log.Warnf("Ignoring unexpected value log file %s.", p)
+			continue
+		}
+		gens = append(gens, gen)
+	}
+
+	sort.Ints(gens)
+	return gens, nil
+}
+
+func openValueLog(dir string) (*valueLog, error) {
+	gens, err := valueLogGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &valueLog{dir, 0, make(map[int]index.DataLog)}
+	for _, gen := range gens {
+		v.logs[gen] = index.NewLocalDataLog(valueLogPath(dir, gen))
+		v.generation = gen
+	}
+
+	log.Infof("Opened value log in %s at generation %d.", dir, v.generation)
+	return v, nil
+}
+
+func (v *valueLog) dataLog(generation int) index.DataLog {
+	dataLog, ok := v.logs[generation]
+	if !ok {
+		dataLog = index.NewLocalDataLog(valueLogPath(v.dir, generation))
+		v.logs[generation] = dataLog
+	}
+
+	return dataLog
+}
+
+func (v *valueLog) append(key string, value string) (pointer index.ValuePointer, err error) {
+	item := index.NewLogItem(key, value, 0)
+	offset, err := v.dataLog(v.generation).AddLogItem(item)
+	if err != nil {
+		return pointer, err
+	}
+
+	return index.ValuePointer{Generation: v.generation, Offset: offset,
+		Size: item.Size()}, nil
+}
+
+func (v *valueLog) read(key string, pointer index.ValuePointer) (value string, err error) {
+	item, err := v.dataLog(pointer.Generation).ReadLogItem(pointer.Offset)
+	if err != nil {
+		return "", err
+	}
+
+	if item.Key() != key || item.Size() != pointer.Size {
+		return "", fmt.Errorf("Value log entry at %s does not belong to key %s.",
+			pointer, key)
+	}
+
+	return item.Value(), nil
+}
+
+// sync makes every value appended so far durable, it has to run before
+// pointers to them are written to an ss table.
+func (v *valueLog) sync() error {
+	for _, dataLog := range v.logs {
+		if err := dataLog.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *valueLog) close() (err error) {
+	for _, dataLog := range v.logs {
+		if closeErr := dataLog.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// forEach calls fn for every entry in the given generation, in log order.
+func (v *valueLog) forEach(generation int, fn func(item *index.LogItem) error) error {
+	dataLog := v.dataLog(generation)
+	var offset int64
+	for {
+		item, err := dataLog.ReadLogItem(offset)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = fn(item); err != nil {
+			return err
+		}
+		offset = item.Offset() + item.Length()
+	}
+}
+
+// drop removes every generation older than the active one.
+func (v *valueLog) drop(before int) {
+	for gen := range v.logs {
+		if gen >= before {
+			continue
+		}
+
+		log.Infof("Removing value log generation %d.", gen)
+		v.logs[gen].Close()
+		delete(v.logs, gen)
+		if err := os.Remove(valueLogPath(v.dir, gen)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Could not remove value log generation %d: %v", gen, err)
+		}
+	}
+}
+
+// movedValue is a live value garbage collection copied to pointer.
+type movedValue struct {
+	key     string
+	pointer index.ValuePointer
+}
+
+// CollectGarbage copies every value still referenced by the store into a
+// new value log generation, logs and flushes the relocated pointers and
+// removes the old generations. On error the store keeps appending to the
+// generation it had, the old generations stay until a later collection.
+func (s *SsStore) CollectGarbage() (err error) {
+	if s.failed != nil {
+		return s.failed
+	}
+
+	old := s.values.generation
+	next := old + 1
+	gens := make([]int, 0, len(s.values.logs))
+	for gen := range s.values.logs {
+		gens = append(gens, gen)
+		if gen >= next {
+			next = gen + 1
+		}
+	}
+	sort.Ints(gens)
+
+	log.Infof("Collecting value log garbage, moving live values to generation %d.", next)
+	if err = os.Remove(valueLogPath(s.values.dir, next)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.values.generation = next
+	defer func() {
+		if err != nil {
+			log.Errorf("Value log garbage collection failed, keeping generation %d: %v", old, err)
+			s.values.generation = old
+		}
+	}()
+
+	var moves []movedValue
+	var dropped int
+	for _, gen := range gens {
+		err = s.values.forEach(gen, func(item *index.LogItem) error {
+			current, found := s.lookupItem(item.Key())
+			if !found || !current.IsPointer() {
+				dropped++
+				return nil
+			}
+
+			pointer, err := current.Pointer()
+			if err != nil {
+				return err
+			}
+
+			if pointer.Generation != gen || pointer.Offset != item.Offset() {
+				dropped++
+				return nil
+			}
+
+			relocated, err := s.values.append(item.Key(), item.Value())
+			if err != nil {
+				return err
+			}
+
+			moves = append(moves, movedValue{item.Key(), relocated})
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// The copies are durable before a logged pointer can lead to them.
+	if err = s.values.sync(); err != nil {
+		return err
+	}
+
+	for _, m := range moves {
+		if err = s.logMove(m.key, m.pointer); err != nil {
+			return err
+		}
+	}
+
+	if err = s.flushMemtable(); err != nil {
+		return err
+	}
+
+	s.values.drop(next)
+	log.Infof("Value log garbage collected, moved %d values and dropped %d.", len(moves), dropped)
+	return nil
+}
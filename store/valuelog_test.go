@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func bigValue(tag string) string {
+	return tag + strings.Repeat("v", VALUE_LOG_THRESHOLD)
+}
+
+func valueLogFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, VALUE_LOG_PREFIX+"*"+VALUE_LOG_SUFFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return paths
+}
+
+// putBigValues writes ten values to the value log, overwrites and deletes
+// some of them, part of it flushed and part in the memtable. It returns the
+// live pairs.
+func putBigValues(t *testing.T, s *SsStore) []string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		putAll(t, s, fmt.Sprintf("k%d", i), bigValue("first"))
+	}
+	s.Flush()
+
+	putAll(t, s, "k0", bigValue("second"), "k1", "small", "k8", bigValue("second"))
+	s.Del("k2")
+	s.Del("k9")
+	return []string{"k0", bigValue("second"), "k1", "small", "k3", bigValue("first"),
+		"k8", bigValue("second")}
+}
+
+func TestGarbageCollectionKeepsLiveValues(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	live := putBigValues(t, s)
+	sequence := s.Sequence()
+
+	if err := s.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValues(t, s, live...)
+	for _, key := range []string{"k2", "k9"} {
+		if _, ok := s.Get(key); ok {
+			t.Fatalf("deleted key %s is found", key)
+		}
+	}
+
+	files := valueLogFiles(t, options.Dir)
+	if len(files) != 1 || s.values.generation != 1 {
+		t.Fatalf("value log is at generation %d in %v", s.values.generation, files)
+	}
+
+	// Moving values is no write, followers and watchers see nothing.
+	if records, err := s.LogSince(sequence, 0); err != nil || len(records) != 0 {
+		t.Fatalf("log after collection returned %v, %v", records, err)
+	}
+
+	reopened := openSsStore(t, options)
+	expectValues(t, reopened, live...)
+	putAll(t, reopened, "k5", bigValue("third"))
+	if err := reopened.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValues(t, openSsStore(t, options), append(live, "k5", bigValue("third"))...)
+	if problems, err := CheckDir(options.Dir); err != nil || len(problems) != 0 {
+		t.Fatalf("check found %v, %v", problems, err)
+	}
+}
+
+// failingSync is a data log whose syncs fail once it was synced ok times.
+type failingSync struct {
+	index.DataLog
+	ok int
+}
+
+func (f *failingSync) Sync() error {
+	if f.ok == 0 {
+		return errors.New("disk gone")
+	}
+
+	f.ok--
+	return f.DataLog.Sync()
+}
+
+func TestGarbageCollectionMovesAreReplayed(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	live := putBigValues(t, s)
+
+	// The copies are synced, the flush after logging the moves fails.
+	s.values.logs[0] = &failingSync{s.values.logs[0], 1}
+	if err := s.CollectGarbage(); err == nil {
+		t.Fatal("collection with a failing flush succeeded")
+	}
+
+	if s.values.generation != 0 {
+		t.Fatalf("failed collection left the store at generation %d", s.values.generation)
+	}
+
+	// Reopening is what a crash before the flush leaves behind.
+	reopened := openSsStore(t, options)
+	expectValues(t, reopened, live...)
+	for _, key := range []string{"k0", "k3"} {
+		item, _ := reopened.lookupItem(key)
+		if pointer, err := item.Pointer(); err != nil || pointer.Generation != 1 {
+			t.Fatalf("%s points to %v, %v", key, pointer, err)
+		}
+	}
+
+	if err := reopened.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValues(t, openSsStore(t, options), live...)
+	if files := valueLogFiles(t, options.Dir); len(files) != 1 {
+		t.Fatalf("value log files after collection are %v", files)
+	}
+}
@@ -0,0 +1,380 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	WAL_FILE          string = "wal.log"
+	WAL_PREVIOUS_FILE string = "wal.previous.log"
+	DELRANGE_COMMAND  string = "delrange"
+	INDEX_COMMAND     string = "index"
+	MOVE_COMMAND      string = "move"
+	WAL_COLUMNS       int    = 5
+
+	// WAL_ROTATE_RECORDS is the default number of records the current file
+	// has to hold before a flush starts a new one, so followers find at
+	// least that many records to catch up from.
+	WAL_ROTATE_RECORDS int = 1000
+)
+
+var ErrLogTruncated = errors.New("Write-ahead log no longer holds the requested records.")
+
+// LogRecord is one write of the ss table store as it is kept in the
+// write-ahead log and shipped to followers. A delrange keeps the end of its
+// range in Value, an index its type and prefix length. A move keeps the
+// value log pointer garbage collection moved the value of Key to, it shares
+// the sequence of the write before it and stays local to the store.
+type LogRecord struct {
+	Sequence int64
+	Type     string
+	Key      string
+	Value    string
+}
+
+// encode returns the record as the line it is logged as,
+// "<sequence>,<type>,<key>,<value>,<checksum>". Key and value are base64
+// encoded so any bytes read back unchanged, the checksum is the crc32 of
+// the line up to its last comma.
+func (r LogRecord) encode() []byte {
+	line := fmt.Sprintf("%d,%s,%s,%s", r.Sequence, r.Type,
+		base64.StdEncoding.EncodeToString([]byte(r.Key)),
+		base64.StdEncoding.EncodeToString([]byte(r.Value)))
+	return []byte(fmt.Sprintf("%s,%08x\n", line, crc32.ChecksumIEEE([]byte(line))))
+}
+
+// decodeLogRecord reverses encode for a line without its line feed.
+func decodeLogRecord(line []byte) (record LogRecord, err error) {
+	end := bytes.LastIndexByte(line, ',')
+	if end < 0 || fmt.Sprintf("%08x", crc32.ChecksumIEEE(line[:end])) != string(line[end+1:]) {
+		return record, errors.New("checksum mismatch")
+	}
+
+	fields := strings.Split(string(line[:end]), ",")
+	if len(fields) != WAL_COLUMNS-1 {
+		return record, fmt.Errorf("record has %d fields", len(fields)+1)
+	}
+
+	if record.Sequence, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return record, fmt.Errorf("invalid sequence %q", fields[0])
+	}
+
+	key, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return record, fmt.Errorf("invalid key %q", fields[2])
+	}
+
+	value, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return record, fmt.Errorf("invalid value of key %q", key)
+	}
+
+	record.Type, record.Key, record.Value = fields[1], string(key), string(value)
+	return record, nil
+}
+
+func indexRecord(def IndexDefinition) LogRecord {
+	return LogRecord{Type: INDEX_COMMAND, Key: def.Name,
+		Value: fmt.Sprintf("%s %d", def.Type, def.PrefixLength)}
+}
+
+func (r LogRecord) indexDefinition() (def IndexDefinition, err error) {
+	def.Name = r.Key
+	if _, err = fmt.Sscanf(r.Value, "%s %d", &def.Type, &def.PrefixLength); err != nil {
+		return def, fmt.Errorf("Invalid index record %q for index %s.", r.Value, r.Key)
+	}
+
+	return def, nil
+}
+
+// writeAheadLog records every write before it reaches the memtable, so the
+// writes of a memtable lost in a crash are replayed on the next open. Once
+// its records are in a table the current file may become the previous
+// one, followers read the records of both from the files. Only the number
+// of records in each file and the first sequence of the current one are
+// kept in memory.
+type writeAheadLog struct {
+	dir      string
+	file     *os.File
+	sync     bool
+	rotateAt int
+	previous int
+	current  int
+	first    int64
+}
+
+func walPath(dir string) string {
+	return filepath.Join(dir, WAL_FILE)
+}
+
+func walPreviousPath(dir string) string {
+	return filepath.Join(dir, WAL_PREVIOUS_FILE)
+}
+
+// walScan is what a read of a log file found. Good is the offset after
+// the last intact record, Bad why the rest could not be read. A bad last
+// record is Torn, the tail of an append a crash interrupted.
+type walScan struct {
+	records []LogRecord
+	good    int64
+	bad     error
+	torn    bool
+}
+
+// scanWalFile reads the records of a log file up to the first bad one and
+// changes nothing. A missing file holds no records.
+func scanWalFile(path string) (scan walScan, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scan, nil
+	}
+
+	if err != nil {
+		return scan, err
+	}
+
+	for rest := data; len(rest) > 0; {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			scan.bad, scan.torn = errors.New("record is cut short"), true
+			return scan, nil
+		}
+
+		record, err := decodeLogRecord(rest[:end])
+		if err != nil {
+			scan.bad, scan.torn = err, end+1 == len(rest)
+			return scan, nil
+		}
+
+		scan.records = append(scan.records, record)
+		scan.good += int64(end + 1)
+		rest = rest[end+1:]
+	}
+
+	return scan, nil
+}
+
+// readWalFile returns the records of a log file. A torn last record is cut
+// off, any other bad record means the log lost writes it acknowledged and
+// the store has to be repaired.
+func readWalFile(path string) (records []LogRecord, err error) {
+	scan, err := scanWalFile(path)
+	if err != nil || scan.bad == nil {
+		return scan.records, err
+	}
+
+	if !scan.torn {
+		return nil, fmt.Errorf("Write-ahead log %s is corrupt at byte %d, %v, repair the store.",
+			path, scan.good, scan.bad)
+	}
+
+	log.Warnf("Write-ahead log %s ends in a torn record at byte %d, truncating: %v",
+		path, scan.good, scan.bad)
+	return scan.records, os.Truncate(path, scan.good)
+}
+
+// readWalRecords calls visit with the records of a log file in order until
+// it returns false. The file is read a line at a time, a missing one holds
+// no records.
+func readWalRecords(path string, visit func(record LogRecord) bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		record, err := decodeLogRecord(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			return fmt.Errorf("Write-ahead log %s holds a bad record: %v", path, err)
+		}
+
+		if !visit(record) {
+			return nil
+		}
+	}
+}
+
+// openWriteAheadLog opens the log in dir and returns the records of both
+// files for the store to replay.
+func openWriteAheadLog(dir string, sync bool, rotateAt int) (*writeAheadLog, []LogRecord, error) {
+	previous, err := readWalFile(walPreviousPath(dir))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	current, err := readWalFile(walPath(dir))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(walPath(dir), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := &writeAheadLog{dir: dir, file: file, sync: sync, rotateAt: rotateAt,
+		previous: len(previous), current: len(current)}
+	if len(current) > 0 {
+		l.first = current[0].Sequence
+	}
+
+	return l, append(previous, current...), nil
+}
+
+func (l *writeAheadLog) append(record LogRecord) error {
+	if _, err := l.file.Write(record.encode()); err != nil {
+		return err
+	}
+
+	if l.sync {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if l.current == 0 {
+		l.first = record.Sequence
+	}
+	l.current++
+	return nil
+}
+
+// rotate is called once a flush made the records durable in a table. It
+// keeps the current file as the previous one and starts a new one when the
+// current one holds rotateAt records.
+func (l *writeAheadLog) rotate() error {
+	if l.current < l.rotateAt {
+		return nil
+	}
+
+	return l.startFile()
+}
+
+func (l *writeAheadLog) startFile() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(walPath(l.dir), walPreviousPath(l.dir)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(walPath(l.dir), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.file = file
+	l.previous, l.current, l.first = l.current, 0, 0
+	return nil
+}
+
+// reset drops every record, used once a restored snapshot is flushed.
+func (l *writeAheadLog) reset() error {
+	if err := l.startFile(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(walPreviousPath(l.dir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l.previous = 0
+	return nil
+}
+
+// records is the number of records in both files.
+func (l *writeAheadLog) records() int {
+	return l.previous + l.current
+}
+
+// since returns up to max records after sequence, ErrLogTruncated when the
+// log starts later than that. Moves are left out. The records are read
+// from the files, the previous one is skipped when the current one starts
+// after sequence.
+func (l *writeAheadLog) since(sequence int64, last int64, max int) ([]LogRecord, error) {
+	if sequence > last {
+		return nil, ErrLogTruncated
+	}
+
+	if sequence == last {
+		return nil, nil
+	}
+
+	paths := []string{walPreviousPath(l.dir), walPath(l.dir)}
+	if l.current > 0 && l.first <= sequence {
+		paths = paths[1:]
+	}
+
+	var records []LogRecord
+	found, done := false, false
+	visit := func(record LogRecord) bool {
+		switch {
+		case record.Sequence <= sequence:
+			return true
+		case !found && (record.Sequence != sequence+1 || record.Type == MOVE_COMMAND):
+			done = true
+			return false
+		case max > 0 && len(records) >= max:
+			done = true
+			return false
+		}
+
+		found = true
+		if record.Type != MOVE_COMMAND {
+			records = append(records, record)
+		}
+		return true
+	}
+
+	for _, path := range paths {
+		if err := readWalRecords(path, visit); err != nil {
+			return nil, err
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if !found {
+		return nil, ErrLogTruncated
+	}
+
+	return records, nil
+}
+
+func (l *writeAheadLog) close() error {
+	return l.file.Close()
+}
+
+func (l *writeAheadLog) path() string {
+	return walPath(l.dir)
+}
@@ -0,0 +1,330 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func putAll(t *testing.T, s Store, pairs ...string) {
+	t.Helper()
+	for i := 0; i < len(pairs); i += 2 {
+		if err := s.Put(pairs[i], pairs[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectValues(t *testing.T, s Store, pairs ...string) {
+	t.Helper()
+	for i := 0; i < len(pairs); i += 2 {
+		if value, ok := s.Get(pairs[i]); !ok || value != pairs[i+1] {
+			t.Fatalf("%q is %q, %v, want %q", pairs[i], value, ok, pairs[i+1])
+		}
+	}
+}
+
+func TestWalReplaysCarriageReturns(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	putAll(t, s, "a", "plain", "b", "has\r\ncrlf", "c", "plain2", "d\r\n", "\r")
+
+	reopened := openSsStore(t, options)
+	expectValues(t, reopened, "a", "plain", "b", "has\r\ncrlf", "c", "plain2", "d\r\n", "\r")
+	if reopened.Sequence() != 4 {
+		t.Fatalf("reopened store is at sequence %d", reopened.Sequence())
+	}
+}
+
+func TestWalCutsOnlyTornTail(t *testing.T) {
+	options := testOptions(t)
+	putAll(t, openSsStore(t, options), "a", "1", "b", "2", "c", "3")
+
+	path := walPath(options.Dir)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torn := string(LogRecord{4, PUT_COMMAND, "d", "4"}.encode())
+	if err = ioutil.WriteFile(path, append(data, torn[:len(torn)/2]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err := CheckDir(options.Dir); err != nil || len(problems) != 1 ||
+		!strings.Contains(problems[0].Message, "torn record") {
+		t.Fatalf("check of a torn tail found %v, %v", problems, err)
+	}
+
+	s := openSsStore(t, options)
+	expectValues(t, s, "a", "1", "b", "2", "c", "3")
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("log is %d bytes after the torn record was cut, want %d", info.Size(), len(data))
+	}
+
+	// A bad record with intact ones after it is not a torn tail.
+	corrupt := strings.Replace(string(data), "Mg==", "Mw==", 1)
+	if err = ioutil.WriteFile(path, []byte(corrupt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewSsStore(options); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("open of a corrupt log returned %v", err)
+	}
+
+	problems, err := CheckDir(options.Dir)
+	if err != nil || len(problems) != 1 || !strings.Contains(problems[0].Message, "bad record") {
+		t.Fatalf("check of a corrupt log found %v, %v", problems, err)
+	}
+
+	repaired := testOptions(t)
+	repaired.Dir = filepath.Join(repaired.Dir, "repaired")
+	if salvaged, _, err := Repair(options.Dir, repaired); err != nil || salvaged != 1 {
+		t.Fatalf("repair salvaged %d keys, %v", salvaged, err)
+	}
+	expectValues(t, openSsStore(t, repaired), "a", "1")
+}
+
+func TestRepairReplaysWal(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	putAll(t, s, "a", "red", "b", "red", "c", "blue")
+	s.Flush()
+
+	if err := s.DefineIndex(IndexDefinition{Name: "color", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+	putAll(t, s, "d", "red", "e", "two\r\nlines")
+	s.Del("a")
+	if err := s.DeleteRange("c", "c"); err != nil {
+		t.Fatal(err)
+	}
+	putAll(t, s, "f", "red")
+
+	want, _ := s.Snapshot()
+	if problems, err := CheckDir(options.Dir); err != nil || len(problems) != 0 {
+		t.Fatalf("check found %v, %v", problems, err)
+	}
+
+	repaired := testOptions(t)
+	repaired.Dir = filepath.Join(repaired.Dir, "repaired")
+	if _, problems, err := Repair(options.Dir, repaired); err != nil || len(problems) != 0 {
+		t.Fatalf("repair found %v, %v", problems, err)
+	}
+
+	r := openSsStore(t, repaired)
+	got, _ := r.Snapshot()
+	if !reflect.DeepEqual(got.Items, want.Items) || !reflect.DeepEqual(got.Indexes, want.Indexes) {
+		t.Fatalf("repaired store holds %v %v, want %v %v", got.Items, got.Indexes,
+			want.Items, want.Indexes)
+	}
+
+	if keys := queryKeys(t, r, "red"); !reflect.DeepEqual(keys, queryKeys(t, s, "red")) {
+		t.Fatalf("repaired index holds %v", keys)
+	}
+}
+
+func TestApplyFollowsSequence(t *testing.T) {
+	leader := openSsStore(t, testOptions(t))
+	putAll(t, leader, "a", "1", "b", "two\r\nlines")
+	leader.Del("a")
+	if err := leader.DefineIndex(IndexDefinition{Name: "n", Type: VALUE_INDEX}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := leader.LogSince(0, 0)
+	if err != nil || len(records) != 4 {
+		t.Fatalf("log holds %v, %v", records, err)
+	}
+
+	options := testOptions(t)
+	follower := openSsStore(t, options)
+	if err = follower.Apply(records[1]); err == nil {
+		t.Fatal("a record out of sequence was applied")
+	}
+
+	for _, record := range records {
+		if err = follower.Apply(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = follower.Apply(records[3]); err == nil {
+		t.Fatal("a record was applied twice")
+	}
+
+	reopened := openSsStore(t, options)
+	if reopened.Sequence() != leader.Sequence() {
+		t.Fatalf("follower is at sequence %d, leader at %d", reopened.Sequence(),
+			leader.Sequence())
+	}
+
+	if _, ok := reopened.Get("a"); ok {
+		t.Fatal("deleted key a is found")
+	}
+	expectValues(t, reopened, "b", "two\r\nlines")
+
+	if keys, err := reopened.QueryIndex("n", "two\r\nlines"); err != nil || len(keys) != 1 {
+		t.Fatalf("follower index holds %v, %v", keys, err)
+	}
+}
+
+func TestRestoreReplacesContent(t *testing.T) {
+	leader := openSsStore(t, testOptions(t))
+	putAll(t, leader, "a", "1", "b", "2", "c", "3")
+	leader.Del("c")
+	snapshot, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := testOptions(t)
+	follower := openSsStore(t, options)
+	putAll(t, follower, "b", "old", "stale", "x")
+	if err = follower.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if follower.Sequence() != leader.Sequence() {
+		t.Fatalf("follower is at sequence %d, leader at %d", follower.Sequence(),
+			leader.Sequence())
+	}
+
+	if _, err = follower.LogSince(0, 0); err != ErrLogTruncated {
+		t.Fatalf("log of a restored store returned %v", err)
+	}
+
+	putAll(t, leader, "d", "4")
+	next, _ := leader.LogSince(snapshot.Sequence, 0)
+	if err = follower.Apply(next[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openSsStore(t, options)
+	got, _ := reopened.Snapshot()
+	want, _ := leader.Snapshot()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("follower holds %v, want %v", got, want)
+	}
+}
+
+// failingDataLog refuses every append.
+type failingDataLog struct {
+	index.DataLog
+}
+
+func (failingDataLog) AddLogItem(logItem index.LogItem) (int64, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestFailedWriteClosesStore(t *testing.T) {
+	options := testOptions(t)
+	s := openSsStore(t, options)
+	putAll(t, s, "a", "1")
+
+	gen := s.values.generation
+	s.values.logs[gen] = failingDataLog{s.values.dataLog(gen)}
+	big := strings.Repeat("x", VALUE_LOG_THRESHOLD)
+	if err := s.Put("big", big); err == nil {
+		t.Fatal("put with a failing value log succeeded")
+	}
+
+	if err := s.Put("b", "2"); err == nil {
+		t.Fatal("store took a write after a logged write failed")
+	}
+
+	if s.Sequence() != 2 {
+		t.Fatalf("store is at sequence %d", s.Sequence())
+	}
+
+	// The logged write is applied by the replay, the refused one is not.
+	reopened := openSsStore(t, options)
+	expectValues(t, reopened, "a", "1", "big", big)
+	if _, ok := reopened.Get("b"); ok {
+		t.Fatal("refused write of b is found")
+	}
+
+	putAll(t, reopened, "c", "3")
+}
+
+func TestLogSinceReadsBothFiles(t *testing.T) {
+	options := testOptions(t)
+	options.WalRecords = 4
+	s := openSsStore(t, options)
+	for i := 0; i < 20; i++ {
+		putAll(t, s, fmt.Sprintf("k%d", i), fmt.Sprintf("\xff%d", i))
+		if i%3 == 2 {
+			s.Flush()
+		}
+	}
+
+	// The log starts somewhere after the first write and holds every record
+	// from there on.
+	start := int64(0)
+	for ; start < s.Sequence(); start++ {
+		if _, err := s.LogSince(start, 1); err != ErrLogTruncated {
+			break
+		}
+	}
+
+	if start == 0 || s.wal.records() != int(s.Sequence()-start) {
+		t.Fatalf("log holds %d records from %d", s.wal.records(), start)
+	}
+
+	for _, store := range []*SsStore{s, openSsStore(t, options)} {
+		all, err := store.LogSince(start, 0)
+		if err != nil || len(all) != int(s.Sequence()-start) {
+			t.Fatalf("log from %d returned %d records, %v", start, len(all), err)
+		}
+
+		for sequence := start; sequence < s.Sequence(); sequence++ {
+			records, err := store.LogSince(sequence, 2)
+			at := int(sequence - start)
+			want := all[at:]
+			if len(want) > 2 {
+				want = want[:2]
+			}
+
+			if err != nil || !reflect.DeepEqual(records, want) {
+				t.Fatalf("log from %d returned %v, %v, want %v", sequence, records, err, want)
+			}
+		}
+
+		if _, err = store.LogSince(start-1, 0); err != ErrLogTruncated {
+			t.Fatalf("log from %d returned %v", start-1, err)
+		}
+	}
+}
+
+func TestRestoreFlushesFullMemtables(t *testing.T) {
+	var snapshot Snapshot
+	for i := 0; i < 100; i++ {
+		snapshot.Items = append(snapshot.Items, KeyValue{fmt.Sprintf("k%03d", i), "v"})
+	}
+	snapshot.Sequence = 500
+
+	options := testOptions(t)
+	options.MemtableEntries = 10
+	s := openSsStore(t, options)
+	putAll(t, s, "stale", "x")
+	table := s.table
+	if err := s.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.table-table < 10 {
+		t.Fatalf("restore of 100 keys flushed %d times", s.table-table)
+	}
+
+	reopened := openSsStore(t, options)
+	got, _ := reopened.Snapshot()
+	if !reflect.DeepEqual(got, snapshot) {
+		t.Fatalf("restored store holds %v", got)
+	}
+}
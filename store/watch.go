@@ -0,0 +1,208 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-A/index"
+	"strconv"
+	"strings"
+)
+
+// Watchable is implemented by stores whose changes can be followed from
+// their write-ahead logs.
+type Watchable interface {
+	Watch(filter WatchFilter, from WatchPosition) (*Watcher, error)
+}
+
+// WatchPosition is where a watcher is in the logs of the store it
+// watches, the last sequence read from each. An ss table store keeps one
+// log, a sharded store one per shard. Its text form is the sequences
+// separated by commas, for one log just its sequence.
+type WatchPosition []int64
+
+func (p WatchPosition) String() string {
+	fields := make([]string, len(p))
+	for i, sequence := range p {
+		fields[i] = strconv.FormatInt(sequence, 10)
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// ParseWatchPosition reads a position from its text form.
+func ParseWatchPosition(text string) (position WatchPosition, err error) {
+	for _, field := range strings.Split(text, ",") {
+		sequence, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || sequence < 0 {
+			return nil, fmt.Errorf("Invalid watch position %q.", text)
+		}
+		position = append(position, sequence)
+	}
+
+	return position, nil
+}
+
+// WatchFilter selects the keys a watcher reports. Prefix keeps the keys
+// starting with it, Start and End the keys a scan between them returns.
+// Both are optional, an empty filter reports every key.
+type WatchFilter struct {
+	Prefix string
+	Start  string
+	End    string
+}
+
+func (f WatchFilter) Validate() error {
+	if (f.Start == "") != (f.End == "") {
+		return fmt.Errorf("A watched range needs both start and end, got %q and %q.",
+			f.Start, f.End)
+	}
+
+	return nil
+}
+
+func (f WatchFilter) matches(key string) bool {
+	if IsInternalKey(key) || !strings.HasPrefix(key, f.Prefix) {
+		return false
+	}
+
+	return f.Start == "" || index.InScanRange(key, f.Start, f.End)
+}
+
+// ChangeEvent is a write a watcher reports. Type is PUT_COMMAND,
+// DEL_COMMAND or DELRANGE_COMMAND, a delrange carries the end of its range
+// in Value and is reported to every watcher since the keys it removed are
+// not logged. Shard is the shard of a sharded store the write went to and
+// Sequence its sequence there.
+type ChangeEvent struct {
+	Shard    int
+	Sequence int64
+	Type     string
+	Key      string
+	Value    string
+}
+
+// watchedLog is a log a watcher reads, last is the sequence of its latest
+// record.
+type watchedLog struct {
+	last  int64
+	since func(sequence int64, max int) ([]LogRecord, error)
+}
+
+// Watcher reads the changes after a position from the write-ahead logs.
+// It is not safe for concurrent use, on a store that is not Concurrent it
+// has to be called under the same lock as the store. Position is the last
+// sequence read from each log, filtered out or not, a consumer that keeps
+// it resumes there with a new watcher as long as the logs still hold the
+// records after it.
+type Watcher struct {
+	filter   WatchFilter
+	position WatchPosition
+	logs     []watchedLog
+	caughtUp bool
+}
+
+// newWatcher starts a watcher on logs at from, at their latest records
+// when from is nil.
+func newWatcher(filter WatchFilter, from WatchPosition, logs []watchedLog) (*Watcher, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	if from == nil {
+		for _, l := range logs {
+			from = append(from, l.last)
+		}
+	}
+
+	if len(from) != len(logs) {
+		return nil, fmt.Errorf("Position %s has %d sequences, the store keeps %d logs.", from,
+			len(from), len(logs))
+	}
+
+	for i, l := range logs {
+		if from[i] < 0 || from[i] > l.last {
+			return nil, fmt.Errorf("Sequence %d is outside the log's 0 to %d.", from[i], l.last)
+		}
+
+		if _, err := l.since(from[i], 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Watcher{filter: filter, position: append(WatchPosition(nil), from...),
+		logs: logs}, nil
+}
+
+// Next returns the matching changes among the next max records of each
+// log, none when the watcher is caught up. ErrLogTruncated means a log was
+// cut past the position while the watcher was behind, the consumer has to
+// start over from a fresh read of the store.
+func (w *Watcher) Next(max int) (events []ChangeEvent, err error) {
+	w.caughtUp = true
+	for i, l := range w.logs {
+		records, err := l.since(w.position[i], max)
+		if err != nil {
+			return nil, err
+		}
+
+		if max > 0 && len(records) >= max {
+			w.caughtUp = false
+		}
+
+		for _, r := range records {
+			w.position[i] = r.Sequence
+			switch r.Type {
+			case PUT_COMMAND, DEL_COMMAND:
+				if !w.filter.matches(r.Key) {
+					continue
+				}
+			case DELRANGE_COMMAND:
+			default:
+				continue
+			}
+
+			events = append(events, ChangeEvent{i, r.Sequence, r.Type, r.Key, r.Value})
+		}
+	}
+
+	return events, nil
+}
+
+func (w *Watcher) Position() WatchPosition {
+	return append(WatchPosition(nil), w.position...)
+}
+
+// CaughtUp reports whether the last Next read every log to its end.
+func (w *Watcher) CaughtUp() bool {
+	return w.caughtUp
+}
+
+// LockedWatch watches a store shared under a lock of its owner, with runs
+// the start of the watch and every later read of the logs holding it.
+func LockedWatch(storage Watchable, filter WatchFilter, from WatchPosition,
+	with func(f func())) (watcher *Watcher, err error) {
+	with(func() {
+		watcher, err = storage.Watch(filter, from)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range watcher.logs {
+		since := watcher.logs[i].since
+		watcher.logs[i].since = func(sequence int64, max int) (records []LogRecord, err error) {
+			with(func() {
+				records, err = since(sequence, max)
+			})
+			return records, err
+		}
+	}
+
+	return watcher, nil
+}
+
+// Watch reports the writes after from that match filter, a nil from
+// starts with the next write.
+func (s *SsStore) Watch(filter WatchFilter, from WatchPosition) (*Watcher, error) {
+	return newWatcher(filter, from, []watchedLog{{s.sequence, s.LogSince}})
+}
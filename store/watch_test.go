@@ -0,0 +1,170 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// drain reads the watcher until it is caught up.
+func drain(t *testing.T, w *Watcher) (events []ChangeEvent) {
+	t.Helper()
+	for {
+		batch, err := w.Next(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, batch...)
+		if w.CaughtUp() {
+			return events
+		}
+	}
+}
+
+func eventKeys(events []ChangeEvent) (keys []string) {
+	for _, e := range events {
+		keys = append(keys, e.Type+" "+e.Key)
+	}
+
+	return keys
+}
+
+func TestWatchFiltersAndResumes(t *testing.T) {
+	s := openSsStore(t, testOptions(t))
+	putAll(t, s, "old", "1")
+
+	w, err := s.Watch(WatchFilter{Prefix: "user:"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putAll(t, s, "user:1", "a", "other", "b", "user:2", "c", MetaKey("user:1"), "meta")
+	s.Del("user:1")
+	want := []string{"put user:1", "put user:2", "del user:1"}
+	if got := eventKeys(drain(t, w)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("watcher reported %v, want %v", got, want)
+	}
+
+	if !reflect.DeepEqual(w.Position(), WatchPosition{s.Sequence()}) {
+		t.Fatalf("watcher is at %v, store at %d", w.Position(), s.Sequence())
+	}
+
+	resumed, err := s.Watch(WatchFilter{}, WatchPosition{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := eventKeys(drain(t, resumed)); len(got) != 4 || got[0] != "put user:1" {
+		t.Fatalf("resumed watcher reported %v", got)
+	}
+
+	if _, err = s.Watch(WatchFilter{}, WatchPosition{1, 2}); err == nil {
+		t.Fatal("watch took a position of two logs")
+	}
+
+	if position, err := ParseWatchPosition("4,0,17"); err != nil ||
+		!reflect.DeepEqual(position, WatchPosition{4, 0, 17}) || position.String() != "4,0,17" {
+		t.Fatalf("parsed %v, %v", position, err)
+	}
+
+	if _, err = ParseWatchPosition("4,,1"); err == nil {
+		t.Fatal("parsed a position with an empty sequence")
+	}
+}
+
+func TestWatchEndsWhereLogIsCut(t *testing.T) {
+	options := testOptions(t)
+	options.WalRecords = 10
+	s := openSsStore(t, options)
+	w, err := s.Watch(WatchFilter{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < options.WalRecords; i++ {
+			putAll(t, s, fmt.Sprintf("key-%d", i), fmt.Sprint(round))
+		}
+		s.Flush()
+	}
+
+	if _, err = w.Next(0); err != ErrLogTruncated {
+		t.Fatalf("watcher behind the log returned %v", err)
+	}
+
+	if _, err = s.Watch(WatchFilter{}, WatchPosition{0}); err != ErrLogTruncated {
+		t.Fatalf("watch from a cut position returned %v", err)
+	}
+
+	// The log keeps at least WalRecords records.
+	from := WatchPosition{s.Sequence() - int64(options.WalRecords)}
+	if w, err = s.Watch(WatchFilter{}, from); err != nil {
+		t.Fatal(err)
+	}
+
+	if events := drain(t, w); len(events) != options.WalRecords {
+		t.Fatalf("watcher read %d events", len(events))
+	}
+}
+
+func TestShardedWatchMergesShards(t *testing.T) {
+	options := testOptions(t)
+	options.Shards = 3
+	s := openShardedStore(t, options)
+	putAll(t, s, "before", "0")
+
+	w, err := s.Watch(WatchFilter{Prefix: "k"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wantPuts []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%d", i)
+		putAll(t, s, key, "v", fmt.Sprintf("skip%d", i), "v")
+		wantPuts = append(wantPuts, key)
+	}
+	s.Del("k0")
+
+	events := drain(t, w)
+	got := make(map[string]int)
+	shards := make(map[int]bool)
+	for _, e := range events {
+		got[e.Type+" "+e.Key]++
+		shards[e.Shard] = true
+		if s.shards[e.Shard] != s.shardOf(e.Key) {
+			t.Fatalf("%s is reported from shard %d", e.Key, e.Shard)
+		}
+	}
+
+	if len(events) != 31 || got["del k0"] != 1 || len(shards) != 3 {
+		t.Fatalf("watcher reported %v from shards %v", got, shards)
+	}
+
+	for _, key := range wantPuts {
+		if got["put "+key] != 1 {
+			t.Fatalf("put of %s is reported %d times", key, got["put "+key])
+		}
+	}
+
+	// A watcher started at the position sees only what follows it.
+	position := w.Position()
+	if len(position) != 3 {
+		t.Fatalf("position %v has no sequence per shard", position)
+	}
+
+	putAll(t, s, "k-after", "v")
+	resumed, err := s.Watch(WatchFilter{}, position)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := eventKeys(drain(t, resumed)); !reflect.DeepEqual(got, []string{"put k-after"}) {
+		t.Fatalf("resumed watcher reported %v", got)
+	}
+
+	if _, err = s.Watch(WatchFilter{}, WatchPosition{0}); err == nil {
+		t.Fatal("sharded watch took a position of one log")
+	}
+}